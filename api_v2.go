@@ -0,0 +1,194 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/golang/protobuf/proto"
+	"github.com/snarlysodboxer/id-incrementer/pb"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Suffixes on a counter's name that increment it when POSTed to, as in
+// `POST /v2/environments/live/counters/records:next`.
+const (
+	nextSuffix    = ":next"
+	reserveSuffix = ":reserve"
+)
+
+// Largest block of IDs that can be reserved at once.
+const maxReserve = 10000
+
+// Counter is the representation of a single counter in the v2 API.
+type Counter struct {
+	Environment string `json:"environment" yaml:"environment"`
+	Name        string `json:"name" yaml:"name"`
+	ID          int    `json:"id" yaml:"id"`
+	// Formatted is the ID rendered with the counter's format, if it has one.
+	Formatted string `json:"formatted,omitempty" yaml:"formatted,omitempty"`
+}
+
+func (counter Counter) Text() string {
+	return strconv.Itoa(counter.ID)
+}
+
+func (counter Counter) Proto() proto.Message {
+	return counter.pb()
+}
+
+func (counter Counter) pb() *pb.Counter {
+	return &pb.Counter{Environment: counter.Environment, Name: counter.Name, Id: int64(counter.ID)}
+}
+
+// Range is a block of reserved IDs from First to Last, in steps of Step.
+type Range struct {
+	Environment string `json:"environment" yaml:"environment"`
+	Name        string `json:"name" yaml:"name"`
+	First       int    `json:"first" yaml:"first"`
+	Last        int    `json:"last" yaml:"last"`
+	Step        int    `json:"step" yaml:"step"`
+}
+
+func (block Range) Proto() proto.Message {
+	return &pb.Range{
+		Environment: block.Environment,
+		Name:        block.Name,
+		First:       int64(block.First),
+		Last:        int64(block.Last),
+		Step:        int64(block.Step),
+	}
+}
+
+// ReserveValue is the body accepted when reserving a block of IDs.
+type ReserveValue struct {
+	Count int `form:"count" json:"count" binding:"min=1,max=10000"`
+}
+
+func (ids idMap) setupV2Routes(router gin.IRoutes) {
+	router.GET("/v2/environments/:environment/counters/:name", ids.peekCounter)
+	router.POST("/v2/environments/:environment/counters/:name", ids.counterAction)
+	router.PUT("/v2/environments/:environment/counters/:name", ids.setCounter)
+	router.DELETE("/v2/environments/:environment/counters/:name", ids.deleteCounter)
+}
+
+// counterKey reads and validates the counter addressed by a v2 path.
+func counterKey(context *gin.Context) (CounterKey, error) {
+	key := CounterKey{Environment: context.Param("environment"), Name: context.Param("name")}
+	return key, validateStruct(&key)
+}
+
+func (ids idMap) peekCounter(context *gin.Context) {
+	key, err := counterKey(context)
+	if err != nil {
+		abortWithError(context, err)
+		return
+	}
+	unlock := ids.readEnvironment(key.Environment)
+	id, err := ids.Peek(key.Name, key.Environment)
+	unlock()
+	respondWithCounter(context, key, id, err)
+}
+
+// counterAction handles POSTs to `{name}:next`, `{name}:reserve` and
+// `{name}:lease`.
+func (ids idMap) counterAction(context *gin.Context) {
+	name := context.Param("name")
+	switch {
+	case strings.HasSuffix(name, nextSuffix):
+		ids.nextCounter(context, strings.TrimSuffix(name, nextSuffix))
+	case strings.HasSuffix(name, reserveSuffix):
+		ids.reserveCounter(context, strings.TrimSuffix(name, reserveSuffix))
+	case strings.HasSuffix(name, leaseSuffix):
+		ids.leaseCounter(context, strings.TrimSuffix(name, leaseSuffix))
+	default:
+		message := "POST is only supported on `{name}" + nextSuffix + "`, `{name}" + reserveSuffix + "` and `{name}" + leaseSuffix + "`"
+		abortWithError(context, NewAPIError(CodeNotFound, "", message))
+	}
+}
+
+func (ids idMap) nextCounter(context *gin.Context, name string) {
+	key := CounterKey{Environment: context.Param("environment"), Name: name}
+	if err := validateStruct(&key); err != nil {
+		abortWithError(context, err)
+		return
+	}
+	if !negotiable(context, Counter{}) {
+		return
+	}
+	unlock := ids.lockEnvironment(key.Environment)
+	id, err := ids.Get(key.Name, key.Environment)
+	unlock()
+	respondWithCounter(context, key, id, err)
+}
+
+func (ids idMap) reserveCounter(context *gin.Context, name string) {
+	key := CounterKey{Environment: context.Param("environment"), Name: name}
+	if err := validateStruct(&key); err != nil {
+		abortWithError(context, err)
+		return
+	}
+	var value ReserveValue
+	if err := bindRequest(context, &value); err != nil {
+		abortWithError(context, err)
+		return
+	}
+	if !negotiable(context, Range{}) {
+		return
+	}
+	unlock := ids.lockEnvironment(key.Environment)
+	first, last, err := ids.Reserve(key.Name, key.Environment, value.Count)
+	step := configFor(key.Name, key.Environment).Step
+	unlock()
+	if err != nil {
+		abortWithError(context, err)
+		return
+	}
+	respond(context, http.StatusOK, Range{Environment: key.Environment, Name: key.Name, First: first, Last: last, Step: step})
+}
+
+func (ids idMap) setCounter(context *gin.Context) {
+	key, err := counterKey(context)
+	if err != nil {
+		abortWithError(context, err)
+		return
+	}
+	var value CounterValue
+	if err := bindRequest(context, &value); err != nil {
+		abortWithError(context, err)
+		return
+	}
+	if !negotiable(context, Counter{}) {
+		return
+	}
+	passedID, _ := value.ID.Int64()
+	unlock := ids.lockEnvironment(key.Environment)
+	id, err := ids.Set(key.Name, key.Environment, int(passedID))
+	unlock()
+	respondWithCounter(context, key, id, err)
+}
+
+func (ids idMap) deleteCounter(context *gin.Context) {
+	key, err := counterKey(context)
+	if err != nil {
+		abortWithError(context, err)
+		return
+	}
+	if !negotiable(context, Counter{}) {
+		return
+	}
+	mutex.Lock()
+	id, err := ids.Delete(key.Name, key.Environment)
+	mutex.Unlock()
+	respondWithCounter(context, key, id, err)
+}
+
+func respondWithCounter(context *gin.Context, key CounterKey, id int, err error) {
+	if err != nil {
+		abortWithError(context, err)
+		return
+	}
+	mutex.RLock()
+	formatted := configFor(key.Name, key.Environment).format(id)
+	mutex.RUnlock()
+	respond(context, http.StatusOK, Counter{Environment: key.Environment, Name: key.Name, ID: id, Formatted: formatted})
+}
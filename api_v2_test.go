@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func serveV2(t *testing.T, testRouter http.Handler, method, path, body string) (int, Counter) {
+	request, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+	if err != nil {
+		t.Error(err)
+	}
+	if body != "" {
+		request.Header.Add("Content-Type", "application/json")
+	}
+	response := httptest.NewRecorder()
+	testRouter.ServeHTTP(response, request)
+
+	var counter Counter
+	if response.Code == 200 {
+		err = json.Unmarshal(response.Body.Bytes(), &counter)
+		if err != nil {
+			t.Errorf("Unable to unmarshal `%s`", response.Body)
+		}
+	}
+	return response.Code, counter
+}
+
+func TestV2CounterLifecycle(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	testRouter := ids.SetupRouter()
+	path := "/v2/environments/live/counters/records"
+
+	steps := []struct {
+		method string
+		path   string
+		body   string
+		code   int
+		id     int
+	}{
+		{"GET", path, "", 404, 0},
+		{"DELETE", path, "", 404, 0},
+		{"POST", path + ":next", "", 200, initialValue},
+		{"POST", path + ":next", "", 200, initialValue + incrementBy},
+		{"GET", path, "", 200, initialValue + incrementBy},
+		{"PUT", path, `{"id": 100}`, 200, 100},
+		{"GET", path, "", 200, 100},
+		{"DELETE", path, "", 200, 100},
+		{"GET", path, "", 404, 0},
+	}
+
+	for _, step := range steps {
+		code, counter := serveV2(t, testRouter, step.method, step.path, step.body)
+		if code != step.code {
+			t.Errorf("Expected status code %d for %s %s, got %d", step.code, step.method, step.path, code)
+		}
+		if counter.ID != step.id {
+			t.Errorf("Expected `%d` for %s %s, got `%d`", step.id, step.method, step.path, counter.ID)
+		}
+		if code == 200 && (counter.Environment != "live" || counter.Name != "records") {
+			t.Errorf("Expected live/records for %s %s, got %s/%s", step.method, step.path, counter.Environment, counter.Name)
+		}
+	}
+
+	// test that the deleted environment is gone
+	if len(ids) != 0 {
+		t.Error("Expected no environments, got ", ids)
+	}
+}
+
+func TestV2Reserve(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	testRouter := ids.SetupRouter()
+	path := "/v2/environments/live/counters/records" + reserveSuffix
+	request, err := http.NewRequest("POST", path, bytes.NewBufferString(`{"count": 10}`))
+	if err != nil {
+		t.Error(err)
+	}
+	request.Header.Add("Content-Type", "application/json")
+	response := httptest.NewRecorder()
+	testRouter.ServeHTTP(response, request)
+
+	// test for the reserved block
+	if response.Code != 200 {
+		t.Error("Expected status code 200, got ", response.Code)
+	}
+	var block Range
+	err = json.Unmarshal(response.Body.Bytes(), &block)
+	if err != nil {
+		t.Errorf("Unable to unmarshal `%s`", response.Body)
+	}
+	expected := Range{"live", "records", initialValue, initialValue + 9*incrementBy, incrementBy}
+	if block != expected {
+		t.Errorf("Expected %v, got %v", expected, block)
+	}
+
+	// test that the block is skipped by the next increment
+	_, counter := serveV2(t, testRouter, "POST", "/v2/environments/live/counters/records"+nextSuffix, "")
+	if counter.ID != initialValue+10*incrementBy {
+		t.Errorf("Expected `%d`, got `%d`", initialValue+10*incrementBy, counter.ID)
+	}
+
+	// test for invalid counts
+	for _, body := range []string{`{}`, `{"count": 0}`, `{"count": 10001}`} {
+		code, _ := serveV2(t, testRouter, "POST", path, body)
+		if code != 400 {
+			t.Errorf("Expected status code 400 for %s, got %d", body, code)
+		}
+	}
+}
+
+func TestV2SharesCountersWithV1(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	testRouter := ids.SetupRouter()
+
+	// test that a v2 set is visible through the v1 getter
+	serveV2(t, testRouter, "PUT", "/v2/environments/live/counters/records", `{"id": 56}`)
+	request, err := http.NewRequest("GET", "/getter/live/records", nil)
+	if err != nil {
+		t.Error(err)
+	}
+	response := httptest.NewRecorder()
+	testRouter.ServeHTTP(response, request)
+	var id TestID
+	err = json.Unmarshal(response.Body.Bytes(), &id)
+	if err != nil {
+		t.Errorf("Unable to unmarshal `%s`", response.Body)
+	}
+	if id.ID != 56+incrementBy {
+		t.Errorf("Expected `%d`, got `%d`", 56+incrementBy, id.ID)
+	}
+
+	// test that the v1 increment is visible through v2
+	_, counter := serveV2(t, testRouter, "GET", "/v2/environments/live/counters/records", "")
+	if counter.ID != 56+incrementBy {
+		t.Errorf("Expected `%d`, got `%d`", 56+incrementBy, counter.ID)
+	}
+}
+
+func TestV2BadRequests(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	testRouter := ids.SetupRouter()
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{"POST", "/v2/environments/live/counters/records", "", 404},
+		{"POST", "/v2/environments/live/counters/:next", "", 400},
+		{"GET", "/v2/environments/live/counters/rec%20ords", "", 400},
+		{"PUT", "/v2/environments/live/counters/records", `{"id": "abc"}`, 400},
+		{"PUT", "/v2/environments/live/counters/records", `{}`, 400},
+	}
+
+	for _, test := range tests {
+		code, _ := serveV2(t, testRouter, test.method, test.path, test.body)
+		if code != test.code {
+			t.Errorf("Expected status code %d for %s %s %s, got %d", test.code, test.method, test.path, test.body, code)
+		}
+	}
+
+	// test that nothing was created
+	if len(ids) != 0 {
+		t.Error("Expected no environments, got ", ids)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"time"
+)
+
+const maxBatch = 100
+
+// Batch operations, named after the v2 routes they mirror.
+const (
+	BatchNext    = "next"
+	BatchPeek    = "peek"
+	BatchSet     = "set"
+	BatchReserve = "reserve"
+	BatchDelete  = "delete"
+)
+
+// BatchOperation is one step of a batch. ID is only read by `set`, and Count
+// only by `reserve`.
+type BatchOperation struct {
+	Op string `json:"op" binding:"required,oneof=next peek set reserve delete"`
+	CounterKey
+	ID    json.Number `json:"id,omitempty"`
+	Count int         `json:"count,omitempty"`
+}
+
+// BatchRequest is the body accepted by `/v2/batch`.
+type BatchRequest struct {
+	Operations []BatchOperation `json:"operations" binding:"required,min=1,max=100"`
+}
+
+// BatchResult is the outcome of the BatchOperation at the same index. ID is
+// the counter's value after the operation, or before it for `delete`, and
+// First and Last are only set by `reserve`.
+type BatchResult struct {
+	Op          string `json:"op" yaml:"op"`
+	Environment string `json:"environment" yaml:"environment"`
+	Name        string `json:"name" yaml:"name"`
+	ID          int    `json:"id" yaml:"id"`
+	First       int    `json:"first,omitempty" yaml:"first,omitempty"`
+	Last        int    `json:"last,omitempty" yaml:"last,omitempty"`
+}
+
+// BatchResults is returned once every operation of a batch has been applied.
+type BatchResults struct {
+	Results []BatchResult `json:"results" yaml:"results"`
+}
+
+func (ids idMap) setupBatchRoutes(router gin.IRoutes) {
+	router.POST("/v2/batch", ids.batch)
+}
+
+func (ids idMap) batch(context *gin.Context) {
+	var request BatchRequest
+	if err := bindRequest(context, &request); err != nil {
+		abortWithError(context, err)
+		return
+	}
+	if err := request.validate(); err != nil {
+		abortWithError(context, err)
+		return
+	}
+
+	mutex.Lock()
+	results, err := ids.Batch(request.Operations)
+	mutex.Unlock()
+	if err != nil {
+		abortWithError(context, err)
+		return
+	}
+	respond(context, http.StatusOK, BatchResults{Results: results})
+}
+
+// validate checks every operation's key and arguments, reporting failures
+// with fields such as `operations[2].name`.
+func (request BatchRequest) validate() error {
+	details := []*APIError{}
+	for i, operation := range request.Operations {
+		err := validateStruct(&operation)
+		if err == nil && operation.Op == BatchSet {
+			err = validateStruct(&CounterValue{ID: operation.ID})
+		}
+		if err == nil && operation.Op == BatchReserve {
+			err = validateStruct(&ReserveValue{Count: operation.Count})
+		}
+		if err != nil {
+			details = append(details, indexedErrors("operations", i, err)...)
+		}
+	}
+	return newBatchError(details)
+}
+
+// Batch applies every operation in order, or none of them if any would fail.
+// In cluster mode the operations are committed as one entry, so losing the
+// leadership doesn't leave some of them applied either. The caller must hold
+// the mutex.
+func (ids idMap) Batch(operations []BatchOperation) ([]BatchResult, error) {
+	defer metrics.observeWrite("batch", time.Now())
+	results, commands, err := ids.planBatch(operations)
+	if err != nil {
+		return nil, err
+	}
+	if err := ids.commitAll(commands); err != nil {
+		return nil, err
+	}
+	for _, operation := range operations {
+		switch operation.Op {
+		case BatchNext:
+			metrics.issued.add(1, operation.Environment)
+		case BatchReserve:
+			metrics.issued.add(float64(operation.Count), operation.Environment)
+		}
+	}
+	return results, nil
+}
+
+// batchCounter is a counter as planBatch expects it to be after the
+// operations played so far.
+type batchCounter struct {
+	id     int
+	found  bool
+	config CounterConfig
+}
+
+// planBatch plays the operations against what each counter would be, so
+// that `peek` and `delete` of a missing counter, and values outside a
+// counter's bounds, fail before anything changes. It returns the result of
+// each operation, and the commands that make them.
+func (ids idMap) planBatch(operations []BatchOperation) ([]BatchResult, []raftCommand, error) {
+	counters := map[CounterKey]batchCounter{}
+	results := []BatchResult{}
+	commands := []raftCommand{}
+	details := []*APIError{}
+	for i, operation := range operations {
+		if err := validateKey(operation.Name, operation.Environment); err != nil {
+			details = append(details, indexedErrors("operations", i, err)...)
+			continue
+		}
+		counter, ok := counters[operation.CounterKey]
+		if !ok {
+			counter.id, counter.found = ids[operation.Environment][operation.Name]
+			counter.config = configFor(operation.Name, operation.Environment)
+		}
+		result := BatchResult{Op: operation.Op, Environment: operation.Environment, Name: operation.Name, ID: counter.id}
+		command := raftCommand{Environment: operation.Environment, Name: operation.Name}
+		var err error
+		switch operation.Op {
+		case BatchPeek:
+			if !counter.found {
+				err = ErrNotFound
+			}
+		case BatchDelete:
+			if !counter.found {
+				err = ErrNotFound
+			}
+			command.Type, command.ID = ChangeDelete, counter.id
+			// Delete drops the counter's config along with it
+			counter = batchCounter{config: defaultConfig()}
+		case BatchNext, BatchReserve:
+			count := 1
+			command.Type = ChangeIncrement
+			if operation.Op == BatchReserve {
+				count = operation.Count
+				command.Type = ChangeReserve
+			}
+			var first, last int
+			if first, last, err = counter.config.next(counter.id, counter.found, count); err == nil {
+				counter.id, counter.found = last, true
+				result.ID, command.ID = last, last
+				if operation.Op == BatchReserve {
+					result.First, result.Last = first, last
+				}
+			}
+		case BatchSet:
+			id64, _ := operation.ID.Int64()
+			id := int(id64)
+			if err = counter.config.check(counter.id, counter.found, id); err == nil {
+				counter.id, counter.found = id, true
+				result.ID = id
+				command.Type, command.ID = ChangeSet, id
+			}
+		}
+		if err != nil {
+			details = append(details, indexedErrors("operations", i, err)...)
+		}
+		counters[operation.CounterKey] = counter
+		results = append(results, result)
+		if command.Type != "" {
+			commands = append(commands, command)
+		}
+	}
+	if err := newBatchError(details); err != nil {
+		return nil, nil, err
+	}
+	return results, commands, nil
+}
+
+// indexedErrors returns err, or each of its details, with the field prefixed
+// by the index of the element of list it's about, e.g. `operations[2].name`.
+func indexedErrors(list string, index int, err error) []*APIError {
+	return prefixedErrors(fmt.Sprintf("%s[%d]", list, index), err)
+}
+
+// prefixedErrors returns err, or each of its details, with the field and
+// message prefixed by prefix.
+func prefixedErrors(prefix string, err error) []*APIError {
+	apiError := toAPIError(err)
+	errors := apiError.Details
+	if len(errors) == 0 {
+		errors = []*APIError{apiError}
+	}
+	prefixed := []*APIError{}
+	for _, each := range errors {
+		field := prefix
+		if each.Field != "" {
+			field += "." + each.Field
+		}
+		prefixed = append(prefixed, NewAPIError(each.Code, field, field+": "+each.Message))
+	}
+	return prefixed
+}
+
+// newBatchError reports every failure, in order, in Details and the first one
+// at the top level, or returns nil if there are none.
+func newBatchError(details []*APIError) error {
+	if len(details) == 0 {
+		return nil
+	}
+	apiError := NewAPIError(details[0].Code, details[0].Field, details[0].Message+"; nothing was applied")
+	apiError.Details = details
+	return apiError
+}
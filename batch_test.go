@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func serveBatch(t *testing.T, testRouter http.Handler, body string) *httptest.ResponseRecorder {
+	request, err := http.NewRequest("POST", "/v2/batch", bytes.NewBufferString(body))
+	if err != nil {
+		t.Error(err)
+	}
+	request.Header.Add("Content-Type", "application/json")
+	response := httptest.NewRecorder()
+	testRouter.ServeHTTP(response, request)
+	return response
+}
+
+func TestBatch(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	ids.Set("old", "live", 7)
+	testRouter := ids.SetupRouter()
+	body := `{"operations": [
+		{"op": "set", "environment": "live", "name": "records", "id": 100},
+		{"op": "next", "environment": "live", "name": "records"},
+		{"op": "reserve", "environment": "dev", "name": "records", "count": 3},
+		{"op": "peek", "environment": "dev", "name": "records"},
+		{"op": "delete", "environment": "live", "name": "old"}
+	]}`
+	response := serveBatch(t, testRouter, body)
+
+	// test for 200 response code
+	if response.Code != 200 {
+		t.Errorf("Expected status code 200, got %d: %s", response.Code, response.Body)
+	}
+
+	// test for one result per operation, in order
+	var results BatchResults
+	err := json.Unmarshal(response.Body.Bytes(), &results)
+	if err != nil {
+		t.Errorf("Unable to unmarshal `%s`", response.Body)
+	}
+	last := initialValue + 2*incrementBy
+	expected := []BatchResult{
+		{Op: BatchSet, Environment: "live", Name: "records", ID: 100},
+		{Op: BatchNext, Environment: "live", Name: "records", ID: 100 + incrementBy},
+		{Op: BatchReserve, Environment: "dev", Name: "records", ID: last, First: initialValue, Last: last},
+		{Op: BatchPeek, Environment: "dev", Name: "records", ID: last},
+		{Op: BatchDelete, Environment: "live", Name: "old", ID: 7},
+	}
+	if !reflect.DeepEqual(results.Results, expected) {
+		t.Errorf("Expected %v, got %v", expected, results.Results)
+	}
+
+	// test that the operations were applied
+	stored := idMap{"live": {"records": 100 + incrementBy}, "dev": {"records": last}}
+	if !reflect.DeepEqual(ids, stored) {
+		t.Errorf("Expected %v, got %v", stored, ids)
+	}
+}
+
+func TestBatchAllOrNothing(t *testing.T) {
+	tests := []struct {
+		body   string
+		code   int
+		fields []string
+	}{
+		{`{"operations": []}`, 400, []string{"operations"}},
+		{`{"operations": [{"op": "incr", "environment": "live", "name": "records"}]}`, 400, []string{"operations[0].op"}},
+		{`{"operations": [
+			{"op": "set", "environment": "live", "name": "records", "id": 100},
+			{"op": "set", "environment": "live", "name": "records"},
+			{"op": "reserve", "environment": "live", "name": "records bad", "count": 0}
+		]}`, 400, []string{"operations[1].id", "operations[2].name"}},
+		{`{"operations": [
+			{"op": "next", "environment": "live", "name": "records"},
+			{"op": "delete", "environment": "live", "name": "records"},
+			{"op": "peek", "environment": "live", "name": "records"},
+			{"op": "delete", "environment": "live", "name": "missing"}
+		]}`, 404, []string{"operations[2]", "operations[3]"}},
+		{`{"operations": [
+			{"op": "set", "environment": "live", "name": "records", "id": 9007199254740990},
+			{"op": "next", "environment": "live", "name": "records"},
+			{"op": "next", "environment": "live", "name": "existing"}
+		]}`, 400, []string{"operations[1].id"}},
+	}
+
+	for _, test := range tests {
+		// setup
+		ids := NewIDMap()
+		ids.Set("existing", "live", 7)
+		testRouter := ids.SetupRouter()
+		response := serveBatch(t, testRouter, test.body)
+
+		// test for the response code
+		if response.Code != test.code {
+			t.Errorf("Expected status code %d for `%s`, got %d", test.code, test.body, response.Code)
+		}
+
+		// test for an error on every failed operation
+		var apiError APIError
+		err := json.Unmarshal(response.Body.Bytes(), &apiError)
+		if err != nil {
+			t.Errorf("Unable to unmarshal `%s`", response.Body)
+		}
+		if apiError.Field != test.fields[0] {
+			t.Errorf("Expected field `%s` for `%s`, got `%s`", test.fields[0], test.body, apiError.Field)
+		}
+		if len(apiError.Details) != len(test.fields) {
+			t.Errorf("Expected %d details for `%s`, got %v", len(test.fields), test.body, apiError.Details)
+			continue
+		}
+		for i, field := range test.fields {
+			if apiError.Details[i].Field != field {
+				t.Errorf("Expected field `%s` for `%s`, got `%s`", field, test.body, apiError.Details[i].Field)
+			}
+		}
+
+		// test that nothing was applied
+		if !reflect.DeepEqual(ids, idMap{"live": {"existing": 7}}) {
+			t.Errorf("Expected no changes for `%s`, got %v", test.body, ids)
+		}
+	}
+}
+
+func TestBatchClustered(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	cluster = ids.newRaftNode("http://localhost:0", []string{"http://localhost:1"})
+	defer func() {
+		cluster.stop()
+		cluster = nil
+	}()
+	operations := []BatchOperation{
+		{Op: BatchSet, CounterKey: CounterKey{Environment: "live", Name: "records"}, ID: "100"},
+		{Op: BatchNext, CounterKey: CounterKey{Environment: "live", Name: "records"}},
+		{Op: BatchReserve, CounterKey: CounterKey{Environment: "dev", Name: "records"}, Count: 3},
+	}
+
+	// test that a batch that isn't committed fails with the cluster's error,
+	// leaving nothing applied
+	mutex.Lock()
+	_, err := ids.Batch(operations)
+	mutex.Unlock()
+	if err != ErrLeadershipLost || len(ids) != 0 {
+		t.Errorf("Expected ErrLeadershipLost and nothing applied, got %v %v", err, ids)
+	}
+
+	// test that a committed batch is one entry in the log
+	cluster.stop()
+	cluster = ids.newRaftNode("http://localhost:0", nil)
+	cluster.start()
+	leaderOf(t, []*testNode{{node: cluster}})
+	mutex.Lock()
+	_, err = ids.Batch(operations)
+	mutex.Unlock()
+	stored := idMap{"live": {"records": 100 + incrementBy}, "dev": {"records": initialValue + 2*incrementBy}}
+	if err != nil || !reflect.DeepEqual(ids, stored) {
+		t.Errorf("Expected %v, got %v (%v)", stored, ids, err)
+	}
+	if status := cluster.status(); status.LastIndex != 2 {
+		t.Error("Expected a noop and the batch in the log, got ", status)
+	}
+}
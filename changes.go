@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Number of changes kept for clients resuming a stream.
+const changeHistory = 10000
+
+// Types of Change.
+const (
+	ChangeIncrement = "increment"
+	ChangeReserve   = "reserve"
+	ChangeSet       = "set"
+	ChangeDelete    = "delete"
+)
+
+// Change records one mutation of a counter. Sequences start at 1 and
+// increase by one with every change. Position is the sequence qualified by
+// the feed's epoch, for clients to resume after.
+type Change struct {
+	Sequence    uint64 `json:"sequence"`
+	Position    string `json:"position"`
+	Type        string `json:"type"`
+	Environment string `json:"environment"`
+	Name        string `json:"name"`
+	ID          int    `json:"id"`
+}
+
+// errBadPosition is returned for positions that aren't an epoch and a
+// sequence, so callers can name the parameter it came from.
+var errBadPosition = errors.New("must be a position, such as a change's")
+
+// changes is fed by every idMap mutation.
+var changes = newChangeFeed(changeHistory)
+
+// changeFeed keeps the most recent changes, and wakes anyone waiting on them.
+// Its epoch tells clients when the feed starts over, as it does every time
+// the server starts, so a sequence from before can't be mistaken for one of
+// the new feed's.
+type changeFeed struct {
+	mutex    sync.Mutex
+	epoch    string
+	sequence uint64
+	size     int
+	history  []Change
+	changed  chan struct{}
+}
+
+func newChangeFeed(size int) *changeFeed {
+	return &changeFeed{epoch: newRequestID(), size: size, changed: make(chan struct{})}
+}
+
+// position returns sequence qualified by the feed's epoch, e.g.
+// `1f2e3d4c5b6a7980.1234`.
+func (feed *changeFeed) position(sequence uint64) string {
+	return feed.epoch + "." + strconv.FormatUint(sequence, 10)
+}
+
+// parsePosition returns the sequence of a position, or 0 for an empty one.
+// It fails with ErrHistoryCompacted if the position is from another epoch,
+// since the changes after it are lost, and errBadPosition if it isn't a
+// position at all.
+func (feed *changeFeed) parsePosition(position string) (uint64, error) {
+	if position == "" {
+		return 0, nil
+	}
+	dot := strings.LastIndex(position, ".")
+	if dot < 0 {
+		return 0, errBadPosition
+	}
+	sequence, err := strconv.ParseUint(position[dot+1:], 10, 64)
+	if err != nil {
+		return 0, errBadPosition
+	}
+	if position[:dot] != feed.epoch {
+		return 0, ErrHistoryCompacted
+	}
+	return sequence, nil
+}
+
+func (feed *changeFeed) record(changeType, name, environment string, id int) Change {
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+	feed.sequence++
+	change := Change{Sequence: feed.sequence, Position: feed.position(feed.sequence), Type: changeType, Environment: environment, Name: name, ID: id}
+	feed.history = append(feed.history, change)
+	if len(feed.history) > feed.size {
+		feed.history = feed.history[len(feed.history)-feed.size:]
+	}
+	// wake every waiter, and start a new generation for the next change
+	close(feed.changed)
+	feed.changed = make(chan struct{})
+	return change
+}
+
+// since returns the changes after sequence, or ErrHistoryCompacted if some of
+// them are no longer kept, or sequence is ahead of the feed.
+func (feed *changeFeed) since(sequence uint64) ([]Change, error) {
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+	if sequence > feed.sequence {
+		return nil, ErrHistoryCompacted
+	}
+	if sequence == feed.sequence {
+		return nil, nil
+	}
+	oldest := feed.sequence - uint64(len(feed.history)) + 1
+	if sequence+1 < oldest {
+		return nil, ErrHistoryCompacted
+	}
+	pending := feed.history[sequence+1-oldest:]
+	return append([]Change{}, pending...), nil
+}
+
+// wait returns the latest sequence, and a channel closed once a change
+// follows it.
+func (feed *changeFeed) wait() (uint64, <-chan struct{}) {
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+	return feed.sequence, feed.changed
+}
+
+// ChangeList is a page of the changes after a sequence. Sequence is the
+// latest change it covers, whether or not that change matched, and Position
+// the same qualified by the feed's epoch, to fetch the next page after.
+// Horizon is the oldest sequence changes can still be fetched after.
+type ChangeList struct {
+	Changes  []Change `json:"changes" yaml:"changes"`
+	Sequence uint64   `json:"sequence" yaml:"sequence"`
+	Position string   `json:"position" yaml:"position"`
+	Horizon  uint64   `json:"horizon" yaml:"horizon"`
+	More     bool     `json:"more" yaml:"more"`
+}
+
+// page returns up to limit of the changes after sequence that match. Like
+// since, it fails with ErrHistoryCompacted if sequence is before the horizon,
+// or ahead of the feed.
+func (feed *changeFeed) page(sequence uint64, limit int, matches func(Change) bool) (ChangeList, error) {
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+	horizon := feed.sequence - uint64(len(feed.history))
+	if sequence < horizon || sequence > feed.sequence {
+		return ChangeList{}, ErrHistoryCompacted
+	}
+	list := ChangeList{Changes: []Change{}, Sequence: feed.sequence, Horizon: horizon}
+	for _, change := range feed.history[sequence-horizon:] {
+		if len(list.Changes) == limit {
+			list.Sequence, list.More = change.Sequence-1, true
+			break
+		}
+		if matches(change) {
+			list.Changes = append(list.Changes, change)
+		}
+	}
+	list.Position = feed.position(list.Sequence)
+	return list, nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestChangeFeed(t *testing.T) {
+	// setup
+	feed := newChangeFeed(3)
+	current, changed := feed.wait()
+	if current != 0 {
+		t.Error("Expected sequence 0, got ", current)
+	}
+
+	// test that recording wakes waiters
+	feed.record(ChangeSet, "records", "live", 5)
+	select {
+	case <-changed:
+	default:
+		t.Error("Expected the wait channel to be closed")
+	}
+
+	// test that changes are returned after a sequence
+	feed.record(ChangeIncrement, "records", "live", 10)
+	feed.record(ChangeDelete, "records", "live", 10)
+	pending, err := feed.since(1)
+	if err != nil {
+		t.Error("Expected no error, got ", err)
+	}
+	if len(pending) != 2 || pending[0].Sequence != 2 || pending[1].Type != ChangeDelete {
+		t.Error("Expected sequences 2 and 3, got ", pending)
+	}
+	pending, err = feed.since(3)
+	if err != nil || len(pending) != 0 {
+		t.Errorf("Expected nothing after the latest sequence, got %v (%v)", pending, err)
+	}
+
+	// test that a sequence ahead of the feed is reported too
+	if _, err = feed.since(4); err != ErrHistoryCompacted {
+		t.Error("Expected ErrHistoryCompacted ahead of the feed, got ", err)
+	}
+
+	// test that changes older than the history are reported as compacted
+	feed.record(ChangeSet, "records", "live", 1)
+	feed.record(ChangeSet, "records", "live", 2)
+	if _, err = feed.since(1); err != ErrHistoryCompacted {
+		t.Error("Expected ErrHistoryCompacted, got ", err)
+	}
+	pending, err = feed.since(2)
+	if err != nil || len(pending) != 3 || pending[2].Sequence != 5 {
+		t.Errorf("Expected sequences 3 to 5, got %v (%v)", pending, err)
+	}
+}
+
+func TestMutationsRecordChanges(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	start, _ := changes.wait()
+
+	// test that every mutation, and only mutations, is recorded in order
+	ids.Get("records", "changes-test")
+	ids.Set("records", "changes-test", 100)
+	ids.Peek("records", "changes-test")
+	ids.Delete("records", "changes-test")
+	pending, err := changes.since(start)
+	if err != nil {
+		t.Error("Expected no error, got ", err)
+	}
+	expected := []Change{
+		{start + 1, changes.position(start + 1), ChangeIncrement, "changes-test", "records", initialValue},
+		{start + 2, changes.position(start + 2), ChangeSet, "changes-test", "records", 100},
+		{start + 3, changes.position(start + 3), ChangeDelete, "changes-test", "records", 100},
+	}
+	if len(pending) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, pending)
+	}
+	for i := range expected {
+		if pending[i] != expected[i] {
+			t.Errorf("Expected %v, got %v", expected[i], pending[i])
+		}
+	}
+}
+
+func TestChangeFeedPage(t *testing.T) {
+	// setup
+	feed := newChangeFeed(3)
+	for id := 1; id <= 5; id++ {
+		environment := "live"
+		if id%2 == 0 {
+			environment = "dev"
+		}
+		feed.record(ChangeSet, "records", environment, id)
+	}
+	live := func(change Change) bool { return change.Environment == "live" }
+	all := func(change Change) bool { return true }
+
+	tests := []struct {
+		after    uint64
+		limit    int
+		matches  func(Change) bool
+		err      error
+		ids      []int
+		sequence uint64
+		more     bool
+	}{
+		{2, 10, all, nil, []int{3, 4, 5}, 5, false},
+		{2, 2, all, nil, []int{3, 4}, 4, true},
+		{2, 10, live, nil, []int{3, 5}, 5, false},
+		{3, 1, live, nil, []int{5}, 5, false},
+		{5, 10, all, nil, []int{}, 5, false},
+		{1, 10, all, ErrHistoryCompacted, nil, 0, false},
+		{6, 10, all, ErrHistoryCompacted, nil, 0, false},
+	}
+
+	for _, test := range tests {
+		list, err := feed.page(test.after, test.limit, test.matches)
+		// test for the changes and sequence returned, or the error
+		if err != test.err {
+			t.Errorf("Expected %v after %d, got %v", test.err, test.after, err)
+		}
+		if err != nil {
+			continue
+		}
+		ids := []int{}
+		for _, change := range list.Changes {
+			ids = append(ids, change.ID)
+		}
+		if !reflect.DeepEqual(ids, test.ids) || list.Sequence != test.sequence || list.More != test.more || list.Horizon != 2 {
+			t.Errorf("Expected %v up to %d after %d, got %v", test.ids, test.sequence, test.after, list)
+		}
+	}
+}
+
+func TestChangeFeedPositions(t *testing.T) {
+	// setup
+	feed := newChangeFeed(3)
+	feed.record(ChangeSet, "records", "live", 1)
+	restarted := newChangeFeed(3)
+
+	// test that positions round trip within a feed, but not across restarts
+	if sequence, err := feed.parsePosition(feed.position(1)); err != nil || sequence != 1 {
+		t.Errorf("Expected sequence 1, got %d (%v)", sequence, err)
+	}
+	if _, err := restarted.parsePosition(feed.position(1)); err != ErrHistoryCompacted {
+		t.Error("Expected a position from another epoch to be compacted, got ", err)
+	}
+	for _, position := range []string{"1", "x.", feed.epoch + ".-1"} {
+		if _, err := feed.parsePosition(position); err != errBadPosition {
+			t.Errorf("Expected `%s` to be refused, got %v", position, err)
+		}
+	}
+}
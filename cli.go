@@ -0,0 +1,539 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/snarlysodboxer/id-incrementer/client"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Exit codes of the command-line client, for scripts.
+const (
+	exitOK = 0
+	// the server couldn't be reached, or failed
+	exitFailed = 1
+	// the arguments were wrong, or the server rejected them
+	exitUsage    = 2
+	exitNotFound = 3
+	// the server was shut down, but cut off requests in flight or didn't
+	// write its final snapshot
+	exitUnclean = 4
+)
+
+const serverEnv = "ID_INCREMENTER_URL"
+
+// cliContext is what a client subcommand runs with.
+type cliContext struct {
+	ctx    context.Context
+	api    *client.Client
+	json   bool
+	stdin  io.Reader
+	stdout io.Writer
+}
+
+// cliCommand is a subcommand talking to a running server. setup registers
+// any flags of its own, and returns the function to run once they're parsed.
+type cliCommand struct {
+	name    string
+	args    []string
+	summary string
+	setup   func(flags *flag.FlagSet) func(cli cliContext, args []string) error
+}
+
+// usageError is returned for arguments that are wrong before they reach the
+// server.
+type usageError string
+
+func (err usageError) Error() string {
+	return string(err)
+}
+
+var cliCommands = []cliCommand{
+	{"next", []string{"ENVIRONMENT", "NAME"}, "Increment a counter, creating it if needed, and print it", counterCommand(
+		func(cli cliContext, args []string) (client.Counter, error) {
+			return cli.api.Next(cli.ctx, args[0], args[1])
+		})},
+	{"peek", []string{"ENVIRONMENT", "NAME"}, "Print a counter without incrementing it", counterCommand(
+		func(cli cliContext, args []string) (client.Counter, error) {
+			return cli.api.Peek(cli.ctx, args[0], args[1])
+		})},
+	{"set", []string{"ENVIRONMENT", "NAME", "ID"}, "Set a counter, creating it if needed", counterCommand(
+		func(cli cliContext, args []string) (client.Counter, error) {
+			id, err := strconv.Atoi(args[2])
+			if err != nil {
+				return client.Counter{}, usageError("ID must be an integer, got " + args[2])
+			}
+			return cli.api.Set(cli.ctx, args[0], args[1], id)
+		})},
+	{"delete", []string{"ENVIRONMENT", "NAME"}, "Delete a counter and print its last value", counterCommand(
+		func(cli cliContext, args []string) (client.Counter, error) {
+			return cli.api.Delete(cli.ctx, args[0], args[1])
+		})},
+	{"list", nil, "Print every counter matching the filters", listCommand},
+	{"export", nil, "Print every counter, with the server's settings, as JSON or YAML", exportCommand},
+	{"import", []string{"[FILE]"}, "Import an export, read from FILE or stdin, and print what changed", importCommand},
+	{"plan", []string{"[FILE]"}, "Print what applying a YAML spec of counters, read from FILE or stdin, would change", specCommand(false)},
+	{"apply", []string{"[FILE]"}, "Apply a YAML spec of counters, read from FILE or stdin, and print what changed", specCommand(true)},
+	{"leases", nil, "Print the leases matching the filters, and the reclaimed ranges waiting to be leased again", leasesCommand},
+	{"revoke", []string{"LEASE"}, "Stop a lease being renewed, asking its holder to release it", leaseCommand(
+		func(cli cliContext, args []string) (client.Lease, error) {
+			return cli.api.RevokeLease(cli.ctx, args[0])
+		})},
+	{"reclaim", []string{"LEASE", "[NEXT]"}, "Take back the IDs of an expired lease from NEXT, or from its holder's last report", leaseCommand(
+		func(cli cliContext, args []string) (client.Lease, error) {
+			var next *int
+			if len(args) > 1 {
+				value, err := strconv.Atoi(args[1])
+				if err != nil {
+					return client.Lease{}, usageError("NEXT must be an integer, got " + args[1])
+				}
+				next = &value
+			}
+			return cli.api.ReclaimLease(cli.ctx, args[0], next)
+		})},
+}
+
+// runCLI runs the subcommand named by args[0], and returns its exit code.
+// Without one, or with only flags, it serves the API as before subcommands
+// existed.
+func runCLI(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return runServe(args, stderr)
+	}
+	switch args[0] {
+	case "serve":
+		return runServe(args[1:], stderr)
+	case "help":
+		printCLIUsage(stdout)
+		return exitOK
+	}
+	for _, command := range cliCommands {
+		if command.name == args[0] {
+			return command.run(args[1:], stdin, stdout, stderr)
+		}
+	}
+	fmt.Fprintf(stderr, "unknown command %q\n\n", args[0])
+	printCLIUsage(stderr)
+	return exitUsage
+}
+
+func runServe(args []string, stderr io.Writer) int {
+	err := serve(args)
+	if err == nil {
+		return exitOK
+	}
+	fmt.Fprintln(stderr, "error:", err)
+	if _, ok := err.(shutdownError); ok {
+		return exitUnclean
+	}
+	return exitFailed
+}
+
+func printCLIUsage(writer io.Writer) {
+	fmt.Fprint(writer, "usage: id-incrementer <command> [flags] [args]\n\ncommands:\n")
+	table := tabwriter.NewWriter(writer, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(table, "  serve\tServe the API; the default without a command\n")
+	for _, command := range cliCommands {
+		fmt.Fprintf(table, "  %s\t%s\n", command.name, command.summary)
+	}
+	table.Flush()
+	fmt.Fprintf(writer, "\nRun `id-incrementer <command> -h` for a command's flags. The server defaults\nto $%s, or http://localhost:8080.\n", serverEnv)
+}
+
+func (command cliCommand) run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet(command.name, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	server := flags.String("server", defaultServer(), "URL of the server")
+	output := flags.String("output", "table", "output format, table or json")
+	timeout := flags.Duration("timeout", 10*time.Second, "timeout of each attempt")
+	retries := flags.Int("retries", 3, "retries after network and server errors")
+	run := command.setup(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "usage: id-incrementer %s [flags] %s\n\n%s\n\nflags:\n", command.name, strings.Join(command.args, " "), command.summary)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if !command.acceptsArgs(flags.NArg()) || (*output != "table" && *output != "json") {
+		flags.Usage()
+		return exitUsage
+	}
+
+	api := client.New(*server)
+	api.Timeout = *timeout
+	api.Retries = *retries
+	cli := cliContext{ctx: context.Background(), api: api, json: *output == "json", stdin: stdin, stdout: stdout}
+	err := run(cli, flags.Args())
+	if err != nil {
+		fmt.Fprintln(stderr, "error:", err)
+	}
+	return exitCode(err)
+}
+
+// acceptsArgs reports whether count positional arguments match the command's
+// usage, where those in brackets are optional.
+func (command cliCommand) acceptsArgs(count int) bool {
+	required := 0
+	for _, arg := range command.args {
+		if !strings.HasPrefix(arg, "[") {
+			required++
+		}
+	}
+	return count >= required && count <= len(command.args)
+}
+
+func defaultServer() string {
+	if server := os.Getenv(serverEnv); server != "" {
+		return server
+	}
+	return "http://localhost:8080"
+}
+
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	if _, ok := err.(usageError); ok {
+		return exitUsage
+	}
+	if apiError, ok := err.(*client.Error); ok {
+		if client.IsNotFound(err) {
+			return exitNotFound
+		}
+		if apiError.StatusCode < 500 {
+			return exitUsage
+		}
+	}
+	return exitFailed
+}
+
+// counterCommand is the setup of a subcommand printing a single counter.
+func counterCommand(get func(cli cliContext, args []string) (client.Counter, error)) func(flags *flag.FlagSet) func(cli cliContext, args []string) error {
+	return func(flags *flag.FlagSet) func(cli cliContext, args []string) error {
+		return func(cli cliContext, args []string) error {
+			counter, err := get(cli, args)
+			if err != nil {
+				return err
+			}
+			if cli.json {
+				return printJSON(cli.stdout, counter)
+			}
+			return printCounters(cli.stdout, []client.Counter{counter})
+		}
+	}
+}
+
+func listCommand(flags *flag.FlagSet) func(cli cliContext, args []string) error {
+	var options client.ListOptions
+	flags.StringVar(&options.Environment, "environment", "", "only list counters in this environment")
+	flags.StringVar(&options.Name, "name", "", "only list counters whose name matches this glob")
+	flags.StringVar(&options.Prefix, "prefix", "", "only list counters whose name starts with this prefix")
+	flags.StringVar(&options.Sort, "sort", "name", "sort by name, -name, id or -id")
+	return func(cli cliContext, args []string) error {
+		counters := []client.Counter{}
+		for {
+			list, err := cli.api.List(cli.ctx, options)
+			if err != nil {
+				return err
+			}
+			counters = append(counters, list.Counters...)
+			if list.NextCursor == "" {
+				break
+			}
+			options.Cursor = list.NextCursor
+		}
+		if cli.json {
+			return printJSON(cli.stdout, counters)
+		}
+		return printCounters(cli.stdout, counters)
+	}
+}
+
+func exportCommand(flags *flag.FlagSet) func(cli cliContext, args []string) error {
+	format := flags.String("format", "json", "format of the export, json or yaml")
+	return func(cli cliContext, args []string) error {
+		if *format != "json" && *format != "yaml" {
+			return usageError("format must be json or yaml, got " + *format)
+		}
+		export, err := cli.api.Export(cli.ctx)
+		if err != nil {
+			return err
+		}
+		if *format == "json" {
+			return printJSON(cli.stdout, export)
+		}
+		encoded, err := yaml.Marshal(export)
+		if err != nil {
+			return err
+		}
+		_, err = cli.stdout.Write(encoded)
+		return err
+	}
+}
+
+// importCommand imports an export as a whole, so either every counter is set
+// or none is.
+func importCommand(flags *flag.FlagSet) func(cli cliContext, args []string) error {
+	var options client.ImportOptions
+	flags.StringVar(&options.Strategy, "strategy", client.ImportFailOnConflict, "what to do with counters that exist with another value: overwrite, keep-higher or fail-on-conflict")
+	flags.BoolVar(&options.DryRun, "dry-run", false, "only print what the import would change")
+	return func(cli cliContext, args []string) error {
+		encoded, err := readInput(cli, args)
+		if err != nil {
+			return err
+		}
+		export, err := parseExport(encoded)
+		if err != nil {
+			return usageError("unable to parse the export: " + err.Error())
+		}
+
+		report, err := cli.api.Import(cli.ctx, export, options)
+		if err != nil {
+			return err
+		}
+		if cli.json {
+			return printJSON(cli.stdout, report)
+		}
+		return printImportReport(cli.stdout, report)
+	}
+}
+
+// specCommand plans, or applies, a spec. Either way the plan is printed,
+// including any changes applying it would refuse.
+func specCommand(apply bool) func(flags *flag.FlagSet) func(cli cliContext, args []string) error {
+	return func(flags *flag.FlagSet) func(cli cliContext, args []string) error {
+		var options client.SpecOptions
+		flags.BoolVar(&options.Force, "force", false, "allow counters outside their new bounds to be lowered to their start, handing out IDs again")
+		return func(cli cliContext, args []string) error {
+			encoded, err := readInput(cli, args)
+			if err != nil {
+				return err
+			}
+			var spec client.Spec
+			if err := yaml.Unmarshal(encoded, &spec); err != nil {
+				return usageError("unable to parse the spec: " + err.Error())
+			}
+
+			var plan client.Plan
+			if apply {
+				plan, err = cli.api.Apply(cli.ctx, spec, options)
+			} else {
+				plan, err = cli.api.Plan(cli.ctx, spec, options)
+			}
+			if err != nil {
+				return err
+			}
+			if cli.json {
+				return printJSON(cli.stdout, plan)
+			}
+			return printPlan(cli.stdout, plan, apply)
+		}
+	}
+}
+
+func leasesCommand(flags *flag.FlagSet) func(cli cliContext, args []string) error {
+	var filter client.LeaseFilter
+	flags.StringVar(&filter.Environment, "environment", "", "only list leases in this environment")
+	flags.StringVar(&filter.Name, "name", "", "only list leases of this counter")
+	flags.StringVar(&filter.Holder, "holder", "", "only list leases held by this holder")
+	flags.StringVar(&filter.State, "state", "", "only list leases in this state: active, revoked, expired, released or reclaimed")
+	return func(cli cliContext, args []string) error {
+		list, err := cli.api.Leases(cli.ctx, filter)
+		if err != nil {
+			return err
+		}
+		if cli.json {
+			return printJSON(cli.stdout, list)
+		}
+		return printLeases(cli.stdout, list.Leases, list.Reclaimed)
+	}
+}
+
+// leaseCommand is the setup of a subcommand printing a single lease.
+func leaseCommand(act func(cli cliContext, args []string) (client.Lease, error)) func(flags *flag.FlagSet) func(cli cliContext, args []string) error {
+	return func(flags *flag.FlagSet) func(cli cliContext, args []string) error {
+		return func(cli cliContext, args []string) error {
+			lease, err := act(cli, args)
+			if err != nil {
+				return err
+			}
+			if cli.json {
+				return printJSON(cli.stdout, lease)
+			}
+			return printLeases(cli.stdout, []client.Lease{lease}, nil)
+		}
+	}
+}
+
+// readInput reads the file named by args, or stdin without one or with `-`.
+func readInput(cli cliContext, args []string) ([]byte, error) {
+	if len(args) == 0 || args[0] == "-" {
+		return ioutil.ReadAll(cli.stdin)
+	}
+	encoded, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return nil, usageError(err.Error())
+	}
+	return encoded, nil
+}
+
+// parseExport reads an export as JSON or YAML, which it's a superset of. The
+// map of environments to names to IDs returned by /lister is accepted too.
+func parseExport(encoded []byte) (client.Export, error) {
+	var export client.Export
+	var fields map[string]interface{}
+	if err := yaml.Unmarshal(encoded, &fields); err != nil {
+		return export, err
+	}
+	// an environment may be called version, but its value would be a map
+	version, ok := fields["version"]
+	if _, isMap := version.(map[interface{}]interface{}); ok && !isMap {
+		err := yaml.Unmarshal(encoded, &export)
+		return export, err
+	}
+
+	var ids map[string]map[string]int
+	if err := yaml.Unmarshal(encoded, &ids); err != nil {
+		return export, err
+	}
+	export.Version = exportVersion
+	for _, counter := range idMap(ids).counters() {
+		export.Counters = append(export.Counters, client.ExportedCounter{Environment: counter.Environment, Name: counter.Name, ID: counter.ID})
+	}
+	return export, nil
+}
+
+func printJSON(writer io.Writer, value interface{}) error {
+	encoded, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(writer, "%s\n", encoded)
+	return err
+}
+
+func printImportReport(writer io.Writer, report client.ImportReport) error {
+	if len(report.Changes) > 0 {
+		table := tabwriter.NewWriter(writer, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(table, "ENVIRONMENT\tNAME\tACTION\tCURRENT\tIMPORTED")
+		for _, change := range report.Changes {
+			current := "-"
+			if change.Current != nil {
+				current = strconv.Itoa(*change.Current)
+			}
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%d\n", change.Environment, change.Name, change.Action, current, change.Imported)
+		}
+		if err := table.Flush(); err != nil {
+			return err
+		}
+	}
+	summary := fmt.Sprintf("created %d, updated %d, unchanged %d, skipped %d, conflicts %d", report.Created, report.Updated, report.Unchanged, report.Skipped, report.Conflicts)
+	if report.DryRun {
+		summary = "dry run: " + summary
+	}
+	_, err := fmt.Fprintln(writer, summary)
+	return err
+}
+
+func printPlan(writer io.Writer, plan client.Plan, applied bool) error {
+	if len(plan.Changes) > 0 {
+		table := tabwriter.NewWriter(writer, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(table, "ACTION\tENVIRONMENT\tNAME\tID\tCHANGES")
+		for _, change := range plan.Changes {
+			id := ""
+			if change.ID != nil {
+				id = strconv.Itoa(*change.ID)
+			}
+			if change.NewID != nil && change.ID != nil {
+				id += " -> " + strconv.Itoa(*change.NewID)
+			} else if change.NewID != nil {
+				id = strconv.Itoa(*change.NewID)
+			}
+			details := strings.Join(configChanges(change.Config, change.NewConfig), ", ")
+			if change.Refused != "" {
+				details = "refused: " + change.Refused
+			}
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\n", change.Action, change.Environment, change.Name, id, details)
+		}
+		if err := table.Flush(); err != nil {
+			return err
+		}
+	}
+	summary := fmt.Sprintf("plan: %d to create, %d to update, %d to delete, %d unchanged, %d refused", plan.Created, plan.Updated, plan.Deleted, plan.Unchanged, plan.Refused)
+	if applied {
+		summary = fmt.Sprintf("applied: created %d, updated %d, deleted %d, unchanged %d", plan.Created, plan.Updated, plan.Deleted, plan.Unchanged)
+	}
+	_, err := fmt.Fprintln(writer, summary)
+	return err
+}
+
+// configChanges describes the fields that differ between two configs, or
+// every field of to when there's no from.
+func configChanges(from, to *client.CounterConfig) []string {
+	if to == nil {
+		return nil
+	}
+	fields := []struct {
+		name     string
+		from, to interface{}
+	}{
+		{"start", nil, to.Start},
+		{"step", nil, to.Step},
+		{"min", nil, to.Min},
+		{"max", nil, to.Max},
+		{"format", nil, to.Format},
+		{"monotonic", nil, to.Monotonic},
+	}
+	if from != nil {
+		for i, value := range []interface{}{from.Start, from.Step, from.Min, from.Max, from.Format, from.Monotonic} {
+			fields[i].from = value
+		}
+	}
+	changes := []string{}
+	for _, field := range fields {
+		switch {
+		case field.from == nil && field.to == "":
+		case field.from == nil:
+			changes = append(changes, fmt.Sprintf("%s %v", field.name, field.to))
+		case field.from != field.to:
+			changes = append(changes, fmt.Sprintf("%s %v -> %v", field.name, field.from, field.to))
+		}
+	}
+	return changes
+}
+
+func printCounters(writer io.Writer, counters []client.Counter) error {
+	table := tabwriter.NewWriter(writer, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "ENVIRONMENT\tNAME\tID")
+	for _, counter := range counters {
+		fmt.Fprintf(table, "%s\t%s\t%d\n", counter.Environment, counter.Name, counter.ID)
+	}
+	return table.Flush()
+}
+
+func printLeases(writer io.Writer, leases []client.Lease, reclaimed []client.Range) error {
+	table := tabwriter.NewWriter(writer, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "LEASE\tENVIRONMENT\tNAME\tHOLDER\tRANGE\tNEXT\tREMAINING\tSTATE\tEXPIRES")
+	for _, lease := range leases {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%d-%d\t%d\t%d\t%s\t%s\n", lease.ID, lease.Environment, lease.Name, lease.Holder,
+			lease.First, lease.Last, lease.Next, lease.Remaining, lease.State, lease.Expires.Format(time.RFC3339))
+	}
+	for _, block := range reclaimed {
+		fmt.Fprintf(table, "-\t%s\t%s\t-\t%d-%d\t%d\t%d\treclaimed\t-\n", block.Environment, block.Name,
+			block.First, block.Last, block.First, (block.Last-block.First)/block.Step+1)
+	}
+	return table.Flush()
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runAgainst runs the command-line client against server, and returns its
+// exit code and output.
+func runAgainst(server *httptest.Server, stdin string, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	args = append([]string{args[0], "-server", server.URL, "-retries", "0"}, args[1:]...)
+	code := runCLI(args, strings.NewReader(stdin), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestCLICommands(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	server := httptest.NewServer(ids.SetupRouter())
+	defer server.Close()
+
+	steps := []struct {
+		args   []string
+		code   int
+		stdout string
+	}{
+		{[]string{"peek", "live", "records"}, exitNotFound, ""},
+		{[]string{"next", "live", "records"}, exitOK, "ENVIRONMENT  NAME     ID\nlive         records  42\n"},
+		{[]string{"set", "live", "records", "100"}, exitOK, "ENVIRONMENT  NAME     ID\nlive         records  100\n"},
+		{[]string{"next", "-output", "json", "dev", "records"}, exitOK, "{\n  \"environment\": \"dev\",\n  \"name\": \"records\",\n  \"id\": 42\n}\n"},
+		{[]string{"list", "-sort", "-id"}, exitOK, "ENVIRONMENT  NAME     ID\nlive         records  100\ndev          records  42\n"},
+		{[]string{"list", "-environment", "dev", "-output", "json"}, exitOK, "[\n  {\n    \"environment\": \"dev\",\n    \"name\": \"records\",\n    \"id\": 42\n  }\n]\n"},
+		{[]string{"delete", "dev", "records"}, exitOK, "ENVIRONMENT  NAME     ID\ndev          records  42\n"},
+		{[]string{"set", "live", "records", "ten"}, exitUsage, ""},
+		{[]string{"set", "live", "bad!name", "10"}, exitUsage, ""},
+		{[]string{"next", "live"}, exitUsage, ""},
+		{[]string{"next", "-output", "xml", "live", "records"}, exitUsage, ""},
+	}
+
+	for _, step := range steps {
+		code, stdout, stderr := runAgainst(server, "", step.args...)
+		// test for the exit code and output
+		if code != step.code {
+			t.Errorf("Expected exit code %d for %v, got %d: %s", step.code, step.args, code, stderr)
+		}
+		if stdout != step.stdout {
+			t.Errorf("Expected output\n%s\nfor %v, got\n%s", step.stdout, step.args, stdout)
+		}
+		if code != exitOK && stderr == "" {
+			t.Errorf("Expected an error message for %v", step.args)
+		}
+	}
+}
+
+func TestCLIExportImport(t *testing.T) {
+	// setup
+	source := NewIDMap()
+	source.Set("records", "live", 100)
+	source.Set("records", "dev", 7)
+	sourceServer := httptest.NewServer(source.SetupRouter())
+	defer sourceServer.Close()
+	target := NewIDMap()
+	targetServer := httptest.NewServer(target.SetupRouter())
+	defer targetServer.Close()
+
+	// test that an export is the counters as JSON, or YAML
+	code, exported, _ := runAgainst(sourceServer, "", "export")
+	var decoded Export
+	if err := json.Unmarshal([]byte(exported), &decoded); code != exitOK || err != nil || len(decoded.Counters) != 2 {
+		t.Errorf("Expected a JSON export, got %d `%s`", code, exported)
+	}
+	code, exportedYAML, _ := runAgainst(sourceServer, "", "export", "-format", "yaml")
+	if code != exitOK || !strings.HasPrefix(exportedYAML, "version: 1\n") {
+		t.Errorf("Expected a YAML export, got %d `%s`", code, exportedYAML)
+	}
+
+	// test that a dry run only reports what would change
+	code, stdout, stderr := runAgainst(targetServer, exportedYAML, "import", "-dry-run")
+	expected := "ENVIRONMENT  NAME     ACTION  CURRENT  IMPORTED\ndev          records  create  -        7\nlive         records  create  -        100\n" +
+		"dry run: created 2, updated 0, unchanged 0, skipped 0, conflicts 0\n"
+	if code != exitOK || stdout != expected {
+		t.Errorf("Expected a dry run report, got %d `%s` `%s`", code, stdout, stderr)
+	}
+	if len(target) != 0 {
+		t.Error("Expected a dry run to change nothing, got ", target)
+	}
+
+	// test that importing it copies the counters
+	code, stdout, stderr = runAgainst(targetServer, exported, "import", "-output", "json")
+	var report ImportReport
+	if err := json.Unmarshal([]byte(stdout), &report); code != exitOK || err != nil || report.Created != 2 {
+		t.Errorf("Expected 2 counters to be created, got %d `%s` `%s`", code, stdout, stderr)
+	}
+	if !reflect.DeepEqual(target, source) {
+		t.Errorf("Expected %v, got %v", source, target)
+	}
+
+	// test that conflicts in a legacy /lister export fail unless a strategy
+	// resolves them
+	legacy := `{"live": {"records": 50}}`
+	if code, _, stderr = runAgainst(targetServer, legacy, "import"); code != exitUsage || !strings.Contains(stderr, "conflict") {
+		t.Errorf("Expected a conflict, got %d `%s`", code, stderr)
+	}
+	if code, stdout, _ = runAgainst(targetServer, legacy, "import", "-strategy", "keep-higher"); code != exitOK || !strings.Contains(stdout, "skipped 1") {
+		t.Errorf("Expected the counter to be skipped, got %d `%s`", code, stdout)
+	}
+	if target["live"]["records"] != 100 {
+		t.Error("Expected the higher counter to be kept, got ", target["live"]["records"])
+	}
+
+	// test for a malformed export
+	if code, _, _ = runAgainst(targetServer, "{", "import"); code != exitUsage {
+		t.Error("Expected a usage error, got ", code)
+	}
+}
+
+func TestCLIUnreachableServer(t *testing.T) {
+	// setup
+	server := httptest.NewServer(nil)
+	server.Close()
+
+	// test for a failure exit code
+	if code, _, stderr := runAgainst(server, "", "peek", "live", "records"); code != exitFailed || stderr == "" {
+		t.Errorf("Expected exit code %d, got %d: %s", exitFailed, code, stderr)
+	}
+
+	// test for an unknown command
+	var stdout, stderr bytes.Buffer
+	if code := runCLI([]string{"frobnicate"}, nil, &stdout, &stderr); code != exitUsage || !strings.Contains(stderr.String(), "usage:") {
+		t.Errorf("Expected usage, got %d: %s", code, stderr.String())
+	}
+}
+
+func TestCLIPlanApply(t *testing.T) {
+	// setup
+	ids := idMap{"live": {"records": 7}}
+	defer func() { configs = counterConfigs{} }()
+	server := httptest.NewServer(ids.SetupRouter())
+	defer server.Close()
+	spec := "environments:\n  live:\n    records:\n      start: 1000\n      min: 1000\n      monotonic: true\n"
+
+	// test that a plan prints the changes without making them
+	code, stdout, stderr := runAgainst(server, spec, "plan")
+	expected := "ACTION  ENVIRONMENT  NAME     ID         CHANGES\n" +
+		"update  live         records  7 -> 1000  start 42 -> 1000, min 0 -> 1000, monotonic false -> true\n" +
+		"plan: 0 to create, 1 to update, 0 to delete, 0 unchanged, 0 refused\n"
+	if code != exitOK || stdout != expected {
+		t.Errorf("Expected\n%s\ngot %d\n%s%s", expected, code, stdout, stderr)
+	}
+	if ids["live"]["records"] != 7 {
+		t.Error("Expected a plan to change nothing, got ", ids)
+	}
+
+	// test that applying makes them
+	code, stdout, stderr = runAgainst(server, spec, "apply")
+	if code != exitOK || !strings.HasSuffix(stdout, "applied: created 0, updated 1, deleted 0, unchanged 0\n") || ids["live"]["records"] != 1000 {
+		t.Errorf("Expected records to be updated, got %d `%s` `%s`", code, stdout, stderr)
+	}
+
+	// test that removing a monotonic counter is refused
+	code, _, stderr = runAgainst(server, "environments:\n  live: {}\n", "apply")
+	if code != exitUsage || !strings.Contains(stderr, "monotonic") || ids["live"]["records"] != 1000 {
+		t.Errorf("Expected the delete to be refused, got %d `%s`", code, stderr)
+	}
+}
+
+func TestCLILeases(t *testing.T) {
+	// setup
+	leases = newLeaseTable()
+	ids := NewIDMap()
+	server := httptest.NewServer(ids.SetupRouter())
+	defer server.Close()
+	mutex.Lock()
+	lease, _ := ids.Lease("records", "live", "east", 10, time.Minute)
+	mutex.Unlock()
+
+	// test that leases are listed, and reclaiming an active one is refused
+	code, stdout, stderr := runAgainst(server, "", "leases", "-holder", "east")
+	if code != exitOK || !strings.Contains(stdout, lease.ID+"  live         records  east    42-87  42    10         active") {
+		t.Errorf("Expected the lease listed, got %d\n%s%s", code, stdout, stderr)
+	}
+	if code, _, stderr := runAgainst(server, "", "reclaim", lease.ID); code != exitUsage || !strings.Contains(stderr, "expire") {
+		t.Errorf("Expected the reclaim to be refused, got %d `%s`", code, stderr)
+	}
+
+	// test that a revoked lease is reclaimed once it expires
+	if code, stdout, _ := runAgainst(server, "", "revoke", lease.ID); code != exitOK || !strings.Contains(stdout, "revoked") {
+		t.Errorf("Expected the lease revoked, got %d `%s`", code, stdout)
+	}
+	mutex.Lock()
+	leases.leases[lease.ID].Expires = time.Now()
+	mutex.Unlock()
+	if code, _, stderr := runAgainst(server, "", "reclaim", lease.ID, "52"); code != exitOK {
+		t.Errorf("Expected the lease reclaimed, got %d `%s`", code, stderr)
+	}
+	code, stdout, _ = runAgainst(server, "", "leases", "-state", "reclaimed")
+	if code != exitOK || !strings.Contains(stdout, "-                 live         records  -       52-87  52    8          reclaimed  -") {
+		t.Errorf("Expected the remainder listed, got %d\n%s", code, stdout)
+	}
+}
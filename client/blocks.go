@@ -0,0 +1,57 @@
+package client
+
+import (
+	"context"
+	"sync"
+)
+
+// BlockCache hands out a counter's IDs locally, from blocks reserved Size at
+// a time, so only one in Size calls to Next makes a request. IDs left in a
+// block when the process exits are never handed out, so counters using a
+// cache have gaps.
+type BlockCache struct {
+	client      *Client
+	environment string
+	name        string
+	size        int
+
+	mutex sync.Mutex
+	next  int
+	block Range
+	ready bool
+}
+
+// NewBlockCache returns a cache handing out IDs from the counter, reserving
+// size of them at a time.
+func (client *Client) NewBlockCache(environment, name string, size int) *BlockCache {
+	return &BlockCache{client: client, environment: environment, name: name, size: size}
+}
+
+// Next returns the next ID from the current block, reserving a new block
+// first if that one is used up. It's safe for concurrent use.
+func (cache *BlockCache) Next(ctx context.Context) (int, error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if !cache.ready || cache.next > cache.block.Last {
+		block, err := cache.client.Reserve(ctx, cache.environment, cache.name, cache.size)
+		if err != nil {
+			return 0, err
+		}
+		cache.block = block
+		cache.next = block.First
+		cache.ready = true
+	}
+	id := cache.next
+	cache.next += cache.block.Step
+	return id, nil
+}
+
+// Remaining returns how many IDs are left in the current block.
+func (cache *BlockCache) Remaining() int {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if !cache.ready || cache.next > cache.block.Last {
+		return 0
+	}
+	return (cache.block.Last-cache.next)/cache.block.Step + 1
+}
@@ -0,0 +1,336 @@
+// Package client is a Go client for the id-incrementer HTTP API.
+//
+//	ids := client.New("http://localhost:8080")
+//	counter, err := ids.Next(ctx, "live", "records")
+//
+// Requests that change counters carry an Idempotency-Key, so they are safely
+// retried after network errors and server errors. BlockCache reserves blocks
+// of IDs and hands them out locally, cutting round trips for busy counters.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// Client calls the API at BaseURL. Its fields may be changed before first
+// use, but not after.
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	// Timeout bounds each attempt, on top of any deadline on the context.
+	Timeout time.Duration
+	// Retries is how many times a request is retried after a network error
+	// or a server error, waiting Backoff and then twice as long each time.
+	Retries int
+	Backoff time.Duration
+}
+
+// New returns a Client for the API at baseURL, e.g. `http://localhost:8080`,
+// with a 10 second timeout and three retries.
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    baseURL,
+		HTTPClient: http.DefaultClient,
+		Timeout:    10 * time.Second,
+		Retries:    3,
+		Backoff:    100 * time.Millisecond,
+	}
+}
+
+// Counter is a single counter. Formatted is set for counters configured with
+// a format.
+type Counter struct {
+	Environment string `json:"environment"`
+	Name        string `json:"name"`
+	ID          int    `json:"id"`
+	Formatted   string `json:"formatted,omitempty"`
+}
+
+// Range is a block of reserved IDs from First to Last, in steps of Step.
+type Range struct {
+	Environment string `json:"environment"`
+	Name        string `json:"name"`
+	First       int    `json:"first"`
+	Last        int    `json:"last"`
+	Step        int    `json:"step"`
+}
+
+// CounterList is one page of counters. NextCursor is empty on the last page.
+// Version is that of the snapshot the page was taken from, the same on pages
+// consistent with each other, and Position the same to pass to Changes.
+type CounterList struct {
+	Counters   []Counter `json:"counters"`
+	NextCursor string    `json:"next_cursor"`
+	Version    uint64    `json:"version"`
+	Position   string    `json:"position"`
+}
+
+// ListOptions filters, sorts and pages List. Its zero value lists the first
+// page of every counter.
+type ListOptions struct {
+	Environment string
+	// Name is a glob, e.g. `records_*`.
+	Name   string
+	Prefix string
+	// Sort is one of `name`, `-name`, `id` or `-id`.
+	Sort   string
+	Limit  int
+	Cursor string
+}
+
+// Batch operations.
+const (
+	OpNext    = "next"
+	OpPeek    = "peek"
+	OpSet     = "set"
+	OpReserve = "reserve"
+	OpDelete  = "delete"
+)
+
+// Operation is one step of a Batch. ID is only read by OpSet, and Count only
+// by OpReserve.
+type Operation struct {
+	Op          string `json:"op"`
+	Environment string `json:"environment"`
+	Name        string `json:"name"`
+	ID          int    `json:"id"`
+	Count       int    `json:"count,omitempty"`
+}
+
+// Result is the outcome of the Operation at the same index.
+type Result struct {
+	Op          string `json:"op"`
+	Environment string `json:"environment"`
+	Name        string `json:"name"`
+	ID          int    `json:"id"`
+	First       int    `json:"first"`
+	Last        int    `json:"last"`
+}
+
+// Error is returned for every response the API rejects.
+type Error struct {
+	StatusCode int      `json:"-"`
+	Code       string   `json:"code"`
+	Message    string   `json:"error"`
+	Field      string   `json:"field"`
+	RequestID  string   `json:"request_id"`
+	Details    []*Error `json:"details"`
+}
+
+func (err *Error) Error() string {
+	if err.Field != "" {
+		return fmt.Sprintf("%d %s: %s: %s", err.StatusCode, err.Code, err.Field, err.Message)
+	}
+	return fmt.Sprintf("%d %s: %s", err.StatusCode, err.Code, err.Message)
+}
+
+// IsNotFound reports whether err is the API saying a counter doesn't exist.
+func IsNotFound(err error) bool {
+	apiError, ok := err.(*Error)
+	return ok && apiError.StatusCode == http.StatusNotFound
+}
+
+// Next increments a counter, creating it if needed, and returns it.
+func (client *Client) Next(ctx context.Context, environment, name string) (Counter, error) {
+	var counter Counter
+	err := client.do(ctx, "POST", counterPath(environment, name)+":next", nil, nil, &counter)
+	return counter, err
+}
+
+// Reserve increments a counter by count IDs at once, creating it if needed,
+// and returns the block.
+func (client *Client) Reserve(ctx context.Context, environment, name string, count int) (Range, error) {
+	var block Range
+	body := map[string]int{"count": count}
+	err := client.do(ctx, "POST", counterPath(environment, name)+":reserve", nil, body, &block)
+	return block, err
+}
+
+// Peek returns a counter without incrementing it.
+func (client *Client) Peek(ctx context.Context, environment, name string) (Counter, error) {
+	var counter Counter
+	err := client.do(ctx, "GET", counterPath(environment, name), nil, nil, &counter)
+	return counter, err
+}
+
+// Set sets a counter, creating it if needed.
+func (client *Client) Set(ctx context.Context, environment, name string, id int) (Counter, error) {
+	var counter Counter
+	body := map[string]int{"id": id}
+	err := client.do(ctx, "PUT", counterPath(environment, name), nil, body, &counter)
+	return counter, err
+}
+
+// Delete deletes a counter and returns its last value.
+func (client *Client) Delete(ctx context.Context, environment, name string) (Counter, error) {
+	var counter Counter
+	err := client.do(ctx, "DELETE", counterPath(environment, name), nil, nil, &counter)
+	return counter, err
+}
+
+// List returns one page of the counters matching options.
+func (client *Client) List(ctx context.Context, options ListOptions) (CounterList, error) {
+	query := url.Values{}
+	for key, value := range map[string]string{
+		"environment": options.Environment,
+		"name":        options.Name,
+		"prefix":      options.Prefix,
+		"sort":        options.Sort,
+		"cursor":      options.Cursor,
+	} {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+	if options.Limit != 0 {
+		query.Set("limit", strconv.Itoa(options.Limit))
+	}
+	var list CounterList
+	err := client.do(ctx, "GET", "/v2/counters", query, nil, &list)
+	return list, err
+}
+
+// All returns every counter, keyed by environment and then name.
+func (client *Client) All(ctx context.Context) (map[string]map[string]int, error) {
+	ids := map[string]map[string]int{}
+	err := client.do(ctx, "GET", "/lister", nil, nil, &ids)
+	return ids, err
+}
+
+// Watch waits up to timeout, which the server caps at 5 minutes, for a
+// counter to be above after, and returns it.
+func (client *Client) Watch(ctx context.Context, environment, name string, after int, timeout time.Duration) (Counter, error) {
+	query := url.Values{}
+	query.Set("after", strconv.Itoa(after))
+	query.Set("timeout", strconv.Itoa(int(timeout/time.Second)))
+	// allow for the wait on top of the usual timeout
+	watcher := *client
+	watcher.Timeout += timeout
+	var counter Counter
+	err := watcher.do(ctx, "GET", counterPath(environment, name)+"/watch", query, nil, &counter)
+	return counter, err
+}
+
+// Batch applies every operation atomically, either all of them or none.
+func (client *Client) Batch(ctx context.Context, operations []Operation) ([]Result, error) {
+	var results struct {
+		Results []Result `json:"results"`
+	}
+	body := map[string][]Operation{"operations": operations}
+	err := client.do(ctx, "POST", "/v2/batch", nil, body, &results)
+	return results.Results, err
+}
+
+func counterPath(environment, name string) string {
+	return "/v2/environments/" + url.QueryEscape(environment) + "/counters/" + url.QueryEscape(name)
+}
+
+// do sends a request, retrying it after network errors and server errors,
+// and decodes the response into result. Requests other than GETs carry the
+// same Idempotency-Key on every attempt.
+func (client *Client) do(ctx context.Context, method, path string, query url.Values, body, result interface{}) error {
+	var encoded []byte
+	if body != nil {
+		var err error
+		if encoded, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	endpoint := client.BaseURL + path
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	idempotencyKey := ""
+	if method != "GET" {
+		idempotencyKey = newIdempotencyKey()
+	}
+
+	backoff := client.Backoff
+	for attempt := 0; ; attempt++ {
+		err := client.attempt(ctx, method, endpoint, idempotencyKey, encoded, result)
+		if !retryable(err) || attempt >= client.Retries || ctx.Err() != nil {
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+func (client *Client) attempt(ctx context.Context, method, endpoint, idempotencyKey string, body []byte, result interface{}) error {
+	if client.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, client.Timeout)
+		defer cancel()
+	}
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	request, err := http.NewRequest(method, endpoint, reader)
+	if err != nil {
+		return err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Accept", "application/json")
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	if idempotencyKey != "" {
+		request.Header.Set(idempotencyKeyHeader, idempotencyKey)
+	}
+
+	response, err := client.HTTPClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	encoded, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		apiError := &Error{StatusCode: response.StatusCode}
+		if err := json.Unmarshal(encoded, apiError); err != nil || apiError.Code == "" {
+			apiError.Message = http.StatusText(response.StatusCode)
+		}
+		return apiError
+	}
+	return json.Unmarshal(encoded, result)
+}
+
+// retryable reports whether err might not happen again: a network error,
+// including an attempt timing out, or a server error.
+func retryable(err error) bool {
+	switch err := err.(type) {
+	case nil, *json.SyntaxError, *json.UnmarshalTypeError:
+		return false
+	case *Error:
+		return err.StatusCode >= http.StatusInternalServerError
+	}
+	return true
+}
+
+func newIdempotencyKey() string {
+	buffer := make([]byte, 16)
+	if _, err := rand.Read(buffer); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buffer)
+}
@@ -0,0 +1,225 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer answers with the responses in order, repeating the last, and
+// records the requests it received.
+type fakeServer struct {
+	mutex     sync.Mutex
+	responses []fakeResponse
+	requests  []*http.Request
+	bodies    []string
+}
+
+type fakeResponse struct {
+	status int
+	body   string
+}
+
+func (server *fakeServer) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	server.mutex.Lock()
+	body, _ := ioutil.ReadAll(request.Body)
+	server.requests = append(server.requests, request)
+	server.bodies = append(server.bodies, string(body))
+	response := server.responses[0]
+	if len(server.responses) > 1 {
+		server.responses = server.responses[1:]
+	}
+	server.mutex.Unlock()
+	writer.WriteHeader(response.status)
+	fmt.Fprint(writer, response.body)
+}
+
+func newFakeClient(responses ...fakeResponse) (*Client, *fakeServer, func()) {
+	fake := &fakeServer{responses: responses}
+	server := httptest.NewServer(fake)
+	client := New(server.URL)
+	client.Backoff = time.Millisecond
+	return client, fake, server.Close
+}
+
+func TestNextRetriesWithOneIdempotencyKey(t *testing.T) {
+	// setup
+	client, fake, stop := newFakeClient(
+		fakeResponse{503, `{"code": "internal", "error": "unavailable"}`},
+		fakeResponse{500, `not json`},
+		fakeResponse{200, `{"environment": "live", "name": "records", "id": 42}`},
+	)
+	defer stop()
+	counter, err := client.Next(context.Background(), "live", "records")
+
+	// test for the counter from the last attempt
+	if err != nil || counter != (Counter{Environment: "live", Name: "records", ID: 42}) {
+		t.Errorf("Expected records at 42, got %v (%v)", counter, err)
+	}
+
+	// test that every attempt carried the same key
+	if len(fake.requests) != 3 {
+		t.Fatal("Expected 3 attempts, got ", len(fake.requests))
+	}
+	key := fake.requests[0].Header.Get(idempotencyKeyHeader)
+	for _, request := range fake.requests {
+		if key == "" || request.Header.Get(idempotencyKeyHeader) != key {
+			t.Errorf("Expected Idempotency-Key `%s`, got `%s`", key, request.Header.Get(idempotencyKeyHeader))
+		}
+		if request.Method != "POST" || request.URL.Path != "/v2/environments/live/counters/records:next" {
+			t.Error("Expected POST to records:next, got ", request.Method, request.URL.Path)
+		}
+	}
+
+	// test that the next call uses a new key
+	client.Next(context.Background(), "live", "records")
+	if fake.requests[3].Header.Get(idempotencyKeyHeader) == key {
+		t.Error("Expected a new Idempotency-Key for a new call")
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	// setup
+	client, fake, stop := newFakeClient(
+		fakeResponse{404, `{"code": "not_found", "error": "counter not found", "request_id": "abc"}`},
+	)
+	defer stop()
+	_, err := client.Peek(context.Background(), "live", "records")
+
+	// test that rejected requests aren't retried
+	if len(fake.requests) != 1 {
+		t.Error("Expected 1 attempt, got ", len(fake.requests))
+	}
+	if fake.requests[0].Header.Get(idempotencyKeyHeader) != "" {
+		t.Error("Expected no Idempotency-Key on a GET")
+	}
+
+	// test for a typed error
+	if !IsNotFound(err) {
+		t.Error("Expected a not found error, got ", err)
+	}
+	apiError, _ := err.(*Error)
+	if apiError == nil || apiError.Code != "not_found" || apiError.RequestID != "abc" {
+		t.Error("Expected the error body to be decoded, got ", err)
+	}
+}
+
+func TestClientGivesUp(t *testing.T) {
+	// setup
+	client, fake, stop := newFakeClient(fakeResponse{502, ``})
+	defer stop()
+	client.Retries = 2
+	_, err := client.Set(context.Background(), "live", "records", 100)
+
+	// test for the last error after every retry
+	if len(fake.requests) != 3 {
+		t.Error("Expected 3 attempts, got ", len(fake.requests))
+	}
+	if apiError, ok := err.(*Error); !ok || apiError.StatusCode != 502 {
+		t.Error("Expected a 502 error, got ", err)
+	}
+	if fake.bodies[0] != `{"id":100}` {
+		t.Error("Expected the id in the body, got ", fake.bodies[0])
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	// setup
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	client := New(server.URL)
+	client.Timeout = 10 * time.Millisecond
+	client.Retries = 1
+	client.Backoff = time.Millisecond
+
+	// test that each attempt times out
+	start := time.Now()
+	if _, err := client.Peek(context.Background(), "live", "records"); err == nil {
+		t.Error("Expected a timeout")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Error("Expected the attempts to time out quickly, took ", elapsed)
+	}
+
+	// test that a cancelled context stops retries
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := client.Peek(ctx, "live", "records"); err == nil {
+		t.Error("Expected a cancelled request to fail")
+	}
+}
+
+func TestBlockCache(t *testing.T) {
+	// setup
+	client, fake, stop := newFakeClient(
+		fakeResponse{200, `{"environment": "live", "name": "records", "first": 42, "last": 52, "step": 5}`},
+		fakeResponse{200, `{"environment": "live", "name": "records", "first": 57, "last": 67, "step": 5}`},
+	)
+	defer stop()
+	cache := client.NewBlockCache("live", "records", 3)
+
+	// test that IDs come from one block until it's used up
+	for _, expected := range []int{42, 47, 52, 57} {
+		id, err := cache.Next(context.Background())
+		if err != nil || id != expected {
+			t.Errorf("Expected %d, got %d (%v)", expected, id, err)
+		}
+	}
+	if len(fake.requests) != 2 {
+		t.Error("Expected 2 reservations, got ", len(fake.requests))
+	}
+	if fake.bodies[0] != `{"count":3}` {
+		t.Error("Expected a count of 3, got ", fake.bodies[0])
+	}
+	if cache.Remaining() != 2 {
+		t.Error("Expected 2 IDs remaining, got ", cache.Remaining())
+	}
+}
+
+func TestEvents(t *testing.T) {
+	// setup
+	connections := 0
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		connections++
+		writer.Header().Set("Content-Type", "text/event-stream")
+		if connections == 1 {
+			fmt.Fprint(writer, ": heartbeat\n\n")
+			fmt.Fprint(writer, "id:e.1\nevent:increment\ndata:{\"sequence\":1,\"position\":\"e.1\",\"type\":\"increment\",\"environment\":\"live\",\"name\":\"records\",\"id\":42}\n\n")
+			return
+		}
+		if request.Header.Get("Last-Event-ID") != "e.1" {
+			t.Error("Expected to resume after e.1, got ", request.Header.Get("Last-Event-ID"))
+		}
+		fmt.Fprint(writer, "id:f.9\nevent:resync\ndata:{\"error\":\"compacted\",\"sequence\":9,\"position\":\"f.9\"}\n\n")
+	}))
+	defer server.Close()
+	client := New(server.URL)
+	client.Backoff = time.Millisecond
+
+	// test that changes are passed across reconnections until the handler fails
+	changes := []Change{}
+	stop := errors.New("stop")
+	err := client.Events(context.Background(), EventOptions{Environment: "live"}, func(change Change) error {
+		changes = append(changes, change)
+		if len(changes) == 2 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop {
+		t.Error("Expected the handler's error, got ", err)
+	}
+	if len(changes) != 2 || changes[0].ID != 42 || changes[1] != (Change{Sequence: 9, Position: "f.9", Type: ChangeResync}) {
+		t.Error("Expected an increment and a resync, got ", changes)
+	}
+}
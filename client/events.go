@@ -0,0 +1,210 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Types of Change.
+const (
+	ChangeIncrement = "increment"
+	ChangeReserve   = "reserve"
+	ChangeSet       = "set"
+	ChangeDelete    = "delete"
+	// ChangeResync means changes were missed because the server no longer
+	// keeps them, or restarted, so counters should be read again. Only its
+	// Sequence and Position are set.
+	ChangeResync = "resync"
+)
+
+// Change is one mutation of a counter, as passed by Events. Position is its
+// sequence qualified by the server's epoch, to resume after.
+type Change struct {
+	Sequence    uint64 `json:"sequence"`
+	Position    string `json:"position"`
+	Type        string `json:"type"`
+	Environment string `json:"environment"`
+	Name        string `json:"name"`
+	ID          int    `json:"id"`
+}
+
+// EventOptions filters the changes passed by Events. With a LastEventID, a
+// change's Position, the stream starts after that change rather than with
+// the next one.
+type EventOptions struct {
+	Environment string
+	// Name is a glob, e.g. `records_*`.
+	Name        string
+	LastEventID string
+}
+
+// ChangeOptions filters and pages Changes.
+type ChangeOptions struct {
+	Environment string
+	// Name is a glob, e.g. `records_*`.
+	Name  string
+	Limit int
+}
+
+// ChangeList is a page of changes. Sequence is the latest change it covers,
+// and Position the same to pass as after for the next page, and More whether
+// one follows.
+type ChangeList struct {
+	Changes  []Change `json:"changes"`
+	Sequence uint64   `json:"sequence"`
+	Position string   `json:"position"`
+	Horizon  uint64   `json:"horizon"`
+	More     bool     `json:"more"`
+}
+
+// Changes returns a page of the changes after a position, such as a
+// listing's. It fails with an error satisfying IsHistoryCompacted once those
+// changes are no longer kept, or the server restarted since, when counters
+// must be listed again.
+func (client *Client) Changes(ctx context.Context, after string, options ChangeOptions) (ChangeList, error) {
+	query := url.Values{"after": {after}}
+	if options.Environment != "" {
+		query.Set("environment", options.Environment)
+	}
+	if options.Name != "" {
+		query.Set("name", options.Name)
+	}
+	if options.Limit > 0 {
+		query.Set("limit", strconv.Itoa(options.Limit))
+	}
+	var list ChangeList
+	err := client.do(ctx, "GET", "/v2/changes", query, nil, &list)
+	return list, err
+}
+
+// IsHistoryCompacted reports whether err is the API saying the changes after
+// the position asked for are no longer kept.
+func IsHistoryCompacted(err error) bool {
+	apiError, ok := err.(*Error)
+	return ok && apiError.StatusCode == http.StatusConflict && apiError.Field == "after"
+}
+
+// Events passes changes to handle, in order, until ctx is done or handle
+// returns an error. After a network error it reconnects, resuming after the
+// last change it passed, up to Retries times in a row.
+func (client *Client) Events(ctx context.Context, options EventOptions, handle func(Change) error) error {
+	query := url.Values{}
+	if options.Environment != "" {
+		query.Set("environment", options.Environment)
+	}
+	if options.Name != "" {
+		query.Set("name", options.Name)
+	}
+	endpoint := client.BaseURL + "/v2/events?" + query.Encode()
+
+	last := options.LastEventID
+	backoff := client.Backoff
+	for failures := 0; ; failures++ {
+		passed, err := client.stream(ctx, endpoint, &last, handle)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if handlerErr, ok := err.(handlerError); ok {
+			return handlerErr.err
+		}
+		if passed {
+			failures, backoff = 0, client.Backoff
+		}
+		if !retryable(err) || failures >= client.Retries {
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// handlerError wraps an error returned by the handler passed to Events, so it
+// isn't retried.
+type handlerError struct {
+	err error
+}
+
+func (err handlerError) Error() string {
+	return err.err.Error()
+}
+
+// stream reads one connection's events, updating last as it passes them, and
+// reports whether it passed any.
+func (client *Client) stream(ctx context.Context, endpoint string, last *string, handle func(Change) error) (bool, error) {
+	request, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return false, err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Accept", "text/event-stream")
+	if *last != "" {
+		request.Header.Set("Last-Event-ID", *last)
+	}
+	response, err := client.HTTPClient.Do(request)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		apiError := &Error{StatusCode: response.StatusCode}
+		if err := json.NewDecoder(response.Body).Decode(apiError); err != nil || apiError.Code == "" {
+			apiError.Message = http.StatusText(response.StatusCode)
+		}
+		return false, apiError
+	}
+
+	passed := false
+	var id, event, data string
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line != "" {
+			field := strings.SplitN(line, ":", 2)
+			if len(field) == 2 {
+				switch value := strings.TrimPrefix(field[1], " "); field[0] {
+				case "id":
+					id = value
+				case "event":
+					event = value
+				case "data":
+					data = value
+				}
+			}
+			continue
+		}
+
+		// a blank line ends an event, or a heartbeat comment
+		if id == "" {
+			continue
+		}
+		var change Change
+		if err := json.Unmarshal([]byte(data), &change); err != nil {
+			return passed, err
+		}
+		if event == ChangeResync {
+			change = Change{Type: ChangeResync, Sequence: change.Sequence, Position: id}
+		}
+		if err := handle(change); err != nil {
+			return passed, handlerError{err}
+		}
+		*last = id
+		passed = true
+		id, event, data = "", "", ""
+	}
+	if err := scanner.Err(); err != nil {
+		return passed, err
+	}
+	// the server closed the stream
+	return passed, io.ErrUnexpectedEOF
+}
@@ -0,0 +1,87 @@
+package client
+
+import (
+	"context"
+	"net/url"
+)
+
+// Import strategies, deciding what happens to a counter that already exists
+// with a different value.
+const (
+	ImportOverwrite      = "overwrite"
+	ImportKeepHigher     = "keep-higher"
+	ImportFailOnConflict = "fail-on-conflict"
+)
+
+// Export is every counter on a server, with the settings they were handed out
+// with.
+type Export struct {
+	Version      int               `json:"version" yaml:"version"`
+	ExportedAt   string            `json:"exported_at" yaml:"exported_at"`
+	Sequence     uint64            `json:"sequence" yaml:"sequence"`
+	InitialValue int               `json:"initial_value" yaml:"initial_value"`
+	IncrementBy  int               `json:"increment_by" yaml:"increment_by"`
+	Counters     []ExportedCounter `json:"counters" yaml:"counters"`
+}
+
+// ExportedCounter is one counter in an Export. Config is nil for counters
+// using the server's defaults.
+type ExportedCounter struct {
+	Environment string         `json:"environment" yaml:"environment"`
+	Name        string         `json:"name" yaml:"name"`
+	ID          int            `json:"id" yaml:"id"`
+	Config      *CounterConfig `json:"config,omitempty" yaml:"config,omitempty"`
+}
+
+// ImportOptions picks the Strategy of an Import, defaulting to
+// ImportFailOnConflict, and whether it's only a DryRun.
+type ImportOptions struct {
+	Strategy string
+	DryRun   bool
+}
+
+// ImportReport is what an Import changed, or would change with DryRun.
+type ImportReport struct {
+	Strategy  string         `json:"strategy" yaml:"strategy"`
+	DryRun    bool           `json:"dry_run" yaml:"dry_run"`
+	Created   int            `json:"created" yaml:"created"`
+	Updated   int            `json:"updated" yaml:"updated"`
+	Unchanged int            `json:"unchanged" yaml:"unchanged"`
+	Skipped   int            `json:"skipped" yaml:"skipped"`
+	Conflicts int            `json:"conflicts" yaml:"conflicts"`
+	Changes   []ImportChange `json:"changes" yaml:"changes"`
+}
+
+// ImportChange is what an Import did to one counter; Action is one of
+// `create`, `update`, `skip` or `conflict`. Current is nil for counters it
+// created, and Config for counters imported without one.
+type ImportChange struct {
+	Environment string         `json:"environment" yaml:"environment"`
+	Name        string         `json:"name" yaml:"name"`
+	Action      string         `json:"action" yaml:"action"`
+	Current     *int           `json:"current,omitempty" yaml:"current,omitempty"`
+	Imported    int            `json:"imported" yaml:"imported"`
+	Config      *CounterConfig `json:"config,omitempty" yaml:"config,omitempty"`
+}
+
+// Export returns every counter, sorted by environment and then name.
+func (client *Client) Export(ctx context.Context) (Export, error) {
+	var export Export
+	err := client.do(ctx, "GET", "/v2/export", nil, nil, &export)
+	return export, err
+}
+
+// Import applies every counter in export, or none of them if any is invalid
+// or conflicts under options.Strategy.
+func (client *Client) Import(ctx context.Context, export Export, options ImportOptions) (ImportReport, error) {
+	query := url.Values{}
+	if options.Strategy != "" {
+		query.Set("strategy", options.Strategy)
+	}
+	if options.DryRun {
+		query.Set("dry_run", "true")
+	}
+	var report ImportReport
+	err := client.do(ctx, "POST", "/v2/import", query, export, &report)
+	return report, err
+}
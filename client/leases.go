@@ -0,0 +1,124 @@
+package client
+
+import (
+	"context"
+	"net/url"
+	"time"
+)
+
+// States of a Lease. Holders issue IDs from active leases only, and hand
+// back revoked ones.
+const (
+	LeaseActive    = "active"
+	LeaseRevoked   = "revoked"
+	LeaseExpired   = "expired"
+	LeaseReleased  = "released"
+	LeaseReclaimed = "reclaimed"
+)
+
+// Lease is a range of a counter's IDs, from First to Last in steps of Step,
+// that Holder issues on its own until Expires unless it renews the lease.
+// Next is the first ID the holder hadn't issued when it last reported, and
+// Remaining how many IDs are left from there.
+type Lease struct {
+	ID          string    `json:"id"`
+	Environment string    `json:"environment"`
+	Name        string    `json:"name"`
+	Holder      string    `json:"holder"`
+	First       int       `json:"first"`
+	Last        int       `json:"last"`
+	Step        int       `json:"step"`
+	Next        int       `json:"next"`
+	Remaining   int       `json:"remaining"`
+	State       string    `json:"state"`
+	TTL         int       `json:"ttl"`
+	Format      string    `json:"format,omitempty"`
+	Granted     time.Time `json:"granted"`
+	Expires     time.Time `json:"expires"`
+}
+
+// LeaseOptions are how many IDs to lease, for whom and for how long. TTL is
+// rounded down to whole seconds, and defaults to 5 minutes.
+type LeaseOptions struct {
+	Holder string
+	Count  int
+	TTL    time.Duration
+}
+
+// LeaseFilter narrows Leases to those matching every field set.
+type LeaseFilter struct {
+	Environment string
+	Name        string
+	Holder      string
+	State       string
+}
+
+// LeaseList is every lease the server keeps, and the ranges reclaimed from
+// ended leases that haven't been leased again.
+type LeaseList struct {
+	Leases    []Lease `json:"leases"`
+	Reclaimed []Range `json:"reclaimed"`
+}
+
+// Lease leases up to options.Count of a counter's IDs, creating it if
+// needed. Leases made from a reclaimed remainder may be smaller.
+func (client *Client) Lease(ctx context.Context, environment, name string, options LeaseOptions) (Lease, error) {
+	var lease Lease
+	body := map[string]interface{}{"holder": options.Holder, "count": options.Count}
+	if options.TTL > 0 {
+		body["ttl"] = int(options.TTL / time.Second)
+	}
+	err := client.do(ctx, "POST", counterPath(environment, name)+":lease", nil, body, &lease)
+	return lease, err
+}
+
+// Leases returns the leases matching filter, oldest first.
+func (client *Client) Leases(ctx context.Context, filter LeaseFilter) (LeaseList, error) {
+	query := url.Values{}
+	for key, value := range map[string]string{
+		"environment": filter.Environment,
+		"name":        filter.Name,
+		"holder":      filter.Holder,
+		"state":       filter.State,
+	} {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+	var list LeaseList
+	err := client.do(ctx, "GET", "/v2/leases", query, nil, &list)
+	return list, err
+}
+
+// RenewLease extends a lease, reporting next as the first ID not yet
+// issued from it. A revoked lease isn't extended, and should be released.
+func (client *Client) RenewLease(ctx context.Context, id string, next int) (Lease, error) {
+	return client.leaseAction(ctx, id, ":renew", &next)
+}
+
+// ReleaseLease ends a lease, handing back the IDs from next on.
+func (client *Client) ReleaseLease(ctx context.Context, id string, next int) (Lease, error) {
+	return client.leaseAction(ctx, id, ":release", &next)
+}
+
+// RevokeLease asks a lease's holder to release it, and stops it being
+// extended.
+func (client *Client) RevokeLease(ctx context.Context, id string) (Lease, error) {
+	return client.leaseAction(ctx, id, ":revoke", nil)
+}
+
+// ReclaimLease ends an expired lease, taking back the IDs from next on, or
+// from the last ID its holder reported if next is nil.
+func (client *Client) ReclaimLease(ctx context.Context, id string, next *int) (Lease, error) {
+	return client.leaseAction(ctx, id, ":reclaim", next)
+}
+
+func (client *Client) leaseAction(ctx context.Context, id, action string, next *int) (Lease, error) {
+	var body interface{}
+	if next != nil {
+		body = map[string]int{"next": *next}
+	}
+	var lease Lease
+	err := client.do(ctx, "POST", "/v2/leases/"+url.QueryEscape(id)+action, nil, body, &lease)
+	return lease, err
+}
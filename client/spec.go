@@ -0,0 +1,95 @@
+package client
+
+import (
+	"context"
+	"net/url"
+)
+
+// Spec declares the counters of some environments, keyed by environment and
+// then name. Applying it creates or reconfigures every counter listed, and
+// deletes every other counter in the environments it lists.
+type Spec struct {
+	Environments map[string]map[string]CounterSpec `json:"environments" yaml:"environments"`
+}
+
+// CounterSpec is a counter's config in a Spec. Numbers left nil take the
+// server's defaults.
+type CounterSpec struct {
+	Start     *int   `json:"start,omitempty" yaml:"start,omitempty"`
+	Step      *int   `json:"step,omitempty" yaml:"step,omitempty"`
+	Min       *int   `json:"min,omitempty" yaml:"min,omitempty"`
+	Max       *int   `json:"max,omitempty" yaml:"max,omitempty"`
+	Format    string `json:"format,omitempty" yaml:"format,omitempty"`
+	Monotonic bool   `json:"monotonic,omitempty" yaml:"monotonic,omitempty"`
+}
+
+// CounterConfig is how a counter hands out IDs.
+type CounterConfig struct {
+	Start     int    `json:"start" yaml:"start"`
+	Step      int    `json:"step" yaml:"step"`
+	Min       int    `json:"min" yaml:"min"`
+	Max       int    `json:"max" yaml:"max"`
+	Format    string `json:"format,omitempty" yaml:"format,omitempty"`
+	Monotonic bool   `json:"monotonic" yaml:"monotonic"`
+}
+
+// What applying a Spec does to each counter.
+const (
+	PlanCreate = "create"
+	PlanUpdate = "update"
+	PlanDelete = "delete"
+)
+
+// PlanChange is what applying a Spec does to one counter. ID and Config are
+// nil for counters it creates, and NewID and NewConfig if they don't change.
+// Refused explains why applying would fail.
+type PlanChange struct {
+	Action      string         `json:"action" yaml:"action"`
+	Environment string         `json:"environment" yaml:"environment"`
+	Name        string         `json:"name" yaml:"name"`
+	ID          *int           `json:"id,omitempty" yaml:"id,omitempty"`
+	NewID       *int           `json:"new_id,omitempty" yaml:"new_id,omitempty"`
+	Config      *CounterConfig `json:"config,omitempty" yaml:"config,omitempty"`
+	NewConfig   *CounterConfig `json:"new_config,omitempty" yaml:"new_config,omitempty"`
+	Refused     string         `json:"refused,omitempty" yaml:"refused,omitempty"`
+}
+
+// Plan is every change applying a Spec makes.
+type Plan struct {
+	Created   int          `json:"created" yaml:"created"`
+	Updated   int          `json:"updated" yaml:"updated"`
+	Deleted   int          `json:"deleted" yaml:"deleted"`
+	Unchanged int          `json:"unchanged" yaml:"unchanged"`
+	Refused   int          `json:"refused" yaml:"refused"`
+	Changes   []PlanChange `json:"changes" yaml:"changes"`
+}
+
+// SpecOptions are the options of Plan and Apply. Force allows counters
+// outside their new bounds to be lowered to their start, which hands out IDs
+// again.
+type SpecOptions struct {
+	Force bool
+}
+
+func (options SpecOptions) query() url.Values {
+	query := url.Values{}
+	if options.Force {
+		query.Set("force", "true")
+	}
+	return query
+}
+
+// Plan returns what applying spec would change, without changing anything.
+func (client *Client) Plan(ctx context.Context, spec Spec, options SpecOptions) (Plan, error) {
+	var plan Plan
+	err := client.do(ctx, "POST", "/v2/plan", options.query(), spec, &plan)
+	return plan, err
+}
+
+// Apply makes every change in spec's Plan, or none of them if any is refused,
+// and returns the Plan applied.
+func (client *Client) Apply(ctx context.Context, spec Spec, options SpecOptions) (Plan, error) {
+	var plan Plan
+	err := client.do(ctx, "POST", "/v2/apply", options.query(), spec, &plan)
+	return plan, err
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	clusterAdvertise = flag.String("cluster-advertise", "", "URL other cluster nodes reach this one at, e.g. http://10.0.0.1:8080")
+	clusterDir       = flag.String("cluster-dir", "", "directory the Raft log and vote are kept in; required with -cluster-peers")
+	clusterPeers     = flag.String("cluster-peers", "", "comma separated URLs of the other cluster nodes; enables cluster mode")
+	clusterRedirect  = flag.Bool("cluster-redirect", false, "redirect writes to the leader with 307, rather than forwarding them")
+)
+
+// standaloneFlags are listeners that aren't replicated, so can't be combined
+// with cluster mode or run on a replica.
+var standaloneFlags = map[string]*string{"redis-addr": redisAddr, "memcached-addr": memcachedAddr}
+
+// Longest a write waits for a leader to be elected and for its change to be
+// replicated.
+const clusterTimeout = 5 * time.Second
+
+// forwardedHeader marks writes forwarded by a follower, so that one reaching
+// a node that isn't the leader either fails rather than bouncing around.
+const forwardedHeader = "X-Forwarded-To-Leader"
+
+// Errors returned by writes in cluster mode, all of which are safe to retry.
+var (
+	ErrNoLeader       = errors.New("no leader is elected yet")
+	ErrLeadershipLost = errors.New("leadership changed before the change was replicated")
+	ErrNotReplicated  = errors.New("the change wasn't replicated to a majority of the cluster in time")
+)
+
+// Types of raftCommand besides the Change types, which set a counter to ID,
+// or delete it.
+const (
+	commandBatch  = "batch"
+	commandConfig = "config"
+	commandLease  = "lease"
+	commandNoop   = "noop"
+)
+
+// raftCommand is one mutation of the store, as replicated in cluster mode.
+// It carries the result of the mutation rather than the request, so it's
+// applied the same way on every node.
+type raftCommand struct {
+	Type        string         `json:"type"`
+	Environment string         `json:"environment,omitempty"`
+	Name        string         `json:"name,omitempty"`
+	ID          int            `json:"id,omitempty"`
+	Config      *CounterConfig `json:"config,omitempty"`
+	Lease       *Lease         `json:"lease,omitempty"`
+	// Ranges are the remainders of a counter's leases after a commandLease.
+	Ranges []Range `json:"ranges,omitempty"`
+	// Commands are the mutations of a commandBatch, applied in order.
+	Commands []raftCommand `json:"commands,omitempty"`
+}
+
+// ClusterStatus describes a node's view of the cluster. State is
+// `standalone` outside cluster mode.
+type ClusterStatus struct {
+	ID          string   `json:"id,omitempty" yaml:"id,omitempty"`
+	State       string   `json:"state" yaml:"state"`
+	Term        uint64   `json:"term" yaml:"term"`
+	Leader      string   `json:"leader,omitempty" yaml:"leader,omitempty"`
+	CommitIndex uint64   `json:"commit_index" yaml:"commit_index"`
+	LastIndex   uint64   `json:"last_index" yaml:"last_index"`
+	Peers       []string `json:"peers,omitempty" yaml:"peers,omitempty"`
+}
+
+// cluster is the node this process runs in cluster mode, or nil.
+var cluster *raftNode
+
+// startCluster starts cluster mode if -cluster-peers is set.
+func startCluster(ids idMap) error {
+	if *clusterPeers == "" {
+		return nil
+	}
+	if *clusterAdvertise == "" {
+		return errors.New("-cluster-advertise is required with -cluster-peers")
+	}
+	if *clusterDir == "" {
+		return errors.New("-cluster-dir is required with -cluster-peers")
+	}
+	if err := checkStandalone("in cluster mode"); err != nil {
+		return err
+	}
+	storage, state, entries, err := openRaftStorage(*clusterDir)
+	if err != nil {
+		return errors.New("loading the Raft log: " + err.Error())
+	}
+	peers := []string{}
+	for _, peer := range strings.Split(*clusterPeers, ",") {
+		if peer = strings.TrimRight(strings.TrimSpace(peer), "/"); peer != "" {
+			peers = append(peers, peer)
+		}
+	}
+	cluster = newRaftNode(strings.TrimRight(*clusterAdvertise, "/"), peers, mutex, ids.applyCommand, storage, state, entries)
+	cluster.start()
+	return nil
+}
+
+// checkStandalone fails if any listener in standaloneFlags is configured.
+func checkStandalone(mode string) error {
+	for name, value := range standaloneFlags {
+		if *value != "" {
+			return errors.New("-" + name + " can't be used " + mode)
+		}
+	}
+	return nil
+}
+
+// newRaftNode returns a node replicating the mutations of ids, keeping its
+// log in memory only.
+func (ids idMap) newRaftNode(id string, peers []string) *raftNode {
+	return newRaftNode(id, peers, mutex, ids.applyCommand, nil, raftState{}, nil)
+}
+
+// commit makes a mutation: in cluster mode, only once it's committed to the
+// Raft log, failing if it isn't. It's then applied, published to the change
+// feed, and shipped to replicas. The caller must hold the mutex, or the
+// environment of the mutated counter locked; mutations in different
+// environments commute, so they may be logged in either order.
+func (ids idMap) commit(command raftCommand) error {
+	if cluster != nil {
+		if err := cluster.propose(command, time.Now().Add(clusterTimeout)); err != nil {
+			return err
+		}
+	}
+	ids.applyCommand(command)
+	shipped.append(command)
+	return nil
+}
+
+// commitAll commits commands as one mutation, so that in cluster mode either
+// every one of them is applied or, if it isn't committed, none are.
+func (ids idMap) commitAll(commands []raftCommand) error {
+	switch len(commands) {
+	case 0:
+		return nil
+	case 1:
+		return ids.commit(commands[0])
+	}
+	return ids.commit(raftCommand{Type: commandBatch, Commands: commands})
+}
+
+// configure sets a counter's config. The caller must hold the mutex.
+func (ids idMap) configure(name, environment string, config CounterConfig) error {
+	return ids.commit(raftCommand{Type: commandConfig, Environment: environment, Name: name, Config: &config})
+}
+
+// applyCommand applies a replicated mutation, already checked by the leader.
+// The caller must hold the mutex.
+func (ids idMap) applyCommand(command raftCommand) {
+	key := CounterKey{Environment: command.Environment, Name: command.Name}
+	switch command.Type {
+	case commandBatch:
+		for _, batched := range command.Commands {
+			ids.applyCommand(batched)
+		}
+	case ChangeIncrement, ChangeReserve, ChangeSet:
+		if _, ok := ids[command.Environment]; !ok {
+			ids[command.Environment] = map[string]int{}
+		}
+		ids[command.Environment][command.Name] = command.ID
+		changes.record(command.Type, command.Name, command.Environment, command.ID)
+	case ChangeDelete:
+		delete(ids[command.Environment], command.Name)
+		delete(configs, key)
+		leases.forget(key)
+		if len(ids[command.Environment]) == 0 {
+			delete(ids, command.Environment)
+		}
+		changes.record(command.Type, command.Name, command.Environment, command.ID)
+	case commandConfig:
+		configs[key] = *command.Config
+	case commandLease:
+		leases.apply(command)
+	}
+}
+
+// resetState empties the counters, their configs and the leases. The caller
+// must hold the mutex.
+func (ids idMap) resetState() {
+	for environment := range ids {
+		delete(ids, environment)
+	}
+	configs = counterConfigs{}
+	leases = newLeaseTable()
+	resets++
+}
+
+func (node *raftNode) status() ClusterStatus {
+	if node == nil {
+		return ClusterStatus{State: "standalone"}
+	}
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	return ClusterStatus{
+		ID:          node.id,
+		State:       node.state,
+		Term:        node.term,
+		Leader:      node.leader,
+		CommitIndex: node.commitIndex,
+		LastIndex:   node.lastIndex(),
+		Peers:       node.peers,
+	}
+}
+
+// setupClusterRoutes serves the node's status, and the endpoints its peers
+// call. Outside cluster mode, node is nil and only the status is served.
+func setupClusterRoutes(router gin.IRoutes, node *raftNode) {
+	router.GET("/v2/cluster", func(context *gin.Context) {
+		respond(context, http.StatusOK, node.status())
+	})
+	router.POST("/raft/vote", func(context *gin.Context) {
+		var request voteRequest
+		if !bindRaftRequest(context, node, &request) {
+			return
+		}
+		response, err := node.handleVote(request)
+		if err != nil {
+			abortWithError(context, err)
+			return
+		}
+		context.JSON(http.StatusOK, response)
+	})
+	router.POST("/raft/append", func(context *gin.Context) {
+		var request appendRequest
+		if !bindRaftRequest(context, node, &request) {
+			return
+		}
+		response, err := node.handleAppend(request)
+		if err != nil {
+			abortWithError(context, err)
+			return
+		}
+		context.JSON(http.StatusOK, response)
+	})
+}
+
+func bindRaftRequest(context *gin.Context, node *raftNode, request interface{}) bool {
+	if node == nil {
+		abortWithError(context, NewAPIError(CodeNotFound, "", "not running in cluster mode"))
+		return false
+	}
+	if err := context.BindJSON(request); err != nil {
+		abortWithError(context, NewAPIError(CodeInvalidArgument, "", "Unable to parse raft request: "+err.Error()))
+		return false
+	}
+	return true
+}
+
+// internalRoutes are handled by whichever node they reach, as they only
+// concern that node.
+var internalRoutes = []string{"/raft/", "/replication/", "/v2/replication/"}
+
+// isWrite reports whether a request can change counters, and so has to be
+// handled by the leader or primary. `/getter` increments despite being a GET.
+func isWrite(request *http.Request) bool {
+	for _, prefix := range internalRoutes {
+		if strings.HasPrefix(request.URL.Path, prefix) {
+			return false
+		}
+	}
+	return request.Method != "GET" || strings.HasPrefix(request.URL.Path, "/getter/")
+}
+
+// clustered sends writes on to the leader. The leader handles them itself,
+// each mutation failing with 503 unless a majority hold it, so no client is
+// handed an ID a new leader could hand out again.
+func clustered(node *raftNode) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		if !isWrite(context.Request) {
+			context.Next()
+			return
+		}
+		leader, _, err := node.leadership(time.Now().Add(clusterTimeout))
+		if err != nil {
+			abortWithError(context, err)
+			return
+		}
+		if leader != node.id {
+			forwardToLeader(context, leader)
+			return
+		}
+		context.Next()
+	}
+}
+
+func forwardToLeader(context *gin.Context, leader string) {
+	if context.Request.Header.Get(forwardedHeader) != "" {
+		abortWithError(context, ErrLeadershipLost)
+		return
+	}
+	if *clusterRedirect {
+		redirectTo(context, leader)
+		return
+	}
+	target, err := url.Parse(leader)
+	if err != nil {
+		abortWithError(context, err)
+		return
+	}
+	context.Request.Header.Set(forwardedHeader, leader)
+	httputil.NewSingleHostReverseProxy(target).ServeHTTP(context.Writer, context.Request)
+	context.Abort()
+}
+
+// redirectTo sends the client to the same request on another node, keeping
+// its method and body.
+func redirectTo(context *gin.Context, node string) {
+	context.Redirect(http.StatusTemporaryRedirect, node+context.Request.URL.RequestURI())
+	context.Abort()
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testMachine is a state machine for raftNode tests, holding the last ID
+// set for each name.
+type testMachine struct {
+	sync.Mutex
+	ids map[string]int
+}
+
+func (machine *testMachine) apply(command raftCommand) {
+	if command.Type == ChangeSet {
+		machine.ids[command.Name] = command.ID
+	}
+}
+
+func (machine *testMachine) get(name string) int {
+	machine.Lock()
+	defer machine.Unlock()
+	return machine.ids[name]
+}
+
+type testNode struct {
+	node    *raftNode
+	machine *testMachine
+	server  *httptest.Server
+}
+
+// startTestCluster starts size nodes on local servers, with short timeouts.
+func startTestCluster(size int) []*testNode {
+	nodes := make([]*testNode, size)
+	handlers := make([]http.Handler, size)
+	for i := range nodes {
+		i := i
+		nodes[i] = &testNode{machine: &testMachine{ids: map[string]int{}}}
+		nodes[i].server = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			handlers[i].ServeHTTP(writer, request)
+		}))
+	}
+	for i, test := range nodes {
+		peers := []string{}
+		for _, peer := range nodes {
+			if peer != test {
+				peers = append(peers, peer.server.URL)
+			}
+		}
+		test.node = newRaftNode(test.server.URL, peers, test.machine, test.machine.apply, nil, raftState{}, nil)
+		test.node.heartbeat = 10 * time.Millisecond
+		test.node.electionTimeout = 50 * time.Millisecond
+		router := gin.New()
+		router.Use(requestID())
+		setupClusterRoutes(router, test.node)
+		handlers[i] = router
+	}
+	for _, test := range nodes {
+		test.node.start()
+	}
+	return nodes
+}
+
+func (test *testNode) stop() {
+	test.node.stop()
+	test.server.Close()
+}
+
+// leaderOf waits for one of nodes to lead, and be ready for commands.
+func leaderOf(t *testing.T, nodes []*testNode) *testNode {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, test := range nodes {
+			if leader, _, err := test.node.leadership(time.Now().Add(time.Second)); err == nil && leader == test.node.id {
+				return test
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Expected a leader to be elected")
+	return nil
+}
+
+// set sets name to id on the leader, once a majority hold the change.
+func (test *testNode) set(name string, id int) error {
+	if _, _, err := test.node.leadership(time.Now().Add(time.Second)); err != nil {
+		return err
+	}
+	test.machine.Lock()
+	defer test.machine.Unlock()
+	command := raftCommand{Type: ChangeSet, Name: name, ID: id}
+	if err := test.node.propose(command, time.Now().Add(time.Second)); err != nil {
+		return err
+	}
+	test.machine.apply(command)
+	return nil
+}
+
+func waitFor(t *testing.T, description string, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected " + description)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRaftReplicatesAndSurvivesLeaderLoss(t *testing.T) {
+	// setup
+	nodes := startTestCluster(3)
+	defer func() {
+		for _, test := range nodes {
+			test.stop()
+		}
+	}()
+	leader := leaderOf(t, nodes)
+
+	// test that committed changes reach every node
+	for id := 1; id <= 20; id++ {
+		if err := leader.set("records", id); err != nil {
+			t.Fatal("Expected the change to commit, got ", err)
+		}
+	}
+	for _, test := range nodes {
+		waitFor(t, "every node to apply 20", func() bool { return test.machine.get("records") == 20 })
+	}
+
+	// test that after losing the leader, the rest elect a new one that
+	// carries on from every committed change
+	remaining := []*testNode{}
+	for _, test := range nodes {
+		if test != leader {
+			remaining = append(remaining, test)
+		}
+	}
+	leader.stop()
+	nodes = remaining
+	leader = leaderOf(t, nodes)
+	if id := leader.machine.get("records"); id != 20 {
+		t.Error("Expected the new leader to hold 20, got ", id)
+	}
+	if err := leader.set("records", 21); err != nil {
+		t.Fatal("Expected the change to commit with 2 of 3 nodes, got ", err)
+	}
+	for _, test := range nodes {
+		waitFor(t, "every node to apply 21", func() bool { return test.machine.get("records") == 21 })
+	}
+
+	// test that without a majority, changes aren't acknowledged
+	follower := nodes[0]
+	if follower == leader {
+		follower = nodes[1]
+	}
+	follower.stop()
+	nodes = []*testNode{leader}
+	if err := leader.set("records", 22); err != ErrNotReplicated && err != ErrLeadershipLost {
+		t.Error("Expected the change not to be replicated, got ", err)
+	}
+	if id := leader.machine.get("records"); id != 21 {
+		t.Error("Expected the change not to be applied, got ", id)
+	}
+}
+
+func TestRaftFollowerDiscardsUncommittedEntries(t *testing.T) {
+	// setup
+	machine := &testMachine{ids: map[string]int{}}
+	node := newRaftNode("http://a", []string{"http://b", "http://c"}, machine, machine.apply, nil, raftState{}, nil)
+	node.handleAppend(appendRequest{Term: 1, Leader: "http://b", Entries: []raftEntry{
+		{Term: 1, Command: raftCommand{Type: ChangeSet, Name: "records", ID: 1}},
+		{Term: 1, Command: raftCommand{Type: ChangeSet, Name: "records", ID: 2}},
+	}, LeaderCommit: 1})
+
+	// test that a new leader's conflicting entry replaces an uncommitted one
+	response, _ := node.handleAppend(appendRequest{Term: 2, Leader: "http://c", PrevLogIndex: 1, PrevLogTerm: 1, Entries: []raftEntry{
+		{Term: 2, Command: raftCommand{Type: ChangeSet, Name: "records", ID: 3}},
+	}, LeaderCommit: 2})
+	if !response.Success || node.lastIndex() != 2 || node.log[2].Command.ID != 3 || node.commitIndex != 2 {
+		t.Errorf("Expected the entry to be replaced and committed, got %v %v", response, node.log)
+	}
+
+	// test that stale leaders and gaps are rejected
+	if response, _ := node.handleAppend(appendRequest{Term: 1, Leader: "http://b"}); response.Success || response.Term != 2 {
+		t.Error("Expected a stale leader to be rejected, got ", response)
+	}
+	if response, _ := node.handleAppend(appendRequest{Term: 2, Leader: "http://c", PrevLogIndex: 5, PrevLogTerm: 2}); response.Success || response.LastIndex != 2 {
+		t.Error("Expected a gap to be rejected with the last index, got ", response)
+	}
+
+	// test that votes go only to candidates at least as up to date, once per term
+	if vote, _ := node.handleVote(voteRequest{Term: 3, Candidate: "http://b", LastLogIndex: 2, LastLogTerm: 1}); vote.Granted {
+		t.Error("Expected a vote for an out of date candidate to be refused")
+	}
+	if vote, _ := node.handleVote(voteRequest{Term: 3, Candidate: "http://c", LastLogIndex: 2, LastLogTerm: 2}); !vote.Granted {
+		t.Error("Expected a vote for an up to date candidate")
+	}
+	if vote, _ := node.handleVote(voteRequest{Term: 3, Candidate: "http://b", LastLogIndex: 9, LastLogTerm: 2}); vote.Granted {
+		t.Error("Expected only one vote per term")
+	}
+}
+
+func TestClusteredWrites(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	cluster = ids.newRaftNode("http://localhost:0", nil)
+	cluster.start()
+	defer func() {
+		cluster.stop()
+		cluster = nil
+	}()
+	testRouter := ids.SetupRouter()
+
+	// test that a single node elects itself and acknowledges writes once
+	// they're committed
+	for _, expected := range []int{initialValue, initialValue + incrementBy} {
+		response := serveAccept(t, testRouter, "/getter/live/records", mimeText)
+		if response.Code != 200 || strings.TrimSpace(response.Body.String()) != strconv.Itoa(expected) {
+			t.Errorf("Expected %d, got %d `%s`", expected, response.Code, response.Body)
+		}
+	}
+	status := cluster.status()
+	if status.State != raftLeader || status.CommitIndex != 3 || status.CommitIndex != status.LastIndex {
+		t.Error("Expected a noop and two committed changes, got ", status)
+	}
+
+	// test that failures aren't replicated
+	code, _ := serveV2(t, testRouter, "PUT", "/v2/environments/live/counters/records", `{"id": "x"}`)
+	if code != 400 || cluster.status().LastIndex != 3 {
+		t.Errorf("Expected status code 400 and nothing proposed, got %d %v", code, cluster.status())
+	}
+}
+
+func TestForwardToLeader(t *testing.T) {
+	// setup
+	leader := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte(request.Method + " " + request.URL.RequestURI() + " " + request.Header.Get(forwardedHeader)))
+	}))
+	defer leader.Close()
+	router := gin.New()
+	router.Use(requestID())
+	router.Use(func(context *gin.Context) { forwardToLeader(context, leader.URL) })
+	router.POST("/v2/batch", func(context *gin.Context) { t.Error("Expected the follower not to handle the write") })
+
+	follower := httptest.NewServer(router)
+	defer follower.Close()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	post := func(header string) (*http.Response, string) {
+		request, _ := http.NewRequest("POST", follower.URL+"/v2/batch?x=1", nil)
+		request.Header.Set(forwardedHeader, header)
+		response, err := client.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		body, _ := ioutil.ReadAll(response.Body)
+		return response, string(body)
+	}
+
+	// test that writes are forwarded, marked as such
+	if response, body := post(""); response.StatusCode != 200 || body != "POST /v2/batch?x=1 "+leader.URL {
+		t.Errorf("Expected the leader's response, got %d `%s`", response.StatusCode, body)
+	}
+
+	// test that a forwarded write isn't forwarded again
+	if response, _ := post(leader.URL); response.StatusCode != 503 {
+		t.Error("Expected status code 503, got ", response.StatusCode)
+	}
+
+	// test that writes are redirected with -cluster-redirect
+	*clusterRedirect = true
+	defer func() { *clusterRedirect = false }()
+	if response, _ := post(""); response.StatusCode != 307 || response.Header.Get("Location") != leader.URL+"/v2/batch?x=1" {
+		t.Errorf("Expected a redirect to the leader, got %d %v", response.StatusCode, response.Header)
+	}
+}
+
+func TestClusterStandalone(t *testing.T) {
+	// setup
+	testRouter := NewIDMap().SetupRouter()
+
+	// test that the status reports standalone mode
+	response := serveAccept(t, testRouter, "/v2/cluster", "")
+	var status ClusterStatus
+	json.Unmarshal(response.Body.Bytes(), &status)
+	if response.Code != 200 || status.State != "standalone" {
+		t.Errorf("Expected standalone, got %d `%s`", response.Code, response.Body)
+	}
+
+	// test that the Raft endpoints aren't served
+	request, _ := http.NewRequest("POST", "/raft/vote", nil)
+	recorder := httptest.NewRecorder()
+	testRouter.ServeHTTP(recorder, request)
+	if recorder.Code != 404 {
+		t.Error("Expected status code 404, got ", recorder.Code)
+	}
+}
+
+func TestIsWrite(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		write  bool
+	}{
+		{"GET", "/lister", false},
+		{"GET", "/getter/live/records", true},
+		{"GET", "/v2/environments/live/counters/records", false},
+		{"POST", "/v2/environments/live/counters/records:next", true},
+		{"DELETE", "/v2/environments/live/counters/records", true},
+		{"POST", "/raft/append", false},
+	}
+
+	for _, test := range tests {
+		request, _ := http.NewRequest(test.method, test.path, nil)
+		// test for whether the request goes to the leader
+		if isWrite(request) != test.write {
+			t.Errorf("Expected %s %s to be a write: %v", test.method, test.path, test.write)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CounterConfig is how a counter hands out IDs. Counters without one, which
+// is every counter not created by applying a Spec, use defaultConfig.
+type CounterConfig struct {
+	// Start is the value the counter is created at.
+	Start int `json:"start" yaml:"start" binding:"min=0,max=9007199254740991"`
+	Step  int `json:"step" yaml:"step" binding:"min=1,max=9007199254740991"`
+	// Min and Max bound every value the counter can take.
+	Min int `json:"min" yaml:"min" binding:"min=0,max=9007199254740991"`
+	Max int `json:"max" yaml:"max" binding:"min=0,max=9007199254740991"`
+	// Format renders IDs for display, e.g. `INV-%06d`.
+	Format string `json:"format,omitempty" yaml:"format,omitempty" binding:"max=64"`
+	// Monotonic counters are never set or added below their current value.
+	Monotonic bool `json:"monotonic" yaml:"monotonic"`
+}
+
+type counterConfigs map[CounterKey]CounterConfig
+
+// configs holds the config of counters that have one, guarded by the mutex
+// along with the counters. It's only changed with the mutex held
+// exclusively, so reading it only needs the mutex shared. A config only
+// exists alongside its counter, and is dropped by Delete.
+var configs = counterConfigs{}
+
+func defaultConfig() CounterConfig {
+	return CounterConfig{Start: initialValue, Step: incrementBy, Min: 0, Max: maxID}
+}
+
+// configFor returns a counter's config. The caller must hold the mutex,
+// shared or exclusively.
+func configFor(name, environment string) CounterConfig {
+	if config, ok := configs[CounterKey{Environment: environment, Name: name}]; ok {
+		return config
+	}
+	return defaultConfig()
+}
+
+// validate checks the config's fields, and that Start lies within its bounds.
+func (config CounterConfig) validate() error {
+	if err := validateStruct(&config); err != nil {
+		return err
+	}
+	if config.Start < config.Min || config.Start > config.Max {
+		return NewAPIError(CodeInvalidArgument, "start", fmt.Sprintf("start must be between min %d and max %d", config.Min, config.Max))
+	}
+	if config.Format != "" && (strings.Count(strings.Replace(config.Format, "%%", "", -1), "%") != 1 || strings.Contains(fmt.Sprintf(config.Format, 1), "%!")) {
+		return NewAPIError(CodeInvalidArgument, "format", "format must contain a single integer verb, e.g. `INV-%06d`")
+	}
+	return nil
+}
+
+// format renders id with Format, or returns "" without one.
+func (config CounterConfig) format(id int) string {
+	if config.Format == "" {
+		return ""
+	}
+	return fmt.Sprintf(config.Format, id)
+}
+
+// next returns the first and last of the next count IDs after id, or from
+// Start if the counter wasn't found. It fails with ErrOutOfRange rather than
+// passing Max.
+func (config CounterConfig) next(id int, found bool, count int) (int, int, error) {
+	first := config.Start
+	if found {
+		if id > config.Max-config.Step {
+			return 0, 0, ErrOutOfRange
+		}
+		first = id + config.Step
+	}
+	if first > config.Max || count-1 > (config.Max-first)/config.Step {
+		return 0, 0, ErrOutOfRange
+	}
+	return first, first + (count-1)*config.Step, nil
+}
+
+// check returns ErrOutOfRange if id is outside the bounds, or ErrNotMonotonic
+// if it would lower a monotonic counter found at current.
+func (config CounterConfig) check(current int, found bool, id int) error {
+	if id < config.Min || id > config.Max {
+		return ErrOutOfRange
+	}
+	if config.Monotonic && found && id < current {
+		return ErrNotMonotonic
+	}
+	return nil
+}
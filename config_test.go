@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestConfiguredCounter(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	ids.Set("records", "live", 1000)
+	configs[CounterKey{Environment: "live", Name: "records"}] = CounterConfig{Start: 1000, Step: 10, Min: 1000, Max: 1030, Monotonic: true}
+	defer func() { configs = counterConfigs{} }()
+
+	// test that increments use the counter's step up to its max
+	for _, expected := range []int{1010, 1020, 1030} {
+		if id, err := ids.Get("records", "live"); err != nil || id != expected {
+			t.Errorf("Expected %d, got %d (%v)", expected, id, err)
+		}
+	}
+	if _, err := ids.Get("records", "live"); err != ErrOutOfRange {
+		t.Error("Expected ErrOutOfRange past the max, got ", err)
+	}
+
+	// test that a monotonic counter isn't lowered
+	if _, err := ids.Set("records", "live", 1020); err != ErrNotMonotonic {
+		t.Error("Expected ErrNotMonotonic, got ", err)
+	}
+	if _, err := ids.Add("records", "live", -10); err != ErrNotMonotonic {
+		t.Error("Expected ErrNotMonotonic, got ", err)
+	}
+	if ids["live"]["records"] != 1030 {
+		t.Error("Expected the counter to stay at 1030, got ", ids["live"]["records"])
+	}
+
+	// test that deleting the counter drops its config
+	ids.Delete("records", "live")
+	if id, err := ids.Get("records", "live"); err != nil || id != initialValue {
+		t.Errorf("Expected %d, got %d (%v)", initialValue, id, err)
+	}
+}
+
+func TestCounterConfigValidate(t *testing.T) {
+	tests := []struct {
+		config CounterConfig
+		field  string
+	}{
+		{CounterConfig{Start: 10, Step: 1, Min: 0, Max: 100, Format: "INV-%06d"}, ""},
+		{CounterConfig{Start: 10, Step: 0, Min: 0, Max: 100}, "step"},
+		{CounterConfig{Start: 10, Step: 1, Min: 20, Max: 100}, "start"},
+		{CounterConfig{Start: 10, Step: 1, Min: 0, Max: 100, Format: "INV-%s"}, "format"},
+		{CounterConfig{Start: 10, Step: 1, Min: 0, Max: 100, Format: "%d-%d"}, "format"},
+		{CounterConfig{Start: 10, Step: 1, Min: 0, Max: 100, Format: "none"}, "format"},
+	}
+
+	for _, test := range tests {
+		err := test.config.validate()
+		// test for the invalid field
+		if test.field == "" && err != nil {
+			t.Errorf("Expected %v to be valid, got %v", test.config, err)
+		}
+		if test.field != "" && (err == nil || toAPIError(err).Field != test.field) {
+			t.Errorf("Expected %v to fail on %s, got %v", test.config, test.field, err)
+		}
+	}
+
+	// test for formatting
+	if formatted := (CounterConfig{Format: "INV-%06d"}).format(42); formatted != "INV-000042" {
+		t.Error("Expected INV-000042, got ", formatted)
+	}
+}
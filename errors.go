@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+// Error codes returned in the `code` field of every error response.
+const (
+	CodeInvalidArgument  = "invalid_argument"
+	CodeNotFound         = "not_found"
+	CodeNotAcceptable    = "not_acceptable"
+	CodeConflict         = "conflict"
+	CodeDeadlineExceeded = "deadline_exceeded"
+	CodeInternal         = "internal"
+	CodeUnavailable      = "unavailable"
+)
+
+// HTTP status returned for each error code.
+var codeStatus = map[string]int{
+	CodeInvalidArgument:  http.StatusBadRequest,
+	CodeNotFound:         http.StatusNotFound,
+	CodeNotAcceptable:    http.StatusNotAcceptable,
+	CodeConflict:         http.StatusConflict,
+	CodeDeadlineExceeded: http.StatusRequestTimeout,
+	CodeInternal:         http.StatusInternalServerError,
+	CodeUnavailable:      http.StatusServiceUnavailable,
+}
+
+// Errors returned by the idMap methods.
+var (
+	ErrEmptyName            = errors.New("name must not be empty")
+	ErrEmptyEnvironment     = errors.New("environment must not be empty")
+	ErrNotFound             = errors.New("counter not found")
+	ErrInvalidCount         = errors.New("count must be at least 1")
+	ErrOutOfRange           = errors.New("counter would go outside its bounds, by default 0 to 9007199254740991")
+	ErrNotMonotonic         = errors.New("counter is monotonic and can't be lowered")
+	ErrWatchTimeout         = errors.New("counter did not pass the watched value before the timeout")
+	ErrWatchCancelled       = errors.New("watch was cancelled")
+	ErrHistoryCompacted     = errors.New("changes since the requested sequence are no longer kept, or it's from before the server restarted")
+	ErrIdempotencyKeyReused = errors.New("Idempotency-Key was already used for a request with a different body")
+	ErrIdempotencyCancelled = errors.New("request was cancelled while waiting for another with the same Idempotency-Key")
+)
+
+// APIError is the body returned by every endpoint when a request fails.
+type APIError struct {
+	Code      string      `json:"code"`
+	Message   string      `json:"error"`
+	Field     string      `json:"field,omitempty"`
+	RequestID string      `json:"request_id,omitempty"`
+	Details   []*APIError `json:"details,omitempty"`
+}
+
+func (apiError *APIError) Error() string {
+	return apiError.Message
+}
+
+// Status returns the HTTP status code for the error's code.
+func (apiError *APIError) Status() int {
+	if status, ok := codeStatus[apiError.Code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+func NewAPIError(code, field, message string) *APIError {
+	return &APIError{Code: code, Field: field, Message: message}
+}
+
+// toAPIError maps errors returned by the store onto the API taxonomy.
+func toAPIError(err error) *APIError {
+	switch err {
+	case ErrEmptyName:
+		return NewAPIError(CodeInvalidArgument, "name", err.Error())
+	case ErrEmptyEnvironment:
+		return NewAPIError(CodeInvalidArgument, "environment", err.Error())
+	case ErrInvalidCount:
+		return NewAPIError(CodeInvalidArgument, "count", err.Error())
+	case ErrOutOfRange:
+		return NewAPIError(CodeInvalidArgument, "id", err.Error())
+	case ErrNotMonotonic:
+		return NewAPIError(CodeConflict, "id", err.Error())
+	case ErrNotFound:
+		return NewAPIError(CodeNotFound, "", err.Error())
+	case ErrWatchTimeout:
+		return NewAPIError(CodeDeadlineExceeded, "", err.Error())
+	case ErrHistoryCompacted, ErrSequenceUnknown:
+		return NewAPIError(CodeConflict, "after", err.Error())
+	case ErrIdempotencyKeyReused:
+		return NewAPIError(CodeConflict, "Idempotency-Key", err.Error())
+	case ErrEpochChanged:
+		return NewAPIError(CodeConflict, "epoch", err.Error())
+	case ErrLeaseNotFound:
+		return NewAPIError(CodeNotFound, "", err.Error())
+	case ErrLeaseEnded, ErrLeaseNotExpired:
+		return NewAPIError(CodeConflict, "", err.Error())
+	case ErrNotReplica:
+		return NewAPIError(CodeConflict, "", err.Error())
+	case ErrNoLeader, ErrLeadershipLost, ErrNotReplicated, ErrNoLease, ErrTooManyLeases:
+		return NewAPIError(CodeUnavailable, "", err.Error())
+	}
+	if apiError, ok := err.(*APIError); ok {
+		return apiError
+	}
+	return NewAPIError(CodeInternal, "", err.Error())
+}
+
+// abortWithError writes err as an APIError tagged with the request's ID and
+// stops any remaining handlers.
+func abortWithError(context *gin.Context, err error) {
+	apiError := *toAPIError(err)
+	apiError.RequestID = context.MustGet(requestIDKey).(string)
+	context.JSON(apiError.Status(), apiError)
+	context.Abort()
+}
+
+const requestIDKey = "request_id"
+const requestIDHeader = "X-Request-ID"
+
+// requestID tags every request with the caller's X-Request-ID, or a random
+// one if none was passed, and echoes it back in the response.
+func requestID() gin.HandlerFunc {
+	return func(context *gin.Context) {
+		id := context.Request.Header.Get(requestIDHeader)
+		if id == "" {
+			id = newRequestID()
+		}
+		context.Set(requestIDKey, id)
+		context.Header(requestIDHeader, id)
+		context.Next()
+	}
+}
+
+func newRequestID() string {
+	buffer := make([]byte, 8)
+	if _, err := rand.Read(buffer); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(buffer)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+func TestSetterEndpointEmptyID(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	testRouter := ids.SetupRouter()
+	form := url.Values{}
+	form.Add("environment", "live")
+	form.Add("name", "records_name")
+	request, err := http.NewRequest("POST", "/setter", bytes.NewBufferString(form.Encode()))
+	if err != nil {
+		t.Error(err)
+	}
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Add("Content-Length", strconv.Itoa(len(form.Encode())))
+	request.Header.Add(requestIDHeader, "test-request")
+	response := httptest.NewRecorder()
+	testRouter.ServeHTTP(response, request)
+
+	// test for 400 response code
+	if response.Code != 400 {
+		t.Error("Expected status code 400, got ", response.Code)
+	}
+
+	// test for a JSON object rather than a quoted string
+	var apiError APIError
+	err = json.Unmarshal(response.Body.Bytes(), &apiError)
+	if err != nil {
+		t.Errorf("Unable to unmarshal `%s`", response.Body)
+	}
+	if apiError.Code != CodeInvalidArgument {
+		t.Errorf("Expected code `%s`, got `%s`", CodeInvalidArgument, apiError.Code)
+	}
+	if apiError.Field != "id" {
+		t.Errorf("Expected field `id`, got `%s`", apiError.Field)
+	}
+	if apiError.RequestID != "test-request" {
+		t.Errorf("Expected request ID `test-request`, got `%s`", apiError.RequestID)
+	}
+}
+
+func TestUnknownRoute(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	testRouter := ids.SetupRouter()
+	request, err := http.NewRequest("GET", "/nowhere", nil)
+	if err != nil {
+		t.Error(err)
+	}
+	response := httptest.NewRecorder()
+	testRouter.ServeHTTP(response, request)
+
+	// test for 404 response code
+	if response.Code != 404 {
+		t.Error("Expected status code 404, got ", response.Code)
+	}
+
+	// test for a generated request ID in the header and the body
+	var apiError APIError
+	err = json.Unmarshal(response.Body.Bytes(), &apiError)
+	if err != nil {
+		t.Errorf("Unable to unmarshal `%s`", response.Body)
+	}
+	if apiError.Code != CodeNotFound {
+		t.Errorf("Expected code `%s`, got `%s`", CodeNotFound, apiError.Code)
+	}
+	if apiError.RequestID == "" || apiError.RequestID != response.Header().Get(requestIDHeader) {
+		t.Errorf("Expected request ID `%s`, got `%s`", response.Header().Get(requestIDHeader), apiError.RequestID)
+	}
+}
+
+func TestGetSetEmptyKey(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+
+	// test for errors instead of counters under the empty string
+	if _, err := ids.Get("", "live"); err != ErrEmptyName {
+		t.Errorf("Expected `%v`, got `%v`", ErrEmptyName, err)
+	}
+	if _, err := ids.Set("records", "", 5); err != ErrEmptyEnvironment {
+		t.Errorf("Expected `%v`, got `%v`", ErrEmptyEnvironment, err)
+	}
+	if len(ids) != 0 {
+		t.Error("Expected no environments, got ", len(ids))
+	}
+
+	// test for mapping onto the API taxonomy
+	apiError := toAPIError(ErrEmptyName)
+	if apiError.Status() != http.StatusBadRequest || apiError.Field != "name" {
+		t.Errorf("Expected a 400 on field `name`, got %d on `%s`", apiError.Status(), apiError.Field)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/manucorporat/sse"
+	"net/http"
+	"time"
+)
+
+// How often an idle event stream writes a comment, so proxies keep it open
+// and disconnected clients are noticed.
+var heartbeatInterval = 15 * time.Second
+
+const defaultChangesLimit = 1000
+
+// eventsRequest is the query accepted by the event stream.
+type eventsRequest struct {
+	Environment string `form:"environment" json:"environment" binding:"omitempty,max=64,identifier"`
+	// Name is a glob as understood by path.Match, e.g. `records_*`.
+	Name string `form:"name" json:"name"`
+	// LastEventID is an alternative to the Last-Event-ID header for clients
+	// that can't set headers.
+	LastEventID string `form:"last_event_id" json:"last_event_id"`
+}
+
+func (request eventsRequest) matches(change Change) bool {
+	if request.Environment != "" && change.Environment != request.Environment {
+		return false
+	}
+	return matchesGlob(request.Name, change.Name)
+}
+
+// changesRequest is the query accepted when fetching changes.
+type changesRequest struct {
+	After       string `form:"after" json:"after"`
+	Limit       int    `form:"limit" json:"limit" binding:"omitempty,min=1,max=10000"`
+	Environment string `form:"environment" json:"environment" binding:"omitempty,max=64,identifier"`
+	Name        string `form:"name" json:"name"`
+}
+
+func setupEventRoutes(router gin.IRoutes) {
+	router.GET("/v2/events", streamChanges)
+	router.GET("/v2/changes", listChanges)
+}
+
+// listChanges returns a page of the changes after a position matching the
+// query, for clients syncing counters without holding a stream open. A
+// client starts from the position of a listing, and lists again if the
+// changes after it are no longer kept, or were made before a restart.
+func listChanges(context *gin.Context) {
+	var request changesRequest
+	if err := bindRequest(context, &request); err != nil {
+		abortWithError(context, err)
+		return
+	}
+	if err := validateGlob("name", request.Name); err != nil {
+		abortWithError(context, err)
+		return
+	}
+	if request.Limit == 0 {
+		request.Limit = defaultChangesLimit
+	}
+	after, err := changes.parsePosition(request.After)
+	if err == errBadPosition {
+		err = NewAPIError(CodeInvalidArgument, "after", "after "+err.Error())
+	}
+	if err != nil {
+		abortWithError(context, err)
+		return
+	}
+	filter := eventsRequest{Environment: request.Environment, Name: request.Name}
+	list, err := changes.page(after, request.Limit, filter.matches)
+	if err != nil {
+		abortWithError(context, err)
+		return
+	}
+	respond(context, http.StatusOK, list)
+}
+
+// streamChanges sends every change matching the query as a server-sent event
+// whose ID is the change's position. Clients reconnecting with Last-Event-ID
+// receive the changes they missed, or a `resync` event if those are no
+// longer kept, or their ID is from before a restart. The stream ends once the
+// server starts draining, so clients reconnect elsewhere.
+func streamChanges(context *gin.Context) {
+	var request eventsRequest
+	if err := bindRequest(context, &request); err != nil {
+		abortWithError(context, err)
+		return
+	}
+	if err := validateGlob("name", request.Name); err != nil {
+		abortWithError(context, err)
+		return
+	}
+	last, _ := changes.wait()
+	lastEventID := context.Request.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = request.LastEventID
+	}
+	// an ID from another epoch is treated like one no longer kept
+	stale := false
+	if lastEventID != "" {
+		var err error
+		last, err = changes.parsePosition(lastEventID)
+		if err == errBadPosition {
+			abortWithError(context, NewAPIError(CodeInvalidArgument, "last_event_id", "Last-Event-ID "+err.Error()))
+			return
+		}
+		stale = err == ErrHistoryCompacted
+	}
+
+	context.Header("Content-Type", sse.ContentType)
+	context.Header("Cache-Control", "no-cache")
+	context.Status(http.StatusOK)
+	context.Writer.WriteHeaderNow()
+	context.Writer.Flush()
+
+	done := context.Request.Context().Done()
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		current, changed := changes.wait()
+		if current != last || stale {
+			pending, err := changes.since(last)
+			if stale {
+				pending, err = nil, ErrHistoryCompacted
+			}
+			if err == ErrHistoryCompacted {
+				position := changes.position(current)
+				context.Render(-1, sse.Event{
+					Id:    position,
+					Event: "resync",
+					Data:  map[string]interface{}{"error": err.Error(), "sequence": current, "position": position},
+				})
+				last, stale = current, false
+			}
+			for _, change := range pending {
+				if request.matches(change) {
+					context.Render(-1, sse.Event{
+						Id:    change.Position,
+						Event: change.Type,
+						Data:  change,
+					})
+				}
+				last = change.Sequence
+			}
+			context.Writer.Flush()
+			continue
+		}
+
+		select {
+		case <-changed:
+		case <-heartbeat.C:
+			context.Writer.WriteString(": heartbeat\n\n")
+			context.Writer.Flush()
+		case <-done:
+			return
+		case <-draining:
+			return
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/snarlysodboxer/id-incrementer/client"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testEvent struct {
+	ID     string
+	Event  string
+	Change Change
+}
+
+// openEvents connects to the event stream, and returns a channel of the
+// events it sends.
+func openEvents(t *testing.T, server *httptest.Server, query, lastEventID string) (*http.Response, chan testEvent) {
+	request, err := http.NewRequest("GET", server.URL+"/v2/events?"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastEventID != "" {
+		request.Header.Set("Last-Event-ID", lastEventID)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan testEvent, 100)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(response.Body)
+		var event testEvent
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "id:"):
+				event.ID = line[3:]
+			case strings.HasPrefix(line, "event:"):
+				event.Event = line[6:]
+			case strings.HasPrefix(line, "data:"):
+				json.Unmarshal([]byte(line[5:]), &event.Change)
+			case line == "" && event.Event != "":
+				events <- event
+				event = testEvent{}
+			}
+		}
+	}()
+	return response, events
+}
+
+func nextEvent(t *testing.T, events chan testEvent) testEvent {
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for an event")
+	}
+	return testEvent{}
+}
+
+func TestEventStream(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	server := httptest.NewServer(ids.SetupRouter())
+	defer server.Close()
+	response, events := openEvents(t, server, "environment=events-test&name=records*", "")
+	defer response.Body.Close()
+
+	// test for an event stream
+	if response.StatusCode != 200 {
+		t.Error("Expected status code 200, got ", response.StatusCode)
+	}
+	if response.Header.Get("Content-Type") != "text/event-stream" {
+		t.Error("Expected text/event-stream, got ", response.Header.Get("Content-Type"))
+	}
+
+	// test that matching changes are sent, and others skipped
+	mutex.Lock()
+	ids.Get("records", "events-test")
+	ids.Get("records", "elsewhere")
+	ids.Get("users", "events-test")
+	ids.Set("records_other", "events-test", 100)
+	ids.Delete("records", "events-test")
+	mutex.Unlock()
+	expected := []struct {
+		event string
+		name  string
+		id    int
+	}{
+		{ChangeIncrement, "records", initialValue},
+		{ChangeSet, "records_other", 100},
+		{ChangeDelete, "records", initialValue},
+	}
+	first := ""
+	for _, want := range expected {
+		event := nextEvent(t, events)
+		if event.Event != want.event || event.Change.Name != want.name || event.Change.ID != want.id {
+			t.Errorf("Expected %s of %s to %d, got %v", want.event, want.name, want.id, event)
+		}
+		if event.ID != changes.position(event.Change.Sequence) || event.Change.Position != event.ID {
+			t.Errorf("Expected the event ID to be the position, got %s for %v", event.ID, event.Change)
+		}
+		if first == "" {
+			first = event.ID
+		}
+	}
+
+	// test that a reconnecting client receives the changes it missed
+	resumed, resumedEvents := openEvents(t, server, "environment=events-test&name=records*", first)
+	defer resumed.Body.Close()
+	for _, want := range expected[1:] {
+		event := nextEvent(t, resumedEvents)
+		if event.Event != want.event || event.Change.Name != want.name {
+			t.Errorf("Expected %s of %s after resuming, got %v", want.event, want.name, event)
+		}
+	}
+}
+
+func TestEventStreamResync(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	server := httptest.NewServer(ids.SetupRouter())
+	defer server.Close()
+	mutex.Lock()
+	for i := 0; i <= changeHistory; i++ {
+		ids.Set("records", "resync-test", i)
+	}
+	mutex.Unlock()
+
+	// test that resuming from a compacted sequence asks the client to resync
+	response, events := openEvents(t, server, "environment=resync-test", changes.position(1))
+	defer response.Body.Close()
+	event := nextEvent(t, events)
+	if event.Event != "resync" {
+		t.Error("Expected a resync event, got ", event)
+	}
+
+	// test that resuming from ahead of the feed, as after a restart, does too
+	current, _ := changes.wait()
+	ahead, aheadEvents := openEvents(t, server, "environment=resync-test", changes.position(current+100))
+	defer ahead.Body.Close()
+	if event := nextEvent(t, aheadEvents); event.Event != "resync" || event.ID != changes.position(current) {
+		t.Error("Expected a resync event at the current position, got ", event)
+	}
+}
+
+func TestChangesAfterRestart(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	server := httptest.NewServer(ids.SetupRouter())
+	defer server.Close()
+	previous := changes
+	defer func() { changes = previous }()
+	mutex.Lock()
+	ids.Set("records", "restart-test", 1)
+	mutex.Unlock()
+	before, _ := changes.wait()
+	position := changes.position(before)
+
+	// a restarted server starts a new feed, whose sequences soon pass the
+	// old one's
+	changes = newChangeFeed(changeHistory)
+	mutex.Lock()
+	for i := uint64(0); i <= before; i++ {
+		ids.Set("records", "restart-test", int(i)+2)
+	}
+	mutex.Unlock()
+
+	// test that a position from before the restart must resync, though its
+	// sequence is one the new feed has
+	response, events := openEvents(t, server, "environment=restart-test", position)
+	defer response.Body.Close()
+	current, _ := changes.wait()
+	if event := nextEvent(t, events); event.Event != "resync" || event.ID != changes.position(current) {
+		t.Error("Expected a resync event at the current position, got ", event)
+	}
+	listed, err := http.Get(server.URL + "/v2/changes?after=" + position)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed.Body.Close()
+	if listed.StatusCode != 409 {
+		t.Error("Expected status code 409, got ", listed.StatusCode)
+	}
+}
+
+func TestEventStreamBadLastEventID(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	server := httptest.NewServer(ids.SetupRouter())
+	defer server.Close()
+
+	// test for 400 response code
+	response, _ := openEvents(t, server, "", "latest")
+	defer response.Body.Close()
+	if response.StatusCode != 400 {
+		t.Error("Expected status code 400, got ", response.StatusCode)
+	}
+}
+
+func TestSyncFromChanges(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	server := httptest.NewServer(ids.SetupRouter())
+	defer server.Close()
+	api := client.New(server.URL)
+	api.Retries = 0
+	ctx := context.Background()
+	api.Set(ctx, "sync-test", "records", 100)
+	response, err := http.Get(server.URL + "/lister")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	since := response.Header.Get(changePositionHeader)
+
+	// test that the changes after a listing's version are returned a page at a time
+	api.Next(ctx, "sync-test", "records")
+	api.Set(ctx, "sync-test", "orders", 7)
+	api.Delete(ctx, "sync-test", "records")
+	page, err := api.Changes(ctx, since, client.ChangeOptions{Environment: "sync-test", Limit: 2})
+	if err != nil || len(page.Changes) != 2 || !page.More || page.Changes[0].ID != 100+incrementBy || page.Changes[1].Name != "orders" {
+		t.Errorf("Expected the increment and set, got %v %v", page, err)
+	}
+	page, err = api.Changes(ctx, page.Position, client.ChangeOptions{Environment: "sync-test", Limit: 2})
+	if err != nil || len(page.Changes) != 1 || page.More || page.Changes[0].Type != client.ChangeDelete {
+		t.Errorf("Expected the delete, got %v %v", page, err)
+	}
+
+	// test that a position the server doesn't have requires listing again
+	if _, err := api.Changes(ctx, changes.position(1<<60), client.ChangeOptions{}); !client.IsHistoryCompacted(err) {
+		t.Error("Expected status code 409, got ", err)
+	}
+}
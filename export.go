@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const exportVersion = 1
+
+// Merge strategies for an import, deciding what happens to a counter that
+// already exists with a different value.
+const (
+	ImportOverwrite      = "overwrite"
+	ImportKeepHigher     = "keep-higher"
+	ImportFailOnConflict = "fail-on-conflict"
+)
+
+// What an import does, or would do, to each counter.
+const (
+	ImportCreate    = "create"
+	ImportUpdate    = "update"
+	ImportUnchanged = "unchanged"
+	ImportSkip      = "skip"
+	ImportConflict  = "conflict"
+)
+
+// Export is every counter, with the settings they were handed out with, as
+// of one point in the change feed.
+type Export struct {
+	Version    int    `json:"version" yaml:"version" binding:"required,min=1,max=1"`
+	ExportedAt string `json:"exported_at" yaml:"exported_at"`
+	// Sequence is the last change included.
+	Sequence     uint64            `json:"sequence" yaml:"sequence"`
+	InitialValue int               `json:"initial_value" yaml:"initial_value"`
+	IncrementBy  int               `json:"increment_by" yaml:"increment_by"`
+	Counters     []ExportedCounter `json:"counters" yaml:"counters"`
+}
+
+// ExportedCounter is one counter in an Export. Config is absent for counters
+// using the defaults.
+type ExportedCounter struct {
+	Environment string         `json:"environment" yaml:"environment" binding:"required,max=64,identifier"`
+	Name        string         `json:"name" yaml:"name" binding:"required,max=128,identifier"`
+	ID          int            `json:"id" yaml:"id" binding:"min=0,max=9007199254740991"`
+	Config      *CounterConfig `json:"config,omitempty" yaml:"config,omitempty"`
+}
+
+// importRequest is the query accepted by the import route.
+type importRequest struct {
+	Strategy string `form:"strategy" json:"strategy" binding:"omitempty,oneof=overwrite keep-higher fail-on-conflict"`
+	DryRun   bool   `form:"dry_run" json:"dry_run"`
+}
+
+// ImportChange is what an import does, or would do, to one counter. Current
+// is absent for counters it creates, and Config for counters imported
+// without one, which keep their own.
+type ImportChange struct {
+	Environment string         `json:"environment" yaml:"environment"`
+	Name        string         `json:"name" yaml:"name"`
+	Action      string         `json:"action" yaml:"action"`
+	Current     *int           `json:"current,omitempty" yaml:"current,omitempty"`
+	Imported    int            `json:"imported" yaml:"imported"`
+	Config      *CounterConfig `json:"config,omitempty" yaml:"config,omitempty"`
+}
+
+// ImportReport counts what an import did, or would do with DryRun, and lists
+// every counter it changed, skipped or conflicted on.
+type ImportReport struct {
+	Strategy  string         `json:"strategy" yaml:"strategy"`
+	DryRun    bool           `json:"dry_run" yaml:"dry_run"`
+	Created   int            `json:"created" yaml:"created"`
+	Updated   int            `json:"updated" yaml:"updated"`
+	Unchanged int            `json:"unchanged" yaml:"unchanged"`
+	Skipped   int            `json:"skipped" yaml:"skipped"`
+	Conflicts int            `json:"conflicts" yaml:"conflicts"`
+	Changes   []ImportChange `json:"changes" yaml:"changes"`
+}
+
+func (ids idMap) setupExportRoutes(router gin.IRoutes) {
+	router.GET("/v2/export", ids.exportCounters)
+	router.POST("/v2/import", ids.importCounters)
+}
+
+func (ids idMap) exportCounters(context *gin.Context) {
+	mutex.Lock()
+	export := ids.Export()
+	mutex.Unlock()
+	respond(context, http.StatusOK, export)
+}
+
+// importCounters loads an Export, as JSON or YAML, with the strategy and
+// dry_run query parameters.
+func (ids idMap) importCounters(context *gin.Context) {
+	request := importRequest{
+		Strategy: context.DefaultQuery("strategy", ImportFailOnConflict),
+		DryRun:   context.Query("dry_run") == "true",
+	}
+	if err := validateStruct(&request); err != nil {
+		abortWithError(context, err)
+		return
+	}
+	var export Export
+	if err := bindYAMLRequest(context, &export); err != nil {
+		abortWithError(context, err)
+		return
+	}
+
+	mutex.Lock()
+	report, err := ids.Import(export, request.Strategy, request.DryRun)
+	mutex.Unlock()
+	if err != nil {
+		abortWithError(context, err)
+		return
+	}
+	respond(context, http.StatusOK, report)
+}
+
+// bindYAMLRequest decodes and validates a body sent as YAML into obj, or
+// otherwise binds it like bindRequest.
+func bindYAMLRequest(context *gin.Context, obj interface{}) error {
+	if !strings.Contains(context.ContentType(), "yaml") {
+		return bindRequest(context, obj)
+	}
+	body, err := ioutil.ReadAll(context.Request.Body)
+	if err != nil {
+		return err
+	}
+	if err := yaml.Unmarshal(body, obj); err != nil {
+		return NewAPIError(CodeInvalidArgument, "", "Unable to parse yaml request: "+err.Error())
+	}
+	return validateStruct(obj)
+}
+
+// Export returns every counter, sorted by environment and then name. The
+// caller must hold the mutex.
+func (ids idMap) Export() Export {
+	sequence, _ := changes.wait()
+	export := Export{
+		Version:      exportVersion,
+		ExportedAt:   time.Now().UTC().Format(time.RFC3339),
+		Sequence:     sequence,
+		InitialValue: initialValue,
+		IncrementBy:  incrementBy,
+		Counters:     []ExportedCounter{},
+	}
+	for _, counter := range ids.counters() {
+		exported := ExportedCounter{Environment: counter.Environment, Name: counter.Name, ID: counter.ID}
+		if config, ok := configs[CounterKey{Environment: counter.Environment, Name: counter.Name}]; ok {
+			exported.Config = &config
+		}
+		export.Counters = append(export.Counters, exported)
+	}
+	return export
+}
+
+// Import merges export's counters using strategy, or only reports what it
+// would do if dryRun is set. It applies every change or, if a counter is
+// invalid or conflicts, none of them. A counter's config is imported along
+// with its value, so one differing only in config is updated, skipped or
+// conflicts like one with another value. Values outside the counter's
+// bounds, or lowering a monotonic one, are conflicts whatever the strategy.
+// In cluster mode the changes are committed as one entry, so losing the
+// leadership doesn't leave some of them applied either. The caller must hold
+// the mutex.
+func (ids idMap) Import(export Export, strategy string, dryRun bool) (ImportReport, error) {
+	report := ImportReport{Strategy: strategy, DryRun: dryRun, Changes: []ImportChange{}}
+	details := []*APIError{}
+	seen := map[CounterKey]int{}
+	for i, counter := range export.Counters {
+		if err := validateStruct(&counter); err != nil {
+			details = append(details, indexedErrors("counters", i, err)...)
+			continue
+		}
+		if counter.Config != nil {
+			if err := counter.Config.validate(); err != nil {
+				details = append(details, prefixedErrors(fmt.Sprintf("counters[%d].config", i), err)...)
+				continue
+			}
+		}
+		key := CounterKey{Environment: counter.Environment, Name: counter.Name}
+		if first, ok := seen[key]; ok {
+			message := fmt.Sprintf("duplicates counters[%d]", first)
+			details = append(details, indexedErrors("counters", i, NewAPIError(CodeInvalidArgument, "", message))...)
+			continue
+		}
+		seen[key] = i
+
+		change := ImportChange{Environment: counter.Environment, Name: counter.Name, Imported: counter.ID, Action: ImportCreate, Config: counter.Config}
+		current, found := ids[counter.Environment][counter.Name]
+		config := configFor(counter.Name, counter.Environment)
+		message := ""
+		if found {
+			change.Current = &current
+			sameConfig := counter.Config == nil || *counter.Config == config
+			change.Action = mergeAction(strategy, current, counter.ID, sameConfig)
+			message = fmt.Sprintf("is %d here but %d in the import", current, counter.ID)
+			if current == counter.ID {
+				message = "has another config here than in the import"
+			}
+		}
+		// the bounds the counter will have may also refuse the imported
+		// value, and a monotonic one isn't lowered by importing another config
+		if change.Action == ImportCreate || change.Action == ImportUpdate {
+			imported := config
+			if counter.Config != nil {
+				imported = *counter.Config
+			}
+			err := imported.check(current, found, counter.ID)
+			if err == nil && config.Monotonic && found && counter.ID < current {
+				err = ErrNotMonotonic
+			}
+			if err != nil {
+				change.Action = ImportConflict
+				message = err.Error()
+			}
+		}
+		switch change.Action {
+		case ImportCreate:
+			report.Created++
+		case ImportUpdate:
+			report.Updated++
+		case ImportUnchanged:
+			report.Unchanged++
+			continue
+		case ImportSkip:
+			report.Skipped++
+		case ImportConflict:
+			report.Conflicts++
+			if !dryRun {
+				details = append(details, indexedErrors("counters", i, NewAPIError(CodeConflict, "", message))...)
+			}
+		}
+		report.Changes = append(report.Changes, change)
+	}
+	if err := newBatchError(details); err != nil {
+		return ImportReport{}, err
+	}
+	if dryRun {
+		return report, nil
+	}
+
+	commands := []raftCommand{}
+	for _, change := range report.Changes {
+		if change.Action != ImportCreate && change.Action != ImportUpdate {
+			continue
+		}
+		if change.Config != nil {
+			config := *change.Config
+			commands = append(commands, raftCommand{Type: commandConfig, Environment: change.Environment, Name: change.Name, Config: &config})
+		}
+		commands = append(commands, raftCommand{Type: ChangeSet, Environment: change.Environment, Name: change.Name, ID: change.Imported})
+	}
+	if err := ids.commitAll(commands); err != nil {
+		return ImportReport{}, err
+	}
+	return report, nil
+}
+
+// mergeAction decides what strategy does with a counter that exists. One
+// whose value is the same, but not its config, is only updated by
+// ImportOverwrite.
+func mergeAction(strategy string, current, imported int, sameConfig bool) string {
+	if current == imported && sameConfig {
+		return ImportUnchanged
+	}
+	switch strategy {
+	case ImportOverwrite:
+		return ImportUpdate
+	case ImportKeepHigher:
+		if imported > current {
+			return ImportUpdate
+		}
+		return ImportSkip
+	}
+	return ImportConflict
+}
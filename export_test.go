@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"gopkg.in/yaml.v2"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func serveImport(t *testing.T, testRouter http.Handler, query, contentType, body string) *httptest.ResponseRecorder {
+	request, err := http.NewRequest("POST", "/v2/import"+query, bytes.NewBufferString(body))
+	if err != nil {
+		t.Error(err)
+	}
+	request.Header.Add("Content-Type", contentType)
+	response := httptest.NewRecorder()
+	testRouter.ServeHTTP(response, request)
+	return response
+}
+
+func TestExport(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	ids.Set("records", "live", 100)
+	ids.Set("records", "dev", 7)
+	testRouter := ids.SetupRouter()
+
+	for _, format := range []string{"json", "yaml"} {
+		response := serveAccept(t, testRouter, "/v2/export?format="+format, "")
+
+		// test for every counter, sorted, with the settings
+		var export Export
+		var err error
+		if format == "json" {
+			err = json.Unmarshal(response.Body.Bytes(), &export)
+		} else {
+			err = yaml.Unmarshal(response.Body.Bytes(), &export)
+		}
+		if response.Code != 200 || err != nil {
+			t.Errorf("Unable to unmarshal %d `%s`", response.Code, response.Body)
+		}
+		expected := []ExportedCounter{{"dev", "records", 7, nil}, {"live", "records", 100, nil}}
+		if !reflect.DeepEqual(export.Counters, expected) {
+			t.Errorf("Expected %v, got %v", expected, export.Counters)
+		}
+		if export.Version != exportVersion || export.InitialValue != initialValue || export.IncrementBy != incrementBy || export.ExportedAt == "" {
+			t.Error("Expected the version and settings, got ", export)
+		}
+	}
+}
+
+func TestImportStrategies(t *testing.T) {
+	body := `{"version": 1, "counters": [
+		{"environment": "live", "name": "records", "id": 50},
+		{"environment": "live", "name": "orders", "id": 200},
+		{"environment": "live", "name": "same", "id": 3},
+		{"environment": "dev", "name": "records", "id": 9}
+	]}`
+	tests := []struct {
+		strategy string
+		code     int
+		report   ImportReport
+		stored   idMap
+	}{
+		{ImportOverwrite, 200,
+			ImportReport{Strategy: ImportOverwrite, Created: 1, Updated: 2, Unchanged: 1},
+			idMap{"live": {"records": 50, "orders": 200, "same": 3}, "dev": {"records": 9}}},
+		{ImportKeepHigher, 200,
+			ImportReport{Strategy: ImportKeepHigher, Created: 1, Updated: 1, Unchanged: 1, Skipped: 1},
+			idMap{"live": {"records": 100, "orders": 200, "same": 3}, "dev": {"records": 9}}},
+		{ImportFailOnConflict, 409, ImportReport{},
+			idMap{"live": {"records": 100, "orders": 150, "same": 3}}},
+	}
+
+	for _, test := range tests {
+		// setup
+		ids := idMap{"live": {"records": 100, "orders": 150, "same": 3}}
+		testRouter := ids.SetupRouter()
+		response := serveImport(t, testRouter, "?strategy="+test.strategy, "application/json", body)
+
+		// test for the response code and counts
+		if response.Code != test.code {
+			t.Errorf("Expected status code %d for %s, got %d: %s", test.code, test.strategy, response.Code, response.Body)
+		}
+		if test.code == 200 {
+			var report ImportReport
+			json.Unmarshal(response.Body.Bytes(), &report)
+			report.Changes = nil
+			if !reflect.DeepEqual(report, test.report) {
+				t.Errorf("Expected %v for %s, got %v", test.report, test.strategy, report)
+			}
+		}
+
+		// test for what was applied
+		if !reflect.DeepEqual(ids, test.stored) {
+			t.Errorf("Expected %v for %s, got %v", test.stored, test.strategy, ids)
+		}
+	}
+}
+
+func TestImportConflicts(t *testing.T) {
+	// setup
+	ids := idMap{"live": {"records": 100}}
+	testRouter := ids.SetupRouter()
+	body := `{"version": 1, "counters": [
+		{"environment": "live", "name": "records", "id": 50},
+		{"environment": "live", "name": "orders", "id": 200}
+	]}`
+	response := serveImport(t, testRouter, "", "application/json", body)
+
+	// test that conflicts fail the whole import by default
+	var apiError APIError
+	json.Unmarshal(response.Body.Bytes(), &apiError)
+	if response.Code != 409 || apiError.Code != CodeConflict || len(apiError.Details) != 1 || apiError.Details[0].Field != "counters[0]" {
+		t.Errorf("Expected a conflict on counters[0], got %d `%s`", response.Code, response.Body)
+	}
+	if _, ok := ids["live"]["orders"]; ok {
+		t.Error("Expected nothing to be applied, got ", ids)
+	}
+
+	// test that a dry run reports the conflict without failing
+	response = serveImport(t, testRouter, "?dry_run=true", "application/json", body)
+	var report ImportReport
+	json.Unmarshal(response.Body.Bytes(), &report)
+	current := 100
+	expected := []ImportChange{
+		{Environment: "live", Name: "records", Action: ImportConflict, Current: &current, Imported: 50},
+		{Environment: "live", Name: "orders", Action: ImportCreate, Imported: 200},
+	}
+	if response.Code != 200 || !report.DryRun || report.Conflicts != 1 || !reflect.DeepEqual(report.Changes, expected) {
+		t.Errorf("Expected a dry run report, got %d `%s`", response.Code, response.Body)
+	}
+	if !reflect.DeepEqual(ids, idMap{"live": {"records": 100}}) {
+		t.Error("Expected a dry run to change nothing, got ", ids)
+	}
+}
+
+func TestImportYAML(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	testRouter := ids.SetupRouter()
+	body := "version: 1\ncounters:\n- environment: live\n  name: records\n  id: 100\n"
+	response := serveImport(t, testRouter, "", "application/x-yaml", body)
+
+	// test that the counters were created
+	if response.Code != 200 || ids["live"]["records"] != 100 {
+		t.Errorf("Expected records at 100, got %d `%s`", response.Code, response.Body)
+	}
+}
+
+func TestImportInvalid(t *testing.T) {
+	tests := []struct {
+		query  string
+		body   string
+		fields []string
+	}{
+		{"?strategy=merge", `{"version": 1, "counters": []}`, []string{"strategy"}},
+		{"", `{"version": 2, "counters": []}`, []string{"version"}},
+		{"", `{"version": 1, "counters": [
+			{"environment": "live", "name": "bad name", "id": 1},
+			{"environment": "live", "name": "records", "id": -1},
+			{"environment": "live", "name": "orders", "id": 1},
+			{"environment": "live", "name": "orders", "id": 2}
+		]}`, []string{"counters[0].name", "counters[1].id", "counters[3]"}},
+	}
+
+	for _, test := range tests {
+		// setup
+		ids := NewIDMap()
+		testRouter := ids.SetupRouter()
+		response := serveImport(t, testRouter, test.query, "application/json", test.body)
+
+		// test for 400 response code, and every invalid field
+		if response.Code != 400 {
+			t.Errorf("Expected status code 400, got %d: %s", response.Code, response.Body)
+		}
+		var apiError APIError
+		json.Unmarshal(response.Body.Bytes(), &apiError)
+		fields := []string{}
+		for _, detail := range apiError.Details {
+			fields = append(fields, detail.Field)
+		}
+		if len(fields) == 0 {
+			fields = append(fields, apiError.Field)
+		}
+		if !reflect.DeepEqual(fields, test.fields) {
+			t.Errorf("Expected fields %v, got %v", test.fields, fields)
+		}
+		if len(ids) != 0 {
+			t.Error("Expected nothing to be applied, got ", ids)
+		}
+	}
+}
+
+func TestExportImportConfigs(t *testing.T) {
+	// setup
+	key := CounterKey{Environment: "live", Name: "records"}
+	config := CounterConfig{Start: 1000, Step: 10, Min: 1000, Max: 5000, Format: "REC-%d", Monotonic: true}
+	from := idMap{"live": {"records": 1200, "orders": 7}}
+	configs[key] = config
+	defer func() { configs = counterConfigs{} }()
+	mutex.Lock()
+	export := from.Export()
+	mutex.Unlock()
+
+	// test that configured counters carry their config
+	if records := export.Counters[1]; records.Config == nil || *records.Config != config {
+		t.Error("Expected records exported with its config, got ", records)
+	}
+	if orders := export.Counters[0]; orders.Config != nil {
+		t.Error("Expected orders exported without a config, got ", orders)
+	}
+
+	// test that importing restores the config along with the value
+	configs = counterConfigs{}
+	to := NewIDMap()
+	encoded, _ := json.Marshal(export)
+	response := serveImport(t, to.SetupRouter(), "", "application/json", string(encoded))
+	if response.Code != 200 || configs[key] != config || to["live"]["records"] != 1200 {
+		t.Errorf("Expected records restored at 1200 with its config, got %d `%s`", response.Code, response.Body)
+	}
+
+	// test that a counter differing only in config conflicts by default, and
+	// is updated when overwriting
+	changed := `{"version": 1, "counters": [{"environment": "live", "name": "records", "id": 1200,
+		"config": {"start": 1000, "step": 20, "min": 1000, "max": 5000, "monotonic": true}}]}`
+	if response = serveImport(t, to.SetupRouter(), "", "application/json", changed); response.Code != 409 {
+		t.Errorf("Expected a conflict, got %d `%s`", response.Code, response.Body)
+	}
+	response = serveImport(t, to.SetupRouter(), "?strategy=overwrite", "application/json", changed)
+	if response.Code != 200 || configs[key].Step != 20 {
+		t.Errorf("Expected the step updated to 20, got %d `%s`", response.Code, response.Body)
+	}
+
+	// test that an invalid config is refused
+	invalid := `{"version": 1, "counters": [{"environment": "live", "name": "other", "id": 5,
+		"config": {"start": 0, "step": 1, "min": 10, "max": 20}}]}`
+	var apiError APIError
+	response = serveImport(t, to.SetupRouter(), "", "application/json", invalid)
+	json.Unmarshal(response.Body.Bytes(), &apiError)
+	if response.Code != 400 || len(apiError.Details) != 1 || apiError.Details[0].Field != "counters[0].config.start" {
+		t.Errorf("Expected counters[0].config.start refused, got %d `%s`", response.Code, response.Body)
+	}
+}
+
+func TestImportClustered(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	defer func() { configs = counterConfigs{} }()
+	cluster = ids.newRaftNode("http://localhost:0", []string{"http://localhost:1"})
+	defer func() {
+		cluster.stop()
+		cluster = nil
+	}()
+	config := CounterConfig{Start: 1000, Step: 10, Min: 1000, Max: 5000}
+	export := Export{Version: exportVersion, Counters: []ExportedCounter{
+		{Environment: "live", Name: "records", ID: 1200, Config: &config},
+		{Environment: "live", Name: "orders", ID: 7},
+	}}
+
+	// test that an import that isn't committed changes nothing, not even a
+	// counter's config
+	mutex.Lock()
+	_, err := ids.Import(export, ImportFailOnConflict, false)
+	mutex.Unlock()
+	if err != ErrLeadershipLost || len(ids) != 0 || len(configs) != 0 {
+		t.Errorf("Expected ErrLeadershipLost and nothing applied, got %v %v %v", err, ids, configs)
+	}
+
+	// test that a committed import is one entry in the log
+	cluster.stop()
+	cluster = ids.newRaftNode("http://localhost:0", nil)
+	cluster.start()
+	leaderOf(t, []*testNode{{node: cluster}})
+	mutex.Lock()
+	_, err = ids.Import(export, ImportFailOnConflict, false)
+	mutex.Unlock()
+	stored := idMap{"live": {"records": 1200, "orders": 7}}
+	if err != nil || !reflect.DeepEqual(ids, stored) || configs[CounterKey{Environment: "live", Name: "records"}] != config {
+		t.Errorf("Expected %v, got %v (%v)", stored, ids, err)
+	}
+	if status := cluster.status(); status.LastIndex != 2 {
+		t.Error("Expected a noop and the import in the log, got ", status)
+	}
+}
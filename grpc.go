@@ -0,0 +1,265 @@
+//go:build grpc
+// +build grpc
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"github.com/snarlysodboxer/id-incrementer/pb"
+	"github.com/snarlysodboxer/id-incrementer/pb/grpcpb"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// grpcAddr is only defined by builds with `-tags grpc`, as the server needs
+// google.golang.org/grpc; other builds refuse it, in nogrpc.go.
+var grpcAddr = flag.String("grpc-addr", "", "address to serve the gRPC API on, if set; needs a build with -tags grpc")
+
+func init() {
+	standaloneFlags["grpc-addr"] = grpcAddr
+	listeners = append(listeners, func(ids idMap) error {
+		if *grpcAddr == "" {
+			return nil
+		}
+		listener, err := net.Listen("tcp", *grpcAddr)
+		if err != nil {
+			return err
+		}
+		server := newGRPCServer(ids)
+		onShutdown(func(deadline <-chan struct{}) error {
+			defer server.Stop()
+			select {
+			case <-grpcCalls.close():
+				return nil
+			case <-deadline:
+				return errors.New("gRPC calls still in flight after -shutdown-timeout were cut off")
+			}
+		})
+		if err := server.Serve(listener); err != nil && !isDraining() {
+			return err
+		}
+		return nil
+	})
+}
+
+// gRPC status code for each error code.
+var codeGRPC = map[string]codes.Code{
+	CodeInvalidArgument:  codes.InvalidArgument,
+	CodeNotFound:         codes.NotFound,
+	CodeConflict:         codes.FailedPrecondition,
+	CodeDeadlineExceeded: codes.DeadlineExceeded,
+	CodeInternal:         codes.Internal,
+	CodeUnavailable:      codes.Unavailable,
+}
+
+// grpcCalls counts the calls being served, so shutting down can wait for
+// them, and turns away new ones until the server stops.
+var grpcCalls = newCallTracker()
+
+// callTracker stands in for GracefulStop, which this version of grpc lacks.
+type callTracker struct {
+	mutex    sync.Mutex
+	inFlight int
+	closed   bool
+	idle     chan struct{}
+}
+
+func newCallTracker() *callTracker {
+	return &callTracker{idle: make(chan struct{})}
+}
+
+// start counts a new call, or returns false once the tracker is closed.
+func (calls *callTracker) start() bool {
+	calls.mutex.Lock()
+	defer calls.mutex.Unlock()
+	if calls.closed {
+		return false
+	}
+	calls.inFlight++
+	return true
+}
+
+func (calls *callTracker) finish() {
+	calls.mutex.Lock()
+	defer calls.mutex.Unlock()
+	calls.inFlight--
+	if calls.closed && calls.inFlight == 0 {
+		close(calls.idle)
+	}
+}
+
+// close turns away new calls, returning a channel closed once those in
+// flight have finished.
+func (calls *callTracker) close() <-chan struct{} {
+	calls.mutex.Lock()
+	defer calls.mutex.Unlock()
+	if !calls.closed {
+		calls.closed = true
+		if calls.inFlight == 0 {
+			close(calls.idle)
+		}
+	}
+	return calls.idle
+}
+
+func newGRPCServer(ids idMap) *grpc.Server {
+	server := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if !grpcCalls.start() {
+			return nil, grpc.Errorf(codes.Unavailable, "%s", "the server is shutting down")
+		}
+		defer grpcCalls.finish()
+		return handler(ctx, request)
+	}))
+	grpcpb.RegisterIDIncrementerServer(server, grpcService{ids: ids, snapshots: ids.newSnapshotter()})
+	return server
+}
+
+// grpcService implements grpcpb.IDIncrementerServer on the same counters, and
+// with the same validation, as the HTTP API.
+type grpcService struct {
+	ids       idMap
+	snapshots *snapshotter
+}
+
+// grpcError maps errors returned by the store and the validator onto gRPC
+// status codes.
+func grpcError(err error) error {
+	apiError := toAPIError(err)
+	code, ok := codeGRPC[apiError.Code]
+	if !ok {
+		code = codes.Unknown
+	}
+	if apiError.Field != "" {
+		return grpc.Errorf(code, "%s: %s", apiError.Field, apiError.Message)
+	}
+	return grpc.Errorf(code, "%s", apiError.Message)
+}
+
+func validKey(environment, name string) error {
+	return validateStruct(&CounterKey{Environment: environment, Name: name})
+}
+
+func (service grpcService) Next(ctx context.Context, key *pb.CounterKey) (*pb.Counter, error) {
+	if err := validKey(key.Environment, key.Name); err != nil {
+		return nil, grpcError(err)
+	}
+	unlock := service.ids.lockEnvironment(key.Environment)
+	id, err := service.ids.Get(key.Name, key.Environment)
+	unlock()
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &pb.Counter{Environment: key.Environment, Name: key.Name, Id: int64(id)}, nil
+}
+
+func (service grpcService) Reserve(ctx context.Context, request *pb.ReserveRequest) (*pb.Range, error) {
+	if err := validKey(request.Environment, request.Name); err != nil {
+		return nil, grpcError(err)
+	}
+	if err := validateStruct(&ReserveValue{Count: int(request.Count)}); err != nil {
+		return nil, grpcError(err)
+	}
+	unlock := service.ids.lockEnvironment(request.Environment)
+	first, last, err := service.ids.Reserve(request.Name, request.Environment, int(request.Count))
+	step := configFor(request.Name, request.Environment).Step
+	unlock()
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &pb.Range{
+		Environment: request.Environment,
+		Name:        request.Name,
+		First:       int64(first),
+		Last:        int64(last),
+		Step:        int64(step),
+	}, nil
+}
+
+func (service grpcService) Peek(ctx context.Context, key *pb.CounterKey) (*pb.Counter, error) {
+	if err := validKey(key.Environment, key.Name); err != nil {
+		return nil, grpcError(err)
+	}
+	unlock := service.ids.readEnvironment(key.Environment)
+	id, err := service.ids.Peek(key.Name, key.Environment)
+	unlock()
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &pb.Counter{Environment: key.Environment, Name: key.Name, Id: int64(id)}, nil
+}
+
+func (service grpcService) Set(ctx context.Context, request *pb.SetRequest) (*pb.Counter, error) {
+	if err := validKey(request.Environment, request.Name); err != nil {
+		return nil, grpcError(err)
+	}
+	if err := validateStruct(&CounterValue{ID: json.Number(strconv.FormatInt(request.Id, 10))}); err != nil {
+		return nil, grpcError(err)
+	}
+	unlock := service.ids.lockEnvironment(request.Environment)
+	id, err := service.ids.Set(request.Name, request.Environment, int(request.Id))
+	unlock()
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &pb.Counter{Environment: request.Environment, Name: request.Name, Id: int64(id)}, nil
+}
+
+func (service grpcService) Delete(ctx context.Context, key *pb.CounterKey) (*pb.Counter, error) {
+	if err := validKey(key.Environment, key.Name); err != nil {
+		return nil, grpcError(err)
+	}
+	mutex.Lock()
+	id, err := service.ids.Delete(key.Name, key.Environment)
+	mutex.Unlock()
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &pb.Counter{Environment: key.Environment, Name: key.Name, Id: int64(id)}, nil
+}
+
+func (service grpcService) List(ctx context.Context, request *pb.ListRequest) (*pb.CounterList, error) {
+	query := listRequest{
+		Environment: request.Environment,
+		Name:        request.Name,
+		Prefix:      request.Prefix,
+		Sort:        request.Sort,
+		Limit:       int(request.Limit),
+		Cursor:      request.Cursor,
+	}
+	if err := validateStruct(&query); err != nil {
+		return nil, grpcError(err)
+	}
+	if err := validateGlob("name", query.Name); err != nil {
+		return nil, grpcError(err)
+	}
+	// like listCounters, filter a snapshot rather than hold up writers
+	list, err := paginate(service.snapshots.take().IDs.matching(query), query)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return countersProto(list.Counters, list.NextCursor), nil
+}
+
+// Watch relies on the call's deadline rather than a timeout of its own.
+func (service grpcService) Watch(ctx context.Context, request *pb.WatchRequest) (*pb.Counter, error) {
+	if err := validKey(request.Environment, request.Name); err != nil {
+		return nil, grpcError(err)
+	}
+	id, err := service.ids.Watch(request.Name, request.Environment, int(request.After), ctx.Done(), nil)
+	if err == ErrWatchCancelled {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, grpc.Errorf(codes.DeadlineExceeded, "%s", ErrWatchTimeout)
+		}
+		return nil, grpc.Errorf(codes.Canceled, "%s", ctx.Err())
+	}
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &pb.Counter{Environment: request.Environment, Name: request.Name, Id: int64(id)}, nil
+}
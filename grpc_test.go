@@ -0,0 +1,163 @@
+//go:build grpc
+// +build grpc
+
+package main
+
+import (
+	"github.com/snarlysodboxer/id-incrementer/pb"
+	"github.com/snarlysodboxer/id-incrementer/pb/grpcpb"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"net"
+	"testing"
+	"time"
+)
+
+// dialGRPC serves ids over gRPC on a free port, and returns a client for it.
+func dialGRPC(t *testing.T, ids idMap) (grpcpb.IDIncrementerClient, func()) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newGRPCServer(ids)
+	go server.Serve(listener)
+	connection, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return grpcpb.NewIDIncrementerClient(connection), func() {
+		connection.Close()
+		server.Stop()
+	}
+}
+
+func TestGRPCCounterLifecycle(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	client, stop := dialGRPC(t, ids)
+	defer stop()
+	ctx := context.Background()
+	key := &pb.CounterKey{Environment: "live", Name: "records"}
+
+	// test for a missing counter
+	if _, err := client.Peek(ctx, key); grpc.Code(err) != codes.NotFound {
+		t.Error("Expected NotFound, got ", err)
+	}
+
+	// test that increments, reservations, sets and deletes share the counters
+	counter, err := client.Next(ctx, key)
+	if err != nil || counter.Id != int64(initialValue) {
+		t.Errorf("Expected %d, got %v (%v)", initialValue, counter, err)
+	}
+	block, err := client.Reserve(ctx, &pb.ReserveRequest{Environment: "live", Name: "records", Count: 3})
+	if err != nil || block.First != int64(initialValue+incrementBy) || block.Last != int64(initialValue+3*incrementBy) {
+		t.Errorf("Expected %d to %d, got %v (%v)", initialValue+incrementBy, initialValue+3*incrementBy, block, err)
+	}
+	counter, err = client.Set(ctx, &pb.SetRequest{Environment: "live", Name: "records", Id: 100})
+	if err != nil || counter.Id != 100 {
+		t.Errorf("Expected 100, got %v (%v)", counter, err)
+	}
+	if ids["live"]["records"] != 100 {
+		t.Error("Expected 100 to be stored, got ", ids["live"]["records"])
+	}
+	list, err := client.List(ctx, &pb.ListRequest{Environment: "live"})
+	if err != nil || len(list.Counters) != 1 || list.Counters[0].Id != 100 {
+		t.Errorf("Expected live/records at 100, got %v (%v)", list, err)
+	}
+	counter, err = client.Delete(ctx, key)
+	if err != nil || counter.Id != 100 {
+		t.Errorf("Expected 100, got %v (%v)", counter, err)
+	}
+	if len(ids) != 0 {
+		t.Error("Expected no environments, got ", ids)
+	}
+}
+
+func TestGRPCValidation(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	client, stop := dialGRPC(t, ids)
+	defer stop()
+	ctx := context.Background()
+
+	// test that invalid requests are rejected like they are over HTTP
+	_, err := client.Next(ctx, &pb.CounterKey{Environment: "live", Name: "rec ords"})
+	if grpc.Code(err) != codes.InvalidArgument {
+		t.Error("Expected InvalidArgument for an invalid name, got ", err)
+	}
+	_, err = client.Set(ctx, &pb.SetRequest{Environment: "live", Name: "records", Id: -1})
+	if grpc.Code(err) != codes.InvalidArgument {
+		t.Error("Expected InvalidArgument for a negative id, got ", err)
+	}
+	_, err = client.Reserve(ctx, &pb.ReserveRequest{Environment: "live", Name: "records"})
+	if grpc.Code(err) != codes.InvalidArgument {
+		t.Error("Expected InvalidArgument for no count, got ", err)
+	}
+	_, err = client.List(ctx, &pb.ListRequest{Sort: "size"})
+	if grpc.Code(err) != codes.InvalidArgument {
+		t.Error("Expected InvalidArgument for an unknown sort, got ", err)
+	}
+	if len(ids) != 0 {
+		t.Error("Expected no environments, got ", ids)
+	}
+}
+
+func TestGRPCWatch(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	client, stop := dialGRPC(t, ids)
+	defer stop()
+	request := &pb.WatchRequest{Environment: "grpc-watch-test", Name: "builds", After: int64(initialValue)}
+
+	// test that the watch returns once the counter passes the value
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		mutex.Lock()
+		ids.Get("builds", "grpc-watch-test")
+		ids.Get("builds", "grpc-watch-test")
+		mutex.Unlock()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	counter, err := client.Watch(ctx, request)
+	if err != nil || counter.Id != int64(initialValue+incrementBy) {
+		t.Errorf("Expected %d, got %v (%v)", initialValue+incrementBy, counter, err)
+	}
+
+	// test that the call's deadline ends the watch
+	request.After = 1000
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err = client.Watch(ctx, request); grpc.Code(err) != codes.DeadlineExceeded {
+		t.Error("Expected DeadlineExceeded, got ", err)
+	}
+}
+
+func TestCallTracker(t *testing.T) {
+	// setup
+	calls := newCallTracker()
+	if !calls.start() {
+		t.Fatal("Expected a call started before closing")
+	}
+
+	// test that closing waits for calls in flight, and turns away new ones
+	idle := calls.close()
+	select {
+	case <-idle:
+		t.Error("Expected idle to wait for the call in flight")
+	default:
+	}
+	if calls.start() {
+		t.Error("Expected new calls turned away once closed")
+	}
+	calls.finish()
+	select {
+	case <-idle:
+	case <-time.After(time.Second):
+		t.Error("Expected idle closed once the call finished")
+	}
+
+	// test that closing again doesn't panic
+	<-calls.close()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"flag"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Build info, set when building a release with e.g.
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse HEAD)"
+var (
+	version = "dev"
+	commit  = ""
+)
+
+var started = time.Now()
+
+const (
+	healthOK          = "ok"
+	healthUnavailable = "unavailable"
+)
+
+// Health is the response of the liveness and readiness probes. Reasons says
+// why a node isn't ready.
+type Health struct {
+	Status  string   `json:"status" yaml:"status"`
+	Reasons []string `json:"reasons,omitempty" yaml:"reasons,omitempty"`
+}
+
+// BuildInfo describes the running server, and the flags it was started with.
+type BuildInfo struct {
+	Version   string            `json:"version" yaml:"version"`
+	Commit    string            `json:"commit,omitempty" yaml:"commit,omitempty"`
+	GoVersion string            `json:"go_version" yaml:"go_version"`
+	Started   time.Time         `json:"started" yaml:"started"`
+	Flags     map[string]string `json:"flags" yaml:"flags"`
+}
+
+// readiness returns why the node shouldn't be sent traffic, if it shouldn't:
+// a node that's shutting down, a cluster node that isn't the leader, or is
+// still applying the log it led with, and a replica, which serves reads
+// only, more so while it's loading the primary's snapshot.
+func readiness(node *raftNode, replica *replicaNode) []string {
+	reasons := []string{}
+	if isUnready() {
+		reasons = append(reasons, "shutting down")
+	}
+	if node != nil {
+		node.mutex.Lock()
+		if node.state != raftLeader {
+			reasons = append(reasons, "not the cluster leader")
+		} else if !node.ready {
+			reasons = append(reasons, "replaying the log")
+		}
+		node.mutex.Unlock()
+	}
+	if replica != nil {
+		replica.mutex.Lock()
+		if !replica.promoted {
+			if replica.epoch == "" {
+				reasons = append(reasons, "loading the primary's snapshot")
+			}
+			reasons = append(reasons, "read-only replica")
+		}
+		replica.mutex.Unlock()
+	}
+	return reasons
+}
+
+// activeFlags returns the value of every flag, with the passwords in URLs,
+// and flags named for secrets, redacted.
+func activeFlags(flags *flag.FlagSet) map[string]string {
+	active := map[string]string{}
+	flags.VisitAll(func(current *flag.Flag) {
+		// skip those `go test` adds
+		if strings.HasPrefix(current.Name, "test.") {
+			return
+		}
+		active[current.Name] = redactFlag(current.Name, current.Value.String())
+	})
+	return active
+}
+
+func redactFlag(name, value string) string {
+	for _, secret := range []string{"password", "secret", "token"} {
+		if strings.Contains(name, secret) && value != "" {
+			return "REDACTED"
+		}
+	}
+	// some flags are comma separated lists of URLs
+	values := strings.Split(value, ",")
+	for i, part := range values {
+		if parsed, err := url.Parse(part); err == nil && parsed.User != nil {
+			values[i] = parsed.Redacted()
+		}
+	}
+	return strings.Join(values, ",")
+}
+
+// setupHealthRoutes serves the probes for load balancers and orchestrators,
+// which are cheap and don't take the mutex, and the build info.
+func setupHealthRoutes(router gin.IRoutes, node *raftNode, replica *replicaNode) {
+	router.GET("/healthz", func(context *gin.Context) {
+		respond(context, http.StatusOK, Health{Status: healthOK})
+	})
+
+	router.GET("/readyz", func(context *gin.Context) {
+		if reasons := readiness(node, replica); len(reasons) > 0 {
+			respond(context, http.StatusServiceUnavailable, Health{Status: healthUnavailable, Reasons: reasons})
+			return
+		}
+		respond(context, http.StatusOK, Health{Status: healthOK})
+	})
+
+	router.GET("/version", func(context *gin.Context) {
+		respond(context, http.StatusOK, BuildInfo{
+			Version:   version,
+			Commit:    commit,
+			GoVersion: runtime.Version(),
+			Started:   started,
+			Flags:     activeFlags(flag.CommandLine),
+		})
+	})
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"github.com/gin-gonic/gin"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// How long, and how many, responses are kept for replay.
+const (
+	idempotencyTTL     = 24 * time.Hour
+	idempotencyEntries = 10000
+)
+
+// idempotentResponse is a response kept for replay, along with a digest of
+// the request body it answered. done is closed once it has been written.
+// position is its key's place in the cache's order.
+type idempotentResponse struct {
+	digest      [sha256.Size]byte
+	done        chan struct{}
+	position    *list.Element
+	status      int
+	contentType string
+	body        []byte
+	expires     time.Time
+}
+
+// idempotencyCache keeps responses by method, URL and Idempotency-Key,
+// dropping the oldest finished ones beyond size. order holds every key, the
+// oldest first.
+type idempotencyCache struct {
+	mutex     sync.Mutex
+	size      int
+	ttl       time.Duration
+	responses map[string]*idempotentResponse
+	order     *list.List
+}
+
+func newIdempotencyCache(size int, ttl time.Duration) *idempotencyCache {
+	return &idempotencyCache{size: size, ttl: ttl, responses: map[string]*idempotentResponse{}, order: list.New()}
+}
+
+// claim returns the response kept for key, or claims key for the caller and
+// returns nil. A claimed key must be released with keep or forget. It fails
+// with ErrIdempotencyKeyReused if key was used with a body of another digest,
+// and with ErrIdempotencyCancelled if done is closed while it waits for a
+// request with the same key.
+func (cache *idempotencyCache) claim(key string, digest [sha256.Size]byte, done <-chan struct{}) (*idempotentResponse, error) {
+	for {
+		cache.mutex.Lock()
+		response, ok := cache.responses[key]
+		if !ok || (response.expires.Before(time.Now()) && isClosed(response.done)) {
+			// an expired key moves to the back, rather than leaving its old
+			// place to evict the new response early
+			if ok {
+				cache.order.Remove(response.position)
+			}
+			cache.responses[key] = &idempotentResponse{digest: digest, done: make(chan struct{}), position: cache.order.PushBack(key)}
+			cache.evict()
+			cache.mutex.Unlock()
+			return nil, nil
+		}
+		cache.mutex.Unlock()
+		if response.digest != digest {
+			return nil, ErrIdempotencyKeyReused
+		}
+
+		// wait for a request with the same key that's still running, then
+		// look again in case it was forgotten
+		select {
+		case <-response.done:
+		case <-done:
+			return nil, ErrIdempotencyCancelled
+		}
+		if response.status != 0 {
+			return response, nil
+		}
+	}
+}
+
+func (cache *idempotencyCache) keep(key string, status int, contentType string, body []byte) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	response := cache.responses[key]
+	response.status = status
+	response.contentType = contentType
+	response.body = body
+	response.expires = time.Now().Add(cache.ttl)
+	close(response.done)
+}
+
+func (cache *idempotencyCache) forget(key string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	response := cache.responses[key]
+	delete(cache.responses, key)
+	cache.order.Remove(response.position)
+	close(response.done)
+}
+
+// evict drops the oldest finished responses beyond size. Responses still
+// being written keep their place, so a later claim drops them once they're
+// finished. The caller must hold the mutex.
+func (cache *idempotencyCache) evict() {
+	position := cache.order.Front()
+	for len(cache.responses) > cache.size && position != nil {
+		next := position.Next()
+		key := position.Value.(string)
+		if isClosed(cache.responses[key].done) {
+			delete(cache.responses, key)
+			cache.order.Remove(position)
+		}
+		position = next
+	}
+}
+
+func isClosed(done chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+// recordingWriter copies the body of a response as it's written.
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (writer *recordingWriter) Write(data []byte) (int, error) {
+	writer.body.Write(data)
+	return writer.ResponseWriter.Write(data)
+}
+
+func (writer *recordingWriter) WriteString(data string) (int, error) {
+	writer.body.WriteString(data)
+	return writer.ResponseWriter.WriteString(data)
+}
+
+// idempotency replays the response to a POST, PUT or DELETE carrying an
+// Idempotency-Key header that was already answered, so clients can safely
+// retry requests that increment counters. Server errors aren't kept, so
+// those are retried for real. Reusing a key with a different body is refused
+// rather than answered with the response to another request.
+func idempotency(cache *idempotencyCache) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		header := context.Request.Header.Get(idempotencyKeyHeader)
+		if header == "" || context.Request.Method == "GET" {
+			context.Next()
+			return
+		}
+		body, err := ioutil.ReadAll(context.Request.Body)
+		if err != nil {
+			abortWithError(context, NewAPIError(CodeInvalidArgument, "", "failed to read the request body: "+err.Error()))
+			return
+		}
+		context.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		key := context.Request.Method + " " + context.Request.URL.RequestURI() + " " + header
+		response, err := cache.claim(key, sha256.Sum256(body), context.Request.Context().Done())
+		if err == ErrIdempotencyCancelled {
+			// the client is gone, so there's no one to answer
+			context.Abort()
+			return
+		}
+		if err != nil {
+			abortWithError(context, err)
+			return
+		}
+		if response != nil {
+			context.Header("Idempotent-Replayed", "true")
+			context.Data(response.status, response.contentType, response.body)
+			context.Abort()
+			return
+		}
+
+		writer := &recordingWriter{ResponseWriter: context.Writer}
+		context.Writer = writer
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				cache.forget(key)
+				panic(recovered)
+			}
+			if status := writer.Status(); status < http.StatusInternalServerError {
+				cache.keep(key, status, writer.Header().Get("Content-Type"), writer.body.Bytes())
+			} else {
+				cache.forget(key)
+			}
+		}()
+		context.Next()
+	}
+}
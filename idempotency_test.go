@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"github.com/snarlysodboxer/id-incrementer/client"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func serveIdempotent(t *testing.T, testRouter http.Handler, method, path, key, body string) *httptest.ResponseRecorder {
+	request, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+	if err != nil {
+		t.Error(err)
+	}
+	if body != "" {
+		request.Header.Add("Content-Type", "application/json")
+	}
+	if key != "" {
+		request.Header.Add(idempotencyKeyHeader, key)
+	}
+	response := httptest.NewRecorder()
+	testRouter.ServeHTTP(response, request)
+	return response
+}
+
+func TestIdempotencyKeyReplays(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	testRouter := ids.SetupRouter()
+	path := "/v2/environments/live/counters/records:next"
+	first := serveIdempotent(t, testRouter, "POST", path, "abc", "")
+	replayed := serveIdempotent(t, testRouter, "POST", path, "abc", "")
+
+	// test that the retry got the same response without incrementing again
+	if replayed.Code != 200 || replayed.Body.String() != first.Body.String() {
+		t.Errorf("Expected `%s`, got %d `%s`", first.Body, replayed.Code, replayed.Body)
+	}
+	if replayed.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("Expected the replay to be marked")
+	}
+	if ids["live"]["records"] != initialValue {
+		t.Error("Expected one increment, got ", ids["live"]["records"])
+	}
+
+	// test that other keys, other paths and no key run again
+	serveIdempotent(t, testRouter, "POST", path, "def", "")
+	serveIdempotent(t, testRouter, "POST", path, "", "")
+	serveIdempotent(t, testRouter, "POST", "/v2/environments/live/counters/other:next", "abc", "")
+	if ids["live"]["records"] != initialValue+2*incrementBy || ids["live"]["other"] != initialValue {
+		t.Error("Expected three more increments, got ", ids)
+	}
+
+	// test that errors are replayed too
+	notFound := serveIdempotent(t, testRouter, "DELETE", "/v2/environments/live/counters/missing", "ghi", "")
+	ids.Set("missing", "live", 7)
+	replayed = serveIdempotent(t, testRouter, "DELETE", "/v2/environments/live/counters/missing", "ghi", "")
+	if notFound.Code != 404 || replayed.Code != 404 || ids["live"]["missing"] != 7 {
+		t.Errorf("Expected a replayed 404, got %d then %d", notFound.Code, replayed.Code)
+	}
+}
+
+func TestClientAgainstServer(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	server := httptest.NewServer(ids.SetupRouter())
+	defer server.Close()
+	ctx := context.Background()
+	api := client.New(server.URL)
+
+	// test each typed method against the real routes
+	counter, err := api.Next(ctx, "live", "records")
+	if err != nil || counter.ID != initialValue {
+		t.Errorf("Expected %d, got %v (%v)", initialValue, counter, err)
+	}
+	block, err := api.Reserve(ctx, "live", "records", 2)
+	if err != nil || block.First != initialValue+incrementBy || block.Step != incrementBy {
+		t.Errorf("Expected a block from %d, got %v (%v)", initialValue+incrementBy, block, err)
+	}
+	if counter, err = api.Set(ctx, "live", "records", 100); err != nil || counter.ID != 100 {
+		t.Errorf("Expected 100, got %v (%v)", counter, err)
+	}
+	if counter, err = api.Peek(ctx, "live", "records"); err != nil || counter.ID != 100 {
+		t.Errorf("Expected 100, got %v (%v)", counter, err)
+	}
+	list, err := api.List(ctx, client.ListOptions{Environment: "live"})
+	if err != nil || len(list.Counters) != 1 || list.Counters[0].ID != 100 {
+		t.Errorf("Expected records at 100, got %v (%v)", list, err)
+	}
+	results, err := api.Batch(ctx, []client.Operation{
+		{Op: client.OpSet, Environment: "dev", Name: "records", ID: 0},
+		{Op: client.OpNext, Environment: "dev", Name: "records"},
+	})
+	if err != nil || len(results) != 2 || results[1].ID != incrementBy {
+		t.Errorf("Expected dev records at %d, got %v (%v)", incrementBy, results, err)
+	}
+	if counter, err = api.Delete(ctx, "live", "records"); err != nil || counter.ID != 100 {
+		t.Errorf("Expected 100, got %v (%v)", counter, err)
+	}
+	if _, err = api.Peek(ctx, "live", "records"); !client.IsNotFound(err) {
+		t.Error("Expected a not found error, got ", err)
+	}
+	all, err := api.All(ctx)
+	if err != nil || len(all) != 1 || all["dev"]["records"] != incrementBy {
+		t.Errorf("Expected only dev records, got %v (%v)", all, err)
+	}
+
+	// test that a block cache hands out reserved IDs
+	cache := api.NewBlockCache("live", "cached", 10)
+	for i := 0; i < 3; i++ {
+		if id, err := cache.Next(ctx); err != nil || id != initialValue+i*incrementBy {
+			t.Errorf("Expected %d, got %d (%v)", initialValue+i*incrementBy, id, err)
+		}
+	}
+	if ids["live"]["cached"] != initialValue+9*incrementBy {
+		t.Error("Expected one block of 10 to be reserved, got ", ids["live"]["cached"])
+	}
+}
+
+func TestIdempotencyKeyReusedWithAnotherBody(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	testRouter := ids.SetupRouter()
+	path := "/v2/environments/live/counters/records:reserve"
+	first := serveIdempotent(t, testRouter, "POST", path, "abc", `{"count": 2}`)
+
+	// test that the same body is replayed
+	replayed := serveIdempotent(t, testRouter, "POST", path, "abc", `{"count": 2}`)
+	if replayed.Code != 200 || replayed.Body.String() != first.Body.String() {
+		t.Errorf("Expected `%s`, got %d `%s`", first.Body, replayed.Code, replayed.Body)
+	}
+
+	// test that another body is refused rather than given the first's response
+	reused := serveIdempotent(t, testRouter, "POST", path, "abc", `{"count": 3}`)
+	if reused.Code != 409 {
+		t.Errorf("Expected 409, got %d `%s`", reused.Code, reused.Body)
+	}
+	if ids["live"]["records"] != initialValue+incrementBy {
+		t.Error("Expected one reservation, got ", ids["live"]["records"])
+	}
+}
+
+func TestIdempotencyClaimCancelled(t *testing.T) {
+	// setup
+	cache := newIdempotencyCache(10, time.Minute)
+	digest := sha256.Sum256(nil)
+	if _, err := cache.claim("key", digest, nil); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	close(done)
+
+	// test that waiting on a running request gives up once done is closed
+	if _, err := cache.claim("key", digest, done); err != ErrIdempotencyCancelled {
+		t.Error("Expected ErrIdempotencyCancelled, got ", err)
+	}
+}
+
+func TestIdempotencyEviction(t *testing.T) {
+	// setup
+	cache := newIdempotencyCache(2, time.Minute)
+	digest := sha256.Sum256(nil)
+	cache.claim("running", digest, nil)
+	cache.claim("a", digest, nil)
+	cache.keep("a", 200, "", nil)
+	cache.claim("b", digest, nil)
+	cache.keep("b", 200, "", nil)
+
+	// test that a running request isn't dropped, but is once it's finished
+	if _, ok := cache.responses["running"]; !ok || len(cache.responses) != 2 {
+		t.Errorf("Expected the running request kept, and the oldest finished one dropped, got %v", cache.responses)
+	}
+	cache.keep("running", 200, "", nil)
+	cache.claim("c", digest, nil)
+	if _, ok := cache.responses["running"]; ok || len(cache.responses) != 2 || cache.order.Len() != 2 {
+		t.Errorf("Expected the finished request dropped, got %v", cache.responses)
+	}
+
+	// test that reusing an expired key moves it to the back, so it isn't
+	// dropped in its old place
+	cache = newIdempotencyCache(2, -time.Minute)
+	for _, key := range []string{"a", "b", "a", "c"} {
+		cache.claim(key, digest, nil)
+		cache.keep(key, 200, "", nil)
+	}
+	if _, ok := cache.responses["a"]; !ok || cache.order.Len() != 2 {
+		t.Errorf("Expected the reused key kept, got %v", cache.responses)
+	}
+}
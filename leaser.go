@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"github.com/gin-gonic/gin"
+	"github.com/snarlysodboxer/id-incrementer/client"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	leaseFrom   = flag.String("lease-from", "", "URL of a coordinating server to lease ranges of IDs from, issuing them here")
+	leaseHolder = flag.String("lease-holder", "", "name this node holds leases under, by default its hostname")
+	leaseSize   = flag.Int("lease-size", 1000, "IDs to lease at a time, with -lease-from")
+	leaseTTL    = flag.Duration("lease-ttl", 5*time.Minute, "how long a lease lasts unless renewed, with -lease-from")
+)
+
+// ErrNoLease is returned when no lease could be had from the coordinator.
+var ErrNoLease = errors.New("no lease could be had from the coordinator")
+
+// leaser is the node this process runs with -lease-from, or nil.
+var leaser *rangeLeaser
+
+// startLeaser starts issuing IDs from leases if -lease-from is set.
+func startLeaser() error {
+	if *leaseFrom == "" {
+		return nil
+	}
+	if *clusterPeers != "" || *replicaOf != "" {
+		return errors.New("-lease-from can't be combined with -cluster-peers or -replica-of")
+	}
+	if err := checkStandalone("with -lease-from"); err != nil {
+		return err
+	}
+	if *leaseSize < 1 || *leaseSize > maxReserve || *leaseTTL < time.Second {
+		return errors.New("-lease-size must be from 1 to 10000, and -lease-ttl at least 1s")
+	}
+	holder := *leaseHolder
+	if holder == "" {
+		holder, _ = os.Hostname()
+	}
+	leaser = newRangeLeaser(client.New(*leaseFrom), holder, *leaseSize, *leaseTTL)
+	leaser.start()
+	return nil
+}
+
+// rangeLeaser issues IDs from ranges leased from a coordinator, leasing the
+// next range in the background once fewer than a quarter of size are left.
+// It renews its leases every third of their TTL, and stops issuing from a
+// lease when it would expire by its own clock, counted from before the
+// lease was asked for, so never after the coordinator considers it expired.
+type rangeLeaser struct {
+	api    *client.Client
+	holder string
+	size   int
+	ttl    time.Duration
+
+	mutex sync.Mutex
+	// changed is broadcast whenever a lease request finishes.
+	changed  *sync.Cond
+	held     map[CounterKey][]*heldLease
+	fetching map[CounterKey]bool
+	failed   map[CounterKey]error
+	done     chan struct{}
+}
+
+// heldLease is a lease being issued from. Lease.Next is the next ID to issue.
+type heldLease struct {
+	client.Lease
+	expires time.Time
+}
+
+func (lease *heldLease) remaining() int {
+	if lease.Next > lease.Last {
+		return 0
+	}
+	return (lease.Last-lease.Next)/lease.Step + 1
+}
+
+func newRangeLeaser(api *client.Client, holder string, size int, ttl time.Duration) *rangeLeaser {
+	leaser := &rangeLeaser{
+		api:      api,
+		holder:   holder,
+		size:     size,
+		ttl:      ttl,
+		held:     map[CounterKey][]*heldLease{},
+		fetching: map[CounterKey]bool{},
+		failed:   map[CounterKey]error{},
+		done:     make(chan struct{}),
+	}
+	leaser.changed = sync.NewCond(&leaser.mutex)
+	return leaser
+}
+
+func (leaser *rangeLeaser) start() {
+	go leaser.renewLeases()
+}
+
+func (leaser *rangeLeaser) stop() {
+	close(leaser.done)
+}
+
+// releaseAll stops the leaser, and hands back what's left of every lease it
+// holds, so the coordinator can lease it again rather than wait for it to
+// expire and be reclaimed. Nothing may be issued once it's called.
+func (leaser *rangeLeaser) releaseAll() {
+	leaser.stop()
+	leaser.mutex.Lock()
+	held := []*heldLease{}
+	for _, leases := range leaser.held {
+		held = append(held, leases...)
+	}
+	leaser.mutex.Unlock()
+	for _, lease := range held {
+		leaser.release(lease.ID, leaser.drop(lease))
+	}
+}
+
+// next issues a counter's next ID from a lease, waiting for one if none is
+// held, and returns it with the counter's format.
+func (leaser *rangeLeaser) next(key CounterKey) (int, string, error) {
+	leaser.mutex.Lock()
+	defer leaser.mutex.Unlock()
+	for {
+		held := leaser.usable(key)
+		remaining := 0
+		for _, lease := range held {
+			remaining += lease.remaining()
+		}
+		if remaining <= leaser.size/4 && !leaser.fetching[key] {
+			leaser.fetching[key] = true
+			go leaser.fetch(key)
+		}
+		if len(held) > 0 {
+			lease := held[0]
+			id := lease.Next
+			lease.Next += lease.Step
+			return id, lease.Format, nil
+		}
+
+		for leaser.fetching[key] {
+			leaser.changed.Wait()
+		}
+		if len(leaser.usable(key)) == 0 {
+			if err := leaser.failed[key]; err != nil {
+				return 0, "", err
+			}
+			return 0, "", ErrNoLease
+		}
+	}
+}
+
+// usable drops the leases of a counter that are used up, releasing them, or
+// expired, and returns the rest. The caller must hold the mutex.
+func (leaser *rangeLeaser) usable(key CounterKey) []*heldLease {
+	now := time.Now()
+	held := []*heldLease{}
+	for _, lease := range leaser.held[key] {
+		switch {
+		case lease.remaining() == 0:
+			go leaser.release(lease.ID, lease.Next)
+		case now.Before(lease.expires):
+			held = append(held, lease)
+		}
+	}
+	leaser.held[key] = held
+	return held
+}
+
+func (leaser *rangeLeaser) fetch(key CounterKey) {
+	requested := time.Now()
+	lease, err := leaser.api.Lease(context.Background(), key.Environment, key.Name, client.LeaseOptions{
+		Holder: leaser.holder,
+		Count:  leaser.size,
+		TTL:    leaser.ttl,
+	})
+	if err != nil {
+		log.Print("leasing ", key.Environment, "/", key.Name, ": ", err)
+	}
+
+	leaser.mutex.Lock()
+	defer leaser.mutex.Unlock()
+	leaser.fetching[key] = false
+	leaser.failed[key] = err
+	if err == nil {
+		expires := requested.Add(time.Duration(lease.TTL) * time.Second)
+		leaser.held[key] = append(leaser.held[key], &heldLease{Lease: lease, expires: expires})
+	}
+	leaser.changed.Broadcast()
+}
+
+func (leaser *rangeLeaser) release(id string, next int) {
+	if _, err := leaser.api.ReleaseLease(context.Background(), id, next); err != nil {
+		log.Print("releasing lease ", id, ": ", err)
+	}
+}
+
+func (leaser *rangeLeaser) renewLeases() {
+	ticker := time.NewTicker(leaser.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-leaser.done:
+			return
+		case <-ticker.C:
+		}
+		leaser.mutex.Lock()
+		held := []*heldLease{}
+		for _, leases := range leaser.held {
+			held = append(held, leases...)
+		}
+		leaser.mutex.Unlock()
+		for _, lease := range held {
+			leaser.renew(lease)
+		}
+	}
+}
+
+// renew extends a lease, or stops issuing from it if the coordinator won't,
+// handing back what's left if the lease was revoked.
+func (leaser *rangeLeaser) renew(lease *heldLease) {
+	leaser.mutex.Lock()
+	next := lease.Next
+	leaser.mutex.Unlock()
+	requested := time.Now()
+	renewed, err := leaser.api.RenewLease(context.Background(), lease.ID, next)
+	if apiError, ok := err.(*client.Error); ok && apiError.StatusCode < http.StatusInternalServerError {
+		log.Print("renewing lease ", lease.ID, ": ", err)
+		leaser.drop(lease)
+		return
+	}
+	if err != nil {
+		// it's used until it expires, when the coordinator may be back
+		log.Print("renewing lease ", lease.ID, ": ", err)
+		return
+	}
+	if renewed.State == client.LeaseRevoked {
+		leaser.release(lease.ID, leaser.drop(lease))
+		return
+	}
+	leaser.mutex.Lock()
+	lease.expires = requested.Add(time.Duration(renewed.TTL) * time.Second)
+	leaser.mutex.Unlock()
+}
+
+// drop stops issuing from a lease, and returns the next ID it would have
+// issued.
+func (leaser *rangeLeaser) drop(dropped *heldLease) int {
+	leaser.mutex.Lock()
+	defer leaser.mutex.Unlock()
+	key := CounterKey{Environment: dropped.Environment, Name: dropped.Name}
+	held := []*heldLease{}
+	for _, lease := range leaser.held[key] {
+		if lease != dropped {
+			held = append(held, lease)
+		}
+	}
+	leaser.held[key] = held
+	return dropped.Next
+}
+
+// localPaths are served by an edge node itself, rather than redirected to the
+// coordinator: the documentation, and what describes the node.
+var localPaths = map[string]bool{
+	"/openapi.json": true,
+	"/docs":         true,
+	"/metrics":      true,
+	"/healthz":      true,
+	"/readyz":       true,
+	"/version":      true,
+}
+
+// leasing issues IDs for `/getter` and `{name}:next` from leases, and
+// redirects every other request, besides localPaths, to the coordinator.
+func leasing(leaser *rangeLeaser) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		path := context.Request.URL.Path
+		name := context.Param("name")
+		switch {
+		case context.Request.Method == "GET" && strings.HasPrefix(path, "/getter/"):
+			key := CounterKey{Environment: context.Param("environment"), Name: name}
+			if !negotiable(context, idResponse{}) {
+				return
+			}
+			if id, _, err := issueLeased(context, leaser, key); err == nil {
+				respond(context, http.StatusOK, idResponse{id})
+			}
+		case context.Request.Method == "POST" && strings.HasPrefix(path, "/v2/environments/") && strings.HasSuffix(name, nextSuffix):
+			key := CounterKey{Environment: context.Param("environment"), Name: strings.TrimSuffix(name, nextSuffix)}
+			if !negotiable(context, Counter{}) {
+				return
+			}
+			if id, format, err := issueLeased(context, leaser, key); err == nil {
+				formatted := CounterConfig{Format: format}.format(id)
+				respond(context, http.StatusOK, Counter{Environment: key.Environment, Name: key.Name, ID: id, Formatted: formatted})
+			}
+		case localPaths[path]:
+			context.Next()
+			return
+		default:
+			redirectTo(context, leaser.api.BaseURL)
+		}
+		context.Abort()
+	}
+}
+
+func issueLeased(context *gin.Context, leaser *rangeLeaser, key CounterKey) (int, string, error) {
+	err := validateStruct(&key)
+	var id int
+	var format string
+	if err == nil {
+		id, format, err = leaser.next(key)
+	}
+	if apiError, ok := err.(*client.Error); ok {
+		err = &APIError{Code: apiError.Code, Field: apiError.Field, Message: apiError.Message}
+	} else if err != nil && err != ErrNoLease {
+		err = NewAPIError(CodeUnavailable, "", "no lease could be had from the coordinator: "+err.Error())
+	}
+	if err != nil {
+		abortWithError(context, err)
+	}
+	return id, format, err
+}
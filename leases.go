@@ -0,0 +1,514 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// leaseSuffix on a counter's name leases a range of its IDs when POSTed to,
+// as in `POST /v2/environments/live/counters/records:lease`.
+const leaseSuffix = ":lease"
+
+// Suffixes on a lease's ID acting on it when POSTed to, as in
+// `POST /v2/leases/5f1c0e9a:renew`.
+const (
+	renewSuffix   = ":renew"
+	releaseSuffix = ":release"
+	revokeSuffix  = ":revoke"
+	reclaimSuffix = ":reclaim"
+)
+
+// States of a Lease. Holders issue IDs from active leases only, and hand
+// back revoked ones when they next renew them.
+const (
+	LeaseActive    = "active"
+	LeaseRevoked   = "revoked"
+	LeaseExpired   = "expired"
+	LeaseReleased  = "released"
+	LeaseReclaimed = "reclaimed"
+)
+
+const (
+	defaultLeaseTTL = 300
+	// Most leases kept, beyond which the oldest released or reclaimed ones,
+	// and then the oldest expired ones, are forgotten. No more are granted
+	// while this many are active or revoked.
+	leaseHistory = 1000
+)
+
+// Errors returned by the lease table.
+var (
+	ErrLeaseNotFound   = errors.New("lease not found")
+	ErrLeaseEnded      = errors.New("lease has ended; request a new one")
+	ErrLeaseNotExpired = errors.New("lease hasn't expired, so its holder may still issue from it; revoke it, and reclaim it once it expires")
+	ErrTooManyLeases   = errors.New("too many leases are active; wait for some to be released or to expire")
+)
+
+// Lease is a range of a counter's IDs, from First to Last in steps of Step,
+// that Holder issues on its own until Expires unless it renews the lease.
+// Next is the first ID the holder hadn't issued when it last renewed or
+// released the lease, and Remaining how many IDs are left from there.
+type Lease struct {
+	ID          string    `json:"id" yaml:"id"`
+	Environment string    `json:"environment" yaml:"environment"`
+	Name        string    `json:"name" yaml:"name"`
+	Holder      string    `json:"holder" yaml:"holder"`
+	First       int       `json:"first" yaml:"first"`
+	Last        int       `json:"last" yaml:"last"`
+	Step        int       `json:"step" yaml:"step"`
+	Next        int       `json:"next" yaml:"next"`
+	Remaining   int       `json:"remaining" yaml:"remaining"`
+	State       string    `json:"state" yaml:"state"`
+	TTL         int       `json:"ttl" yaml:"ttl"`
+	Format      string    `json:"format,omitempty" yaml:"format,omitempty"`
+	Granted     time.Time `json:"granted" yaml:"granted"`
+	Expires     time.Time `json:"expires" yaml:"expires"`
+}
+
+// LeaseRequest is the body accepted when leasing a range of IDs. TTL is in
+// seconds.
+type LeaseRequest struct {
+	Holder string `form:"holder" json:"holder" binding:"required,max=128"`
+	Count  int    `form:"count" json:"count" binding:"min=1,max=10000"`
+	TTL    int    `form:"ttl" json:"ttl" binding:"omitempty,min=1,max=86400"`
+}
+
+// LeaseProgress is the body accepted when renewing, releasing or reclaiming
+// a lease: the first ID its holder hasn't issued. Without it, the last one
+// reported is kept.
+type LeaseProgress struct {
+	Next json.Number `form:"next" json:"next" binding:"omitempty,integer"`
+}
+
+// leaseFilter is the query accepted when listing leases.
+type leaseFilter struct {
+	Environment string `form:"environment" json:"environment"`
+	Name        string `form:"name" json:"name"`
+	Holder      string `form:"holder" json:"holder"`
+	State       string `form:"state" json:"state" binding:"omitempty,oneof=active revoked expired released reclaimed"`
+}
+
+func (filter leaseFilter) matches(lease Lease) bool {
+	for _, field := range []struct{ filter, value string }{
+		{filter.Environment, lease.Environment},
+		{filter.Name, lease.Name},
+		{filter.Holder, lease.Holder},
+		{filter.State, lease.State},
+	} {
+		if field.filter != "" && field.filter != field.value {
+			return false
+		}
+	}
+	return true
+}
+
+// LeaseList is every lease kept, and the ranges reclaimed from them that
+// haven't been leased again.
+type LeaseList struct {
+	Leases    []Lease `json:"leases" yaml:"leases"`
+	Reclaimed []Range `json:"reclaimed" yaml:"reclaimed"`
+}
+
+// leases is the coordinator's record of every lease it granted.
+var leases = newLeaseTable()
+
+// leaseTable tracks leases, and the remainders of those that ended, which
+// are leased again before any new IDs are reserved. It's guarded by the
+// mutex, like the counters, and only changed by applying commandLease, so
+// it's replicated like them.
+type leaseTable struct {
+	leases map[string]*Lease
+	// order is the IDs of leases, oldest first.
+	order     []string
+	reclaimed map[CounterKey][]Range
+}
+
+func newLeaseTable() *leaseTable {
+	return &leaseTable{leases: map[string]*Lease{}, reclaimed: map[CounterKey][]Range{}}
+}
+
+// Lease grants holder up to count of a counter's IDs for ttl, taken from a
+// reclaimed remainder if there is one, and otherwise reserved from the
+// counter. A lease from a remainder may be smaller than count. A reservation
+// and the lease are committed as one entry, so a lease isn't granted without
+// its IDs being reserved, or the other way round. The caller must hold the
+// mutex.
+func (ids idMap) Lease(name, environment, holder string, count int, ttl time.Duration) (Lease, error) {
+	defer metrics.observeWrite("lease", time.Now())
+	now := time.Now()
+	if !leases.hasRoom(now) {
+		return Lease{}, ErrTooManyLeases
+	}
+	if err := validateKey(name, environment); err != nil {
+		return Lease{}, err
+	}
+	if count < 1 {
+		return Lease{}, ErrInvalidCount
+	}
+	key := CounterKey{Environment: environment, Name: name}
+	config := configFor(name, environment)
+	commands := []raftCommand{}
+	block, remainders, reclaimed := leases.takeReclaimed(key, count)
+	if !reclaimed {
+		id, found := ids[environment][name]
+		first, last, err := config.next(id, found, count)
+		if err != nil {
+			return Lease{}, err
+		}
+		commands = append(commands, raftCommand{Type: ChangeReserve, Environment: environment, Name: name, ID: last})
+		block = Range{Environment: environment, Name: name, First: first, Last: last, Step: config.Step}
+		remainders = leases.reclaimed[key]
+	}
+	lease := &Lease{
+		ID:          newRequestID(),
+		Environment: environment,
+		Name:        name,
+		Holder:      holder,
+		First:       block.First,
+		Last:        block.Last,
+		Step:        block.Step,
+		Next:        block.First,
+		State:       LeaseActive,
+		TTL:         int(ttl / time.Second),
+		Format:      config.Format,
+		Granted:     now,
+		Expires:     now.Add(ttl),
+	}
+	if err := ids.commitAll(append(commands, recordLease(lease, remainders))); err != nil {
+		return Lease{}, err
+	}
+	if !reclaimed {
+		metrics.issued.add(float64(count), environment)
+	}
+	return leases.leases[lease.ID].current(now), nil
+}
+
+// recordLease returns the command recording lease, and the remainders its
+// counter is left with, once it's granted or changed.
+func recordLease(lease *Lease, remainders []Range) raftCommand {
+	return raftCommand{Type: commandLease, Environment: lease.Environment, Name: lease.Name, Lease: lease, Ranges: remainders}
+}
+
+// apply records a commandLease. Without a lease, it only sets the
+// remainders. The caller must hold the mutex.
+func (table *leaseTable) apply(command raftCommand) {
+	if command.Lease != nil {
+		lease := *command.Lease
+		if _, ok := table.leases[lease.ID]; ok {
+			table.leases[lease.ID] = &lease
+		} else {
+			table.add(&lease)
+		}
+	}
+	key := CounterKey{Environment: command.Environment, Name: command.Name}
+	if len(command.Ranges) == 0 {
+		delete(table.reclaimed, key)
+	} else {
+		table.reclaimed[key] = append([]Range{}, command.Ranges...)
+	}
+}
+
+// forget drops the remainders of a deleted counter, which a counter created
+// again under its name would hand out too.
+func (table *leaseTable) forget(key CounterKey) {
+	delete(table.reclaimed, key)
+}
+
+// commands returns the commands rebuilding the table, for a replica's
+// snapshot.
+func (table *leaseTable) commands() []raftCommand {
+	commands := []raftCommand{}
+	covered := map[CounterKey]bool{}
+	for _, id := range table.order {
+		lease := *table.leases[id]
+		key := CounterKey{Environment: lease.Environment, Name: lease.Name}
+		commands = append(commands, recordLease(&lease, table.reclaimed[key]))
+		covered[key] = true
+	}
+	for key, remainders := range table.reclaimed {
+		if !covered[key] {
+			commands = append(commands, raftCommand{Type: commandLease, Environment: key.Environment, Name: key.Name, Ranges: remainders})
+		}
+	}
+	return commands
+}
+
+// hasRoom reports whether fewer than leaseHistory leases are active or
+// revoked as of now, so another can be granted.
+func (table *leaseTable) hasRoom(now time.Time) bool {
+	live := 0
+	for _, lease := range table.leases {
+		if state := lease.stateAt(now); state == LeaseActive || state == LeaseRevoked {
+			live++
+		}
+	}
+	return live < leaseHistory
+}
+
+// add keeps a new lease, forgetting the oldest released or reclaimed leases,
+// and then the oldest expired ones, once more than leaseHistory are kept.
+// Expiry is judged as of when the new lease was granted, so every node
+// forgets the same leases.
+func (table *leaseTable) add(lease *Lease) {
+	table.leases[lease.ID] = lease
+	table.order = append(table.order, lease.ID)
+	for _, forgettable := range []map[string]bool{
+		{LeaseReleased: true, LeaseReclaimed: true},
+		{LeaseExpired: true},
+	} {
+		excess := len(table.order) - leaseHistory
+		if excess <= 0 {
+			return
+		}
+		kept := []string{}
+		for _, id := range table.order {
+			if excess > 0 && forgettable[table.leases[id].stateAt(lease.Granted)] {
+				delete(table.leases, id)
+				excess--
+				continue
+			}
+			kept = append(kept, id)
+		}
+		table.order = kept
+	}
+}
+
+// takeReclaimed takes up to count IDs from the first reclaimed remainder of
+// a counter, returning them and the remainders left.
+func (table *leaseTable) takeReclaimed(key CounterKey, count int) (Range, []Range, bool) {
+	remainders := table.reclaimed[key]
+	if len(remainders) == 0 {
+		return Range{}, nil, false
+	}
+	block := remainders[0]
+	left := append([]Range{}, remainders[1:]...)
+	if (block.Last-block.First)/block.Step+1 > count {
+		rest := block
+		rest.First = block.First + count*block.Step
+		block.Last = block.First + (count-1)*block.Step
+		left = append([]Range{rest}, left...)
+	}
+	return block, left, true
+}
+
+// stateAt returns the lease's state as of now, which is expired if its time
+// is up.
+func (lease *Lease) stateAt(now time.Time) string {
+	if (lease.State == LeaseActive || lease.State == LeaseRevoked) && !now.Before(lease.Expires) {
+		return LeaseExpired
+	}
+	return lease.State
+}
+
+// current returns a copy of the lease as of now, marked expired if its time
+// is up. The lease itself is left as it was recorded.
+func (lease *Lease) current(now time.Time) Lease {
+	copied := *lease
+	copied.State = lease.stateAt(now)
+	copied.Remaining = 0
+	if lease.Next <= lease.Last {
+		copied.Remaining = (lease.Last-lease.Next)/lease.Step + 1
+	}
+	return copied
+}
+
+// list returns the leases matching filter, oldest first, and every
+// reclaimed remainder. The caller must hold the mutex.
+func (table *leaseTable) list(filter leaseFilter) LeaseList {
+	now := time.Now()
+	list := LeaseList{Leases: []Lease{}, Reclaimed: []Range{}}
+	for _, id := range table.order {
+		if lease := table.leases[id].current(now); filter.matches(lease) {
+			list.Leases = append(list.Leases, lease)
+		}
+	}
+	for _, remainders := range table.reclaimed {
+		list.Reclaimed = append(list.Reclaimed, remainders...)
+	}
+	sort.Slice(list.Reclaimed, func(i, j int) bool {
+		a, b := list.Reclaimed[i], list.Reclaimed[j]
+		if a.Environment != b.Environment {
+			return a.Environment < b.Environment
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.First < b.First
+	})
+	return list
+}
+
+// act applies a lease action, as named by its suffix. next is the holder's
+// progress, or nil to keep the last reported. The caller must hold the
+// mutex.
+func (ids idMap) act(id, action string, next *int) (Lease, error) {
+	stored, ok := leases.leases[id]
+	if !ok {
+		return Lease{}, ErrLeaseNotFound
+	}
+	now := time.Now()
+	lease := stored.current(now)
+	state := lease.State
+	ended := state == LeaseReleased || state == LeaseReclaimed
+	switch {
+	case ended,
+		action == renewSuffix && state == LeaseExpired,
+		action == revokeSuffix && state == LeaseExpired:
+		return Lease{}, ErrLeaseEnded
+	case action == reclaimSuffix && state != LeaseExpired:
+		return Lease{}, ErrLeaseNotExpired
+	}
+	if next != nil {
+		if err := lease.advance(*next); err != nil {
+			return Lease{}, err
+		}
+	}
+
+	remainders := leases.reclaimed[CounterKey{Environment: lease.Environment, Name: lease.Name}]
+	switch action {
+	case renewSuffix:
+		// revoked leases aren't extended, and their holder hands them back
+		if state == LeaseActive {
+			lease.Expires = now.Add(time.Duration(lease.TTL) * time.Second)
+		}
+	case revokeSuffix:
+		lease.State = LeaseRevoked
+	case releaseSuffix:
+		lease.State = LeaseReleased
+		remainders = lease.reclaim(remainders)
+	case reclaimSuffix:
+		lease.State = LeaseReclaimed
+		remainders = lease.reclaim(remainders)
+	}
+	lease.Remaining = 0
+	if err := ids.commit(recordLease(&lease, remainders)); err != nil {
+		return Lease{}, err
+	}
+	return leases.leases[id].current(now), nil
+}
+
+// advance records the holder's progress through the lease.
+func (lease *Lease) advance(next int) error {
+	if next < lease.Next || next > lease.Last+lease.Step || (next-lease.First)%lease.Step != 0 {
+		message := fmt.Sprintf("must be an ID of the lease from %d, or %d once it's used up", lease.Next, lease.Last+lease.Step)
+		return NewAPIError(CodeInvalidArgument, "next", message)
+	}
+	lease.Next = next
+	return nil
+}
+
+// reclaim returns remainders with what's left of the lease added.
+func (lease *Lease) reclaim(remainders []Range) []Range {
+	if lease.Next > lease.Last {
+		return remainders
+	}
+	return append(append([]Range{}, remainders...), Range{
+		Environment: lease.Environment,
+		Name:        lease.Name,
+		First:       lease.Next,
+		Last:        lease.Last,
+		Step:        lease.Step,
+	})
+}
+
+func (ids idMap) setupLeaseRoutes(router gin.IRoutes) {
+	router.GET("/v2/leases", listLeases)
+	router.GET("/v2/leases/:id", getLease)
+	router.POST("/v2/leases/:id", ids.leaseAction)
+}
+
+func (ids idMap) leaseCounter(context *gin.Context, name string) {
+	key := CounterKey{Environment: context.Param("environment"), Name: name}
+	if err := validateStruct(&key); err != nil {
+		abortWithError(context, err)
+		return
+	}
+	var request LeaseRequest
+	if err := bindRequest(context, &request); err != nil {
+		abortWithError(context, err)
+		return
+	}
+	if request.TTL == 0 {
+		request.TTL = defaultLeaseTTL
+	}
+	mutex.Lock()
+	lease, err := ids.Lease(key.Name, key.Environment, request.Holder, request.Count, time.Duration(request.TTL)*time.Second)
+	mutex.Unlock()
+	if err != nil {
+		abortWithError(context, err)
+		return
+	}
+	respond(context, http.StatusOK, lease)
+}
+
+func listLeases(context *gin.Context) {
+	var filter leaseFilter
+	if err := bindRequest(context, &filter); err != nil {
+		abortWithError(context, err)
+		return
+	}
+	mutex.RLock()
+	list := leases.list(filter)
+	mutex.RUnlock()
+	respond(context, http.StatusOK, list)
+}
+
+func getLease(context *gin.Context) {
+	mutex.RLock()
+	lease, ok := leases.leases[context.Param("id")]
+	var current Lease
+	if ok {
+		current = lease.current(time.Now())
+	}
+	mutex.RUnlock()
+	if !ok {
+		abortWithError(context, ErrLeaseNotFound)
+		return
+	}
+	respond(context, http.StatusOK, current)
+}
+
+// leaseAction handles POSTs to `{id}:renew`, `{id}:release`, `{id}:revoke`
+// and `{id}:reclaim`.
+func (ids idMap) leaseAction(context *gin.Context) {
+	id := context.Param("id")
+	action := ""
+	for _, suffix := range []string{renewSuffix, releaseSuffix, revokeSuffix, reclaimSuffix} {
+		if strings.HasSuffix(id, suffix) {
+			id, action = strings.TrimSuffix(id, suffix), suffix
+		}
+	}
+	if action == "" {
+		message := "POST is only supported on `{id}" + renewSuffix + "`, `{id}" + releaseSuffix + "`, `{id}" + revokeSuffix + "` and `{id}" + reclaimSuffix + "`"
+		abortWithError(context, NewAPIError(CodeNotFound, "", message))
+		return
+	}
+	var progress LeaseProgress
+	if context.Request.ContentLength != 0 {
+		if err := bindRequest(context, &progress); err != nil {
+			abortWithError(context, err)
+			return
+		}
+	}
+	var next *int
+	if progress.Next != "" {
+		value, _ := progress.Next.Int64()
+		converted := int(value)
+		next = &converted
+	}
+
+	mutex.Lock()
+	lease, err := ids.act(id, action, next)
+	mutex.Unlock()
+	if err != nil {
+		abortWithError(context, err)
+		return
+	}
+	respond(context, http.StatusOK, lease)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"github.com/snarlysodboxer/id-incrementer/client"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLeaseLifecycle(t *testing.T) {
+	// setup
+	leases = newLeaseTable()
+	server := httptest.NewServer(NewIDMap().SetupRouter())
+	defer server.Close()
+	api := client.New(server.URL)
+	api.Retries = 0
+	ctx := context.Background()
+	expire := func(id string) {
+		mutex.Lock()
+		leases.leases[id].Expires = time.Now()
+		mutex.Unlock()
+	}
+
+	// test that holders are leased disjoint ranges
+	east, err := api.Lease(ctx, "live", "records", client.LeaseOptions{Holder: "east", Count: 10})
+	if err != nil || east.First != initialValue || east.Last != initialValue+9*incrementBy || east.State != LeaseActive || east.TTL != defaultLeaseTTL {
+		t.Errorf("Expected a lease of %d to %d, got %v %v", initialValue, initialValue+9*incrementBy, east, err)
+	}
+	west, err := api.Lease(ctx, "live", "records", client.LeaseOptions{Holder: "west", Count: 10, TTL: time.Minute})
+	if err != nil || west.First != east.Last+incrementBy || west.TTL != 60 {
+		t.Errorf("Expected a lease from %d, got %v %v", east.Last+incrementBy, west, err)
+	}
+
+	// test that renewing records progress, and only an ID of the lease
+	renewed, err := api.RenewLease(ctx, east.ID, east.First+3*incrementBy)
+	if err != nil || renewed.Next != east.First+3*incrementBy || renewed.Remaining != 7 || !renewed.Expires.After(east.Expires) {
+		t.Errorf("Expected the lease renewed with 7 remaining, got %v %v", renewed, err)
+	}
+	for _, next := range []int{east.First, east.First + 1, east.Last + 2*incrementBy} {
+		if _, err := api.RenewLease(ctx, east.ID, next); err == nil || err.(*client.Error).StatusCode != 400 {
+			t.Errorf("Expected status code 400 renewing to %d, got %v", next, err)
+		}
+	}
+
+	// test that a revoked lease isn't extended, and its release is reused
+	revoked, err := api.RevokeLease(ctx, east.ID)
+	if err != nil || revoked.State != LeaseRevoked {
+		t.Errorf("Expected the lease revoked, got %v %v", revoked, err)
+	}
+	if renewed, err := api.RenewLease(ctx, east.ID, east.First+5*incrementBy); err != nil || renewed.State != LeaseRevoked || !renewed.Expires.Equal(revoked.Expires) {
+		t.Errorf("Expected the revoked lease not extended, got %v %v", renewed, err)
+	}
+	if released, err := api.ReleaseLease(ctx, east.ID, east.First+5*incrementBy); err != nil || released.State != LeaseReleased {
+		t.Errorf("Expected the lease released, got %v %v", released, err)
+	}
+	if _, err := api.RenewLease(ctx, east.ID, east.Last+incrementBy); err == nil || err.(*client.Error).StatusCode != 409 {
+		t.Error("Expected status code 409 renewing a released lease, got ", err)
+	}
+	reused, err := api.Lease(ctx, "live", "records", client.LeaseOptions{Holder: "north", Count: 3})
+	if err != nil || reused.First != east.First+5*incrementBy || reused.Last != east.First+7*incrementBy {
+		t.Errorf("Expected a lease of the released remainder, got %v %v", reused, err)
+	}
+	list, _ := api.Leases(ctx, client.LeaseFilter{})
+	if len(list.Leases) != 3 || len(list.Reclaimed) != 1 || list.Reclaimed[0].First != east.First+8*incrementBy {
+		t.Errorf("Expected 3 leases and the rest of the remainder, got %v", list)
+	}
+
+	// test that only expired leases are reclaimed, from the last progress reported
+	if _, err := api.ReclaimLease(ctx, west.ID, nil); err == nil || err.(*client.Error).StatusCode != 409 {
+		t.Error("Expected status code 409 reclaiming an active lease, got ", err)
+	}
+	expire(west.ID)
+	if list, _ := api.Leases(ctx, client.LeaseFilter{Holder: "west"}); len(list.Leases) != 1 || list.Leases[0].State != LeaseExpired {
+		t.Errorf("Expected west's lease listed as expired, got %v", list)
+	}
+	mutex.Lock()
+	recorded := leases.leases[west.ID].State
+	mutex.Unlock()
+	if recorded != LeaseActive {
+		t.Error("Expected reading the lease to leave it recorded as active, got ", recorded)
+	}
+	if reclaimed, err := api.ReclaimLease(ctx, west.ID, nil); err != nil || reclaimed.State != LeaseReclaimed || reclaimed.Remaining != 10 {
+		t.Errorf("Expected the whole lease reclaimed, got %v %v", reclaimed, err)
+	}
+	list, _ = api.Leases(ctx, client.LeaseFilter{Holder: "west"})
+	if len(list.Leases) != 1 || list.Leases[0].State != LeaseReclaimed || len(list.Reclaimed) != 2 {
+		t.Errorf("Expected west's lease reclaimed, got %v", list)
+	}
+
+	// test for unknown leases and actions
+	if _, err := api.RevokeLease(ctx, "missing"); !client.IsNotFound(err) {
+		t.Error("Expected status code 404, got ", err)
+	}
+	request, _ := http.NewRequest("POST", server.URL+"/v2/leases/"+east.ID+":extend", nil)
+	if response, err := http.DefaultClient.Do(request); err != nil || response.StatusCode != 404 {
+		t.Error("Expected status code 404 for an unknown action, got ", response.StatusCode)
+	}
+}
+
+func TestLeaseClustered(t *testing.T) {
+	// setup
+	leases = newLeaseTable()
+	defer func() { leases = newLeaseTable() }()
+	ids := NewIDMap()
+	cluster = ids.newRaftNode("http://localhost:0", []string{"http://localhost:1"})
+	defer func() {
+		cluster.stop()
+		cluster = nil
+	}()
+
+	// test that a lease that isn't committed fails with the cluster's error,
+	// reserving nothing
+	mutex.Lock()
+	_, err := ids.Lease("records", "live", "east", 10, time.Minute)
+	mutex.Unlock()
+	if err != ErrLeadershipLost || len(ids) != 0 || len(leases.leases) != 0 {
+		t.Errorf("Expected ErrLeadershipLost and nothing applied, got %v %v %v", err, ids, leases.leases)
+	}
+
+	// test that the reservation and the lease are one entry in the log
+	cluster.stop()
+	cluster = ids.newRaftNode("http://localhost:0", nil)
+	cluster.start()
+	leaderOf(t, []*testNode{{node: cluster}})
+	mutex.Lock()
+	lease, err := ids.Lease("records", "live", "east", 10, time.Minute)
+	id := ids["live"]["records"]
+	mutex.Unlock()
+	if err != nil || lease.Last != initialValue+9*incrementBy || id != lease.Last {
+		t.Errorf("Expected a lease up to %d reserved, got %v %d %v", initialValue+9*incrementBy, lease, id, err)
+	}
+	if status := cluster.status(); status.LastIndex != 2 {
+		t.Error("Expected a noop and the lease in the log, got ", status)
+	}
+}
+
+func TestLeasingNode(t *testing.T) {
+	// setup
+	leases = newLeaseTable()
+	coordinatorIDs := NewIDMap()
+	coordinator := httptest.NewServer(coordinatorIDs.SetupRouter())
+	defer coordinator.Close()
+	api := client.New(coordinator.URL)
+	api.Retries = 0
+	leaser = newRangeLeaser(api, "edge", 4, time.Minute)
+	node := leaser
+	testRouter := NewIDMap().SetupRouter()
+	leaser = nil
+	defer node.stop()
+
+	// test that IDs are issued in order from leases, each leased before the last runs out
+	for i := 0; i < 10; i++ {
+		method, path := "POST", "/v2/environments/live/counters/records"+nextSuffix
+		if i%2 == 0 {
+			method, path = "GET", "/getter/live/records"
+		}
+		code, counter := serveV2(t, testRouter, method, path, "")
+		if code != 200 || counter.ID != initialValue+i*incrementBy {
+			t.Errorf("Expected %d from %s, got %d %v", initialValue+i*incrementBy, path, code, counter)
+		}
+	}
+	waitFor(t, "the next lease", func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(leases.order) == 3
+	})
+
+	// test that the coordinator issues after the leased ranges
+	http.Get(coordinator.URL + "/getter/live/records")
+	mutex.Lock()
+	id := coordinatorIDs["live"]["records"]
+	mutex.Unlock()
+	if id != initialValue+12*incrementBy {
+		t.Error("Expected the coordinator to skip the leased ranges, got ", id)
+	}
+
+	// test that a revoked lease is released on renewal, from the next ID
+	node.mutex.Lock()
+	held := node.held[CounterKey{Environment: "live", Name: "records"}][0]
+	node.mutex.Unlock()
+	api.RevokeLease(context.Background(), held.ID)
+	node.renew(held)
+	list, _ := api.Leases(context.Background(), client.LeaseFilter{State: LeaseReleased})
+	if len(list.Leases) == 0 || list.Leases[len(list.Leases)-1].ID != held.ID || list.Leases[len(list.Leases)-1].Next != initialValue+10*incrementBy {
+		t.Errorf("Expected lease %s released from %d, got %v", held.ID, initialValue+10*incrementBy, list.Leases)
+	}
+	if code, _ := serveV2(t, testRouter, "GET", "/getter/live/records", ""); code != 200 {
+		t.Error("Expected status code 200 from a new lease, got ", code)
+	}
+
+	// test that other requests are redirected to the coordinator
+	request, _ := http.NewRequest("PUT", "/v2/environments/live/counters/records", nil)
+	response := httptest.NewRecorder()
+	testRouter.ServeHTTP(response, request)
+	if response.Code != 307 || response.Header().Get("Location") != coordinator.URL+"/v2/environments/live/counters/records" {
+		t.Errorf("Expected a redirect to the coordinator, got %d %v", response.Code, response.Header())
+	}
+}
+
+func TestLeasesReplicatedAndBounded(t *testing.T) {
+	// setup
+	leases = newLeaseTable()
+	defer func() { leases = newLeaseTable() }()
+	ids := NewIDMap()
+	mutex.Lock()
+	defer mutex.Unlock()
+	released, _ := ids.Lease("records", "live", "east", 10, time.Minute)
+	ids.act(released.ID, releaseSuffix, nil)
+	ids.Lease("records", "live", "west", 4, time.Minute)
+
+	// test that the table is rebuilt from its commands, as on a replica
+	primary := leases
+	leases = newLeaseTable()
+	for _, command := range primary.commands() {
+		ids.applyCommand(command)
+	}
+	if expected, list := primary.list(leaseFilter{}), leases.list(leaseFilter{}); !reflect.DeepEqual(list, expected) {
+		t.Errorf("Expected %v, got %v", expected, list)
+	}
+	if remainders := leases.reclaimed[CounterKey{Environment: "live", Name: "records"}]; len(remainders) != 1 || remainders[0].First != initialValue+4*incrementBy {
+		t.Error("Expected the rest of the released lease to be left, got ", remainders)
+	}
+
+	// test that deleting the counter forgets its remainders
+	ids.Delete("records", "live")
+	if len(leases.reclaimed) != 0 {
+		t.Error("Expected no remainders, got ", leases.reclaimed)
+	}
+
+	// test that ended, then expired, leases are forgotten past the history,
+	// and no more are granted while it's full of live ones
+	leases = newLeaseTable()
+	now := time.Now()
+	for i := 0; i < leaseHistory; i++ {
+		leases.add(&Lease{ID: strconv.Itoa(i), Step: 1, State: LeaseActive, Granted: now, Expires: now.Add(time.Hour)})
+	}
+	leases.leases["5"].State = LeaseReleased
+	leases.leases["0"].Expires = now
+	for _, forgotten := range []string{"5", "0"} {
+		if _, err := ids.Lease("records", "live", "east", 1, time.Minute); err != nil {
+			t.Fatal("Expected a lease while there's room, got ", err)
+		}
+		if _, ok := leases.leases[forgotten]; ok || len(leases.order) != leaseHistory {
+			t.Errorf("Expected lease %s forgotten, keeping %d, got %d", forgotten, leaseHistory, len(leases.order))
+		}
+	}
+	if _, err := ids.Lease("records", "live", "east", 1, time.Minute); err != ErrTooManyLeases {
+		t.Error("Expected ErrTooManyLeases, got ", err)
+	}
+	for _, err := range []error{ErrTooManyLeases, ErrNoLease} {
+		if status := toAPIError(err).Status(); status != 503 {
+			t.Errorf("Expected status code 503 for `%v`, got %d", err, status)
+		}
+	}
+}
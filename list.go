@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/golang/protobuf/proto"
+	"github.com/snarlysodboxer/id-incrementer/pb"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const defaultListLimit = 100
+
+// listRequest is the query accepted by the v2 list routes.
+type listRequest struct {
+	Environment string `form:"environment" json:"environment" binding:"omitempty,max=64,identifier"`
+	// Name is a glob as understood by path.Match, e.g. `records_*`.
+	Name   string `form:"name" json:"name"`
+	Prefix string `form:"prefix" json:"prefix"`
+	Sort   string `form:"sort" json:"sort" binding:"omitempty,oneof=name -name id -id"`
+	Limit  int    `form:"limit" json:"limit" binding:"omitempty,min=1,max=1000"`
+	Cursor string `form:"cursor" json:"cursor"`
+}
+
+// CounterList is one page of counters returned by the v2 list routes.
+type CounterList struct {
+	Counters   []Counter `json:"counters" yaml:"counters"`
+	NextCursor string    `json:"next_cursor,omitempty" yaml:"next_cursor,omitempty"`
+	// Version is that of the snapshot the page was taken from. Pages of one
+	// listing with the same version are consistent with each other. Position
+	// is the same in the change feed, to fetch the changes after.
+	Version  uint64 `json:"version" yaml:"version"`
+	Position string `json:"position" yaml:"position"`
+}
+
+func (list CounterList) CSV() [][]string {
+	return countersCSV(list.Counters)
+}
+
+func (list CounterList) Proto() proto.Message {
+	return countersProto(list.Counters, list.NextCursor)
+}
+
+func countersCSV(counters []Counter) [][]string {
+	records := [][]string{{"environment", "name", "id"}}
+	for _, counter := range counters {
+		records = append(records, []string{counter.Environment, counter.Name, strconv.Itoa(counter.ID)})
+	}
+	return records
+}
+
+func countersProto(counters []Counter, nextCursor string) *pb.CounterList {
+	list := &pb.CounterList{NextCursor: nextCursor}
+	for _, counter := range counters {
+		list.Counters = append(list.Counters, counter.pb())
+	}
+	return list
+}
+
+// listCursor marks the last counter returned on a page. It is handed to
+// clients base64 encoded, so they can only pass it back.
+type listCursor struct {
+	Sort        string `json:"s"`
+	Environment string `json:"e"`
+	Name        string `json:"n"`
+	ID          int    `json:"i"`
+}
+
+func (ids idMap) setupListRoutes(router gin.IRoutes, snapshots *snapshotter) {
+	router.GET("/v2/counters", func(context *gin.Context) {
+		listCounters(context, snapshots, context.Query("environment"))
+	})
+	router.GET("/v2/environments/:environment/counters", func(context *gin.Context) {
+		listCounters(context, snapshots, context.Param("environment"))
+	})
+}
+
+// listCounters serves a page of counters from a snapshot, so filtering,
+// sorting and encoding them doesn't hold up writers.
+func listCounters(context *gin.Context, snapshots *snapshotter, environment string) {
+	var request listRequest
+	if err := bindRequest(context, &request); err != nil {
+		abortWithError(context, err)
+		return
+	}
+	request.Environment = environment
+	if err := validateStruct(&request); err != nil {
+		abortWithError(context, err)
+		return
+	}
+	if err := validateGlob("name", request.Name); err != nil {
+		abortWithError(context, err)
+		return
+	}
+
+	snapshot := snapshots.take()
+	list, err := paginate(snapshot.IDs.matching(request), request)
+	if err != nil {
+		abortWithError(context, err)
+		return
+	}
+	list.Version, list.Position = snapshot.Version, changes.position(snapshot.Version)
+	context.Header(snapshotVersionHeader, strconv.FormatUint(snapshot.Version, 10))
+	context.Header(changePositionHeader, list.Position)
+	respond(context, http.StatusOK, list)
+}
+
+func validateGlob(field, pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return NewAPIError(CodeInvalidArgument, field, field+" is not a valid glob: "+err.Error())
+	}
+	return nil
+}
+
+// matchesGlob reports whether name matches pattern, treating an empty pattern
+// as matching everything.
+func matchesGlob(pattern, name string) bool {
+	if pattern == "" {
+		return true
+	}
+	matched, _ := path.Match(pattern, name)
+	return matched
+}
+
+// matching returns the counters selected by request's filters.
+func (ids idMap) matching(request listRequest) []Counter {
+	counters := []Counter{}
+	for environment, names := range ids {
+		if request.Environment != "" && environment != request.Environment {
+			continue
+		}
+		for name, id := range names {
+			if !strings.HasPrefix(name, request.Prefix) {
+				continue
+			}
+			if !matchesGlob(request.Name, name) {
+				continue
+			}
+			counters = append(counters, Counter{Environment: environment, Name: name, ID: id})
+		}
+	}
+	return counters
+}
+
+// paginate sorts counters and returns the page following request's cursor.
+func paginate(counters []Counter, request listRequest) (CounterList, error) {
+	if request.Sort == "" {
+		request.Sort = "name"
+	}
+	if request.Limit == 0 {
+		request.Limit = defaultListLimit
+	}
+	less := counterOrder(request.Sort)
+	sort.Sort(counterSorter{counters, less})
+
+	start := 0
+	if request.Cursor != "" {
+		cursor, err := decodeCursor(request.Cursor)
+		if err != nil || cursor.Sort != request.Sort {
+			return CounterList{}, NewAPIError(CodeInvalidArgument, "cursor", "cursor is invalid or was issued for a different sort order")
+		}
+		last := Counter{Environment: cursor.Environment, Name: cursor.Name, ID: cursor.ID}
+		start = sort.Search(len(counters), func(i int) bool { return less(last, counters[i]) })
+	}
+
+	end := start + request.Limit
+	if end >= len(counters) {
+		return CounterList{Counters: counters[start:]}, nil
+	}
+	last := counters[end-1]
+	next := encodeCursor(listCursor{Sort: request.Sort, Environment: last.Environment, Name: last.Name, ID: last.ID})
+	return CounterList{Counters: counters[start:end], NextCursor: next}, nil
+}
+
+// counterOrder returns a strict total order for a sort parameter, breaking ties by
+// environment and then name so cursors are stable.
+func counterOrder(order string) func(a, b Counter) bool {
+	byKey := func(a, b Counter) bool {
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Environment < b.Environment
+	}
+	byID := func(a, b Counter) bool {
+		if a.ID != b.ID {
+			return a.ID < b.ID
+		}
+		return byKey(a, b)
+	}
+	switch order {
+	case "-name":
+		return func(a, b Counter) bool { return byKey(b, a) }
+	case "id":
+		return byID
+	case "-id":
+		return func(a, b Counter) bool { return byID(b, a) }
+	}
+	return byKey
+}
+
+type counterSorter struct {
+	counters []Counter
+	less     func(a, b Counter) bool
+}
+
+func (sorter counterSorter) Len() int {
+	return len(sorter.counters)
+}
+
+func (sorter counterSorter) Swap(i, j int) {
+	sorter.counters[i], sorter.counters[j] = sorter.counters[j], sorter.counters[i]
+}
+
+func (sorter counterSorter) Less(i, j int) bool {
+	return sorter.less(sorter.counters[i], sorter.counters[j])
+}
+
+func encodeCursor(cursor listCursor) string {
+	encoded, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+func decodeCursor(encoded string) (listCursor, error) {
+	var cursor listCursor
+	decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return cursor, err
+	}
+	err = json.Unmarshal(decoded, &cursor)
+	return cursor, err
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func serveList(t *testing.T, testRouter http.Handler, path string, query url.Values) (int, CounterList) {
+	request, err := http.NewRequest("GET", path+"?"+query.Encode(), nil)
+	if err != nil {
+		t.Error(err)
+	}
+	response := httptest.NewRecorder()
+	testRouter.ServeHTTP(response, request)
+
+	var list CounterList
+	if response.Code == 200 {
+		err = json.Unmarshal(response.Body.Bytes(), &list)
+		if err != nil {
+			t.Errorf("Unable to unmarshal `%s`", response.Body)
+		}
+	}
+	return response.Code, list
+}
+
+func listedKeys(list CounterList) []string {
+	keys := []string{}
+	for _, counter := range list.Counters {
+		keys = append(keys, counter.Environment+"/"+counter.Name)
+	}
+	return keys
+}
+
+func TestListFilters(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	ids["live"] = map[string]int{"records": 75, "records_other": 67, "users": 12}
+	ids["test"] = map[string]int{"records": 5, "orders": 99}
+	testRouter := ids.SetupRouter()
+
+	tests := []struct {
+		path  string
+		query url.Values
+		keys  []string
+	}{
+		{"/v2/counters", url.Values{}, []string{"test/orders", "live/records", "test/records", "live/records_other", "live/users"}},
+		{"/v2/counters", url.Values{"environment": {"live"}}, []string{"live/records", "live/records_other", "live/users"}},
+		{"/v2/environments/test/counters", url.Values{}, []string{"test/orders", "test/records"}},
+		{"/v2/environments/live/counters", url.Values{"prefix": {"rec"}}, []string{"live/records", "live/records_other"}},
+		{"/v2/counters", url.Values{"name": {"*s"}}, []string{"test/orders", "live/records", "test/records", "live/users"}},
+		{"/v2/counters", url.Values{"name": {"records_*"}}, []string{"live/records_other"}},
+		{"/v2/counters", url.Values{"sort": {"-name"}}, []string{"live/users", "live/records_other", "test/records", "live/records", "test/orders"}},
+		{"/v2/counters", url.Values{"sort": {"id"}}, []string{"test/records", "live/users", "live/records_other", "live/records", "test/orders"}},
+		{"/v2/counters", url.Values{"sort": {"-id"}, "limit": {"2"}}, []string{"test/orders", "live/records"}},
+		{"/v2/environments/nowhere/counters", url.Values{}, []string{}},
+	}
+
+	for _, test := range tests {
+		code, list := serveList(t, testRouter, test.path, test.query)
+		if code != 200 {
+			t.Errorf("Expected status code 200 for %s?%s, got %d", test.path, test.query.Encode(), code)
+		}
+		if fmt.Sprint(listedKeys(list)) != fmt.Sprint(test.keys) {
+			t.Errorf("Expected %v for %s?%s, got %v", test.keys, test.path, test.query.Encode(), listedKeys(list))
+		}
+	}
+}
+
+func TestListPagination(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	ids["live"] = map[string]int{}
+	for i := 0; i < 25; i++ {
+		ids["live"][fmt.Sprintf("counter%02d", i)] = 100 - i
+	}
+	testRouter := ids.SetupRouter()
+
+	for _, order := range []string{"name", "-name", "id", "-id"} {
+		// test that walking the cursors returns every counter exactly once
+		seen := map[string]bool{}
+		query := url.Values{"sort": {order}, "limit": {"10"}}
+		pages := 0
+		for {
+			code, list := serveList(t, testRouter, "/v2/environments/live/counters", query)
+			if code != 200 {
+				t.Fatalf("Expected status code 200 for sort `%s`, got %d", order, code)
+			}
+			pages++
+			for _, key := range listedKeys(list) {
+				if seen[key] {
+					t.Errorf("Expected `%s` to be listed once for sort `%s`", key, order)
+				}
+				seen[key] = true
+			}
+			if list.NextCursor == "" {
+				break
+			}
+			query.Set("cursor", list.NextCursor)
+		}
+		if pages != 3 || len(seen) != 25 {
+			t.Errorf("Expected 25 counters over 3 pages for sort `%s`, got %d over %d", order, len(seen), pages)
+		}
+	}
+}
+
+func TestListBadRequests(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	ids["live"] = map[string]int{"records": 75, "records_other": 67}
+	testRouter := ids.SetupRouter()
+	_, page := serveList(t, testRouter, "/v2/counters", url.Values{"limit": {"1"}})
+
+	tests := []url.Values{
+		{"sort": {"size"}},
+		{"limit": {"1001"}},
+		{"limit": {"ten"}},
+		{"name": {"records["}},
+		{"cursor": {"not a cursor"}},
+		{"cursor": {page.NextCursor}, "sort": {"-id"}},
+		{"environment": {"live env"}},
+	}
+
+	for _, query := range tests {
+		code, _ := serveList(t, testRouter, "/v2/counters", query)
+		if code != 400 {
+			t.Errorf("Expected status code 400 for %s, got %d", query.Encode(), code)
+		}
+	}
+}
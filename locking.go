@@ -0,0 +1,75 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// lockShards is how many locks the environments are spread over. Counters
+// in environments sharing a shard contend as if they shared an environment.
+const lockShards = 64
+
+// mutex guards the counters, their configs and the leases.
+var mutex = &storeLock{}
+
+// storeLock is held exclusively, with Lock, by anything touching several
+// environments, creating or dropping one, or changing configs or leases. An
+// operation on a single counter instead shares it and locks the shard of the
+// counter's environment, with idMap.lockEnvironment or readEnvironment, so
+// counters in other environments aren't held up by it, or by each other.
+type storeLock struct {
+	sync.RWMutex
+	shards [lockShards]sync.Mutex
+}
+
+// Lock locks the store exclusively, recording how long that took.
+func (store *storeLock) Lock() {
+	start := time.Now()
+	store.RWMutex.Lock()
+	metrics.lockWaits.observe(time.Since(start).Seconds(), "exclusive")
+}
+
+func (store *storeLock) shard(environment string) *sync.Mutex {
+	hash := fnv.New32a()
+	hash.Write([]byte(environment))
+	return &store.shards[hash.Sum32()%lockShards]
+}
+
+// lockEnvironment locks an environment's counters for reading and changing
+// them, though not for deleting one, and returns the function unlocking
+// them. It falls back to locking the whole store if the environment doesn't
+// exist yet, since creating it changes the map of environments, so callers
+// that only read should use readEnvironment.
+func (ids idMap) lockEnvironment(environment string) func() {
+	start := time.Now()
+	mutex.RLock()
+	if _, ok := ids[environment]; ok {
+		return lockShard(environment, start)
+	}
+	mutex.RUnlock()
+	mutex.Lock()
+	return mutex.Unlock
+}
+
+// readEnvironment locks an environment's counters for reading them, and
+// returns the function unlocking them. Unlike lockEnvironment, it only
+// shares the store's lock if the environment doesn't exist, as nothing can
+// create it while that's held.
+func (ids idMap) readEnvironment(environment string) func() {
+	start := time.Now()
+	mutex.RLock()
+	return lockShard(environment, start)
+}
+
+// lockShard locks the shard of an environment, once the caller shares the
+// store's lock, and returns the function unlocking both.
+func lockShard(environment string, start time.Time) func() {
+	shard := mutex.shard(environment)
+	shard.Lock()
+	metrics.lockWaits.observe(time.Since(start).Seconds(), "environment")
+	return func() {
+		shard.Unlock()
+		mutex.RUnlock()
+	}
+}
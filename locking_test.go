@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReadMissingEnvironmentShares(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	// test that reading a missing environment doesn't wait for the store's
+	// lock exclusively, as creating it does
+	read := make(chan error)
+	go func() {
+		unlock := ids.readEnvironment("live")
+		defer unlock()
+		_, err := ids.Peek("records", "live")
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		if err != ErrNotFound {
+			t.Error("Expected ErrNotFound, got ", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the read not to wait for the store's lock")
+	}
+}
@@ -1,98 +1,367 @@
 package main
 
 import (
-	"fmt"
+	"flag"
 	"github.com/gin-gonic/gin"
+	"github.com/golang/protobuf/proto"
+	"github.com/snarlysodboxer/id-incrementer/pb"
+	"log"
 	"net/http"
+	"os"
+	ossignal "os/signal"
+	"sort"
 	"strconv"
-	"sync"
+	"syscall"
+	"time"
 )
 
-// TODO setup auto API documentation, add auth, add persistent storage, add settings flags or file
+// TODO add auth, add persistent storage, add settings file
 
 var initialValue = 42
 var incrementBy = 5
-var mutex = &sync.Mutex{}
+
+// maxID is the largest ID a counter can hold, 2^53-1, so IDs survive a round
+// trip through JSON decoders that store numbers as doubles.
+const maxID = 1<<53 - 1
 
 type idMap map[string]map[string]int
 
+// idResponse is returned by the legacy getter and setter.
+type idResponse struct {
+	ID int `json:"id" yaml:"id"`
+}
+
+func (response idResponse) Text() string {
+	return strconv.Itoa(response.ID)
+}
+
+func (response idResponse) Proto() proto.Message {
+	return &pb.Counter{Id: int64(response.ID)}
+}
+
 func NewIDMap() idMap {
 	return map[string]map[string]int{}
 }
 
-func (ids idMap) Get(name, environment string) (int, int) {
-	// check if the environment is found
-	if _, ok := ids[environment]; ok {
-		// check if the name is found
-		if id, ok := ids[environment][name]; ok {
-			ids[environment][name] = id + incrementBy
-		} else {
-			// add unfound name
-			ids[environment][name] = initialValue
+// Get increments a counter by its step, creating it if needed, and returns
+// the new ID. It fails with ErrOutOfRange rather than passing the counter's
+// max.
+func (ids idMap) Get(name, environment string) (int, error) {
+	defer metrics.observeWrite(ChangeIncrement, time.Now())
+	if err := validateKey(name, environment); err != nil {
+		return 0, err
+	}
+	id, found := ids[environment][name]
+	next, _, err := configFor(name, environment).next(id, found, 1)
+	if err != nil {
+		return 0, err
+	}
+	if err := ids.commit(raftCommand{Type: ChangeIncrement, Environment: environment, Name: name, ID: next}); err != nil {
+		return 0, err
+	}
+	metrics.issued.add(1, environment)
+	return next, nil
+}
+
+// Reserve increments a counter by count IDs at once, creating it if needed,
+// and returns the first and last of them. Like Get, it fails with
+// ErrOutOfRange rather than passing the counter's max.
+func (ids idMap) Reserve(name, environment string, count int) (int, int, error) {
+	defer metrics.observeWrite(ChangeReserve, time.Now())
+	if err := validateKey(name, environment); err != nil {
+		return 0, 0, err
+	}
+	if count < 1 {
+		return 0, 0, ErrInvalidCount
+	}
+	id, found := ids[environment][name]
+	first, last, err := configFor(name, environment).next(id, found, count)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := ids.commit(raftCommand{Type: ChangeReserve, Environment: environment, Name: name, ID: last}); err != nil {
+		return 0, 0, err
+	}
+	metrics.issued.add(float64(count), environment)
+	return first, last, nil
+}
+
+// Add moves a counter by delta of its steps, the one rule shared by Redis
+// INCR and INCRBY and memcached incr and decr. Moving forward hands out the
+// next delta IDs through Get and Reserve, returning the last, so a missing
+// counter starts at its start and the IDs are counted as issued. Moving back
+// returns IDs to a counter, which must exist, and a delta of 0 just reads it.
+// It fails with ErrOutOfRange rather than taking the counter outside its
+// bounds, and ErrNotMonotonic rather than lowering a monotonic one.
+func (ids idMap) Add(name, environment string, delta int) (int, error) {
+	if delta == 1 {
+		return ids.Get(name, environment)
+	}
+	if delta > 1 {
+		_, last, err := ids.Reserve(name, environment, delta)
+		return last, err
+	}
+	defer metrics.observeWrite("add", time.Now())
+	if err := validateKey(name, environment); err != nil {
+		return 0, err
+	}
+	id, found := ids[environment][name]
+	if !found {
+		return 0, ErrNotFound
+	}
+	if delta == 0 {
+		return id, nil
+	}
+	config := configFor(name, environment)
+	if config.Monotonic {
+		return 0, ErrNotMonotonic
+	}
+	// compare in steps, so a large delta can't overflow
+	if -delta > (id-config.Min)/config.Step {
+		return 0, ErrOutOfRange
+	}
+	next := id + delta*config.Step
+	if err := ids.commit(raftCommand{Type: ChangeIncrement, Environment: environment, Name: name, ID: next}); err != nil {
+		return 0, err
+	}
+	return next, nil
+}
+
+// Set sets a counter, creating it if needed. Like Add, it fails with
+// ErrOutOfRange or ErrNotMonotonic.
+func (ids idMap) Set(name, environment string, id int) (int, error) {
+	defer metrics.observeWrite(ChangeSet, time.Now())
+	if err := validateKey(name, environment); err != nil {
+		return 0, err
+	}
+	current, found := ids[environment][name]
+	if err := configFor(name, environment).check(current, found, id); err != nil {
+		return 0, err
+	}
+	if err := ids.commit(raftCommand{Type: ChangeSet, Environment: environment, Name: name, ID: id}); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (ids idMap) Peek(name, environment string) (int, error) {
+	if err := validateKey(name, environment); err != nil {
+		return 0, err
+	}
+	id, ok := ids[environment][name]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	return id, nil
+}
+
+// Delete deletes a counter and its config, and returns its last ID. Since it
+// drops emptied environments, the caller must hold the mutex exclusively.
+func (ids idMap) Delete(name, environment string) (int, error) {
+	defer metrics.observeWrite(ChangeDelete, time.Now())
+	id, err := ids.Peek(name, environment)
+	if err != nil {
+		return 0, err
+	}
+	// applying the delete drops its config, and the environment if emptied
+	if err := ids.commit(raftCommand{Type: ChangeDelete, Environment: environment, Name: name, ID: id}); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// counters returns every counter, sorted by environment and then name.
+func (ids idMap) counters() []Counter {
+	counters := []Counter{}
+	for environment, names := range ids {
+		for name, id := range names {
+			counters = append(counters, Counter{Environment: environment, Name: name, ID: id})
+		}
+	}
+	sort.Sort(counterSorter{counters, func(a, b Counter) bool {
+		if a.Environment != b.Environment {
+			return a.Environment < b.Environment
+		}
+		return a.Name < b.Name
+	}})
+	return counters
+}
+
+func (ids idMap) CSV() [][]string {
+	return countersCSV(ids.counters())
+}
+
+func (ids idMap) Proto() proto.Message {
+	return countersProto(ids.counters(), "")
+}
+
+// Copy returns a deep copy, so it can be read without holding the mutex.
+func (ids idMap) Copy() idMap {
+	copied := make(idMap, len(ids))
+	for environment, names := range ids {
+		copied[environment] = make(map[string]int, len(names))
+		for name, id := range names {
+			copied[environment][name] = id
 		}
-	} else {
-		// add unfound environment and name
-		ids[environment] = map[string]int{name: initialValue}
 	}
-	return http.StatusOK, ids[environment][name]
+	return copied
 }
 
-func (ids idMap) Set(name, environment string, id int) (int, int) {
-	if _, ok := ids[environment]; ok {
-		ids[environment][name] = id
-	} else {
-		ids[environment] = map[string]int{name: id}
+func validateKey(name, environment string) error {
+	if environment == "" {
+		return ErrEmptyEnvironment
+	}
+	if name == "" {
+		return ErrEmptyName
 	}
-	return http.StatusOK, ids[environment][name]
+	return nil
 }
 
 func (ids idMap) SetupRouter() *gin.Engine {
-	// log to stdout
-	router := gin.Default()
+	// log to stdout, except for the requests cluster nodes send each other,
+	// and probes
+	router := gin.New()
+	router.Use(gin.LoggerWithWriter(gin.DefaultWriter, "/raft/vote", "/raft/append", "/healthz", "/readyz"), gin.Recovery())
 
 	// // don't log to stdout (helpful for testing)
 	// router := gin.New()
 	// router.Use(gin.Recovery())
 
-	router.GET("/lister", func(context *gin.Context) {
-		mutex.Lock()
-		context.JSON(http.StatusOK, ids)
-		mutex.Unlock()
+	router.Use(instrument())
+	router.Use(requestID())
+	router.Use(idempotency(newIdempotencyCache(idempotencyEntries, idempotencyTTL)))
+	if cluster != nil {
+		router.Use(clustered(cluster))
+	}
+	if replica != nil {
+		router.Use(readOnly(replica))
+	}
+	if leaser != nil {
+		router.Use(leasing(leaser))
+	}
+
+	router.NoRoute(func(context *gin.Context) {
+		abortWithError(context, NewAPIError(CodeNotFound, "", "no route matches "+context.Request.URL.Path))
 	})
 
-	router.GET("/getter/:environment/:name", func(context *gin.Context) {
-		mutex.Lock()
-		status, id := ids.Get(context.Param("name"), context.Param("environment"))
-		context.JSON(status, map[string]int{"id": id})
-		mutex.Unlock()
+	// routes are registered through labelledRoutes, so instrument knows which
+	// one each request matched
+	routes := labelledRoutes{router}
+
+	// legacy verb-named routes, kept for existing clients alongside the v2 API
+	snapshots := ids.newSnapshotter()
+	routes.GET("/lister", func(context *gin.Context) {
+		snapshot := snapshots.take()
+		context.Header(snapshotVersionHeader, strconv.FormatUint(snapshot.Version, 10))
+		context.Header(changePositionHeader, changes.position(snapshot.Version))
+		respond(context, http.StatusOK, snapshot.IDs)
 	})
 
-	router.POST("/setter", func(context *gin.Context) {
-		mutex.Lock()
-		if context.PostForm("id") == "" {
-			context.JSON(http.StatusBadRequest, `{"error": "ID field was not passed or is empty"}`)
-			mutex.Unlock()
+	routes.GET("/getter/:environment/:name", func(context *gin.Context) {
+		if !negotiable(context, idResponse{}) {
 			return
 		}
-		passedID, err := strconv.Atoi(context.PostForm("id"))
+		unlock := ids.lockEnvironment(context.Param("environment"))
+		id, err := ids.Get(context.Param("name"), context.Param("environment"))
+		unlock()
 		if err != nil {
-			message := fmt.Sprintf("Error converting `%s` to an integer", context.PostForm("id"))
-			msg := map[string]string{"error": message}
-			context.JSON(http.StatusBadRequest, msg)
-			mutex.Unlock()
+			abortWithError(context, err)
 			return
 		}
-		status, id := ids.Set(context.PostForm("name"), context.PostForm("environment"), passedID)
-		idM := map[string]int{"id": id}
-		context.JSON(status, idM)
-		mutex.Unlock()
+		respond(context, http.StatusOK, idResponse{id})
 	})
 
+	routes.POST("/setter", func(context *gin.Context) {
+		var request setterRequest
+		if err := bindRequest(context, &request); err != nil {
+			abortWithError(context, err)
+			return
+		}
+		if !negotiable(context, idResponse{}) {
+			return
+		}
+		passedID, _ := request.ID.Int64()
+		unlock := ids.lockEnvironment(request.Environment)
+		id, err := ids.Set(request.Name, request.Environment, int(passedID))
+		unlock()
+		if err != nil {
+			abortWithError(context, err)
+			return
+		}
+		respond(context, http.StatusOK, idResponse{id})
+	})
+
+	ids.setupV2Routes(routes)
+	ids.setupListRoutes(routes, snapshots)
+	ids.setupWatchRoutes(routes)
+	ids.setupBatchRoutes(routes)
+	ids.setupExportRoutes(routes)
+	ids.setupSpecRoutes(routes)
+	ids.setupLeaseRoutes(routes)
+	setupEventRoutes(routes)
+	setupClusterRoutes(routes, cluster)
+	ids.setupReplicationRoutes(routes, replica)
+	setupDocsRoutes(routes)
+	setupHealthRoutes(routes, cluster, replica)
+	ids.setupMetricsRoutes(routes, snapshots)
+
 	return router
 }
 
+// listeners start the optional servers, other than the HTTP API, that share
+// its counters. Each returns nil straight away if it isn't configured, and
+// otherwise only returns on error, or once stopped by its shutdown hook.
+var listeners []func(ids idMap) error
+
+var addr = flag.String("addr", "localhost:8080", "address to serve the HTTP API on")
+
 func main() {
+	os.Exit(runCLI(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// serve runs the HTTP API, and every configured listener, with the flags in
+// args. It returns on error, or once shut down by SIGTERM or SIGINT; a second
+// signal kills the process.
+func serve(args []string) error {
+	flag.CommandLine.Parse(args)
 	ids := NewIDMap()
-	router := ids.SetupRouter()
-	router.Run("localhost:8080")
+	if err := startCluster(ids); err != nil {
+		return err
+	}
+	if err := startReplica(ids); err != nil {
+		return err
+	}
+	if err := startLeaser(); err != nil {
+		return err
+	}
+	// a cluster's log, a replica's primary, or an edge node's coordinator
+	// holds its counters instead
+	if *snapshotFile != "" && cluster == nil && replica == nil && leaser == nil {
+		if err := ids.loadSnapshotFile(*snapshotFile); err != nil {
+			return err
+		}
+	}
+	failed := make(chan error, len(listeners)+1)
+	for _, listen := range listeners {
+		go func(listen func(ids idMap) error) {
+			if err := listen(ids); err != nil {
+				failed <- err
+			}
+		}(listen)
+	}
+	server := &http.Server{Addr: *addr, Handler: ids.SetupRouter()}
+	go func() {
+		failed <- server.ListenAndServe()
+	}()
+
+	stopping := make(chan os.Signal, 1)
+	ossignal.Notify(stopping, syscall.SIGTERM, os.Interrupt)
+	select {
+	case err := <-failed:
+		return err
+	case received := <-stopping:
+		ossignal.Stop(stopping)
+		log.Print("received ", received, ", shutting down")
+	}
+	return ids.shutdown(server, *drainDelay, *shutdownTimeout, *snapshotFile)
 }
@@ -4,11 +4,15 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"github.com/gin-gonic/gin"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 )
 
@@ -142,7 +146,7 @@ func TestSetterEndpoint(t *testing.T) {
 		t.Errorf("Unable to unmarshal `%s`", response.Body)
 	}
 	if id.ID != number {
-		t.Errorf("Expected `%d`, got `%s`", number, id.ID)
+		t.Errorf("Expected `%d`, got `%d`", number, id.ID)
 	}
 
 	//// ensure the number remains and gets incremented
@@ -164,7 +168,7 @@ func TestSetterEndpoint(t *testing.T) {
 		t.Errorf("Unable to unmarshal `%s`", response.Body)
 	}
 	if id.ID != number+incrementBy {
-		t.Errorf("Expected `%d`, got `%s`", number+incrementBy, id.ID)
+		t.Errorf("Expected `%d`, got `%d`", number+incrementBy, id.ID)
 	}
 }
 
@@ -172,10 +176,10 @@ func TestGet(t *testing.T) {
 	// setup
 	ids := NewIDMap()
 
-	// test for 200 response
-	status, id := ids.Get("live", "records")
-	if status != 200 {
-		t.Error("Expected status code 200, got ", status)
+	// test for no error
+	id, err := ids.Get("live", "records")
+	if err != nil {
+		t.Error("Expected no error, got ", err)
 	}
 
 	// test for new initial value
@@ -183,10 +187,10 @@ func TestGet(t *testing.T) {
 		t.Errorf("Expected %d, got %d", initialValue, id)
 	}
 
-	// test for 200 response
-	status, id = ids.Get("live", "records")
-	if status != 200 {
-		t.Error("Expected status code 200 a second time, got ", status)
+	// test for no error
+	id, err = ids.Get("live", "records")
+	if err != nil {
+		t.Error("Expected no error a second time, got ", err)
 	}
 
 	// test for incremented existing value
@@ -199,11 +203,11 @@ func TestSet(t *testing.T) {
 	// setup
 	ids := NewIDMap()
 	ids["test"] = map[string]int{"thisisthat": 5432}
-	status, id := ids.Set("live", "records", 4242)
+	id, err := ids.Set("live", "records", 4242)
 
-	// test for 200 status
-	if status != 200 {
-		t.Error("Expected status code 200, got ", status)
+	// test for no error
+	if err != nil {
+		t.Error("Expected no error, got ", err)
 	}
 
 	// test for expected id
@@ -211,10 +215,10 @@ func TestSet(t *testing.T) {
 		t.Error("Expected 4242, got ", id)
 	}
 
-	// test for 200 status
-	status, id = ids.Set("live", "records", 4242)
-	if status != 200 {
-		t.Error("Expected status code 200 a second time, got ", status)
+	// test for no error
+	id, err = ids.Set("live", "records", 4242)
+	if err != nil {
+		t.Error("Expected no error a second time, got ", err)
 	}
 
 	// test for expected id
@@ -228,6 +232,129 @@ func TestSet(t *testing.T) {
 	}
 }
 
+func TestReserve(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+
+	// test that a new counter's block starts at the initial value
+	first, last, err := ids.Reserve("records", "live", 3)
+	if err != nil || first != initialValue || last != initialValue+2*incrementBy {
+		t.Errorf("Expected %d to %d, got %d to %d (%v)", initialValue, initialValue+2*incrementBy, first, last, err)
+	}
+
+	// test that the next block, and the next id, follow the last
+	first, last, err = ids.Reserve("records", "live", 1)
+	if err != nil || first != initialValue+3*incrementBy || last != first {
+		t.Errorf("Expected %d, got %d to %d (%v)", initialValue+3*incrementBy, first, last, err)
+	}
+	id, _ := ids.Get("records", "live")
+	if id != initialValue+4*incrementBy {
+		t.Errorf("Expected %d, got %d", initialValue+4*incrementBy, id)
+	}
+
+	// test for an invalid count
+	if _, _, err = ids.Reserve("records", "live", 0); err != ErrInvalidCount {
+		t.Error("Expected ErrInvalidCount, got ", err)
+	}
+}
+
+func TestAdd(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+
+	// test that moving back or reading a missing counter fails
+	for _, delta := range []int{-1, 0} {
+		if _, err := ids.Add("records", "live", delta); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound for %d, got %v", delta, err)
+		}
+	}
+
+	// test that moving forward hands out IDs like Get and Reserve
+	id, err := ids.Add("records", "live", 1)
+	if err != nil || id != initialValue {
+		t.Errorf("Expected %d, got %d (%v)", initialValue, id, err)
+	}
+	id, err = ids.Add("records", "live", 10)
+	if err != nil || id != initialValue+10*incrementBy {
+		t.Errorf("Expected %d, got %d (%v)", initialValue+10*incrementBy, id, err)
+	}
+
+	// test that moving back counts steps too
+	id, err = ids.Add("records", "live", -4)
+	if err != nil || id != initialValue+6*incrementBy {
+		t.Errorf("Expected %d, got %d (%v)", initialValue+6*incrementBy, id, err)
+	}
+	if id, err = ids.Add("records", "live", 0); err != nil || id != initialValue+6*incrementBy {
+		t.Errorf("Expected %d, got %d (%v)", initialValue+6*incrementBy, id, err)
+	}
+
+	// test that the counter stays within 0 and maxID, without overflowing
+	for _, delta := range []int{-maxID, maxID, -(initialValue/incrementBy + 7)} {
+		if _, err = ids.Add("records", "live", delta); err != ErrOutOfRange {
+			t.Errorf("Expected ErrOutOfRange for %d, got %v", delta, err)
+		}
+	}
+	if ids["live"]["records"] != initialValue+6*incrementBy {
+		t.Error("Expected the counter unchanged, got ", ids["live"]["records"])
+	}
+}
+
+func TestOutOfRange(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	ids.Set("records", "live", maxID-incrementBy)
+
+	// test that Get and Reserve stop at maxID
+	if _, _, err := ids.Reserve("records", "live", 2); err != ErrOutOfRange {
+		t.Error("Expected ErrOutOfRange, got ", err)
+	}
+	if id, err := ids.Get("records", "live"); err != nil || id != maxID {
+		t.Errorf("Expected %d, got %d (%v)", maxID, id, err)
+	}
+	if _, err := ids.Get("records", "live"); err != ErrOutOfRange {
+		t.Error("Expected ErrOutOfRange, got ", err)
+	}
+	if _, _, err := ids.Reserve("other", "live", maxID); err != ErrOutOfRange {
+		t.Error("Expected ErrOutOfRange, got ", err)
+	}
+}
+
+func TestPeekDelete(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	ids["live"] = map[string]int{"records": 75, "records_other": 67}
+
+	// test for missing counters
+	if _, err := ids.Peek("missing", "live"); err != ErrNotFound {
+		t.Error("Expected ErrNotFound, got ", err)
+	}
+	if _, err := ids.Delete("records", "test"); err != ErrNotFound {
+		t.Error("Expected ErrNotFound, got ", err)
+	}
+
+	// test that peeking doesn't increment
+	id, err := ids.Peek("records", "live")
+	if err != nil || id != 75 {
+		t.Errorf("Expected 75, got %d (%v)", id, err)
+	}
+	if ids["live"]["records"] != 75 {
+		t.Error("Expected 75 to remain, got ", ids["live"]["records"])
+	}
+
+	// test that deleting returns the last id and drops emptied environments
+	id, err = ids.Delete("records", "live")
+	if err != nil || id != 75 {
+		t.Errorf("Expected 75, got %d (%v)", id, err)
+	}
+	if _, ok := ids["live"]["records"]; ok {
+		t.Error("Expected records to be deleted")
+	}
+	ids.Delete("records_other", "live")
+	if _, ok := ids["live"]; ok {
+		t.Error("Expected live to be deleted")
+	}
+}
+
 func TestParallelGetSetList(t *testing.T) {
 	// setup
 	number := 56
@@ -280,20 +407,59 @@ func TestParallelGetSetList(t *testing.T) {
 	})
 }
 
+// BenchmarkGetParallel increments counters from every goroutine: all the
+// same counter, each in its own environment, which don't contend, and the
+// same again while /lister is listing 10000 other counters.
 func BenchmarkGetParallel(b *testing.B) {
-	// setup
-	ids := NewIDMap()
-	testRouter := ids.SetupRouter()
-	getRequest, err := http.NewRequest("GET", "/getter/live/records", nil)
-	if err != nil {
-		b.Error(err)
+	for _, bench := range []struct {
+		name         string
+		environments int
+		listing      bool
+	}{
+		{"SameCounter", 1, false},
+		{"Environments", lockShards, false},
+		{"EnvironmentsWhileListing", lockShards, true},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			// setup
+			ids := NewIDMap()
+			for i := 0; i < 10000; i++ {
+				ids.Set("listed"+strconv.Itoa(i), "listed", i)
+			}
+			// logging every request would contend more than the counters
+			gin.DefaultWriter = ioutil.Discard
+			testRouter := ids.SetupRouter()
+			gin.DefaultWriter = os.Stdout
+			done := make(chan struct{})
+			defer close(done)
+			if bench.listing {
+				listRequest, _ := http.NewRequest("GET", "/lister", nil)
+				go func() {
+					for {
+						select {
+						case <-done:
+							return
+						default:
+							testRouter.ServeHTTP(httptest.NewRecorder(), listRequest)
+						}
+					}
+				}()
+			}
+			var goroutines int32
+
+			// benchmark getter
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				environment := int(atomic.AddInt32(&goroutines, 1)) % bench.environments
+				getRequest, err := http.NewRequest("GET", "/getter/env"+strconv.Itoa(environment)+"/records", nil)
+				if err != nil {
+					b.Error(err)
+				}
+				for pb.Next() {
+					response := httptest.NewRecorder()
+					testRouter.ServeHTTP(response, getRequest)
+				}
+			})
+		})
 	}
-
-	// benchmark getter
-	b.RunParallel(func(pb *testing.PB) {
-		for pb.Next() {
-			response := httptest.NewRecorder()
-			testRouter.ServeHTTP(response, getRequest)
-		}
-	})
 }
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var memcachedAddr = flag.String("memcached-addr", "", "address to serve the memcached text protocol on, if set")
+
+func init() {
+	listeners = append(listeners, func(ids idMap) error {
+		if *memcachedAddr == "" {
+			return nil
+		}
+		listener, err := net.Listen("tcp", *memcachedAddr)
+		if err != nil {
+			return err
+		}
+		connections := newConnectionTracker()
+		onShutdown(func(deadline <-chan struct{}) error {
+			return connections.drain(listener, "memcached", deadline)
+		})
+		if err := ids.serveMemcached(listener, connections); err != nil && !isDraining() {
+			return err
+		}
+		return nil
+	})
+}
+
+// Longest command line accepted, as in memcached itself.
+const maxMemcachedLine = 2048
+
+var (
+	errBadDataChunk = errors.New("bad data chunk")
+	errLineTooLong  = errors.New("line too long")
+)
+
+// serveMemcached answers the memcached text protocol's get, set, incr and
+// decr commands, mapping keys like `live:records` onto the environment and
+// name of a counter, until listener fails. Connections are followed by
+// connections, so they can be drained.
+func (ids idMap) serveMemcached(listener net.Listener, connections *connectionTracker) error {
+	for {
+		connection, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		if !connections.add(connection) {
+			connection.Close()
+			continue
+		}
+		go ids.serveMemcachedConnection(connection, connections)
+	}
+}
+
+func (ids idMap) serveMemcachedConnection(connection net.Conn, connections *connectionTracker) {
+	defer connections.remove(connection)
+	defer connection.Close()
+	reader := bufio.NewReader(connection)
+	writer := bufio.NewWriter(connection)
+	for {
+		line, err := readMemcachedLine(reader)
+		if err == errLineTooLong {
+			fmt.Fprintf(writer, "CLIENT_ERROR %s\r\n", err)
+			writer.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+		if !connections.begin(connection) {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			fmt.Fprint(writer, "ERROR\r\n")
+		} else if args[0] == "quit" {
+			writer.Flush()
+			return
+		} else if reply, err := ids.memcachedCommand(args, reader); err != nil {
+			// the data block of a set couldn't be read, so the stream is
+			// out of step
+			fmt.Fprintf(writer, "CLIENT_ERROR %s\r\n", err)
+			writer.Flush()
+			return
+		} else if args[len(args)-1] != "noreply" {
+			fmt.Fprint(writer, reply)
+		}
+		// once draining, answer the command served and hang up
+		if !connections.end(connection) {
+			writer.Flush()
+			return
+		}
+		// answer pipelined commands in one write
+		if reader.Buffered() == 0 {
+			if err := writer.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readMemcachedLine reads one command line, failing with errLineTooLong as
+// soon as it passes maxMemcachedLine, rather than buffering whatever a client
+// sends before a newline.
+func readMemcachedLine(reader *bufio.Reader) (string, error) {
+	line := []byte{}
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(line)+len(chunk) > maxMemcachedLine {
+			return "", errLineTooLong
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return string(line), nil
+	}
+}
+
+// memcachedCommand runs one command and returns its reply. It only returns an
+// error if the connection can't continue.
+func (ids idMap) memcachedCommand(args []string, reader *bufio.Reader) (string, error) {
+	switch args[0] {
+	case "get", "gets":
+		if len(args) < 2 {
+			return "ERROR\r\n", nil
+		}
+		return ids.memcachedGet(args[1:]), nil
+	case "set":
+		if len(args) != 5 && len(args) != 6 {
+			return "ERROR\r\n", nil
+		}
+		length, err := strconv.Atoi(args[4])
+		if err != nil || length < 0 || length > maxMemcachedLine {
+			return "", errBadDataChunk
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, data); err != nil || string(data[length:]) != "\r\n" {
+			return "", errBadDataChunk
+		}
+		return ids.memcachedSet(args[1], string(data[:length])), nil
+	case "incr", "decr":
+		if len(args) != 3 && len(args) != 4 {
+			return "ERROR\r\n", nil
+		}
+		return ids.memcachedIncr(args[1], args[2], args[0] == "decr"), nil
+	}
+	return "ERROR\r\n", nil
+}
+
+func (ids idMap) memcachedGet(keys []string) string {
+	reply := ""
+	for _, arg := range keys {
+		key, err := parseKey(arg)
+		if err != nil {
+			return memcachedClientError(err)
+		}
+		unlock := ids.readEnvironment(key.Environment)
+		id, err := ids.Peek(key.Name, key.Environment)
+		unlock()
+		if err == nil {
+			value := strconv.Itoa(id)
+			reply += fmt.Sprintf("VALUE %s 0 %d\r\n%s\r\n", arg, len(value), value)
+		}
+	}
+	return reply + "END\r\n"
+}
+
+// memcachedSet ignores the flags and expiry, which counters don't have.
+func (ids idMap) memcachedSet(arg, data string) string {
+	key, err := parseKey(arg)
+	if err != nil {
+		return memcachedClientError(err)
+	}
+	value := CounterValue{ID: json.Number(data)}
+	if err := validateStruct(&value); err != nil {
+		return memcachedClientError(err)
+	}
+	id, _ := value.ID.Int64()
+	unlock := ids.lockEnvironment(key.Environment)
+	_, err = ids.Set(key.Name, key.Environment, int(id))
+	unlock()
+	if err != nil {
+		return memcachedClientError(err)
+	}
+	return "STORED\r\n"
+}
+
+// memcachedIncr moves a counter by delta of its steps, by the same rule as
+// Redis INCRBY, so `incr key 1` hands out the same next ID as `/getter`, and
+// `incr key 10` reserves a block of ten and returns the last. Like `/getter`,
+// incr creates missing counters, while decr fails on them with NOT_FOUND.
+// Neither takes a counter outside its bounds.
+func (ids idMap) memcachedIncr(arg, deltaArg string, decrement bool) string {
+	key, err := parseKey(arg)
+	if err != nil {
+		return memcachedClientError(err)
+	}
+	delta, err := strconv.ParseUint(deltaArg, 10, 64)
+	if err != nil || delta > maxID {
+		return "CLIENT_ERROR invalid numeric delta argument\r\n"
+	}
+	steps := int(delta)
+	if decrement {
+		steps = -steps
+	}
+
+	unlock := ids.lockEnvironment(key.Environment)
+	id, err := ids.Add(key.Name, key.Environment, steps)
+	unlock()
+
+	if err == ErrNotFound {
+		return "NOT_FOUND\r\n"
+	}
+	if err != nil {
+		return memcachedClientError(err)
+	}
+	return strconv.Itoa(id) + "\r\n"
+}
+
+func memcachedClientError(err error) string {
+	return "CLIENT_ERROR " + toAPIError(err).Message + "\r\n"
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// dialMemcached serves ids over the memcached text protocol on a free port,
+// and returns a connection to it.
+func dialMemcached(t *testing.T, ids idMap) (net.Conn, *bufio.Reader, func()) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ids.serveMemcached(listener, newConnectionTracker())
+	connection, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return connection, bufio.NewReader(connection), func() {
+		connection.Close()
+		listener.Close()
+	}
+}
+
+// readMemcachedReply reads lines up to and including one that isn't part of
+// a get's values, joining them with `|`.
+func readMemcachedReply(t *testing.T, reader *bufio.Reader) string {
+	lines := []string{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		lines = append(lines, line)
+		if strings.HasPrefix(line, "VALUE ") {
+			value, _ := reader.ReadString('\n')
+			lines = append(lines, strings.TrimRight(value, "\r\n"))
+			continue
+		}
+		return strings.Join(lines, "|")
+	}
+}
+
+func TestMemcachedCommands(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	connection, reader, stop := dialMemcached(t, ids)
+	defer stop()
+
+	steps := []struct {
+		command string
+		reply   string
+	}{
+		{"get live:records", "END"},
+		{"decr live:records 1", "NOT_FOUND"},
+		{"incr live:records 1", fmt.Sprintf("%d", initialValue)},
+		{"incr live:records 3", fmt.Sprintf("%d", initialValue+3*incrementBy)},
+		{"decr live:records 2", fmt.Sprintf("%d", initialValue+incrementBy)},
+		{"incr live:records 0", fmt.Sprintf("%d", initialValue+incrementBy)},
+		{"set live:records 0 0 3\r\n100", "STORED"},
+		{"set dev:records 0 0 1 noreply\r\n7", ""},
+		{"get live:records dev:records live:missing", "VALUE live:records 0 3|100|VALUE dev:records 0 1|7|END"},
+		{"decr dev:records 2", "CLIENT_ERROR " + ErrOutOfRange.Error()},
+		{"incr dev:records -1", "CLIENT_ERROR invalid numeric delta argument"},
+		{"set dev:records 0 0 3\r\n1.5", "CLIENT_ERROR Error converting `1.5` to an integer"},
+		{"incr records 1", "CLIENT_ERROR key must look like environment:name"},
+		{"delete live:records", "ERROR"},
+	}
+
+	for _, step := range steps {
+		if _, err := connection.Write([]byte(step.command + "\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		if step.reply == "" {
+			continue
+		}
+		// test for the reply
+		if reply := readMemcachedReply(t, reader); reply != step.reply {
+			t.Errorf("Expected `%s` for `%s`, got `%s`", step.reply, step.command, reply)
+		}
+	}
+
+	// test that the commands shared the counters
+	if ids["live"]["records"] != 100 || ids["dev"]["records"] != 7 {
+		t.Error("Expected 100 and 7 to be stored, got ", ids)
+	}
+}
+
+func TestMemcachedBadDataChunk(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	connection, reader, stop := dialMemcached(t, ids)
+	defer stop()
+	if _, err := connection.Write([]byte("set live:records 0 0 2\r\n100\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	// test that a mismatched length closes the connection
+	if reply := readMemcachedReply(t, reader); reply != "CLIENT_ERROR bad data chunk" {
+		t.Error("Expected `CLIENT_ERROR bad data chunk`, got ", reply)
+	}
+	if _, err := reader.ReadString('\n'); err == nil {
+		t.Error("Expected the connection to be closed")
+	}
+	if len(ids) != 0 {
+		t.Error("Expected nothing to be stored, got ", ids)
+	}
+}
+
+func TestMemcachedLargeDelta(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	ids.Set("records", "live", maxID/2)
+	configs[CounterKey{Environment: "live", Name: "records"}] = CounterConfig{Start: 1, Step: 1 << 20, Min: 0, Max: maxID}
+	defer func() { configs = counterConfigs{} }()
+	connection, reader, stop := dialMemcached(t, ids)
+	defer stop()
+
+	// test that deltas whose steps would overflow are refused, not wrapped
+	for _, command := range []string{"incr", "decr"} {
+		if _, err := connection.Write([]byte(command + " live:records " + strconv.Itoa(maxID) + "\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		if reply := readMemcachedReply(t, reader); reply != "CLIENT_ERROR "+ErrOutOfRange.Error() {
+			t.Errorf("Expected ErrOutOfRange for %s, got `%s`", command, reply)
+		}
+	}
+	if ids["live"]["records"] != maxID/2 {
+		t.Error("Expected the counter unchanged, got ", ids["live"]["records"])
+	}
+}
+
+func TestMemcachedLongLine(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	connection, reader, stop := dialMemcached(t, ids)
+	defer stop()
+	go connection.Write([]byte("get " + strings.Repeat("a", 1<<20)))
+
+	// test that a line without a newline is cut off once it's too long
+	if reply := readMemcachedReply(t, reader); reply != "CLIENT_ERROR line too long" {
+		t.Error("Expected `CLIENT_ERROR line too long`, got ", reply)
+	}
+	if _, err := reader.ReadString('\n'); err == nil {
+		t.Error("Expected the connection to be closed")
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const mimePrometheus = "text/plain; version=0.0.4; charset=utf-8"
+
+// unmatchedRoute labels requests no route matched, so scanners probing for
+// paths don't each add a series.
+const unmatchedRoute = "unmatched"
+
+// routeKey is where labelledRoutes keep the route a request matched.
+const routeKey = "route"
+
+// Upper bounds, in seconds, of the latency histograms' buckets.
+var (
+	requestBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	lockBuckets    = []float64{.000001, .00001, .0001, .001, .01, .1, 1}
+)
+
+// metrics is what /metrics exposes besides the counters themselves.
+var metrics = newMetricsRegistry()
+
+// metricsRegistry collects the server's metrics until they're scraped. They're
+// recorded on every request, and while taking the store's lock, so recording
+// takes no lock of its own once a combination of labels has been seen.
+type metricsRegistry struct {
+	requests  *counterFamily
+	durations *histogramFamily
+	issued    *counterFamily
+	lockWaits *histogramFamily
+	writes    *histogramFamily
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		requests:  newCounterFamily(),
+		durations: newHistogramFamily(requestBuckets),
+		issued:    newCounterFamily(),
+		lockWaits: newHistogramFamily(lockBuckets),
+		writes:    newHistogramFamily(lockBuckets),
+	}
+}
+
+// observeWrite records how long a store operation that started at start
+// took. It's deferred by the idMap methods that change counters.
+func (registry *metricsRegistry) observeWrite(operation string, start time.Time) {
+	registry.writes.observe(time.Since(start).Seconds(), operation)
+}
+
+// atomicFloat is a float64 updated with atomic operations on its bits.
+type atomicFloat struct {
+	bits uint64
+}
+
+func (value *atomicFloat) add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&value.bits)
+		if atomic.CompareAndSwapUint64(&value.bits, old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+func (value *atomicFloat) load() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&value.bits))
+}
+
+// counterFamily is a Prometheus counter per combination of label values,
+// keyed by the values joined.
+type counterFamily struct {
+	values sync.Map
+}
+
+func newCounterFamily() *counterFamily {
+	return &counterFamily{}
+}
+
+func (family *counterFamily) add(delta float64, labels ...string) {
+	key := strings.Join(labels, "\x00")
+	value, ok := family.values.Load(key)
+	if !ok {
+		value, _ = family.values.LoadOrStore(key, &atomicFloat{})
+	}
+	value.(*atomicFloat).add(delta)
+}
+
+// histogramFamily is a Prometheus histogram per combination of label values,
+// keyed by the values joined.
+type histogramFamily struct {
+	buckets    []float64
+	histograms sync.Map
+}
+
+type histogram struct {
+	// counts[i] is the number of observations in bucket i alone; they're
+	// summed when written. A scrape may see an observation in its bucket
+	// before it's counted, which the next scrape makes up for.
+	counts []uint64
+	count  uint64
+	sum    atomicFloat
+}
+
+func newHistogramFamily(buckets []float64) *histogramFamily {
+	return &histogramFamily{buckets: buckets}
+}
+
+func (family *histogramFamily) observe(value float64, labels ...string) {
+	key := strings.Join(labels, "\x00")
+	bucket := sort.SearchFloat64s(family.buckets, value)
+	loaded, ok := family.histograms.Load(key)
+	if !ok {
+		loaded, _ = family.histograms.LoadOrStore(key, &histogram{counts: make([]uint64, len(family.buckets))})
+	}
+	observed := loaded.(*histogram)
+	if bucket < len(family.buckets) {
+		atomic.AddUint64(&observed.counts[bucket], 1)
+	}
+	observed.sum.add(value)
+	atomic.AddUint64(&observed.count, 1)
+}
+
+// metricsWriter writes metrics in the Prometheus text format.
+type metricsWriter struct {
+	bytes.Buffer
+}
+
+func (writer *metricsWriter) header(name, metricType, help string) {
+	fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func (writer *metricsWriter) sample(name string, names, values []string, value float64) {
+	writer.WriteString(name)
+	if len(names) > 0 {
+		pairs := make([]string, len(names))
+		for i, label := range names {
+			pairs[i] = label + `="` + escapeLabel(values[i]) + `"`
+		}
+		writer.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	writer.WriteString(" " + strconv.FormatFloat(value, 'g', -1, 64) + "\n")
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func (writer *metricsWriter) counters(name, help string, family *counterFamily, labels ...string) {
+	writer.header(name, "counter", help)
+	for _, key := range sortedMapKeys(&family.values) {
+		value, _ := family.values.Load(key)
+		writer.sample(name, labels, strings.Split(key, "\x00"), value.(*atomicFloat).load())
+	}
+}
+
+func (writer *metricsWriter) histograms(name, help string, family *histogramFamily, labels ...string) {
+	writer.header(name, "histogram", help)
+	bucketLabels := append(labels[:len(labels):len(labels)], "le")
+	for _, key := range sortedMapKeys(&family.histograms) {
+		loaded, _ := family.histograms.Load(key)
+		observed := loaded.(*histogram)
+		values := strings.Split(key, "\x00")
+		cumulative := uint64(0)
+		for i, bound := range family.buckets {
+			cumulative += atomic.LoadUint64(&observed.counts[i])
+			writer.sample(name+"_bucket", bucketLabels, append(values[:len(values):len(values)], strconv.FormatFloat(bound, 'g', -1, 64)), float64(cumulative))
+		}
+		count := atomic.LoadUint64(&observed.count)
+		writer.sample(name+"_bucket", bucketLabels, append(values[:len(values):len(values)], "+Inf"), float64(count))
+		writer.sample(name+"_sum", labels, values, observed.sum.load())
+		writer.sample(name+"_count", labels, values, float64(count))
+	}
+}
+
+// sortedMapKeys returns the keys of a family's map, sorted so scrapes list
+// series in the same order.
+func sortedMapKeys(values *sync.Map) []string {
+	keys := []string{}
+	values.Range(func(key, _ interface{}) bool {
+		keys = append(keys, key.(string))
+		return true
+	})
+	sort.Strings(keys)
+	return keys
+}
+
+// instrument counts and times every request by route and status. Routes are
+// labelled as registered through labelledRoutes, e.g.
+// `/getter/:environment/:name`, rather than by path.
+func instrument() gin.HandlerFunc {
+	return func(context *gin.Context) {
+		start := time.Now()
+		context.Next()
+		route := unmatchedRoute
+		if matched, ok := context.Get(routeKey); ok {
+			route = matched.(string)
+		}
+		method := context.Request.Method
+		metrics.requests.add(1, method, route, strconv.Itoa(context.Writer.Status()))
+		metrics.durations.observe(time.Since(start).Seconds(), method, route)
+	}
+}
+
+// labelledRoutes registers routes on an engine, each led by a handler
+// recording the route as registered for instrument. It runs ahead of the
+// engine's middleware, so requests that middleware answers, such as writes
+// forwarded to a cluster's leader, are labelled too.
+type labelledRoutes struct {
+	*gin.Engine
+}
+
+func (routes labelledRoutes) Handle(method, path string, handlers ...gin.HandlerFunc) gin.IRoutes {
+	// the engine puts its middleware ahead of whatever is registered, so
+	// it's set aside while the route is
+	middleware := routes.Handlers
+	defer func() { routes.Handlers = middleware }()
+	routes.Handlers = nil
+	label := func(context *gin.Context) {
+		context.Set(routeKey, path)
+	}
+	chain := append(append([]gin.HandlerFunc{label}, middleware...), handlers...)
+	return routes.Engine.Handle(method, path, chain...)
+}
+
+func (routes labelledRoutes) GET(path string, handlers ...gin.HandlerFunc) gin.IRoutes {
+	return routes.Handle("GET", path, handlers...)
+}
+
+func (routes labelledRoutes) POST(path string, handlers ...gin.HandlerFunc) gin.IRoutes {
+	return routes.Handle("POST", path, handlers...)
+}
+
+func (routes labelledRoutes) PUT(path string, handlers ...gin.HandlerFunc) gin.IRoutes {
+	return routes.Handle("PUT", path, handlers...)
+}
+
+func (routes labelledRoutes) DELETE(path string, handlers ...gin.HandlerFunc) gin.IRoutes {
+	return routes.Handle("DELETE", path, handlers...)
+}
+
+func (ids idMap) setupMetricsRoutes(router gin.IRoutes, snapshots *snapshotter) {
+	router.GET("/metrics", func(context *gin.Context) {
+		context.Data(http.StatusOK, mimePrometheus, ids.writeMetrics(snapshots).Bytes())
+	})
+}
+
+// writeMetrics writes every metric, reading the counters from a snapshot so
+// scrapes don't hold up writers.
+func (ids idMap) writeMetrics(snapshots *snapshotter) *metricsWriter {
+	writer := &metricsWriter{}
+	writer.counters("id_incrementer_http_requests_total", "Requests served, by method, route and status.",
+		metrics.requests, "method", "route", "status")
+	writer.histograms("id_incrementer_http_request_duration_seconds", "Time taken to serve requests, by method and route.",
+		metrics.durations, "method", "route")
+	writer.counters("id_incrementer_ids_issued_total", "IDs handed out by increments and reservations, by environment.",
+		metrics.issued, "environment")
+	writer.histograms("id_incrementer_lock_wait_seconds", "Time spent waiting for the store's lock, held exclusively or for one environment.",
+		metrics.lockWaits, "lock")
+	writer.histograms("id_incrementer_store_write_duration_seconds", "Time taken by writes to the store, by operation, once the lock is held.",
+		metrics.writes, "operation")
+
+	// counters are summed up per environment, so the series don't grow with
+	// the number of counters
+	snapshot := snapshots.take()
+	environments := []string{}
+	headroom := map[string]int{}
+	highest := map[string]int{}
+	mutex.RLock()
+	for _, counter := range snapshot.IDs.counters() {
+		config := configFor(counter.Name, counter.Environment)
+		left := 0
+		if counter.ID < config.Max {
+			left = (config.Max - counter.ID) / config.Step
+		}
+		if least, ok := headroom[counter.Environment]; !ok || left < least {
+			if !ok {
+				environments = append(environments, counter.Environment)
+			}
+			headroom[counter.Environment] = left
+		}
+		if most, ok := highest[counter.Environment]; !ok || counter.ID > most {
+			highest[counter.Environment] = counter.ID
+		}
+	}
+	mutex.RUnlock()
+	labels := []string{"environment"}
+	writer.header("id_incrementer_counters", "gauge", "Counters in each environment.")
+	for _, environment := range environments {
+		writer.sample("id_incrementer_counters", labels, []string{environment}, float64(len(snapshot.IDs[environment])))
+	}
+	writer.header("id_incrementer_counter_headroom", "gauge", "The fewest IDs any counter in each environment can still hand out before reaching its max.")
+	for _, environment := range environments {
+		writer.sample("id_incrementer_counter_headroom", labels, []string{environment}, float64(headroom[environment]))
+	}
+	writer.header("id_incrementer_counter_max_id", "gauge", "The highest ID of any counter in each environment.")
+	for _, environment := range environments {
+		writer.sample("id_incrementer_counter_max_id", labels, []string{environment}, float64(highest[environment]))
+	}
+	writer.header("id_incrementer_change_sequence", "gauge", "The sequence of the latest change to any counter.")
+	writer.sample("id_incrementer_change_sequence", nil, nil, float64(snapshot.Version))
+	return writer
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	// setup
+	metrics = newMetricsRegistry()
+	ids := NewIDMap()
+	testRouter := ids.SetupRouter()
+	mutex.Lock()
+	configs[CounterKey{Environment: "metered", Name: "tickets"}] = CounterConfig{Start: 10, Step: 10, Min: 0, Max: 1000}
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		delete(configs, CounterKey{Environment: "metered", Name: "tickets"})
+		mutex.Unlock()
+	}()
+	serveV2(t, testRouter, "GET", "/getter/metered/tickets", "")
+	serveV2(t, testRouter, "GET", "/getter/metered/tickets", "")
+	serveV2(t, testRouter, "POST", "/v2/environments/metered/counters/tickets:reserve", `{"count": 3}`)
+	serveV2(t, testRouter, "GET", "/no/such/route", "")
+	mutex.Lock()
+	ids.Set("receipts", "metered", 900)
+	mutex.Unlock()
+	connection, reader, stop := dialRedis(t, ids)
+	defer stop()
+	connection.Write([]byte(redisArray("INCRBY", "metered:receipts", "4")))
+	readRedisReply(t, reader)
+
+	request, _ := http.NewRequest("GET", "/metrics", nil)
+	response := httptest.NewRecorder()
+	testRouter.ServeHTTP(response, request)
+	body := response.Body.String()
+
+	// test for the Prometheus text format
+	if response.Code != 200 || !strings.HasPrefix(response.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("Expected status code 200 in the Prometheus format, got %d %v", response.Code, response.Header())
+	}
+
+	// test that each metric is exposed, with routes labelled as registered
+	for _, line := range []string{
+		"# TYPE id_incrementer_http_requests_total counter",
+		`id_incrementer_http_requests_total{method="GET",route="/getter/:environment/:name",status="200"} 2`,
+		`id_incrementer_http_requests_total{method="POST",route="/v2/environments/:environment/counters/:name",status="200"} 1`,
+		`id_incrementer_http_requests_total{method="GET",route="unmatched",status="404"} 1`,
+		`id_incrementer_http_request_duration_seconds_count{method="GET",route="/getter/:environment/:name"} 2`,
+		`id_incrementer_http_request_duration_seconds_bucket{method="GET",route="/getter/:environment/:name",le="+Inf"} 2`,
+		`id_incrementer_ids_issued_total{environment="metered"} 9`,
+		`id_incrementer_store_write_duration_seconds_count{operation="increment"} 2`,
+		`id_incrementer_store_write_duration_seconds_count{operation="reserve"} 2`,
+		`id_incrementer_counters{environment="metered"} 2`,
+		`id_incrementer_counter_headroom{environment="metered"} 95`,
+		`id_incrementer_counter_max_id{environment="metered"} 920`,
+		"# TYPE id_incrementer_lock_wait_seconds histogram",
+		`id_incrementer_lock_wait_seconds_count{lock="environment"}`,
+	} {
+		if !strings.Contains(body, line+"\n") && !strings.Contains(body, line+" ") {
+			t.Errorf("Expected the metrics to contain `%s`, got\n%s", line, body)
+		}
+	}
+}
+
+func TestLabelledRoutes(t *testing.T) {
+	// setup
+	metrics = newMetricsRegistry()
+	router := gin.New()
+	router.Use(instrument())
+	router.Use(func(context *gin.Context) {
+		if context.Query("refuse") != "" {
+			context.AbortWithStatus(http.StatusServiceUnavailable)
+		}
+	})
+	labelledRoutes{router}.GET("/things/:name", func(context *gin.Context) {
+		context.Status(http.StatusOK)
+	})
+	for _, path := range []string{"/things/a", "/things/b?refuse=1"} {
+		request, _ := http.NewRequest("GET", path, nil)
+		router.ServeHTTP(httptest.NewRecorder(), request)
+	}
+
+	// test that requests are labelled with their route, even when
+	// middleware answers them
+	writer := &metricsWriter{}
+	writer.counters("requests", "", metrics.requests, "method", "route", "status")
+	body := writer.String()
+	for _, line := range []string{
+		`requests{method="GET",route="/things/:name",status="200"} 1`,
+		`requests{method="GET",route="/things/:name",status="503"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Expected `%s`, got\n%s", line, body)
+		}
+	}
+}
+
+func TestEscapeLabel(t *testing.T) {
+	// test that quotes, backslashes and newlines are escaped
+	if escaped := escapeLabel("a\"b\\c\nd"); escaped != `a\"b\\c\nd` {
+		t.Error("Expected the label value escaped, got ", escaped)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"github.com/gin-gonic/gin"
+	"github.com/golang/protobuf/proto"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Media types responses can be rendered as.
+const (
+	mimeJSON     = "application/json"
+	mimeYAML     = "application/x-yaml"
+	mimeText     = "text/plain"
+	mimeCSV      = "text/csv"
+	mimeProtobuf = "application/x-protobuf"
+)
+
+// Values of the `format` query parameter, which overrides the Accept header.
+var formatTypes = map[string]string{
+	"json":     mimeJSON,
+	"yaml":     mimeYAML,
+	"text":     mimeText,
+	"csv":      mimeCSV,
+	"protobuf": mimeProtobuf,
+}
+
+// Other names clients use for the media types above.
+var mimeAliases = map[string]string{
+	"application/yaml":     mimeYAML,
+	"text/yaml":            mimeYAML,
+	"text/x-yaml":          mimeYAML,
+	"application/protobuf": mimeProtobuf,
+}
+
+// Responses implement these to be offered as plain text, CSV or protobuf, on
+// top of JSON and YAML.
+type textResponse interface {
+	Text() string
+}
+
+type csvResponse interface {
+	CSV() [][]string
+}
+
+type protoResponse interface {
+	Proto() proto.Message
+}
+
+// offeredFor returns the media types data can be rendered as, JSON first.
+func offeredFor(data interface{}) []string {
+	offered := []string{mimeJSON, mimeYAML}
+	if _, ok := data.(textResponse); ok {
+		offered = append(offered, mimeText)
+	}
+	if _, ok := data.(csvResponse); ok {
+		offered = append(offered, mimeCSV)
+	}
+	if _, ok := data.(protoResponse); ok {
+		offered = append(offered, mimeProtobuf)
+	}
+	return offered
+}
+
+// negotiable reports whether a response like data can be rendered in a format
+// the client accepts, aborting the request if not. Handlers that hand out or
+// change IDs check it first, so a refused response doesn't lose an ID.
+func negotiable(context *gin.Context, data interface{}) bool {
+	if _, err := negotiateFormat(context, offeredFor(data)); err != nil {
+		abortWithError(context, err)
+		return false
+	}
+	return true
+}
+
+// respond renders data in the format negotiated with the client.
+func respond(context *gin.Context, status int, data interface{}) {
+	format, err := negotiateFormat(context, offeredFor(data))
+	if err != nil {
+		abortWithError(context, err)
+		return
+	}
+
+	context.Header("Vary", "Accept")
+	switch format {
+	case mimeYAML:
+		context.YAML(status, data)
+	case mimeText:
+		context.String(status, "%s\n", data.(textResponse).Text())
+	case mimeCSV:
+		buffer := &bytes.Buffer{}
+		writer := csv.NewWriter(buffer)
+		writer.WriteAll(data.(csvResponse).CSV())
+		context.Data(status, mimeCSV+"; charset=utf-8", buffer.Bytes())
+	case mimeProtobuf:
+		encoded, err := proto.Marshal(data.(protoResponse).Proto())
+		if err != nil {
+			abortWithError(context, err)
+			return
+		}
+		context.Data(status, mimeProtobuf, encoded)
+	default:
+		context.JSON(status, data)
+	}
+}
+
+// negotiateFormat picks the offered media type named by the `format` query
+// parameter, or else the one the Accept header prefers. Without either, or
+// when the Accept header names none of them, it picks the first offered, so
+// clients that don't ask for JSON still get it rather than an error.
+func negotiateFormat(context *gin.Context, offered []string) (string, error) {
+	if format := context.Query("format"); format != "" {
+		mediaType, ok := formatTypes[format]
+		if !ok {
+			return "", NewAPIError(CodeInvalidArgument, "format", "format must be one of `json`, `yaml`, `text`, `csv` or `protobuf`")
+		}
+		for _, offer := range offered {
+			if offer == mediaType {
+				return offer, nil
+			}
+		}
+		return "", NewAPIError(CodeNotAcceptable, "format", "this endpoint can't be rendered as "+format)
+	}
+
+	header := context.Request.Header.Get("Accept")
+	if header == "" {
+		return offered[0], nil
+	}
+	for _, accepted := range parseAccept(header) {
+		for _, offer := range offered {
+			if acceptable(accepted, offer) {
+				return offer, nil
+			}
+		}
+	}
+	return offered[0], nil
+}
+
+// acceptable reports whether an Accept header's media range covers offer.
+func acceptable(accepted, offer string) bool {
+	if alias, ok := mimeAliases[accepted]; ok {
+		accepted = alias
+	}
+	if accepted == "*/*" || accepted == offer {
+		return true
+	}
+	return strings.HasSuffix(accepted, "/*") && strings.HasPrefix(offer, strings.TrimSuffix(accepted, "*"))
+}
+
+type acceptedType struct {
+	mediaType string
+	quality   float64
+}
+
+type byQuality []acceptedType
+
+func (types byQuality) Len() int           { return len(types) }
+func (types byQuality) Swap(i, j int)      { types[i], types[j] = types[j], types[i] }
+func (types byQuality) Less(i, j int) bool { return types[i].quality > types[j].quality }
+
+// parseAccept returns the media ranges of an Accept header, most preferred
+// first, dropping any with a quality of 0.
+func parseAccept(header string) []string {
+	types := []acceptedType{}
+	for _, part := range strings.Split(header, ",") {
+		parameters := strings.Split(part, ";")
+		accepted := acceptedType{mediaType: strings.ToLower(strings.TrimSpace(parameters[0])), quality: 1}
+		for _, parameter := range parameters[1:] {
+			parameter = strings.TrimSpace(parameter)
+			if strings.HasPrefix(parameter, "q=") {
+				if quality, err := strconv.ParseFloat(parameter[2:], 64); err == nil {
+					accepted.quality = quality
+				}
+			}
+		}
+		if accepted.mediaType != "" && accepted.quality > 0 {
+			types = append(types, accepted)
+		}
+	}
+	sort.Stable(byQuality(types))
+	mediaTypes := []string{}
+	for _, accepted := range types {
+		mediaTypes = append(mediaTypes, accepted.mediaType)
+	}
+	return mediaTypes
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"github.com/golang/protobuf/proto"
+	"github.com/snarlysodboxer/id-incrementer/pb"
+	"gopkg.in/yaml.v2"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func serveAccept(t *testing.T, testRouter http.Handler, path, accept string) *httptest.ResponseRecorder {
+	request, err := http.NewRequest("GET", path, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	if accept != "" {
+		request.Header.Add("Accept", accept)
+	}
+	response := httptest.NewRecorder()
+	testRouter.ServeHTTP(response, request)
+	return response
+}
+
+func TestGetterPlainText(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	testRouter := ids.SetupRouter()
+	response := serveAccept(t, testRouter, "/getter/live/records", "text/plain")
+
+	// test for just the number
+	if response.Code != 200 {
+		t.Error("Expected status code 200, got ", response.Code)
+	}
+	if !strings.HasPrefix(response.Header().Get("Content-Type"), mimeText) {
+		t.Error("Expected a text/plain response, got ", response.Header().Get("Content-Type"))
+	}
+	if response.Body.String() != "42\n" {
+		t.Errorf("Expected `42\\n`, got `%s`", response.Body)
+	}
+}
+
+func TestCounterYAML(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	ids.Set("records", "live", 60)
+	testRouter := ids.SetupRouter()
+	response := serveAccept(t, testRouter, "/v2/environments/live/counters/records", "application/yaml")
+
+	// test for a YAML encoded counter
+	if !strings.HasPrefix(response.Header().Get("Content-Type"), mimeYAML) {
+		t.Error("Expected a YAML response, got ", response.Header().Get("Content-Type"))
+	}
+	var counter Counter
+	err := yaml.Unmarshal(response.Body.Bytes(), &counter)
+	if err != nil {
+		t.Errorf("Unable to unmarshal `%s`", response.Body)
+	}
+	expected := Counter{Environment: "live", Name: "records", ID: 60}
+	if counter != expected {
+		t.Errorf("Expected %v, got %v", expected, counter)
+	}
+}
+
+func TestListerCSV(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	ids.Set("records", "live", 60)
+	ids.Set("accounts", "live", 7)
+	ids.Set("records", "dev", 1)
+	testRouter := ids.SetupRouter()
+	response := serveAccept(t, testRouter, "/lister?format=csv", "")
+
+	// test for one sorted row per counter
+	records, err := csv.NewReader(response.Body).ReadAll()
+	if err != nil {
+		t.Errorf("Unable to parse `%s`", response.Body)
+	}
+	expected := [][]string{
+		{"environment", "name", "id"},
+		{"dev", "records", "1"},
+		{"live", "accounts", "7"},
+		{"live", "records", "60"},
+	}
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("Expected %v, got %v", expected, records)
+	}
+}
+
+func TestListProtobuf(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	ids.Set("records", "live", 60)
+	testRouter := ids.SetupRouter()
+	response := serveAccept(t, testRouter, "/v2/counters", "application/x-protobuf")
+
+	// test for a protobuf encoded list
+	if response.Header().Get("Content-Type") != mimeProtobuf {
+		t.Error("Expected a protobuf response, got ", response.Header().Get("Content-Type"))
+	}
+	var list pb.CounterList
+	err := proto.Unmarshal(response.Body.Bytes(), &list)
+	if err != nil {
+		t.Error("Unable to unmarshal protobuf, got ", err)
+	}
+	if len(list.Counters) != 1 || list.Counters[0].Name != "records" || list.Counters[0].Id != 60 {
+		t.Error("Expected records at 60, got ", list.Counters)
+	}
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		path        string
+		accept      string
+		code        int
+		contentType string
+	}{
+		{"/getter/live/records", "", 200, mimeJSON},
+		{"/getter/live/records", "*/*", 200, mimeJSON},
+		{"/getter/live/records", "text/*", 200, mimeText},
+		{"/getter/live/records", "text/html, application/x-yaml;q=0.5, text/plain;q=0.9", 200, mimeText},
+		{"/getter/live/records?format=yaml", "text/plain", 200, mimeYAML},
+		{"/getter/live/records?format=csv", "", 406, mimeJSON},
+		{"/getter/live/records?format=xml", "", 400, mimeJSON},
+		{"/getter/live/records", "text/html", 200, mimeJSON},
+		{"/getter/live/records", "application/xml", 200, mimeJSON},
+		{"/lister", "text/plain", 200, mimeJSON},
+	}
+
+	for _, test := range tests {
+		// setup
+		ids := NewIDMap()
+		testRouter := ids.SetupRouter()
+		response := serveAccept(t, testRouter, test.path, test.accept)
+
+		// test for the negotiated format
+		if response.Code != test.code {
+			t.Errorf("Expected status code %d for %s with `%s`, got %d", test.code, test.path, test.accept, response.Code)
+		}
+		if !strings.HasPrefix(response.Header().Get("Content-Type"), test.contentType) {
+			t.Errorf("Expected %s for %s with `%s`, got %s", test.contentType, test.path, test.accept, response.Header().Get("Content-Type"))
+		}
+
+		// test that errors stay JSON encoded
+		if response.Code != 200 {
+			var apiError APIError
+			err := json.Unmarshal(response.Body.Bytes(), &apiError)
+			if err != nil || apiError.Code == "" {
+				t.Errorf("Expected a JSON encoded error for %s, got `%s`", test.path, response.Body)
+			}
+		}
+	}
+}
+
+func TestRefusedFormatKeepsID(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	testRouter := ids.SetupRouter()
+
+	// test that refusing the format hands out no ID
+	if response := serveAccept(t, testRouter, "/getter/live/records?format=csv", ""); response.Code != 406 {
+		t.Error("Expected 406 for /getter as CSV, got ", response.Code)
+	}
+	request, _ := http.NewRequest("POST", "/v2/environments/live/counters/records:next?format=csv", nil)
+	response := httptest.NewRecorder()
+	testRouter.ServeHTTP(response, request)
+	if response.Code != 406 {
+		t.Error("Expected 406 for :next as CSV, got ", response.Code)
+	}
+	request, _ = http.NewRequest("POST", "/v2/environments/live/counters/records:reserve?format=text", strings.NewReader(`{"count": 3}`))
+	request.Header.Set("Content-Type", "application/json")
+	response = httptest.NewRecorder()
+	testRouter.ServeHTTP(response, request)
+	if response.Code != 406 {
+		t.Error("Expected 406 for :reserve as text, got ", response.Code)
+	}
+	mutex.Lock()
+	_, exists := ids["live"]["records"]
+	mutex.Unlock()
+	if exists {
+		t.Error("Expected records not created by refused requests")
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !grpc
+// +build !grpc
+
+package main
+
+import (
+	"errors"
+	"flag"
+)
+
+// grpcAddr stands in for the flag grpc.go defines, which is only built with
+// `-tags grpc` as it needs google.golang.org/grpc, so that setting it fails
+// with how to build the server rather than as an unknown flag.
+var grpcAddr = flag.String("grpc-addr", "", "address to serve the gRPC API on, if set; needs a build with -tags grpc")
+
+func init() {
+	listeners = append(listeners, func(ids idMap) error {
+		if *grpcAddr == "" {
+			return nil
+		}
+		return errors.New("-grpc-addr needs the server built with -tags grpc")
+	})
+}
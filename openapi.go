@@ -0,0 +1,1012 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// apiOperation documents one route registered in SetupRouter. Every route
+// must have an entry here, which TestOpenAPICoversRoutes enforces.
+type apiOperation struct {
+	Method string
+	// Route is the path as registered with gin, e.g. `/getter/:environment/:name`.
+	Route string
+	// Path overrides the documented path when it differs from Route.
+	Path        string
+	ID          string
+	Tag         string
+	Summary     string
+	Query       []apiParameter
+	Body        string
+	Response    string
+	ContentType string
+	// Formats are the media types, besides JSON, the response is negotiated
+	// into by respond.
+	Formats []string
+	Errors  []int
+}
+
+type apiParameter struct {
+	Name        string
+	Type        string
+	Description string
+}
+
+var apiOperations = []apiOperation{
+	{
+		Method: "GET", Route: "/lister", ID: "listLegacy", Tag: "v1",
+		Summary:  "List every counter in every environment",
+		Response: "IDMap", Formats: listFormats, Errors: []int{406},
+	},
+	{
+		Method: "GET", Route: "/getter/:environment/:name", ID: "getLegacy", Tag: "v1",
+		Summary:  "Increment a counter, creating it if needed, and return the new id",
+		Response: "ID", Formats: idFormats, Errors: []int{400, 406},
+	},
+	{
+		Method: "POST", Route: "/setter", ID: "setLegacy", Tag: "v1",
+		Summary: "Set a counter from a JSON or form body",
+		Body:    "SetterRequest", Response: "ID", Formats: idFormats, Errors: []int{400, 406},
+	},
+	{
+		Method: "GET", Route: "/v2/environments/:environment/counters/:name", ID: "getCounter", Tag: "v2",
+		Summary:  "Read a counter without incrementing it",
+		Response: "Counter", Formats: idFormats, Errors: []int{400, 404, 406},
+	},
+	{
+		Method: "POST", Route: "/v2/environments/:environment/counters/:name",
+		Path: "/v2/environments/{environment}/counters/{name}" + nextSuffix, ID: "nextCounter", Tag: "v2",
+		Summary:  "Increment a counter, creating it if needed, and return the new id",
+		Response: "Counter", Formats: idFormats, Errors: []int{400, 404, 406},
+	},
+	{
+		Method: "POST", Route: "/v2/environments/:environment/counters/:name",
+		Path: "/v2/environments/{environment}/counters/{name}" + reserveSuffix, ID: "reserveCounter", Tag: "v2",
+		Summary: "Increment a counter by a block of IDs, creating it if needed, and return the block",
+		Body:    "ReserveValue", Response: "Range", Formats: rangeFormats, Errors: []int{400, 404, 406},
+	},
+	{
+		Method: "POST", Route: "/v2/environments/:environment/counters/:name",
+		Path: "/v2/environments/{environment}/counters/{name}" + leaseSuffix, ID: "leaseCounter", Tag: "leases",
+		Summary: "Lease a range of IDs for a holder to issue on its own, creating the counter if needed",
+		Body:    "LeaseRequest", Response: "Lease", Formats: []string{mimeYAML}, Errors: []int{400, 406, 503},
+	},
+	{
+		Method: "PUT", Route: "/v2/environments/:environment/counters/:name", ID: "setCounter", Tag: "v2",
+		Summary: "Set a counter, creating it if needed",
+		Body:    "CounterValue", Response: "Counter", Formats: idFormats, Errors: []int{400, 406},
+	},
+	{
+		Method: "DELETE", Route: "/v2/environments/:environment/counters/:name", ID: "deleteCounter", Tag: "v2",
+		Summary:  "Delete a counter and return its last id",
+		Response: "Counter", Formats: idFormats, Errors: []int{400, 404, 406},
+	},
+	{
+		Method: "GET", Route: "/v2/counters", ID: "listCounters", Tag: "v2",
+		Summary: "List counters in every environment, one page at a time",
+		Query: append([]apiParameter{
+			{"environment", "string", "Only list counters in this environment"},
+		}, listParameters...),
+		Response: "CounterList", Formats: listFormats, Errors: []int{400, 406},
+	},
+	{
+		Method: "GET", Route: "/v2/environments/:environment/counters", ID: "listEnvironmentCounters", Tag: "v2",
+		Summary:  "List counters in one environment, one page at a time",
+		Query:    listParameters,
+		Response: "CounterList", Formats: listFormats, Errors: []int{400, 406},
+	},
+	{
+		Method: "GET", Route: "/v2/environments/:environment/counters/:name/watch", ID: "watchCounter", Tag: "v2",
+		Summary: "Wait until a counter is above a value, then return it",
+		Query: []apiParameter{
+			{"after", "integer", "Return once the counter is above this value"},
+			{"timeout", "integer", "Seconds to wait, from 1 to 300, defaulting to 30, before failing with 408"},
+		},
+		Response: "Counter", Formats: idFormats, Errors: []int{400, 406, 408},
+	},
+	{
+		Method: "POST", Route: "/v2/batch", ID: "batch", Tag: "v2",
+		Summary: "Apply a list of operations on any counters atomically, either all of them or none",
+		Body:    "BatchRequest", Response: "BatchResults", Formats: []string{mimeYAML}, Errors: []int{400, 404, 406},
+	},
+	{
+		Method: "GET", Route: "/v2/export", ID: "exportCounters", Tag: "v2",
+		Summary:  "Export every counter, with the settings they were handed out with",
+		Response: "Export", Formats: []string{mimeYAML}, Errors: []int{406},
+	},
+	{
+		Method: "POST", Route: "/v2/import", ID: "importCounters", Tag: "v2",
+		Summary: "Import an export as JSON or YAML, either all of it or none, and report what changed",
+		Query: []apiParameter{
+			{"strategy", "string", "What to do with counters that exist with another value: `overwrite`, `keep-higher` or the default `fail-on-conflict`, which fails with 409"},
+			{"dry_run", "boolean", "Only report what the import would change"},
+		},
+		Body: "Export", Response: "ImportReport", Formats: []string{mimeYAML}, Errors: []int{400, 406, 409},
+	},
+	{
+		Method: "POST", Route: "/v2/plan", ID: "planSpec", Tag: "v2",
+		Summary: "Diff a spec of counters, as JSON or YAML, against the server without changing anything",
+		Query:   []apiParameter{forceParameter},
+		Body:    "Spec", Response: "Plan", Formats: []string{mimeYAML}, Errors: []int{400, 406},
+	},
+	{
+		Method: "POST", Route: "/v2/apply", ID: "applySpec", Tag: "v2",
+		Summary: "Apply a spec of counters, as JSON or YAML, either all of it or none, and return the plan applied",
+		Query:   []apiParameter{forceParameter},
+		Body:    "Spec", Response: "Plan", Formats: []string{mimeYAML}, Errors: []int{400, 406, 409},
+	},
+	{
+		Method: "GET", Route: "/v2/leases", ID: "listLeases", Tag: "leases",
+		Summary: "List leases, oldest first, and the ranges reclaimed from them that haven't been leased again",
+		Query: []apiParameter{
+			{"environment", "string", "Only list leases in this environment"},
+			{"name", "string", "Only list leases of this counter"},
+			{"holder", "string", "Only list leases held by this holder"},
+			{"state", "string", "Only list leases in this state: `active`, `revoked`, `expired`, `released` or `reclaimed`"},
+		},
+		Response: "LeaseList", Formats: []string{mimeYAML}, Errors: []int{400, 406},
+	},
+	{
+		Method: "GET", Route: "/v2/leases/:id", ID: "getLease", Tag: "leases",
+		Summary:  "Read a lease",
+		Response: "Lease", Formats: []string{mimeYAML}, Errors: []int{404, 406},
+	},
+	{
+		Method: "POST", Route: "/v2/leases/:id",
+		Path: "/v2/leases/{id}" + renewSuffix, ID: "renewLease", Tag: "leases",
+		Summary: "Extend a lease by its TTL, reporting the holder's progress; revoked leases aren't extended",
+		Body:    "LeaseProgress", Response: "Lease", Formats: []string{mimeYAML}, Errors: []int{400, 404, 406, 409},
+	},
+	{
+		Method: "POST", Route: "/v2/leases/:id",
+		Path: "/v2/leases/{id}" + releaseSuffix, ID: "releaseLease", Tag: "leases",
+		Summary: "End a lease, handing back the IDs from `next` on to be leased again",
+		Body:    "LeaseProgress", Response: "Lease", Formats: []string{mimeYAML}, Errors: []int{400, 404, 406, 409},
+	},
+	{
+		Method: "POST", Route: "/v2/leases/:id",
+		Path: "/v2/leases/{id}" + revokeSuffix, ID: "revokeLease", Tag: "leases",
+		Summary:  "Stop a lease being extended, asking its holder to release it when it next renews",
+		Response: "Lease", Formats: []string{mimeYAML}, Errors: []int{404, 406, 409},
+	},
+	{
+		Method: "POST", Route: "/v2/leases/:id",
+		Path: "/v2/leases/{id}" + reclaimSuffix, ID: "reclaimLease", Tag: "leases",
+		Summary: "End an expired lease, taking back the IDs from `next`, or from the holder's last report, to be leased again",
+		Body:    "LeaseProgress", Response: "Lease", Formats: []string{mimeYAML}, Errors: []int{400, 404, 406, 409},
+	},
+	{
+		Method: "GET", Route: "/v2/events", ID: "streamEvents", Tag: "v2",
+		Summary: "Stream every increment, set and delete as server-sent events, resuming after Last-Event-ID",
+		Query: []apiParameter{
+			{"environment", "string", "Only send changes in this environment"},
+			{"name", "string", "Only send changes to counters whose name matches this glob"},
+			{"last_event_id", "string", "Resume after this position, like the Last-Event-ID header"},
+		},
+		Response: "Change", ContentType: "text/event-stream", Errors: []int{400},
+	},
+	{
+		Method: "GET", Route: "/v2/changes", ID: "listChanges", Tag: "v2",
+		Summary: "Fetch the changes after a position, failing with 409 if they're no longer kept, or the server restarted since, and counters must be listed again",
+		Query: []apiParameter{
+			{"after", "string", "Return the changes after this position, such as a listing's or the last page's `position`; defaults to the start of the feed"},
+			{"limit", "integer", "Changes per page, from 1 to 10000, default 1000"},
+			{"environment", "string", "Only return changes in this environment"},
+			{"name", "string", "Only return changes to counters whose name matches this glob"},
+		},
+		Response: "ChangeList", Formats: []string{mimeYAML}, Errors: []int{400, 406, 409},
+	},
+	{
+		Method: "GET", Route: "/v2/cluster", ID: "getClusterStatus", Tag: "cluster",
+		Summary:  "This node's view of the cluster, or `standalone` outside cluster mode",
+		Response: "ClusterStatus", Formats: []string{mimeYAML}, Errors: []int{406},
+	},
+	{
+		Method: "POST", Route: "/raft/vote", ID: "raftVote", Tag: "cluster",
+		Summary: "Ask this node for its vote in a leader election; only called by other nodes",
+		Body:    "VoteRequest", Response: "VoteResponse", Errors: []int{400, 404},
+	},
+	{
+		Method: "POST", Route: "/raft/append", ID: "raftAppend", Tag: "cluster",
+		Summary: "Replicate the leader's log entries to this node; only called by other nodes",
+		Body:    "AppendRequest", Response: "AppendResponse", Errors: []int{400, 404},
+	},
+	{
+		Method: "GET", Route: "/v2/replication", ID: "getReplicationStatus", Tag: "replication",
+		Summary:  "Whether this node is a primary or a replica, and how far a replica lags behind",
+		Response: "ReplicationStatus", Formats: []string{mimeYAML}, Errors: []int{406},
+	},
+	{
+		Method: "POST", Route: "/v2/replication/promote", ID: "promoteReplica", Tag: "replication",
+		Summary:  "Stop replicating and accept writes, making this replica a primary",
+		Response: "ReplicationStatus", Formats: []string{mimeYAML}, Errors: []int{406, 409},
+	},
+	{
+		Method: "GET", Route: "/replication/snapshot", ID: "replicationSnapshot", Tag: "replication",
+		Summary:  "Every counter and config, and the log sequence they're current as of; only called by replicas",
+		Response: "ReplicationSnapshot",
+	},
+	{
+		Method: "GET", Route: "/replication/log", ID: "replicationLog", Tag: "replication",
+		Summary: "Wait for the mutations after a sequence of this node's log; only called by replicas",
+		Query: []apiParameter{
+			{"epoch", "string", "Fail with 409 unless the log is still the one this epoch came from"},
+			{"after", "integer", "Return the entries after this sequence, failing with 409 if they're no longer kept"},
+			{"timeout", "integer", "Seconds to wait for an entry before returning none, from 1 to 300, default 30"},
+		},
+		Response: "ReplicationBatch", Errors: []int{400, 409},
+	},
+	{
+		Method: "GET", Route: "/openapi.json", ID: "getOpenAPI", Tag: "docs",
+		Summary:  "This OpenAPI document",
+		Response: "OpenAPI",
+	},
+	{
+		Method: "GET", Route: "/docs", ID: "getDocs", Tag: "docs",
+		Summary:  "Interactive documentation for this API",
+		Response: "HTML", ContentType: "text/html",
+	},
+	{
+		Method: "GET", Route: "/metrics", ID: "getMetrics", Tag: "metrics",
+		Summary:  "Request, issuance, lock and counter metrics in the Prometheus text format",
+		Response: "Metrics", ContentType: "text/plain",
+	},
+	{
+		Method: "GET", Route: "/healthz", ID: "checkLiveness", Tag: "health",
+		Summary:  "Whether the server is up, for liveness probes",
+		Response: "Health", Formats: []string{mimeYAML}, Errors: []int{406},
+	},
+	{
+		Method: "GET", Route: "/readyz", ID: "checkReadiness", Tag: "health",
+		Summary:  "Whether this node should be sent traffic, for readiness probes; 503, with the reasons, from a cluster node that isn't the leader or is replaying the log, or a replica",
+		Response: "Health", Formats: []string{mimeYAML}, Errors: []int{406},
+	},
+	{
+		Method: "GET", Route: "/version", ID: "getVersion", Tag: "health",
+		Summary:  "The server's version and build, and the flags it was started with, with secrets redacted",
+		Response: "BuildInfo", Formats: []string{mimeYAML}, Errors: []int{406},
+	},
+}
+
+// Formats offered by each kind of response, see respond.
+var (
+	idFormats    = []string{mimeYAML, mimeText, mimeProtobuf}
+	rangeFormats = []string{mimeYAML, mimeProtobuf}
+	listFormats  = []string{mimeYAML, mimeCSV, mimeProtobuf}
+)
+
+var forceParameter = apiParameter{"force", "boolean", "Allow counters outside their new bounds to be lowered to their start, which hands out IDs again"}
+
+var formatParameter = apiParameter{"format", "string", "Render the response as `json`, `yaml`, `text`, `csv` or `protobuf`, overriding the Accept header"}
+
+var listParameters = []apiParameter{
+	{"name", "string", "Only list counters whose name matches this glob, e.g. `records_*`"},
+	{"prefix", "string", "Only list counters whose name starts with this prefix"},
+	{"sort", "string", "One of `name` (the default), `-name`, `id` or `-id`"},
+	{"limit", "integer", "Counters per page, from 1 to 1000, defaulting to 100"},
+	{"cursor", "string", "The `next_cursor` returned with the previous page"},
+}
+
+var identifierSchema = map[string]interface{}{
+	"type": "string", "pattern": identifierRegex.String(),
+}
+
+var apiSchemas = map[string]interface{}{
+	"ID": map[string]interface{}{
+		"type":       "object",
+		"required":   []string{"id"},
+		"properties": map[string]interface{}{"id": map[string]interface{}{"type": "integer"}},
+	},
+	"IDMap": map[string]interface{}{
+		"type":        "object",
+		"description": "Counters keyed by environment, then by name",
+		"additionalProperties": map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": map[string]interface{}{"type": "integer"},
+		},
+	},
+	"Counter": map[string]interface{}{
+		"type":     "object",
+		"required": []string{"environment", "name", "id"},
+		"properties": map[string]interface{}{
+			"environment": map[string]interface{}{"type": "string"},
+			"name":        map[string]interface{}{"type": "string"},
+			"id":          map[string]interface{}{"type": "integer"},
+			"formatted":   map[string]interface{}{"type": "string", "description": "The id rendered with the counter's format, if it has one"},
+		},
+	},
+	"CounterList": map[string]interface{}{
+		"type":     "object",
+		"required": []string{"counters"},
+		"properties": map[string]interface{}{
+			"counters":    map[string]interface{}{"type": "array", "items": schemaRef("Counter")},
+			"next_cursor": map[string]interface{}{"type": "string", "description": "Absent on the last page"},
+			"version":     map[string]interface{}{"type": "integer", "description": "The change sequence the page's snapshot was taken at, also sent as the X-Snapshot-Version header"},
+			"position":    map[string]interface{}{"type": "string", "description": "The version as a position in the change feed, to fetch the changes after, also sent as the X-Change-Position header"},
+		},
+	},
+	"ChangeList": map[string]interface{}{
+		"type":     "object",
+		"required": []string{"changes", "sequence", "position", "horizon", "more"},
+		"properties": map[string]interface{}{
+			"changes":  map[string]interface{}{"type": "array", "items": schemaRef("Change")},
+			"sequence": map[string]interface{}{"type": "integer", "description": "The latest change the page covers"},
+			"position": map[string]interface{}{"type": "string", "description": "The same as a position, to pass as `after` next"},
+			"horizon":  map[string]interface{}{"type": "integer", "description": "The oldest sequence changes are still kept after"},
+			"more":     map[string]interface{}{"type": "boolean", "description": "Whether changes after `sequence` were left for the next page"},
+		},
+	},
+	"Change": map[string]interface{}{
+		"type":        "object",
+		"description": "Sent as the data of each event, whose ID is the position and whose name is the type",
+		"required":    []string{"sequence", "position", "type", "environment", "name", "id"},
+		"properties": map[string]interface{}{
+			"sequence":    map[string]interface{}{"type": "integer"},
+			"position":    map[string]interface{}{"type": "string", "description": "The sequence qualified by the server's epoch, which changes when it restarts"},
+			"type":        map[string]interface{}{"type": "string", "enum": []string{ChangeIncrement, ChangeReserve, ChangeSet, ChangeDelete}},
+			"environment": map[string]interface{}{"type": "string"},
+			"name":        map[string]interface{}{"type": "string"},
+			"id":          map[string]interface{}{"type": "integer"},
+		},
+	},
+	"CounterValue": map[string]interface{}{
+		"type":     "object",
+		"required": []string{"id"},
+		"properties": map[string]interface{}{
+			"id": map[string]interface{}{"type": "integer", "minimum": 0, "maximum": 9007199254740991},
+		},
+	},
+	"ReserveValue": map[string]interface{}{
+		"type":     "object",
+		"required": []string{"count"},
+		"properties": map[string]interface{}{
+			"count": map[string]interface{}{"type": "integer", "minimum": 1, "maximum": maxReserve},
+		},
+	},
+	"Range": map[string]interface{}{
+		"type":     "object",
+		"required": []string{"environment", "name", "first", "last", "step"},
+		"properties": map[string]interface{}{
+			"environment": map[string]interface{}{"type": "string"},
+			"name":        map[string]interface{}{"type": "string"},
+			"first":       map[string]interface{}{"type": "integer"},
+			"last":        map[string]interface{}{"type": "integer"},
+			"step":        map[string]interface{}{"type": "integer"},
+		},
+	},
+	"LeaseRequest": map[string]interface{}{
+		"type":     "object",
+		"required": []string{"holder", "count"},
+		"properties": map[string]interface{}{
+			"holder": map[string]interface{}{"type": "string", "maxLength": 128},
+			"count":  map[string]interface{}{"type": "integer", "minimum": 1, "maximum": maxReserve},
+			"ttl":    map[string]interface{}{"type": "integer", "minimum": 1, "maximum": 86400, "description": "Seconds, defaulting to 300"},
+		},
+	},
+	"LeaseProgress": map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"next": map[string]interface{}{"type": "integer", "description": "The first ID of the lease the holder hasn't issued"},
+		},
+	},
+	"Lease": map[string]interface{}{
+		"type":     "object",
+		"required": []string{"id", "environment", "name", "holder", "first", "last", "step", "next", "remaining", "state", "ttl", "granted", "expires"},
+		"properties": map[string]interface{}{
+			"id":          map[string]interface{}{"type": "string"},
+			"environment": map[string]interface{}{"type": "string"},
+			"name":        map[string]interface{}{"type": "string"},
+			"holder":      map[string]interface{}{"type": "string"},
+			"first":       map[string]interface{}{"type": "integer"},
+			"last":        map[string]interface{}{"type": "integer"},
+			"step":        map[string]interface{}{"type": "integer"},
+			"next":        map[string]interface{}{"type": "integer", "description": "The first ID the holder hadn't issued when it last reported"},
+			"remaining":   map[string]interface{}{"type": "integer"},
+			"state": map[string]interface{}{
+				"type": "string",
+				"enum": []string{LeaseActive, LeaseRevoked, LeaseExpired, LeaseReleased, LeaseReclaimed},
+			},
+			"ttl":     map[string]interface{}{"type": "integer"},
+			"format":  map[string]interface{}{"type": "string"},
+			"granted": map[string]interface{}{"type": "string", "format": "date-time"},
+			"expires": map[string]interface{}{"type": "string", "format": "date-time"},
+		},
+	},
+	"LeaseList": map[string]interface{}{
+		"type":     "object",
+		"required": []string{"leases", "reclaimed"},
+		"properties": map[string]interface{}{
+			"leases":    map[string]interface{}{"type": "array", "items": schemaRef("Lease")},
+			"reclaimed": map[string]interface{}{"type": "array", "items": schemaRef("Range")},
+		},
+	},
+	"BatchRequest": map[string]interface{}{
+		"type":     "object",
+		"required": []string{"operations"},
+		"properties": map[string]interface{}{
+			"operations": map[string]interface{}{
+				"type": "array", "minItems": 1, "maxItems": maxBatch,
+				"items": map[string]interface{}{
+					"type":     "object",
+					"required": []string{"op", "environment", "name"},
+					"properties": map[string]interface{}{
+						"op": map[string]interface{}{
+							"type": "string",
+							"enum": []string{BatchNext, BatchPeek, BatchSet, BatchReserve, BatchDelete},
+						},
+						"environment": withMaxLength(identifierSchema, 64),
+						"name":        withMaxLength(identifierSchema, 128),
+						"id": map[string]interface{}{
+							"type": "integer", "minimum": 0, "maximum": 9007199254740991,
+							"description": "Required by `set`",
+						},
+						"count": map[string]interface{}{
+							"type": "integer", "minimum": 1, "maximum": maxReserve,
+							"description": "Required by `reserve`",
+						},
+					},
+				},
+			},
+		},
+	},
+	"BatchResults": map[string]interface{}{
+		"type":     "object",
+		"required": []string{"results"},
+		"properties": map[string]interface{}{
+			"results": map[string]interface{}{
+				"type":        "array",
+				"description": "One result per operation, in the same order",
+				"items": map[string]interface{}{
+					"type":     "object",
+					"required": []string{"op", "environment", "name", "id"},
+					"properties": map[string]interface{}{
+						"op":          map[string]interface{}{"type": "string"},
+						"environment": map[string]interface{}{"type": "string"},
+						"name":        map[string]interface{}{"type": "string"},
+						"id":          map[string]interface{}{"type": "integer", "description": "The value after the operation, or before it for `delete`"},
+						"first":       map[string]interface{}{"type": "integer", "description": "Only set by `reserve`"},
+						"last":        map[string]interface{}{"type": "integer", "description": "Only set by `reserve`"},
+					},
+				},
+			},
+		},
+	},
+	"Export": map[string]interface{}{
+		"type":     "object",
+		"required": []string{"version", "counters"},
+		"properties": map[string]interface{}{
+			"version":       map[string]interface{}{"type": "integer", "enum": []int{exportVersion}},
+			"exported_at":   map[string]interface{}{"type": "string", "format": "date-time"},
+			"sequence":      map[string]interface{}{"type": "integer", "description": "The last change in the event stream included"},
+			"initial_value": map[string]interface{}{"type": "integer"},
+			"increment_by":  map[string]interface{}{"type": "integer"},
+			"counters": map[string]interface{}{
+				"type": "array",
+				"items": map[string]interface{}{
+					"type":     "object",
+					"required": []string{"environment", "name", "id"},
+					"properties": map[string]interface{}{
+						"environment": withMaxLength(identifierSchema, 64),
+						"name":        withMaxLength(identifierSchema, 128),
+						"id":          map[string]interface{}{"type": "integer", "minimum": 0, "maximum": 9007199254740991},
+						"config":      schemaRef("CounterConfig"),
+					},
+				},
+			},
+		},
+	},
+	"ImportReport": map[string]interface{}{
+		"type":     "object",
+		"required": []string{"strategy", "dry_run", "created", "updated", "unchanged", "skipped", "conflicts", "changes"},
+		"properties": map[string]interface{}{
+			"strategy":  map[string]interface{}{"type": "string"},
+			"dry_run":   map[string]interface{}{"type": "boolean"},
+			"created":   map[string]interface{}{"type": "integer"},
+			"updated":   map[string]interface{}{"type": "integer"},
+			"unchanged": map[string]interface{}{"type": "integer"},
+			"skipped":   map[string]interface{}{"type": "integer"},
+			"conflicts": map[string]interface{}{"type": "integer"},
+			"changes": map[string]interface{}{
+				"type":        "array",
+				"description": "Every counter created, updated, skipped or conflicting",
+				"items": map[string]interface{}{
+					"type":     "object",
+					"required": []string{"environment", "name", "action", "imported"},
+					"properties": map[string]interface{}{
+						"environment": map[string]interface{}{"type": "string"},
+						"name":        map[string]interface{}{"type": "string"},
+						"action": map[string]interface{}{
+							"type": "string",
+							"enum": []string{ImportCreate, ImportUpdate, ImportSkip, ImportConflict},
+						},
+						"current":  map[string]interface{}{"type": "integer", "description": "Absent for counters created"},
+						"imported": map[string]interface{}{"type": "integer"},
+						"config":   schemaRef("CounterConfig"),
+					},
+				},
+			},
+		},
+	},
+	"Spec": map[string]interface{}{
+		"type":     "object",
+		"required": []string{"environments"},
+		"properties": map[string]interface{}{
+			"environments": map[string]interface{}{
+				"type":        "object",
+				"description": "Counters keyed by environment and then name. Counters in these environments that aren't listed are deleted",
+				"additionalProperties": map[string]interface{}{
+					"type": "object",
+					"additionalProperties": map[string]interface{}{
+						"type": "object",
+						"properties": map[string]interface{}{
+							"start":     map[string]interface{}{"type": "integer", "minimum": 0, "description": "The value the counter is created at"},
+							"step":      map[string]interface{}{"type": "integer", "minimum": 1},
+							"min":       map[string]interface{}{"type": "integer", "minimum": 0},
+							"max":       map[string]interface{}{"type": "integer", "maximum": 9007199254740991},
+							"format":    map[string]interface{}{"type": "string", "description": "Renders IDs for display, e.g. `INV-%06d`"},
+							"monotonic": map[string]interface{}{"type": "boolean", "description": "Never set the counter lower"},
+						},
+					},
+				},
+			},
+		},
+	},
+	"CounterConfig": map[string]interface{}{
+		"type":     "object",
+		"required": []string{"start", "step", "min", "max", "monotonic"},
+		"properties": map[string]interface{}{
+			"start":     map[string]interface{}{"type": "integer"},
+			"step":      map[string]interface{}{"type": "integer"},
+			"min":       map[string]interface{}{"type": "integer"},
+			"max":       map[string]interface{}{"type": "integer"},
+			"format":    map[string]interface{}{"type": "string"},
+			"monotonic": map[string]interface{}{"type": "boolean"},
+		},
+	},
+	"Plan": map[string]interface{}{
+		"type":     "object",
+		"required": []string{"created", "updated", "deleted", "unchanged", "refused", "changes"},
+		"properties": map[string]interface{}{
+			"created":   map[string]interface{}{"type": "integer"},
+			"updated":   map[string]interface{}{"type": "integer"},
+			"deleted":   map[string]interface{}{"type": "integer"},
+			"unchanged": map[string]interface{}{"type": "integer"},
+			"refused":   map[string]interface{}{"type": "integer"},
+			"changes": map[string]interface{}{
+				"type": "array",
+				"items": map[string]interface{}{
+					"type":     "object",
+					"required": []string{"action", "environment", "name"},
+					"properties": map[string]interface{}{
+						"action": map[string]interface{}{
+							"type": "string",
+							"enum": []string{PlanCreate, PlanUpdate, PlanDelete},
+						},
+						"environment": map[string]interface{}{"type": "string"},
+						"name":        map[string]interface{}{"type": "string"},
+						"id":          map[string]interface{}{"type": "integer", "description": "Absent for counters created"},
+						"new_id":      map[string]interface{}{"type": "integer", "description": "Absent if the value doesn't change"},
+						"config":      schemaRef("CounterConfig"),
+						"new_config":  schemaRef("CounterConfig"),
+						"refused":     map[string]interface{}{"type": "string", "description": "Why applying the spec would fail"},
+					},
+				},
+			},
+		},
+	},
+	"ClusterStatus": map[string]interface{}{
+		"type":     "object",
+		"required": []string{"state", "term", "commit_index", "last_index"},
+		"properties": map[string]interface{}{
+			"id": map[string]interface{}{"type": "string", "description": "The URL other nodes reach this one at"},
+			"state": map[string]interface{}{
+				"type": "string",
+				"enum": []string{"standalone", raftFollower, raftCandidate, raftLeader},
+			},
+			"term":         map[string]interface{}{"type": "integer"},
+			"leader":       map[string]interface{}{"type": "string"},
+			"commit_index": map[string]interface{}{"type": "integer"},
+			"last_index":   map[string]interface{}{"type": "integer"},
+			"peers":        map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+		},
+	},
+	"ReplicationStatus": map[string]interface{}{
+		"type":     "object",
+		"required": []string{"role", "epoch", "sequence", "primary_sequence", "lag", "lag_seconds", "connected"},
+		"properties": map[string]interface{}{
+			"role": map[string]interface{}{
+				"type": "string",
+				"enum": []string{replicationPrimary, replicationReplica},
+			},
+			"primary":          map[string]interface{}{"type": "string"},
+			"epoch":            map[string]interface{}{"type": "string"},
+			"sequence":         map[string]interface{}{"type": "integer", "description": "The last entry of the primary's log applied"},
+			"primary_sequence": map[string]interface{}{"type": "integer"},
+			"lag":              map[string]interface{}{"type": "integer", "description": "Entries behind the primary when last in contact"},
+			"lag_seconds":      map[string]interface{}{"type": "number", "description": "How long the replica has been behind"},
+			"connected":        map[string]interface{}{"type": "boolean"},
+			"last_contact":     map[string]interface{}{"type": "string", "format": "date-time"},
+		},
+	},
+	"ReplicationSnapshot": map[string]interface{}{
+		"type":     "object",
+		"required": []string{"epoch", "sequence", "counters", "configs"},
+		"properties": map[string]interface{}{
+			"epoch":    map[string]interface{}{"type": "string"},
+			"sequence": map[string]interface{}{"type": "integer"},
+			"counters": schemaRef("IDMap"),
+			"configs":  map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "object"}},
+		},
+	},
+	"ReplicationBatch": map[string]interface{}{
+		"type":     "object",
+		"required": []string{"epoch", "sequence", "entries"},
+		"properties": map[string]interface{}{
+			"epoch":    map[string]interface{}{"type": "string"},
+			"sequence": map[string]interface{}{"type": "integer"},
+			"entries": map[string]interface{}{
+				"type": "array",
+				"items": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"sequence": map[string]interface{}{"type": "integer"},
+						"command":  map[string]interface{}{"type": "object"},
+					},
+				},
+			},
+		},
+	},
+	"VoteRequest": map[string]interface{}{
+		"type":     "object",
+		"required": []string{"term", "candidate", "last_log_index", "last_log_term"},
+		"properties": map[string]interface{}{
+			"term":           map[string]interface{}{"type": "integer"},
+			"candidate":      map[string]interface{}{"type": "string"},
+			"last_log_index": map[string]interface{}{"type": "integer"},
+			"last_log_term":  map[string]interface{}{"type": "integer"},
+		},
+	},
+	"VoteResponse": map[string]interface{}{
+		"type":     "object",
+		"required": []string{"term", "granted"},
+		"properties": map[string]interface{}{
+			"term":    map[string]interface{}{"type": "integer"},
+			"granted": map[string]interface{}{"type": "boolean"},
+		},
+	},
+	"AppendRequest": map[string]interface{}{
+		"type":     "object",
+		"required": []string{"term", "leader", "prev_log_index", "prev_log_term", "entries", "leader_commit"},
+		"properties": map[string]interface{}{
+			"term":           map[string]interface{}{"type": "integer"},
+			"leader":         map[string]interface{}{"type": "string"},
+			"prev_log_index": map[string]interface{}{"type": "integer"},
+			"prev_log_term":  map[string]interface{}{"type": "integer"},
+			"entries": map[string]interface{}{
+				"type": "array",
+				"items": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"term":    map[string]interface{}{"type": "integer"},
+						"command": map[string]interface{}{"type": "object"},
+					},
+				},
+			},
+			"leader_commit": map[string]interface{}{"type": "integer"},
+		},
+	},
+	"AppendResponse": map[string]interface{}{
+		"type":     "object",
+		"required": []string{"term", "success", "last_index"},
+		"properties": map[string]interface{}{
+			"term":       map[string]interface{}{"type": "integer"},
+			"success":    map[string]interface{}{"type": "boolean"},
+			"last_index": map[string]interface{}{"type": "integer"},
+		},
+	},
+	"SetterRequest": map[string]interface{}{
+		"type":     "object",
+		"required": []string{"environment", "name", "id"},
+		"properties": map[string]interface{}{
+			"environment": withMaxLength(identifierSchema, 64),
+			"name":        withMaxLength(identifierSchema, 128),
+			"id":          map[string]interface{}{"type": "integer", "minimum": 0, "maximum": 9007199254740991},
+		},
+	},
+	"Error": map[string]interface{}{
+		"type":     "object",
+		"required": []string{"code", "error"},
+		"properties": map[string]interface{}{
+			"code": map[string]interface{}{
+				"type": "string",
+				"enum": []string{CodeInvalidArgument, CodeNotFound, CodeNotAcceptable, CodeConflict, CodeDeadlineExceeded, CodeInternal, CodeUnavailable},
+			},
+			"error":      map[string]interface{}{"type": "string"},
+			"field":      map[string]interface{}{"type": "string"},
+			"request_id": map[string]interface{}{"type": "string"},
+			"details":    map[string]interface{}{"type": "array", "items": schemaRef("Error")},
+		},
+	},
+	"OpenAPI": map[string]interface{}{
+		"type":        "object",
+		"description": "An OpenAPI 3 document",
+	},
+	"Health": map[string]interface{}{
+		"type":     "object",
+		"required": []string{"status"},
+		"properties": map[string]interface{}{
+			"status":  map[string]interface{}{"type": "string", "enum": []string{healthOK, healthUnavailable}},
+			"reasons": map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}, "description": "Why the node isn't ready"},
+		},
+	},
+	"BuildInfo": map[string]interface{}{
+		"type":     "object",
+		"required": []string{"version", "go_version", "started", "flags"},
+		"properties": map[string]interface{}{
+			"version":    map[string]interface{}{"type": "string", "description": "The release, or `dev` for other builds"},
+			"commit":     map[string]interface{}{"type": "string"},
+			"go_version": map[string]interface{}{"type": "string"},
+			"started":    map[string]interface{}{"type": "string", "format": "date-time"},
+			"flags": map[string]interface{}{
+				"type":                 "object",
+				"additionalProperties": map[string]interface{}{"type": "string"},
+				"description":          "Every flag's value, with passwords in URLs, and flags for secrets, redacted",
+			},
+		},
+	},
+	"HTML":    map[string]interface{}{"type": "string"},
+	"Metrics": map[string]interface{}{"type": "string"},
+}
+
+func withMaxLength(schema map[string]interface{}, maxLength int) map[string]interface{} {
+	copied := map[string]interface{}{"maxLength": maxLength}
+	for key, value := range schema {
+		copied[key] = value
+	}
+	return copied
+}
+
+func schemaRef(name string) map[string]interface{} {
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+// specPath converts a gin route into an OpenAPI path template.
+func specPath(route string) string {
+	segments := strings.Split(route, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+			segments[i] = "{" + segment[1:] + "}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func (operation apiOperation) specPath() string {
+	if operation.Path != "" {
+		return operation.Path
+	}
+	return specPath(operation.Route)
+}
+
+func (operation apiOperation) spec() map[string]interface{} {
+	parameters := []interface{}{}
+	for _, segment := range strings.Split(operation.Route, "/") {
+		if strings.HasPrefix(segment, ":") {
+			parameters = append(parameters, map[string]interface{}{
+				"name": segment[1:], "in": "path", "required": true, "schema": identifierSchema,
+			})
+		}
+	}
+	queries := operation.Query
+	if len(operation.Formats) > 0 {
+		queries = append(queries[:len(queries):len(queries)], formatParameter)
+	}
+	for _, query := range queries {
+		parameters = append(parameters, map[string]interface{}{
+			"name": query.Name, "in": "query", "description": query.Description,
+			"schema": map[string]interface{}{"type": query.Type},
+		})
+	}
+	if operation.Method != "GET" {
+		parameters = append(parameters, map[string]interface{}{
+			"name": idempotencyKeyHeader, "in": "header",
+			"description": "Replay the response to an earlier request with the same key, rather than running it again. Reusing a key with a different body is refused with a 409",
+			"schema":      map[string]interface{}{"type": "string"},
+		})
+	}
+
+	contentType := operation.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	content := map[string]interface{}{
+		contentType: map[string]interface{}{"schema": schemaRef(operation.Response)},
+	}
+	for _, format := range operation.Formats {
+		if format == mimeYAML {
+			content[format] = map[string]interface{}{"schema": schemaRef(operation.Response)}
+		} else {
+			content[format] = map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}
+		}
+	}
+	responses := map[string]interface{}{
+		"200": map[string]interface{}{"description": "OK", "content": content},
+	}
+	for _, status := range operation.Errors {
+		responses[strconv.Itoa(status)] = map[string]interface{}{
+			"description": http.StatusText(status),
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": schemaRef("Error")},
+			},
+		}
+	}
+
+	spec := map[string]interface{}{
+		"operationId": operation.ID,
+		"tags":        []string{operation.Tag},
+		"summary":     operation.Summary,
+		"parameters":  parameters,
+		"responses":   responses,
+	}
+	if operation.Body != "" {
+		spec["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{
+				"application/json":                  map[string]interface{}{"schema": schemaRef(operation.Body)},
+				"application/x-www-form-urlencoded": map[string]interface{}{"schema": schemaRef(operation.Body)},
+			},
+		}
+	}
+	return spec
+}
+
+// openAPISpec builds the OpenAPI 3 document for every operation in apiOperations.
+func openAPISpec() map[string]interface{} {
+	paths := map[string]map[string]interface{}{}
+	for _, operation := range apiOperations {
+		path := operation.specPath()
+		if _, ok := paths[path]; !ok {
+			paths[path] = map[string]interface{}{}
+		}
+		paths[path][strings.ToLower(operation.Method)] = operation.spec()
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.0",
+		"info": map[string]interface{}{
+			"title":       "ID Incrementer",
+			"description": "Tracks, increments, and returns IDs by name and environment.",
+			"version":     "2",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": apiSchemas,
+		},
+	}
+}
+
+func setupDocsRoutes(router gin.IRoutes) {
+	router.GET("/openapi.json", func(context *gin.Context) {
+		context.JSON(http.StatusOK, openAPISpec())
+	})
+
+	router.GET("/docs", func(context *gin.Context) {
+		context.Data(http.StatusOK, "text/html; charset=utf-8", []byte(docsPage))
+	})
+}
+
+// docsPage renders /openapi.json without loading anything from the network.
+const docsPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>ID Incrementer API</title>
+<style>
+body { font-family: sans-serif; margin: 2em auto; max-width: 60em; color: #222; }
+.operation { border: 1px solid #ccc; border-radius: 4px; margin: 1em 0; padding: 0.5em 1em; }
+.method { display: inline-block; width: 5em; font-weight: bold; }
+.GET { color: #2a7; } .POST { color: #27a; } .PUT { color: #a72; } .DELETE { color: #a22; }
+code, pre, textarea { font-family: monospace; }
+pre { background: #f4f4f4; padding: 0.5em; overflow: auto; }
+label { display: block; margin: 0.3em 0; }
+textarea { width: 100%; height: 5em; }
+</style>
+</head>
+<body>
+<h1>ID Incrementer API</h1>
+<p>Generated from <a href="/openapi.json">/openapi.json</a>.</p>
+<div id="operations"></div>
+<script>
+function element(tag, text, className) {
+  var node = document.createElement(tag);
+  if (text) { node.textContent = text; }
+  if (className) { node.className = className; }
+  return node;
+}
+
+function resolve(spec, schema) {
+  if (schema && schema.$ref) {
+    return spec.components.schemas[schema.$ref.split("/").pop()];
+  }
+  return schema;
+}
+
+function renderOperation(spec, path, method, operation) {
+  var container = element("div", null, "operation");
+  var title = element("h3");
+  title.appendChild(element("span", method.toUpperCase(), "method " + method.toUpperCase()));
+  title.appendChild(element("code", path));
+  container.appendChild(title);
+  container.appendChild(element("p", operation.summary));
+
+  var inputs = {};
+  (operation.parameters || []).forEach(function (parameter) {
+    var label = element("label", parameter.name + " (" + parameter.in + ") ");
+    var input = element("input");
+    inputs[parameter.name] = { input: input, location: parameter.in };
+    label.appendChild(input);
+    container.appendChild(label);
+  });
+
+  var body = null;
+  if (operation.requestBody) {
+    var schema = resolve(spec, operation.requestBody.content["application/json"].schema);
+    container.appendChild(element("p", "Request body"));
+    container.appendChild(element("pre", JSON.stringify(schema, null, 2)));
+    body = element("textarea");
+    body.value = "{}";
+    container.appendChild(body);
+  }
+
+  container.appendChild(element("p", "Responses"));
+  Object.keys(operation.responses).forEach(function (status) {
+    var response = operation.responses[status];
+    var types = Object.keys(response.content || {});
+    var schema = types.length ? resolve(spec, response.content[types[0]].schema) : null;
+    container.appendChild(element("div", status + " " + response.description));
+    if (schema) { container.appendChild(element("pre", JSON.stringify(schema, null, 2))); }
+  });
+
+  var button = element("button", "Try it");
+  var output = element("pre");
+  button.onclick = function () {
+    var url = path;
+    var query = [];
+    Object.keys(inputs).forEach(function (name) {
+      var value = inputs[name].input.value;
+      if (inputs[name].location === "path") {
+        url = url.replace("{" + name + "}", encodeURIComponent(value));
+      } else if (value !== "") {
+        query.push(encodeURIComponent(name) + "=" + encodeURIComponent(value));
+      }
+    });
+    if (query.length) { url += "?" + query.join("&"); }
+    var options = { method: method.toUpperCase() };
+    if (body) {
+      options.body = body.value;
+      options.headers = { "Content-Type": "application/json" };
+    }
+    fetch(url, options).then(function (response) {
+      return response.text().then(function (text) {
+        output.textContent = response.status + " " + response.statusText + "\n" + text;
+      });
+    });
+  };
+  container.appendChild(button);
+  container.appendChild(output);
+  return container;
+}
+
+fetch("/openapi.json").then(function (response) { return response.json(); }).then(function (spec) {
+  var operations = document.getElementById("operations");
+  Object.keys(spec.paths).sort().forEach(function (path) {
+    Object.keys(spec.paths[path]).forEach(function (method) {
+      operations.appendChild(renderOperation(spec, path, method, spec.paths[path][method]));
+    });
+  });
+});
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOpenAPICoversRoutes(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	testRouter := ids.SetupRouter()
+	documented := map[string]bool{}
+	for _, operation := range apiOperations {
+		documented[operation.Method+" "+operation.Route] = true
+	}
+
+	// test that every registered route is documented
+	registered := map[string]bool{}
+	for _, route := range testRouter.Routes() {
+		key := route.Method + " " + route.Path
+		registered[key] = true
+		if !documented[key] {
+			t.Errorf("Route `%s` has no entry in apiOperations", key)
+		}
+	}
+
+	// test that every documented route is registered
+	for key := range documented {
+		if !registered[key] {
+			t.Errorf("apiOperations documents `%s`, which isn't registered", key)
+		}
+	}
+}
+
+func TestOpenAPIEndpoint(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	testRouter := ids.SetupRouter()
+	request, err := http.NewRequest("GET", "/openapi.json", nil)
+	if err != nil {
+		t.Error(err)
+	}
+	response := httptest.NewRecorder()
+	testRouter.ServeHTTP(response, request)
+
+	// test for 200 response code
+	if response.Code != 200 {
+		t.Error("Expected status code 200, got ", response.Code)
+	}
+
+	// test for a document with every path and resolvable schema references
+	var spec struct {
+		OpenAPI    string
+		Paths      map[string]map[string]json.RawMessage
+		Components struct {
+			Schemas map[string]json.RawMessage
+		}
+	}
+	err = json.Unmarshal(response.Body.Bytes(), &spec)
+	if err != nil {
+		t.Errorf("Unable to unmarshal `%s`", response.Body)
+	}
+	if !strings.HasPrefix(spec.OpenAPI, "3.") {
+		t.Errorf("Expected an OpenAPI 3 document, got `%s`", spec.OpenAPI)
+	}
+	for _, operation := range apiOperations {
+		if _, ok := spec.Paths[operation.specPath()][strings.ToLower(operation.Method)]; !ok {
+			t.Errorf("Expected %s %s in the document", operation.Method, operation.specPath())
+		}
+	}
+	for _, reference := range strings.Split(response.Body.String(), `"$ref":"#/components/schemas/`)[1:] {
+		name := reference[:strings.Index(reference, `"`)]
+		if _, ok := spec.Components.Schemas[name]; !ok {
+			t.Errorf("Expected schema `%s` to be defined", name)
+		}
+	}
+	if _, ok := spec.Paths["/v2/environments/{environment}/counters/{name}:next"]["post"]; !ok {
+		t.Error("Expected the increment to be documented on `{name}:next`")
+	}
+}
+
+func TestDocsEndpoint(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	testRouter := ids.SetupRouter()
+	request, err := http.NewRequest("GET", "/docs", nil)
+	if err != nil {
+		t.Error(err)
+	}
+	response := httptest.NewRecorder()
+	testRouter.ServeHTTP(response, request)
+
+	// test for an HTML page that loads the document from this server
+	if response.Code != 200 {
+		t.Error("Expected status code 200, got ", response.Code)
+	}
+	if !strings.HasPrefix(response.Header().Get("Content-Type"), "text/html") {
+		t.Error("Expected HTML, got ", response.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(response.Body.String(), `fetch("/openapi.json")`) {
+		t.Error("Expected the page to load /openapi.json")
+	}
+}
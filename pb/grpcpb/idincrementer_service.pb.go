@@ -0,0 +1,341 @@
+// Code generated by protoc-gen-go.
+// source: idincrementer_service.proto
+// DO NOT EDIT!
+
+/*
+Package grpcpb is a generated protocol buffer package.
+
+It is generated from these files:
+
+	idincrementer_service.proto
+
+It has these top-level messages:
+*/
+package grpcpb
+
+import proto "github.com/golang/protobuf/proto"
+import fmt "fmt"
+import math "math"
+import idincrementer "github.com/snarlysodboxer/id-incrementer/pb"
+
+import (
+	context "golang.org/x/net/context"
+	grpc "google.golang.org/grpc"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion3
+
+// Client API for IDIncrementer service
+
+type IDIncrementerClient interface {
+	// Next increments a counter, creating it if needed, and returns it.
+	Next(ctx context.Context, in *idincrementer.CounterKey, opts ...grpc.CallOption) (*idincrementer.Counter, error)
+	// Reserve increments a counter by a block of IDs, and returns the block.
+	Reserve(ctx context.Context, in *idincrementer.ReserveRequest, opts ...grpc.CallOption) (*idincrementer.Range, error)
+	// Peek returns a counter without incrementing it.
+	Peek(ctx context.Context, in *idincrementer.CounterKey, opts ...grpc.CallOption) (*idincrementer.Counter, error)
+	// Set sets a counter, creating it if needed.
+	Set(ctx context.Context, in *idincrementer.SetRequest, opts ...grpc.CallOption) (*idincrementer.Counter, error)
+	// Delete deletes a counter and returns its last id.
+	Delete(ctx context.Context, in *idincrementer.CounterKey, opts ...grpc.CallOption) (*idincrementer.Counter, error)
+	// List returns one page of counters.
+	List(ctx context.Context, in *idincrementer.ListRequest, opts ...grpc.CallOption) (*idincrementer.CounterList, error)
+	// Watch waits until a counter is above a value, then returns it. It fails
+	// with DEADLINE_EXCEEDED at the call's deadline.
+	Watch(ctx context.Context, in *idincrementer.WatchRequest, opts ...grpc.CallOption) (*idincrementer.Counter, error)
+}
+
+type iDIncrementerClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewIDIncrementerClient(cc *grpc.ClientConn) IDIncrementerClient {
+	return &iDIncrementerClient{cc}
+}
+
+func (c *iDIncrementerClient) Next(ctx context.Context, in *idincrementer.CounterKey, opts ...grpc.CallOption) (*idincrementer.Counter, error) {
+	out := new(idincrementer.Counter)
+	err := grpc.Invoke(ctx, "/idincrementer.IDIncrementer/Next", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *iDIncrementerClient) Reserve(ctx context.Context, in *idincrementer.ReserveRequest, opts ...grpc.CallOption) (*idincrementer.Range, error) {
+	out := new(idincrementer.Range)
+	err := grpc.Invoke(ctx, "/idincrementer.IDIncrementer/Reserve", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *iDIncrementerClient) Peek(ctx context.Context, in *idincrementer.CounterKey, opts ...grpc.CallOption) (*idincrementer.Counter, error) {
+	out := new(idincrementer.Counter)
+	err := grpc.Invoke(ctx, "/idincrementer.IDIncrementer/Peek", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *iDIncrementerClient) Set(ctx context.Context, in *idincrementer.SetRequest, opts ...grpc.CallOption) (*idincrementer.Counter, error) {
+	out := new(idincrementer.Counter)
+	err := grpc.Invoke(ctx, "/idincrementer.IDIncrementer/Set", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *iDIncrementerClient) Delete(ctx context.Context, in *idincrementer.CounterKey, opts ...grpc.CallOption) (*idincrementer.Counter, error) {
+	out := new(idincrementer.Counter)
+	err := grpc.Invoke(ctx, "/idincrementer.IDIncrementer/Delete", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *iDIncrementerClient) List(ctx context.Context, in *idincrementer.ListRequest, opts ...grpc.CallOption) (*idincrementer.CounterList, error) {
+	out := new(idincrementer.CounterList)
+	err := grpc.Invoke(ctx, "/idincrementer.IDIncrementer/List", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *iDIncrementerClient) Watch(ctx context.Context, in *idincrementer.WatchRequest, opts ...grpc.CallOption) (*idincrementer.Counter, error) {
+	out := new(idincrementer.Counter)
+	err := grpc.Invoke(ctx, "/idincrementer.IDIncrementer/Watch", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Server API for IDIncrementer service
+
+type IDIncrementerServer interface {
+	// Next increments a counter, creating it if needed, and returns it.
+	Next(context.Context, *idincrementer.CounterKey) (*idincrementer.Counter, error)
+	// Reserve increments a counter by a block of IDs, and returns the block.
+	Reserve(context.Context, *idincrementer.ReserveRequest) (*idincrementer.Range, error)
+	// Peek returns a counter without incrementing it.
+	Peek(context.Context, *idincrementer.CounterKey) (*idincrementer.Counter, error)
+	// Set sets a counter, creating it if needed.
+	Set(context.Context, *idincrementer.SetRequest) (*idincrementer.Counter, error)
+	// Delete deletes a counter and returns its last id.
+	Delete(context.Context, *idincrementer.CounterKey) (*idincrementer.Counter, error)
+	// List returns one page of counters.
+	List(context.Context, *idincrementer.ListRequest) (*idincrementer.CounterList, error)
+	// Watch waits until a counter is above a value, then returns it. It fails
+	// with DEADLINE_EXCEEDED at the call's deadline.
+	Watch(context.Context, *idincrementer.WatchRequest) (*idincrementer.Counter, error)
+}
+
+func RegisterIDIncrementerServer(s *grpc.Server, srv IDIncrementerServer) {
+	s.RegisterService(&_IDIncrementer_serviceDesc, srv)
+}
+
+func _IDIncrementer_Next_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(idincrementer.CounterKey)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IDIncrementerServer).Next(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/idincrementer.IDIncrementer/Next",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IDIncrementerServer).Next(ctx, req.(*idincrementer.CounterKey))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _IDIncrementer_Reserve_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(idincrementer.ReserveRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IDIncrementerServer).Reserve(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/idincrementer.IDIncrementer/Reserve",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IDIncrementerServer).Reserve(ctx, req.(*idincrementer.ReserveRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _IDIncrementer_Peek_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(idincrementer.CounterKey)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IDIncrementerServer).Peek(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/idincrementer.IDIncrementer/Peek",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IDIncrementerServer).Peek(ctx, req.(*idincrementer.CounterKey))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _IDIncrementer_Set_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(idincrementer.SetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IDIncrementerServer).Set(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/idincrementer.IDIncrementer/Set",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IDIncrementerServer).Set(ctx, req.(*idincrementer.SetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _IDIncrementer_Delete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(idincrementer.CounterKey)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IDIncrementerServer).Delete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/idincrementer.IDIncrementer/Delete",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IDIncrementerServer).Delete(ctx, req.(*idincrementer.CounterKey))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _IDIncrementer_List_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(idincrementer.ListRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IDIncrementerServer).List(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/idincrementer.IDIncrementer/List",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IDIncrementerServer).List(ctx, req.(*idincrementer.ListRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _IDIncrementer_Watch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(idincrementer.WatchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IDIncrementerServer).Watch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/idincrementer.IDIncrementer/Watch",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IDIncrementerServer).Watch(ctx, req.(*idincrementer.WatchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _IDIncrementer_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "idincrementer.IDIncrementer",
+	HandlerType: (*IDIncrementerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Next",
+			Handler:    _IDIncrementer_Next_Handler,
+		},
+		{
+			MethodName: "Reserve",
+			Handler:    _IDIncrementer_Reserve_Handler,
+		},
+		{
+			MethodName: "Peek",
+			Handler:    _IDIncrementer_Peek_Handler,
+		},
+		{
+			MethodName: "Set",
+			Handler:    _IDIncrementer_Set_Handler,
+		},
+		{
+			MethodName: "Delete",
+			Handler:    _IDIncrementer_Delete_Handler,
+		},
+		{
+			MethodName: "List",
+			Handler:    _IDIncrementer_List_Handler,
+		},
+		{
+			MethodName: "Watch",
+			Handler:    _IDIncrementer_Watch_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: fileDescriptor0,
+}
+
+func init() { proto.RegisterFile("idincrementer_service.proto", fileDescriptor0) }
+
+var fileDescriptor0 = []byte{
+	// 217 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0x92, 0xce, 0x4c, 0xc9, 0xcc,
+	0x4b, 0x2e, 0x4a, 0xcd, 0x4d, 0xcd, 0x2b, 0x49, 0x2d, 0x8a, 0x2f, 0x4e, 0x2d, 0x2a, 0xcb, 0x4c,
+	0x4e, 0xd5, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0xe2, 0x45, 0x91, 0x94, 0x12, 0x46, 0xe1, 0x42,
+	0xd4, 0x18, 0x9d, 0x60, 0xe6, 0xe2, 0xf5, 0x74, 0xf1, 0x44, 0x88, 0x0b, 0x59, 0x73, 0xb1, 0xf8,
+	0xa5, 0x56, 0x94, 0x08, 0x49, 0xea, 0xa1, 0xaa, 0x77, 0xce, 0x2f, 0x05, 0xd1, 0xde, 0xa9, 0x95,
+	0x52, 0x62, 0xd8, 0xa5, 0x94, 0x18, 0x84, 0x1c, 0xb8, 0xd8, 0x83, 0x52, 0x41, 0xae, 0x48, 0x15,
+	0x92, 0x45, 0x53, 0x04, 0x15, 0x0f, 0x4a, 0x2d, 0x2c, 0x4d, 0x2d, 0x2e, 0x91, 0x12, 0x41, 0x97,
+	0x4e, 0xcc, 0x4b, 0x4f, 0x55, 0x62, 0x00, 0x59, 0x1f, 0x90, 0x9a, 0x9a, 0x4d, 0x9e, 0xf5, 0x56,
+	0x5c, 0xcc, 0xc1, 0xa9, 0x98, 0x4e, 0x0f, 0x4e, 0x2d, 0x81, 0x59, 0x8b, 0x5b, 0xaf, 0x2d, 0x17,
+	0x9b, 0x4b, 0x6a, 0x4e, 0x6a, 0x49, 0x2a, 0xb9, 0x3e, 0x67, 0xf1, 0xc9, 0x2c, 0x2e, 0x11, 0x92,
+	0x42, 0x53, 0x01, 0x12, 0x84, 0x59, 0x2e, 0x85, 0x5d, 0x37, 0x48, 0x89, 0x12, 0x83, 0x90, 0x1d,
+	0x17, 0x6b, 0x78, 0x62, 0x49, 0x72, 0x86, 0x90, 0x34, 0x9a, 0x32, 0xb0, 0x28, 0x41, 0x0f, 0x38,
+	0x71, 0x44, 0xb1, 0xa5, 0x17, 0x15, 0x24, 0x17, 0x24, 0x25, 0xb1, 0x81, 0xe3, 0xd6, 0x18, 0x30,
+	0x00, 0x94, 0xd9, 0xc8, 0xa9, 0x1e, 0x02, 0x00, 0x00,
+}
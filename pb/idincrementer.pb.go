@@ -0,0 +1,179 @@
+// Code generated by protoc-gen-go.
+// source: idincrementer.proto
+// DO NOT EDIT!
+
+/*
+Package pb is a generated protocol buffer package.
+
+It is generated from these files:
+
+	idincrementer.proto
+
+It has these top-level messages:
+
+	CounterKey
+	Counter
+	SetRequest
+	ReserveRequest
+	Range
+	ListRequest
+	CounterList
+	WatchRequest
+*/
+package pb
+
+import proto "github.com/golang/protobuf/proto"
+import fmt "fmt"
+import math "math"
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
+
+type CounterKey struct {
+	Environment string `protobuf:"bytes,1,opt,name=environment" json:"environment,omitempty"`
+	Name        string `protobuf:"bytes,2,opt,name=name" json:"name,omitempty"`
+}
+
+func (m *CounterKey) Reset()                    { *m = CounterKey{} }
+func (m *CounterKey) String() string            { return proto.CompactTextString(m) }
+func (*CounterKey) ProtoMessage()               {}
+func (*CounterKey) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{0} }
+
+type Counter struct {
+	Environment string `protobuf:"bytes,1,opt,name=environment" json:"environment,omitempty"`
+	Name        string `protobuf:"bytes,2,opt,name=name" json:"name,omitempty"`
+	Id          int64  `protobuf:"varint,3,opt,name=id" json:"id,omitempty"`
+}
+
+func (m *Counter) Reset()                    { *m = Counter{} }
+func (m *Counter) String() string            { return proto.CompactTextString(m) }
+func (*Counter) ProtoMessage()               {}
+func (*Counter) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{1} }
+
+type SetRequest struct {
+	Environment string `protobuf:"bytes,1,opt,name=environment" json:"environment,omitempty"`
+	Name        string `protobuf:"bytes,2,opt,name=name" json:"name,omitempty"`
+	Id          int64  `protobuf:"varint,3,opt,name=id" json:"id,omitempty"`
+}
+
+func (m *SetRequest) Reset()                    { *m = SetRequest{} }
+func (m *SetRequest) String() string            { return proto.CompactTextString(m) }
+func (*SetRequest) ProtoMessage()               {}
+func (*SetRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{2} }
+
+type ReserveRequest struct {
+	Environment string `protobuf:"bytes,1,opt,name=environment" json:"environment,omitempty"`
+	Name        string `protobuf:"bytes,2,opt,name=name" json:"name,omitempty"`
+	// Number of IDs to reserve, from 1 to 10000.
+	Count int64 `protobuf:"varint,3,opt,name=count" json:"count,omitempty"`
+}
+
+func (m *ReserveRequest) Reset()                    { *m = ReserveRequest{} }
+func (m *ReserveRequest) String() string            { return proto.CompactTextString(m) }
+func (*ReserveRequest) ProtoMessage()               {}
+func (*ReserveRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
+
+// Range is a block of IDs from first to last, in steps of step.
+type Range struct {
+	Environment string `protobuf:"bytes,1,opt,name=environment" json:"environment,omitempty"`
+	Name        string `protobuf:"bytes,2,opt,name=name" json:"name,omitempty"`
+	First       int64  `protobuf:"varint,3,opt,name=first" json:"first,omitempty"`
+	Last        int64  `protobuf:"varint,4,opt,name=last" json:"last,omitempty"`
+	Step        int64  `protobuf:"varint,5,opt,name=step" json:"step,omitempty"`
+}
+
+func (m *Range) Reset()                    { *m = Range{} }
+func (m *Range) String() string            { return proto.CompactTextString(m) }
+func (*Range) ProtoMessage()               {}
+func (*Range) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{4} }
+
+type ListRequest struct {
+	Environment string `protobuf:"bytes,1,opt,name=environment" json:"environment,omitempty"`
+	// Glob matched against names, e.g. `records_*`.
+	Name   string `protobuf:"bytes,2,opt,name=name" json:"name,omitempty"`
+	Prefix string `protobuf:"bytes,3,opt,name=prefix" json:"prefix,omitempty"`
+	// One of `name` (the default), `-name`, `id` or `-id`.
+	Sort   string `protobuf:"bytes,4,opt,name=sort" json:"sort,omitempty"`
+	Limit  int32  `protobuf:"varint,5,opt,name=limit" json:"limit,omitempty"`
+	Cursor string `protobuf:"bytes,6,opt,name=cursor" json:"cursor,omitempty"`
+}
+
+func (m *ListRequest) Reset()                    { *m = ListRequest{} }
+func (m *ListRequest) String() string            { return proto.CompactTextString(m) }
+func (*ListRequest) ProtoMessage()               {}
+func (*ListRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{5} }
+
+type CounterList struct {
+	Counters []*Counter `protobuf:"bytes,1,rep,name=counters" json:"counters,omitempty"`
+	// Empty on the last page.
+	NextCursor string `protobuf:"bytes,2,opt,name=next_cursor,json=nextCursor" json:"next_cursor,omitempty"`
+}
+
+func (m *CounterList) Reset()                    { *m = CounterList{} }
+func (m *CounterList) String() string            { return proto.CompactTextString(m) }
+func (*CounterList) ProtoMessage()               {}
+func (*CounterList) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{6} }
+
+func (m *CounterList) GetCounters() []*Counter {
+	if m != nil {
+		return m.Counters
+	}
+	return nil
+}
+
+type WatchRequest struct {
+	Environment string `protobuf:"bytes,1,opt,name=environment" json:"environment,omitempty"`
+	Name        string `protobuf:"bytes,2,opt,name=name" json:"name,omitempty"`
+	After       int64  `protobuf:"varint,3,opt,name=after" json:"after,omitempty"`
+}
+
+func (m *WatchRequest) Reset()                    { *m = WatchRequest{} }
+func (m *WatchRequest) String() string            { return proto.CompactTextString(m) }
+func (*WatchRequest) ProtoMessage()               {}
+func (*WatchRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{7} }
+
+func init() {
+	proto.RegisterType((*CounterKey)(nil), "idincrementer.CounterKey")
+	proto.RegisterType((*Counter)(nil), "idincrementer.Counter")
+	proto.RegisterType((*SetRequest)(nil), "idincrementer.SetRequest")
+	proto.RegisterType((*ReserveRequest)(nil), "idincrementer.ReserveRequest")
+	proto.RegisterType((*Range)(nil), "idincrementer.Range")
+	proto.RegisterType((*ListRequest)(nil), "idincrementer.ListRequest")
+	proto.RegisterType((*CounterList)(nil), "idincrementer.CounterList")
+	proto.RegisterType((*WatchRequest)(nil), "idincrementer.WatchRequest")
+}
+
+func init() { proto.RegisterFile("idincrementer.proto", fileDescriptor0) }
+
+var fileDescriptor0 = []byte{
+	// 322 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xac, 0x93, 0xbf, 0x4e, 0xf3, 0x30,
+	0x14, 0xc5, 0x95, 0xb4, 0xe9, 0xf7, 0xf5, 0x06, 0x3a, 0x18, 0x54, 0x79, 0x23, 0xf2, 0xd4, 0xa9,
+	0x43, 0x79, 0x83, 0x76, 0x04, 0x09, 0xc9, 0x0c, 0x48, 0x15, 0x12, 0x4a, 0xd3, 0x1b, 0xb0, 0xd4,
+	0xd8, 0xc1, 0x76, 0xaa, 0x22, 0x9e, 0x85, 0x77, 0x45, 0xfe, 0x43, 0x45, 0xd7, 0x86, 0xed, 0x9c,
+	0xe3, 0xab, 0x9f, 0x4f, 0x62, 0x1b, 0xae, 0xc4, 0x56, 0xc8, 0x4a, 0x63, 0x83, 0xd2, 0xa2, 0x9e,
+	0xb7, 0x5a, 0x59, 0x45, 0x2e, 0x4f, 0x42, 0xb6, 0x04, 0x58, 0xa9, 0xce, 0xc9, 0x3b, 0xfc, 0x20,
+	0x05, 0xe4, 0x28, 0xf7, 0x42, 0x2b, 0xe9, 0x96, 0x69, 0x52, 0x24, 0xb3, 0x31, 0xff, 0x1d, 0x11,
+	0x02, 0x43, 0x59, 0x36, 0x48, 0x53, 0xbf, 0xe4, 0x35, 0x7b, 0x80, 0x7f, 0x91, 0x71, 0x1e, 0x80,
+	0x4c, 0x20, 0x15, 0x5b, 0x3a, 0x28, 0x92, 0xd9, 0x80, 0xa7, 0x62, 0xcb, 0x38, 0xc0, 0x23, 0x5a,
+	0x8e, 0xef, 0x1d, 0x1a, 0xfb, 0x47, 0xcc, 0x67, 0x98, 0x70, 0x34, 0xa8, 0xf7, 0xd8, 0x8f, 0x7b,
+	0x0d, 0x59, 0xe5, 0x3e, 0x36, 0xa2, 0x83, 0x61, 0x9f, 0x90, 0xf1, 0x52, 0xbe, 0xe2, 0xf9, 0xd0,
+	0x5a, 0x68, 0x73, 0x84, 0x7a, 0xe3, 0x26, 0x77, 0xa5, 0xb1, 0x74, 0xe8, 0x43, 0xaf, 0x5d, 0x66,
+	0x2c, 0xb6, 0x34, 0x0b, 0x99, 0xd3, 0xec, 0x2b, 0x81, 0xfc, 0x5e, 0x98, 0x9e, 0x3f, 0x6c, 0x0a,
+	0xa3, 0x56, 0x63, 0x2d, 0x0e, 0xbe, 0xc4, 0x98, 0x47, 0xe7, 0x77, 0x54, 0x3a, 0xb4, 0x18, 0x73,
+	0xaf, 0x5d, 0xdf, 0x9d, 0x68, 0x84, 0xf5, 0x35, 0x32, 0x1e, 0x8c, 0x23, 0x54, 0x9d, 0x36, 0x4a,
+	0xd3, 0x51, 0x20, 0x04, 0xc7, 0x36, 0x90, 0xc7, 0xfb, 0xe1, 0x5a, 0x92, 0x05, 0xfc, 0xaf, 0x82,
+	0x35, 0x34, 0x29, 0x06, 0xb3, 0x7c, 0x31, 0x9d, 0x9f, 0xde, 0xd4, 0x38, 0xcd, 0x8f, 0x73, 0xe4,
+	0x06, 0x72, 0x89, 0x07, 0xfb, 0x12, 0xf9, 0xa1, 0x37, 0xb8, 0x68, 0x15, 0xf6, 0x58, 0xc3, 0xc5,
+	0x53, 0x69, 0xab, 0xb7, 0xde, 0x87, 0x5b, 0xd6, 0x16, 0xf5, 0xcf, 0x39, 0x78, 0xb3, 0x1c, 0xae,
+	0xd3, 0x76, 0xb3, 0x19, 0xf9, 0xf7, 0x73, 0xfb, 0x3d, 0x00, 0x7c, 0x7b, 0x43, 0xea, 0x56, 0x03,
+	0x00, 0x00,
+}
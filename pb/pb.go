@@ -0,0 +1,7 @@
+// Package pb holds the protocol buffer messages generated from
+// idincrementer.proto. The gRPC service, which needs google.golang.org/grpc,
+// is generated into package grpcpb, imported only by builds with `-tags grpc`.
+package pb
+
+//go:generate protoc --go_out=. idincrementer.proto
+//go:generate protoc --go_out=plugins=grpc,Midincrementer.proto=github.com/snarlysodboxer/id-incrementer/pb:grpcpb idincrementer_service.proto
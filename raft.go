@@ -0,0 +1,601 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Roles of a raftNode.
+const (
+	raftFollower  = "follower"
+	raftCandidate = "candidate"
+	raftLeader    = "leader"
+)
+
+// Most entries sent to a follower in one append request.
+const maxAppendEntries = 500
+
+// raftEntry is one command in the replicated log, tagged with the term of the
+// leader that appended it.
+type raftEntry struct {
+	Term    uint64      `json:"term"`
+	Command raftCommand `json:"command"`
+}
+
+type voteRequest struct {
+	Term         uint64 `json:"term"`
+	Candidate    string `json:"candidate"`
+	LastLogIndex uint64 `json:"last_log_index"`
+	LastLogTerm  uint64 `json:"last_log_term"`
+}
+
+type voteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+type appendRequest struct {
+	Term         uint64      `json:"term"`
+	Leader       string      `json:"leader"`
+	PrevLogIndex uint64      `json:"prev_log_index"`
+	PrevLogTerm  uint64      `json:"prev_log_term"`
+	Entries      []raftEntry `json:"entries"`
+	LeaderCommit uint64      `json:"leader_commit"`
+}
+
+type appendResponse struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+	// LastIndex is the follower's last entry, so the leader can skip back
+	// past a gap at once rather than one entry per request.
+	LastIndex uint64 `json:"last_index"`
+}
+
+// raftNode replicates commands to its peers with the Raft consensus
+// algorithm, over HTTP. Nodes are identified by the URL their peers reach
+// them at.
+//
+// Only the leader accepts commands. Each is proposed under the store's lock,
+// so that the next command is computed from the state it leaves, and applied
+// by whoever proposed it once a majority hold it, so the state machine never
+// reflects an entry that isn't committed. Every other entry is applied by
+// the applier, in order, once committed. A new leader applies its whole log,
+// which Raft guarantees holds every committed entry, before accepting
+// commands. That way no ID handed out is ever handed out again.
+//
+// The term, vote and log are synced to storage before the node answers a
+// vote or an append, or proposes an entry, and reloaded when it restarts, so
+// a node never forgets a vote or an entry it acknowledged. The state machine
+// isn't stored: it's rebuilt from the log once the node learns what's
+// committed.
+type raftNode struct {
+	id    string
+	peers []string
+	// store is held while applying entries, as it is while proposing them.
+	store           sync.Locker
+	apply           func(command raftCommand)
+	storage         *raftStorage
+	client          *http.Client
+	heartbeat       time.Duration
+	electionTimeout time.Duration
+
+	mutex sync.Mutex
+	// changed is broadcast whenever the role, leader or commit index changes.
+	changed  *sync.Cond
+	state    string
+	term     uint64
+	votedFor string
+	leader   string
+	// log[0] is a placeholder, so that indexes start at 1 as in the paper.
+	log         []raftEntry
+	commitIndex uint64
+	// applied is the last entry reflected in the state machine, besides
+	// those in selfApplied, which their proposers applied.
+	applied     uint64
+	selfApplied map[uint64]bool
+	// ready is set once a new leader has applied its whole log, up to
+	// readyIndex, the entry it appended on being elected.
+	ready      bool
+	readyIndex uint64
+	// saved is the state last synced to storage, and savedIndex the last
+	// entry, or 0 if the stored log must be rewritten.
+	saved      raftState
+	savedIndex uint64
+	rewrite    bool
+	deadline   time.Time
+	nextIndex  map[string]uint64
+	matchIndex map[string]uint64
+	sending    map[string]bool
+	done       chan struct{}
+	wake       chan struct{}
+	replicate  chan struct{}
+}
+
+// newRaftNode returns a node resuming from what storage holds, or from
+// scratch if it's nil.
+func newRaftNode(id string, peers []string, store sync.Locker, apply func(command raftCommand), storage *raftStorage, state raftState, entries []raftEntry) *raftNode {
+	node := &raftNode{
+		id:              id,
+		peers:           peers,
+		store:           store,
+		apply:           apply,
+		storage:         storage,
+		client:          &http.Client{Timeout: time.Second},
+		heartbeat:       50 * time.Millisecond,
+		electionTimeout: 300 * time.Millisecond,
+		state:           raftFollower,
+		term:            state.Term,
+		votedFor:        state.VotedFor,
+		log:             append([]raftEntry{{}}, entries...),
+		selfApplied:     map[uint64]bool{},
+		saved:           state,
+		savedIndex:      uint64(len(entries)),
+		nextIndex:       map[string]uint64{},
+		matchIndex:      map[string]uint64{},
+		sending:         map[string]bool{},
+		done:            make(chan struct{}),
+		wake:            make(chan struct{}, 1),
+		replicate:       make(chan struct{}, 1),
+	}
+	node.changed = sync.NewCond(&node.mutex)
+	return node
+}
+
+// start runs elections, replication and the applier until stop.
+func (node *raftNode) start() {
+	node.mutex.Lock()
+	node.resetDeadline()
+	node.mutex.Unlock()
+	go node.runElections()
+	go node.runReplication()
+	go node.runApplier()
+}
+
+func (node *raftNode) stop() {
+	close(node.done)
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	node.storage.close()
+}
+
+// propose appends command to the log, if this node is the leader, and waits
+// until a majority hold it. Once it returns nil, the caller must apply
+// command; otherwise it mustn't, and the node has stepped down, so that the
+// command is applied in order by a new leader if it commits after all. The
+// caller must hold the store's lock, or the environment command mutates
+// locked.
+func (node *raftNode) propose(command raftCommand, deadline time.Time) error {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	if node.state != raftLeader || !node.ready {
+		return ErrLeadershipLost
+	}
+	term := node.term
+	node.log = append(node.log, raftEntry{Term: term, Command: command})
+	index := node.lastIndex()
+	if err := node.persist(); err != nil {
+		node.stepDown(term)
+		return err
+	}
+	node.advanceCommit()
+	signal(node.replicate)
+
+	defer node.broadcastAt(deadline).Stop()
+	for {
+		if node.state != raftLeader || node.term != term {
+			return ErrLeadershipLost
+		}
+		if node.commitIndex >= index {
+			node.selfApplied[index] = true
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			node.stepDown(term)
+			return ErrNotReplicated
+		}
+		node.changed.Wait()
+	}
+}
+
+// persist syncs the term, vote and any entries not yet stored. The caller
+// must hold the mutex.
+func (node *raftNode) persist() error {
+	state := raftState{Term: node.term, VotedFor: node.votedFor}
+	if state != node.saved {
+		if err := node.storage.saveState(state); err != nil {
+			return err
+		}
+		node.saved = state
+	}
+	if node.rewrite {
+		if err := node.storage.rewrite(node.log[1:]); err != nil {
+			return err
+		}
+		node.rewrite = false
+	} else if err := node.storage.append(node.log[node.savedIndex+1:]); err != nil {
+		return err
+	}
+	node.savedIndex = node.lastIndex()
+	return nil
+}
+
+// leadership waits until a leader is known and, if it's this node, ready to
+// accept commands. It returns the leader, and the current term.
+func (node *raftNode) leadership(deadline time.Time) (string, uint64, error) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	defer node.broadcastAt(deadline).Stop()
+	for {
+		if node.state == raftLeader && node.ready {
+			return node.id, node.term, nil
+		}
+		if node.state == raftFollower && node.leader != "" {
+			return node.leader, node.term, nil
+		}
+		if !time.Now().Before(deadline) {
+			return "", 0, ErrNoLeader
+		}
+		node.changed.Wait()
+	}
+}
+
+// broadcastAt wakes every waiter at deadline, so they can give up.
+func (node *raftNode) broadcastAt(deadline time.Time) *time.Timer {
+	return time.AfterFunc(time.Until(deadline), func() {
+		node.mutex.Lock()
+		node.changed.Broadcast()
+		node.mutex.Unlock()
+	})
+}
+
+func (node *raftNode) lastIndex() uint64 {
+	return uint64(len(node.log) - 1)
+}
+
+func (node *raftNode) lastTerm() uint64 {
+	return node.log[len(node.log)-1].Term
+}
+
+func (node *raftNode) resetDeadline() {
+	timeout := node.electionTimeout + time.Duration(rand.Int63n(int64(node.electionTimeout)))
+	node.deadline = time.Now().Add(timeout)
+}
+
+// stepDown follows whoever leads term. The caller must hold the mutex.
+func (node *raftNode) stepDown(term uint64) {
+	if term > node.term {
+		node.term = term
+		node.votedFor = ""
+		node.leader = ""
+	}
+	node.state = raftFollower
+	node.ready = false
+	node.changed.Broadcast()
+}
+
+func (node *raftNode) runElections() {
+	ticker := time.NewTicker(node.heartbeat / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-node.done:
+			return
+		case <-ticker.C:
+		}
+		node.mutex.Lock()
+		if node.state != raftLeader && time.Now().After(node.deadline) {
+			node.startElection()
+		}
+		node.mutex.Unlock()
+	}
+}
+
+// startElection asks every peer for its vote in a new term, once it has
+// stored its own vote. The caller must hold the mutex.
+func (node *raftNode) startElection() {
+	node.state = raftCandidate
+	node.term++
+	node.votedFor = node.id
+	node.leader = ""
+	node.resetDeadline()
+	node.changed.Broadcast()
+	if err := node.persist(); err != nil {
+		log.Printf("not campaigning in term %d: %v", node.term, err)
+		node.stepDown(node.term)
+		return
+	}
+	request := voteRequest{Term: node.term, Candidate: node.id, LastLogIndex: node.lastIndex(), LastLogTerm: node.lastTerm()}
+	votes := 1
+	if votes*2 > len(node.peers)+1 {
+		node.becomeLeader()
+		return
+	}
+	for _, peer := range node.peers {
+		go func(peer string) {
+			var response voteResponse
+			if err := node.call(peer, "/raft/vote", request, &response); err != nil {
+				return
+			}
+			node.mutex.Lock()
+			defer node.mutex.Unlock()
+			if response.Term > node.term {
+				node.stepDown(response.Term)
+				return
+			}
+			if !response.Granted || node.state != raftCandidate || node.term != request.Term {
+				return
+			}
+			votes++
+			if votes*2 > len(node.peers)+1 {
+				node.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// becomeLeader appends an empty entry, as committing an entry of its own term
+// commits every earlier one, and has the applier catch up with the log up to
+// it. The caller must hold the mutex.
+func (node *raftNode) becomeLeader() {
+	node.state = raftLeader
+	node.leader = node.id
+	node.ready = false
+	for _, peer := range node.peers {
+		node.nextIndex[peer] = node.lastIndex() + 1
+		node.matchIndex[peer] = 0
+	}
+	node.log = append(node.log, raftEntry{Term: node.term, Command: raftCommand{Type: commandNoop}})
+	node.readyIndex = node.lastIndex()
+	if err := node.persist(); err != nil {
+		log.Printf("stepping down from leading term %d: %v", node.term, err)
+		node.stepDown(node.term)
+		return
+	}
+	node.advanceCommit()
+	node.changed.Broadcast()
+	signal(node.wake)
+	signal(node.replicate)
+}
+
+// handleVote grants a vote to candidates whose log is at least as up to date
+// as this node's, once per term. It fails if the vote, or the term it's in,
+// can't be stored.
+func (node *raftNode) handleVote(request voteRequest) (voteResponse, error) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	if request.Term > node.term {
+		node.stepDown(request.Term)
+	}
+	response := voteResponse{Term: node.term}
+	upToDate := request.LastLogTerm > node.lastTerm() ||
+		(request.LastLogTerm == node.lastTerm() && request.LastLogIndex >= node.lastIndex())
+	if request.Term == node.term && (node.votedFor == "" || node.votedFor == request.Candidate) && upToDate {
+		node.votedFor = request.Candidate
+		node.resetDeadline()
+		response.Granted = true
+	}
+	if err := node.persist(); err != nil {
+		return voteResponse{}, err
+	}
+	return response, nil
+}
+
+// handleAppend adds the leader's entries to the log, replacing any that
+// conflict, and commits up to the leader's commit index. It fails if they,
+// or the leader's term, can't be stored.
+func (node *raftNode) handleAppend(request appendRequest) (appendResponse, error) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	if request.Term < node.term {
+		return appendResponse{Term: node.term, LastIndex: node.lastIndex()}, nil
+	}
+	if request.Term > node.term || node.state != raftFollower {
+		node.stepDown(request.Term)
+	}
+	if node.leader != request.Leader {
+		node.leader = request.Leader
+		node.changed.Broadcast()
+	}
+	node.resetDeadline()
+	if err := node.persist(); err != nil {
+		return appendResponse{}, err
+	}
+
+	if request.PrevLogIndex > node.lastIndex() {
+		return appendResponse{Term: node.term, LastIndex: node.lastIndex()}, nil
+	}
+	if node.log[request.PrevLogIndex].Term != request.PrevLogTerm {
+		return appendResponse{Term: node.term, LastIndex: request.PrevLogIndex - 1}, nil
+	}
+	for i, entry := range request.Entries {
+		index := request.PrevLogIndex + 1 + uint64(i)
+		if index <= node.lastIndex() {
+			if node.log[index].Term == entry.Term {
+				continue
+			}
+			// committed entries never conflict, so only unapplied ones go
+			node.log = node.log[:index]
+			if index <= node.savedIndex {
+				node.rewrite = true
+			}
+		}
+		node.log = append(node.log, entry)
+	}
+	if err := node.persist(); err != nil {
+		return appendResponse{}, err
+	}
+	last := request.PrevLogIndex + uint64(len(request.Entries))
+	if request.LeaderCommit > node.commitIndex && last > node.commitIndex {
+		node.commitIndex = request.LeaderCommit
+		if last < node.commitIndex {
+			node.commitIndex = last
+		}
+		node.changed.Broadcast()
+		signal(node.wake)
+	}
+	return appendResponse{Term: node.term, Success: true, LastIndex: node.lastIndex()}, nil
+}
+
+func (node *raftNode) runReplication() {
+	ticker := time.NewTicker(node.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-node.done:
+			return
+		case <-ticker.C:
+		case <-node.replicate:
+		}
+		node.mutex.Lock()
+		if node.state == raftLeader {
+			for _, peer := range node.peers {
+				if !node.sending[peer] {
+					node.sending[peer] = true
+					go node.sendAppend(peer)
+				}
+			}
+		}
+		node.mutex.Unlock()
+	}
+}
+
+// sendAppend sends a peer the entries it's missing, or a heartbeat.
+func (node *raftNode) sendAppend(peer string) {
+	node.mutex.Lock()
+	if node.state != raftLeader {
+		node.sending[peer] = false
+		node.mutex.Unlock()
+		return
+	}
+	next := node.nextIndex[peer]
+	end := node.lastIndex() + 1
+	if end > next+maxAppendEntries {
+		end = next + maxAppendEntries
+	}
+	request := appendRequest{
+		Term:         node.term,
+		Leader:       node.id,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  node.log[next-1].Term,
+		Entries:      append([]raftEntry{}, node.log[next:end]...),
+		LeaderCommit: node.commitIndex,
+	}
+	node.mutex.Unlock()
+
+	var response appendResponse
+	err := node.call(peer, "/raft/append", request, &response)
+
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	node.sending[peer] = false
+	if err != nil {
+		return
+	}
+	if response.Term > node.term {
+		node.stepDown(response.Term)
+		return
+	}
+	if node.state != raftLeader || node.term != request.Term {
+		return
+	}
+	if !response.Success {
+		next := request.PrevLogIndex
+		if response.LastIndex+1 < next {
+			next = response.LastIndex + 1
+		}
+		if next < 1 {
+			next = 1
+		}
+		node.nextIndex[peer] = next
+		signal(node.replicate)
+		return
+	}
+	match := request.PrevLogIndex + uint64(len(request.Entries))
+	if match > node.matchIndex[peer] {
+		node.matchIndex[peer] = match
+	}
+	node.nextIndex[peer] = match + 1
+	node.advanceCommit()
+	if match < node.lastIndex() {
+		signal(node.replicate)
+	}
+}
+
+// advanceCommit commits the last entry of the current term held by a
+// majority, and with it every entry before. The caller must hold the mutex.
+func (node *raftNode) advanceCommit() {
+	for index := node.lastIndex(); index > node.commitIndex && node.log[index].Term == node.term; index-- {
+		count := 1
+		for _, peer := range node.peers {
+			if node.matchIndex[peer] >= index {
+				count++
+			}
+		}
+		if count*2 > len(node.peers)+1 {
+			node.commitIndex = index
+			node.changed.Broadcast()
+			signal(node.wake)
+			return
+		}
+	}
+}
+
+// runApplier applies committed entries their proposers didn't, and marks a
+// new leader ready once it has caught up with its log.
+func (node *raftNode) runApplier() {
+	for {
+		select {
+		case <-node.done:
+			return
+		case <-node.wake:
+		}
+		node.store.Lock()
+		node.mutex.Lock()
+		for node.applied < node.commitIndex {
+			node.applied++
+			if node.selfApplied[node.applied] {
+				delete(node.selfApplied, node.applied)
+				continue
+			}
+			node.apply(node.log[node.applied].Command)
+		}
+		if node.state == raftLeader && !node.ready && node.applied >= node.readyIndex {
+			node.ready = true
+			node.changed.Broadcast()
+		}
+		node.mutex.Unlock()
+		node.store.Unlock()
+	}
+}
+
+// call posts request to a peer's Raft endpoint and decodes the response.
+func (node *raftNode) call(peer, path string, request, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	httpResponse, err := node.client.Post(peer+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s%s returned %s", peer, path, httpResponse.Status)
+	}
+	return json.NewDecoder(httpResponse.Body).Decode(response)
+}
+
+// signal wakes a goroutine waiting on channel, without blocking if it's
+// already due to wake.
+func signal(channel chan struct{}) {
+	select {
+	case channel <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Files a raftStorage keeps in its directory.
+const (
+	raftStateFile = "raft-state.json"
+	raftLogFile   = "raft-log.jsonl"
+)
+
+// raftState is what a node must remember about elections across restarts,
+// so it never votes twice in a term.
+type raftState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"voted_for,omitempty"`
+}
+
+// raftStorage keeps a node's raftState, and its log as one raftEntry per
+// line, in a directory, syncing every write before it returns. A nil
+// raftStorage keeps nothing, for nodes that only live in memory.
+type raftStorage struct {
+	directory string
+	log       *os.File
+}
+
+// openRaftStorage opens the storage in directory, creating it if needed,
+// and returns the state and the log entries it holds. A last entry cut off
+// by a crash is dropped, as it was never acknowledged, but a damaged one
+// before it fails.
+func openRaftStorage(directory string) (*raftStorage, raftState, []raftEntry, error) {
+	var state raftState
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, state, nil, err
+	}
+	encoded, err := ioutil.ReadFile(filepath.Join(directory, raftStateFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, state, nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(encoded, &state); err != nil {
+			return nil, state, nil, fmt.Errorf("%s: %v", raftStateFile, err)
+		}
+	}
+
+	storage := &raftStorage{directory: directory}
+	entries, torn, err := readRaftLog(filepath.Join(directory, raftLogFile))
+	if err != nil {
+		return nil, state, nil, err
+	}
+	if torn {
+		err = storage.rewrite(entries)
+	} else {
+		err = storage.openLog()
+	}
+	if err != nil {
+		return nil, state, nil, err
+	}
+	return storage, state, entries, nil
+}
+
+// readRaftLog reads the entries in file, reporting whether its last line was
+// cut off.
+func readRaftLog(file string) ([]raftEntry, bool, error) {
+	entries := []raftEntry{}
+	contents, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return entries, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	reader := bufio.NewReader(bytes.NewReader(contents))
+	for line := 1; ; line++ {
+		encoded, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return entries, len(encoded) > 0, nil
+		}
+		var entry raftEntry
+		if err := json.Unmarshal(encoded, &entry); err != nil {
+			if _, err := reader.Peek(1); err == io.EOF {
+				return entries, true, nil
+			}
+			return nil, false, fmt.Errorf("%s line %d: %v", raftLogFile, line, err)
+		}
+		entries = append(entries, entry)
+	}
+}
+
+func (storage *raftStorage) openLog() error {
+	file, err := os.OpenFile(filepath.Join(storage.directory, raftLogFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	storage.log = file
+	return syncDirectory(storage.directory)
+}
+
+// saveState replaces the stored state.
+func (storage *raftStorage) saveState(state raftState) error {
+	if storage == nil {
+		return nil
+	}
+	encoded, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return writeFileSynced(filepath.Join(storage.directory, raftStateFile), append(encoded, '\n'))
+}
+
+// append adds entries to the end of the stored log.
+func (storage *raftStorage) append(entries []raftEntry) error {
+	if storage == nil || len(entries) == 0 {
+		return nil
+	}
+	encoded, err := encodeRaftEntries(entries)
+	if err != nil {
+		return err
+	}
+	if _, err := storage.log.Write(encoded); err != nil {
+		return err
+	}
+	return storage.log.Sync()
+}
+
+// rewrite replaces the stored log with entries, for when a new leader has
+// the node drop entries it holds.
+func (storage *raftStorage) rewrite(entries []raftEntry) error {
+	if storage == nil {
+		return nil
+	}
+	encoded, err := encodeRaftEntries(entries)
+	if err != nil {
+		return err
+	}
+	if storage.log != nil {
+		storage.log.Close()
+		storage.log = nil
+	}
+	if err := writeFileSynced(filepath.Join(storage.directory, raftLogFile), encoded); err != nil {
+		return err
+	}
+	return storage.openLog()
+}
+
+func (storage *raftStorage) close() error {
+	if storage == nil || storage.log == nil {
+		return nil
+	}
+	return storage.log.Close()
+}
+
+func encodeRaftEntries(entries []raftEntry) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return nil, err
+		}
+	}
+	return buffer.Bytes(), nil
+}
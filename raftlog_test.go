@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRaftStorageSurvivesRestart(t *testing.T) {
+	// setup
+	directory, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	storage, state, entries, err := openRaftStorage(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine := &testMachine{ids: map[string]int{}}
+	node := newRaftNode("http://a", []string{"http://b", "http://c"}, machine, machine.apply, storage, state, entries)
+	node.handleAppend(appendRequest{Term: 1, Leader: "http://b", Entries: []raftEntry{
+		{Term: 1, Command: raftCommand{Type: ChangeSet, Name: "records", ID: 1}},
+		{Term: 1, Command: raftCommand{Type: ChangeSet, Name: "records", ID: 2}},
+	}, LeaderCommit: 1})
+	node.handleVote(voteRequest{Term: 2, Candidate: "http://c", LastLogIndex: 2, LastLogTerm: 1})
+	node.handleAppend(appendRequest{Term: 2, Leader: "http://c", PrevLogIndex: 1, PrevLogTerm: 1, Entries: []raftEntry{
+		{Term: 2, Command: raftCommand{Type: ChangeSet, Name: "records", ID: 3}},
+	}})
+	node.stop()
+
+	// test that the vote and log, with the replaced entry, are reloaded
+	storage, state, entries, err = openRaftStorage(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != (raftState{Term: 2, VotedFor: "http://c"}) {
+		t.Error("Expected the vote in term 2 to be reloaded, got ", state)
+	}
+	if len(entries) != 2 || entries[0].Command.ID != 1 || entries[1].Command.ID != 3 {
+		t.Fatal("Expected the log to be reloaded, got ", entries)
+	}
+
+	// test that a restarted node doesn't vote again in the term, and
+	// rebuilds its state once it learns what's committed
+	machine = &testMachine{ids: map[string]int{}}
+	node = newRaftNode("http://a", []string{"http://b", "http://c"}, machine, machine.apply, storage, state, entries)
+	node.electionTimeout = time.Hour
+	if vote, _ := node.handleVote(voteRequest{Term: 2, Candidate: "http://b", LastLogIndex: 9, LastLogTerm: 2}); vote.Granted {
+		t.Error("Expected no second vote in term 2")
+	}
+	node.start()
+	defer node.stop()
+	if machine.get("records") != 0 {
+		t.Error("Expected nothing applied before it's known to be committed")
+	}
+	node.handleAppend(appendRequest{Term: 2, Leader: "http://c", PrevLogIndex: 2, PrevLogTerm: 2, LeaderCommit: 2})
+	waitFor(t, "the committed log to be applied", func() bool { return machine.get("records") == 3 })
+}
+
+func TestRaftStorageDamagedLog(t *testing.T) {
+	// setup
+	directory, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	file := filepath.Join(directory, raftLogFile)
+	entry := `{"term":1,"command":{"type":"set","name":"records","id":1}}` + "\n"
+
+	// test that an entry cut off by a crash is dropped from the file
+	ioutil.WriteFile(file, []byte(entry+`{"term":1,"comm`), 0644)
+	storage, _, entries, err := openRaftStorage(directory)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Expected the whole entry, got %v (%v)", entries, err)
+	}
+	storage.close()
+	if contents, _ := ioutil.ReadFile(file); string(contents) != entry {
+		t.Errorf("Expected the cut off entry dropped, got `%s`", contents)
+	}
+
+	// test that a damaged entry before the last fails
+	ioutil.WriteFile(file, []byte(`{"term":1,"comm`+"\n"+entry), 0644)
+	if _, _, _, err := openRaftStorage(directory); err == nil {
+		t.Error("Expected a damaged log to fail")
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var redisAddr = flag.String("redis-addr", "", "address to serve the Redis protocol on, if set")
+
+func init() {
+	listeners = append(listeners, func(ids idMap) error {
+		if *redisAddr == "" {
+			return nil
+		}
+		listener, err := net.Listen("tcp", *redisAddr)
+		if err != nil {
+			return err
+		}
+		connections := newConnectionTracker()
+		onShutdown(func(deadline <-chan struct{}) error {
+			return connections.drain(listener, "Redis", deadline)
+		})
+		if err := ids.serveRedis(listener, connections); err != nil && !isDraining() {
+			return err
+		}
+		return nil
+	})
+}
+
+// Longest bulk string, and most arguments, accepted in a Redis command.
+// Keys are short, so these only guard against runaway clients.
+const (
+	maxRedisBulk = 1 << 16
+	maxRedisArgs = 1 << 10
+)
+
+// Redis replies other than integers, bulk strings (string), nil bulk strings
+// (nil) and arrays of bulk strings ([]string).
+type redisStatus string
+type redisError string
+
+var errRedisProtocol = errors.New("Protocol error")
+
+// serveRedis answers the RESP protocol, mapping keys like `live:records` onto
+// the environment and name of a counter, until listener fails. Connections
+// are followed by connections, so they can be drained.
+func (ids idMap) serveRedis(listener net.Listener, connections *connectionTracker) error {
+	snapshots := ids.newSnapshotter()
+	for {
+		connection, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		if !connections.add(connection) {
+			connection.Close()
+			continue
+		}
+		go ids.serveRedisConnection(connection, connections, snapshots)
+	}
+}
+
+func (ids idMap) serveRedisConnection(connection net.Conn, connections *connectionTracker, snapshots *snapshotter) {
+	defer connections.remove(connection)
+	defer connection.Close()
+	reader := bufio.NewReader(connection)
+	writer := bufio.NewWriter(connection)
+	for {
+		args, err := readRedisCommand(reader)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			writeRedisReply(writer, redisError("ERR "+err.Error()))
+			writer.Flush()
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if !connections.begin(connection) {
+			return
+		}
+		writeRedisReply(writer, ids.redisCommand(args, snapshots))
+		// once draining, answer the command served and hang up
+		if !connections.end(connection) {
+			writer.Flush()
+			return
+		}
+		// answer pipelined commands in one write
+		if reader.Buffered() == 0 {
+			if err := writer.Flush(); err != nil {
+				return
+			}
+		}
+		if strings.ToUpper(args[0]) == "QUIT" {
+			writer.Flush()
+			return
+		}
+	}
+}
+
+// redisCommand runs one command and returns its reply. KEYS is answered from
+// a snapshot, so matching every key doesn't hold up writers.
+func (ids idMap) redisCommand(args []string, snapshots *snapshotter) interface{} {
+	command := strings.ToUpper(args[0])
+	args = args[1:]
+	arity := map[string]int{"PING": -1, "QUIT": 0, "INCR": 1, "INCRBY": 2, "GET": 1, "SET": 2, "DEL": -2, "KEYS": 1}
+	expected, ok := arity[command]
+	if !ok {
+		return redisError(fmt.Sprintf("ERR unknown command '%s'", strings.ToLower(command)))
+	}
+	// a negative arity is the negated minimum
+	if (expected >= 0 && len(args) != expected) || (expected < 0 && len(args) < -expected-1) {
+		return redisError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(command)))
+	}
+
+	switch command {
+	case "PING":
+		if len(args) == 0 {
+			return redisStatus("PONG")
+		}
+		return args[0]
+	case "QUIT":
+		return redisStatus("OK")
+	case "KEYS":
+		if _, err := path.Match(args[0], ""); err != nil {
+			return redisError("ERR invalid pattern")
+		}
+		return snapshots.take().IDs.redisKeys(args[0])
+	}
+
+	key, err := parseKey(args[0])
+	if err != nil {
+		return redisErrorFor(err)
+	}
+
+	switch command {
+	case "INCR", "INCRBY":
+		delta := 1
+		if command == "INCRBY" {
+			if delta, err = strconv.Atoi(args[1]); err != nil {
+				return redisError("ERR value is not an integer or out of range")
+			}
+		}
+		unlock := ids.lockEnvironment(key.Environment)
+		id, err := ids.Add(key.Name, key.Environment, delta)
+		unlock()
+		return redisIntegerReply(id, err)
+	case "GET":
+		unlock := ids.readEnvironment(key.Environment)
+		id, err := ids.Peek(key.Name, key.Environment)
+		unlock()
+		if err == ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return redisErrorFor(err)
+		}
+		return strconv.Itoa(id)
+	case "SET":
+		value := CounterValue{ID: json.Number(args[1])}
+		if err := validateStruct(&value); err != nil {
+			return redisError("ERR value is not an integer or out of range")
+		}
+		id, _ := value.ID.Int64()
+		unlock := ids.lockEnvironment(key.Environment)
+		_, err := ids.Set(key.Name, key.Environment, int(id))
+		unlock()
+		if err != nil {
+			return redisErrorFor(err)
+		}
+		return redisStatus("OK")
+	case "DEL":
+		keys := []CounterKey{key}
+		for _, arg := range args[1:] {
+			key, err := parseKey(arg)
+			if err != nil {
+				return redisErrorFor(err)
+			}
+			keys = append(keys, key)
+		}
+		deleted := 0
+		mutex.Lock()
+		for _, key := range keys {
+			if _, err := ids.Delete(key.Name, key.Environment); err == nil {
+				deleted++
+			}
+		}
+		mutex.Unlock()
+		return deleted
+	}
+	return redisError(fmt.Sprintf("ERR unknown command '%s'", strings.ToLower(command)))
+}
+
+// redisKeys returns the keys of the counters matching pattern, sorted.
+func (ids idMap) redisKeys(pattern string) []string {
+	keys := []string{}
+	for environment, names := range ids {
+		for name := range names {
+			if key := environment + ":" + name; matchesGlob(pattern, key) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func redisIntegerReply(id int, err error) interface{} {
+	if err == ErrOutOfRange {
+		return redisError("ERR increment or decrement would overflow")
+	}
+	if err != nil {
+		return redisErrorFor(err)
+	}
+	return id
+}
+
+func redisErrorFor(err error) redisError {
+	return redisError("ERR " + toAPIError(err).Message)
+}
+
+// readRedisCommand reads one command, either as a RESP array of bulk strings,
+// as sent by clients, or inline as space separated words, as typed into
+// telnet.
+func readRedisCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := readRedisLine(reader)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+	count, err := strconv.Atoi(line[1:])
+	if err != nil || count > maxRedisArgs {
+		return nil, errRedisProtocol
+	}
+	args := []string{}
+	for i := 0; i < count; i++ {
+		line, err := readRedisLine(reader)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, errRedisProtocol
+		}
+		length, err := strconv.Atoi(line[1:])
+		if err != nil || length < 0 || length > maxRedisBulk {
+			return nil, errRedisProtocol
+		}
+		bulk := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, bulk); err != nil {
+			return nil, err
+		}
+		if string(bulk[length:]) != "\r\n" {
+			return nil, errRedisProtocol
+		}
+		args = append(args, string(bulk[:length]))
+	}
+	return args, nil
+}
+
+// readRedisLine reads one line, failing with errRedisProtocol as soon as it
+// passes maxRedisBulk, rather than buffering whatever a client sends before a
+// newline.
+func readRedisLine(reader *bufio.Reader) (string, error) {
+	line := []byte{}
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(line)+len(chunk) > maxRedisBulk {
+			return "", errRedisProtocol
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF && len(line) > 0 {
+			return "", io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(line), "\r\n"), nil
+	}
+}
+
+func writeRedisReply(writer *bufio.Writer, reply interface{}) {
+	switch reply := reply.(type) {
+	case redisStatus:
+		fmt.Fprintf(writer, "+%s\r\n", reply)
+	case redisError:
+		fmt.Fprintf(writer, "-%s\r\n", reply)
+	case int:
+		fmt.Fprintf(writer, ":%d\r\n", reply)
+	case string:
+		fmt.Fprintf(writer, "$%d\r\n%s\r\n", len(reply), reply)
+	case []string:
+		fmt.Fprintf(writer, "*%d\r\n", len(reply))
+		for _, bulk := range reply {
+			writeRedisReply(writer, bulk)
+		}
+	default:
+		fmt.Fprint(writer, "$-1\r\n")
+	}
+}
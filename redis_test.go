@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dialRedis serves ids over the Redis protocol on a free port, and returns a
+// connection to it.
+func dialRedis(t *testing.T, ids idMap) (net.Conn, *bufio.Reader, func()) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ids.serveRedis(listener, newConnectionTracker())
+	connection, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return connection, bufio.NewReader(connection), func() {
+		connection.Close()
+		listener.Close()
+	}
+}
+
+// redisArray encodes args as a RESP array of bulk strings.
+func redisArray(args ...string) string {
+	encoded := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		encoded += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return encoded
+}
+
+// readRedisReply reads one reply, flattening arrays into space separated
+// elements.
+func readRedisReply(t *testing.T, reader *bufio.Reader) string {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	line = strings.TrimRight(line, "\r\n")
+	switch line[0] {
+	case '$':
+		if line == "$-1" {
+			return "(nil)"
+		}
+		return readRedisReply(t, reader)
+	case '*':
+		var count int
+		fmt.Sscanf(line, "*%d", &count)
+		elements := []string{}
+		for i := 0; i < count; i++ {
+			elements = append(elements, readRedisReply(t, reader))
+		}
+		return strings.Join(elements, " ")
+	}
+	return line
+}
+
+func TestRedisCommands(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	connection, reader, stop := dialRedis(t, ids)
+	defer stop()
+
+	steps := []struct {
+		args  []string
+		reply string
+	}{
+		{[]string{"PING"}, "+PONG"},
+		{[]string{"ping", "hello"}, "hello"},
+		{[]string{"GET", "live:records"}, "(nil)"},
+		{[]string{"INCR", "live:records"}, fmt.Sprintf(":%d", initialValue)},
+		{[]string{"INCR", "live:records"}, fmt.Sprintf(":%d", initialValue+incrementBy)},
+		{[]string{"INCRBY", "live:records", "10"}, fmt.Sprintf(":%d", initialValue+11*incrementBy)},
+		{[]string{"INCRBY", "live:records", "-2"}, fmt.Sprintf(":%d", initialValue+9*incrementBy)},
+		{[]string{"SET", "live:records", "100"}, "+OK"},
+		{[]string{"GET", "live:records"}, "100"},
+		{[]string{"INCRBY", "dev:records", "-1"}, "-ERR " + ErrNotFound.Error()},
+		{[]string{"INCRBY", "live:records", "-100"}, "-ERR increment or decrement would overflow"},
+		{[]string{"SET", "dev:records", "1.5"}, "-ERR value is not an integer or out of range"},
+		{[]string{"SET", "dev:other", "7"}, "+OK"},
+		{[]string{"KEYS", "*:records"}, "live:records"},
+		{[]string{"KEYS", "*"}, "dev:other live:records"},
+		{[]string{"DEL", "live:records", "live:missing", "dev:other"}, ":2"},
+		{[]string{"GET", "records"}, "-ERR key must look like environment:name"},
+		{[]string{"GET", "live:bad name"}, "-ERR name may only contain letters, digits, `.`, `_` and `-`"},
+		{[]string{"INCR"}, "-ERR wrong number of arguments for 'incr' command"},
+		{[]string{"FLUSHALL"}, "-ERR unknown command 'flushall'"},
+	}
+
+	for _, step := range steps {
+		if _, err := connection.Write([]byte(redisArray(step.args...))); err != nil {
+			t.Fatal(err)
+		}
+		// test for the reply
+		if reply := readRedisReply(t, reader); reply != step.reply {
+			t.Errorf("Expected `%s` for %v, got `%s`", step.reply, step.args, reply)
+		}
+	}
+
+	// test that the commands shared the counters
+	if len(ids) != 0 {
+		t.Error("Expected every counter to be deleted, got ", ids)
+	}
+}
+
+func TestRedisPipelineAndInline(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	connection, reader, stop := dialRedis(t, ids)
+	defer stop()
+
+	// test that pipelined commands are answered in order
+	pipeline := redisArray("SET", "live:records", "1") + redisArray("INCRBY", "live:records", "2") + "GET live:records\r\n"
+	if _, err := connection.Write([]byte(pipeline)); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"+OK", ":11", "11"} {
+		if reply := readRedisReply(t, reader); reply != expected {
+			t.Errorf("Expected `%s`, got `%s`", expected, reply)
+		}
+	}
+
+	// test that QUIT closes the connection
+	if _, err := connection.Write([]byte("QUIT\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if reply := readRedisReply(t, reader); reply != "+OK" {
+		t.Error("Expected `+OK`, got ", reply)
+	}
+	if _, err := reader.ReadString('\n'); err == nil {
+		t.Error("Expected the connection to be closed")
+	}
+}
+
+func TestRedisLongLine(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	connection, reader, stop := dialRedis(t, ids)
+	defer stop()
+	go connection.Write([]byte("GET " + strings.Repeat("a", 1<<20)))
+
+	// test that a line without a newline is cut off once it's too long
+	if reply := readRedisReply(t, reader); reply != "-ERR "+errRedisProtocol.Error() {
+		t.Error("Expected a protocol error, got ", reply)
+	}
+	if _, err := reader.ReadString('\n'); err == nil {
+		t.Error("Expected the connection to be closed")
+	}
+}
+
+func TestRedisDrain(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	connections := newConnectionTracker()
+	go ids.serveRedis(listener, connections)
+	idle, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	busy, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	idle.Write([]byte(redisArray("PING")))
+	readRedisReply(t, bufio.NewReader(idle))
+	// the command waits for the store's lock
+	mutex.Lock()
+	busy.Write([]byte(redisArray("INCR", "live:records")))
+	time.Sleep(50 * time.Millisecond)
+	drained := make(chan error)
+	go func() {
+		drained <- connections.drain(listener, "Redis", nil)
+	}()
+
+	// test that idle connections are closed straight away
+	idle.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := idle.Read(make([]byte, 1)); err != io.EOF {
+		t.Error("Expected the idle connection closed, got ", err)
+	}
+
+	// test that a command in flight is answered before its connection is
+	// closed
+	mutex.Unlock()
+	reader := bufio.NewReader(busy)
+	if reply := readRedisReply(t, reader); reply != fmt.Sprintf(":%d", initialValue) {
+		t.Error("Expected the command answered, got ", reply)
+	}
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Error("Expected the busy connection closed once answered, got ", err)
+	}
+	if err := <-drained; err != nil {
+		t.Error("Expected the connections drained, got ", err)
+	}
+}
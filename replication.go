@@ -0,0 +1,486 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var replicaOf = flag.String("replica-of", "", "URL of a primary to replicate, serving reads only until promoted")
+
+// Roles in ReplicationStatus.
+const (
+	replicationPrimary = "primary"
+	replicationReplica = "replica"
+)
+
+// Most entries returned by one request for the log.
+const maxShippedEntries = 1000
+
+// Errors returned to replicas whose position in the log is no longer valid,
+// which makes them start over from a snapshot.
+var (
+	ErrEpochChanged    = errors.New("the primary restarted, so its log starts over")
+	ErrSequenceUnknown = errors.New("sequence is ahead of the primary's log")
+	ErrNotReplica      = errors.New("this node isn't a replica")
+)
+
+// replicationEntry is one mutation in a primary's log.
+type replicationEntry struct {
+	Sequence uint64      `json:"sequence"`
+	Command  raftCommand `json:"command"`
+}
+
+// replicationBatch is the entries after a replica's position, and how far
+// the log goes.
+type replicationBatch struct {
+	Epoch    string             `json:"epoch"`
+	Sequence uint64             `json:"sequence"`
+	Entries  []replicationEntry `json:"entries"`
+}
+
+// replicationSnapshot is every counter and config as of Sequence.
+type replicationSnapshot struct {
+	Epoch    string        `json:"epoch"`
+	Sequence uint64        `json:"sequence"`
+	Counters idMap         `json:"counters"`
+	Configs  []raftCommand `json:"configs"`
+	Leases   []raftCommand `json:"leases"`
+}
+
+// ReplicationStatus describes a node's place in a primary/replica topology.
+// Lag is how many entries a replica was behind the primary when it last
+// heard from it, and LagSeconds how long it's been behind.
+type ReplicationStatus struct {
+	Role            string     `json:"role" yaml:"role"`
+	Primary         string     `json:"primary,omitempty" yaml:"primary,omitempty"`
+	Epoch           string     `json:"epoch" yaml:"epoch"`
+	Sequence        uint64     `json:"sequence" yaml:"sequence"`
+	PrimarySequence uint64     `json:"primary_sequence" yaml:"primary_sequence"`
+	Lag             uint64     `json:"lag" yaml:"lag"`
+	LagSeconds      float64    `json:"lag_seconds" yaml:"lag_seconds"`
+	Connected       bool       `json:"connected" yaml:"connected"`
+	LastContact     *time.Time `json:"last_contact,omitempty" yaml:"last_contact,omitempty"`
+}
+
+// shipped is fed by every mutation made on this node, for replicas to tail.
+var shipped = newShippingLog(changeHistory)
+
+// shippingLog keeps the most recent mutations, and wakes anyone waiting on
+// them. Its epoch tells replicas when the log starts over, as it does every
+// time the process starts.
+type shippingLog struct {
+	mutex    sync.Mutex
+	epoch    string
+	sequence uint64
+	size     int
+	entries  []replicationEntry
+	changed  chan struct{}
+}
+
+func newShippingLog(size int) *shippingLog {
+	return &shippingLog{epoch: newRequestID(), size: size, changed: make(chan struct{})}
+}
+
+func (shipping *shippingLog) append(command raftCommand) {
+	shipping.mutex.Lock()
+	defer shipping.mutex.Unlock()
+	shipping.sequence++
+	shipping.entries = append(shipping.entries, replicationEntry{Sequence: shipping.sequence, Command: command})
+	if len(shipping.entries) > shipping.size {
+		shipping.entries = shipping.entries[len(shipping.entries)-shipping.size:]
+	}
+	close(shipping.changed)
+	shipping.changed = make(chan struct{})
+}
+
+func (shipping *shippingLog) position() (string, uint64) {
+	shipping.mutex.Lock()
+	defer shipping.mutex.Unlock()
+	return shipping.epoch, shipping.sequence
+}
+
+// since blocks until there are entries after sequence and returns them, or
+// an empty batch once timeout fires, or the server starts draining. It fails
+// with ErrWatchCancelled once done is closed.
+func (shipping *shippingLog) since(epoch string, sequence uint64, done <-chan struct{}, timeout <-chan time.Time) (replicationBatch, error) {
+	for {
+		shipping.mutex.Lock()
+		batch := replicationBatch{Epoch: shipping.epoch, Sequence: shipping.sequence, Entries: []replicationEntry{}}
+		changed := shipping.changed
+		oldest := shipping.sequence - uint64(len(shipping.entries)) + 1
+		var err error
+		switch {
+		case epoch != "" && epoch != shipping.epoch:
+			err = ErrEpochChanged
+		case sequence > shipping.sequence:
+			err = ErrSequenceUnknown
+		case sequence+1 < oldest:
+			err = ErrHistoryCompacted
+		case sequence < shipping.sequence:
+			pending := shipping.entries[sequence+1-oldest:]
+			if len(pending) > maxShippedEntries {
+				pending = pending[:maxShippedEntries]
+			}
+			batch.Entries = append(batch.Entries, pending...)
+		}
+		shipping.mutex.Unlock()
+		if err != nil || len(batch.Entries) > 0 {
+			return batch, err
+		}
+
+		select {
+		case <-changed:
+		case <-timeout:
+			return batch, nil
+		case <-draining:
+			return batch, nil
+		case <-done:
+			return batch, ErrWatchCancelled
+		}
+	}
+}
+
+// replica is the node this process runs with -replica-of, or nil.
+var replica *replicaNode
+
+// startReplica starts replicating if -replica-of is set.
+func startReplica(ids idMap) error {
+	if *replicaOf == "" {
+		return nil
+	}
+	if *clusterPeers != "" {
+		return errors.New("-replica-of can't be combined with -cluster-peers")
+	}
+	if err := checkStandalone("on a replica"); err != nil {
+		return err
+	}
+	replica = newReplicaNode(ids, *replicaOf)
+	replica.start()
+	return nil
+}
+
+// replicaNode tails a primary's log into ids, starting over from a snapshot
+// whenever its position in the log is lost. Once promoted it stops, and ids
+// is written to like any primary's.
+type replicaNode struct {
+	ids           idMap
+	primary       string
+	client        *http.Client
+	pollTimeout   time.Duration
+	retryInterval time.Duration
+	context       context.Context
+	cancel        context.CancelFunc
+
+	mutex           sync.Mutex
+	epoch           string
+	applied         uint64
+	primarySequence uint64
+	connected       bool
+	lastContact     time.Time
+	behindSince     time.Time
+	promoted        bool
+}
+
+// errPromoted stops a replica that was promoted while it was polling.
+var errPromoted = errors.New("promoted to primary")
+
+func newReplicaNode(ids idMap, primary string) *replicaNode {
+	replica := &replicaNode{
+		ids:           ids,
+		primary:       primary,
+		client:        &http.Client{},
+		pollTimeout:   30 * time.Second,
+		retryInterval: time.Second,
+	}
+	replica.context, replica.cancel = context.WithCancel(context.Background())
+	return replica
+}
+
+func (replica *replicaNode) start() {
+	go replica.run()
+}
+
+func (replica *replicaNode) stop() {
+	replica.cancel()
+}
+
+func (replica *replicaNode) run() {
+	for {
+		err := replica.poll()
+		if err == errPromoted || replica.context.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Print("replication: ", err)
+			replica.mutex.Lock()
+			replica.connected = false
+			replica.mutex.Unlock()
+			select {
+			case <-replica.context.Done():
+				return
+			case <-time.After(replica.retryInterval):
+			}
+		}
+	}
+}
+
+// poll applies the next entries in the primary's log, or a snapshot if the
+// replica has no position in it.
+func (replica *replicaNode) poll() error {
+	replica.mutex.Lock()
+	epoch, applied := replica.epoch, replica.applied
+	replica.mutex.Unlock()
+	if epoch == "" {
+		return replica.resync()
+	}
+
+	var batch replicationBatch
+	path := fmt.Sprintf("/replication/log?epoch=%s&after=%d&timeout=%d", epoch, applied, int(replica.pollTimeout/time.Second))
+	err := replica.get(path, &batch)
+	if apiError, ok := err.(*APIError); ok && apiError.Code == CodeConflict {
+		log.Print("replication: ", err, "; starting over from a snapshot")
+		replica.mutex.Lock()
+		replica.epoch = ""
+		replica.mutex.Unlock()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	replica.mutex.Lock()
+	defer replica.mutex.Unlock()
+	if replica.promoted {
+		return errPromoted
+	}
+	for _, entry := range batch.Entries {
+		if entry.Sequence != replica.applied+1 {
+			replica.epoch = ""
+			return nil
+		}
+		replica.ids.applyCommand(entry.Command)
+		replica.applied = entry.Sequence
+	}
+	replica.contact(batch.Sequence)
+	return nil
+}
+
+func (replica *replicaNode) resync() error {
+	var snapshot replicationSnapshot
+	if err := replica.get("/replication/snapshot", &snapshot); err != nil {
+		return err
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	replica.mutex.Lock()
+	defer replica.mutex.Unlock()
+	if replica.promoted {
+		return errPromoted
+	}
+	replica.ids.loadSnapshot(snapshot)
+	replica.epoch = snapshot.Epoch
+	replica.applied = snapshot.Sequence
+	replica.contact(snapshot.Sequence)
+	return nil
+}
+
+// contact records that the primary's log reached sequence. The caller must
+// hold the replica's mutex.
+func (replica *replicaNode) contact(sequence uint64) {
+	now := time.Now()
+	replica.primarySequence = sequence
+	replica.connected = true
+	replica.lastContact = now
+	if replica.applied >= sequence {
+		replica.behindSince = time.Time{}
+	} else if replica.behindSince.IsZero() {
+		replica.behindSince = now
+	}
+}
+
+// get decodes a JSON response from the primary, or the APIError it failed
+// with.
+func (replica *replicaNode) get(path string, response interface{}) error {
+	request, err := http.NewRequest("GET", replica.primary+path, nil)
+	if err != nil {
+		return err
+	}
+	httpResponse, err := replica.client.Do(request.WithContext(replica.context))
+	if err != nil {
+		return err
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode != http.StatusOK {
+		apiError := &APIError{}
+		if err := json.NewDecoder(httpResponse.Body).Decode(apiError); err != nil || apiError.Code == "" {
+			return fmt.Errorf("%s%s returned %s", replica.primary, path, httpResponse.Status)
+		}
+		return apiError
+	}
+	return json.NewDecoder(httpResponse.Body).Decode(response)
+}
+
+// promote stops replicating, so that writes are accepted. The caller must
+// hold the mutex.
+func (replica *replicaNode) promote() {
+	replica.mutex.Lock()
+	defer replica.mutex.Unlock()
+	replica.promoted = true
+	replica.cancel()
+}
+
+func (replica *replicaNode) isPromoted() bool {
+	replica.mutex.Lock()
+	defer replica.mutex.Unlock()
+	return replica.promoted
+}
+
+func (replica *replicaNode) status() ReplicationStatus {
+	epoch, sequence := shipped.position()
+	primary := ReplicationStatus{Role: replicationPrimary, Epoch: epoch, Sequence: sequence, PrimarySequence: sequence, Connected: true}
+	if replica == nil {
+		return primary
+	}
+	replica.mutex.Lock()
+	defer replica.mutex.Unlock()
+	if replica.promoted {
+		return primary
+	}
+	status := ReplicationStatus{
+		Role:            replicationReplica,
+		Primary:         replica.primary,
+		Epoch:           replica.epoch,
+		Sequence:        replica.applied,
+		PrimarySequence: replica.primarySequence,
+		Connected:       replica.connected,
+	}
+	if replica.primarySequence > replica.applied {
+		status.Lag = replica.primarySequence - replica.applied
+	}
+	if !replica.behindSince.IsZero() {
+		status.LagSeconds = time.Since(replica.behindSince).Seconds()
+	}
+	if !replica.lastContact.IsZero() {
+		lastContact := replica.lastContact
+		status.LastContact = &lastContact
+	}
+	return status
+}
+
+// loadSnapshot replaces the counters, their configs and the leases with a
+// snapshot's, recording each counter that differs as a change, so that
+// watchers see it. The caller must hold the mutex.
+func (ids idMap) loadSnapshot(snapshot replicationSnapshot) {
+	previous := ids.Copy()
+	ids.resetState()
+	for environment, counters := range snapshot.Counters {
+		ids[environment] = map[string]int{}
+		for name, id := range counters {
+			ids[environment][name] = id
+			if old, ok := previous[environment][name]; !ok || old != id {
+				changes.record(ChangeSet, name, environment, id)
+			}
+		}
+	}
+	for environment, counters := range previous {
+		for name, id := range counters {
+			if _, ok := ids[environment][name]; !ok {
+				changes.record(ChangeDelete, name, environment, id)
+			}
+		}
+	}
+	for _, command := range snapshot.Configs {
+		ids.applyCommand(command)
+	}
+	for _, command := range snapshot.Leases {
+		ids.applyCommand(command)
+	}
+}
+
+// snapshot returns every counter, config and lease as of the log's sequence.
+// The caller must hold the mutex.
+func (ids idMap) snapshot() replicationSnapshot {
+	epoch, sequence := shipped.position()
+	snapshot := replicationSnapshot{Epoch: epoch, Sequence: sequence, Counters: ids.Copy(), Configs: []raftCommand{}, Leases: leases.commands()}
+	for key, config := range configs {
+		config := config
+		snapshot.Configs = append(snapshot.Configs, raftCommand{Type: commandConfig, Environment: key.Environment, Name: key.Name, Config: &config})
+	}
+	return snapshot
+}
+
+// readOnly redirects writes to the primary until the replica is promoted.
+func readOnly(replica *replicaNode) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		if !isWrite(context.Request) || replica.isPromoted() {
+			context.Next()
+			return
+		}
+		redirectTo(context, replica.primary)
+	}
+}
+
+// replicationLogRequest is the query accepted by the log route.
+type replicationLogRequest struct {
+	Epoch   string      `form:"epoch" json:"epoch"`
+	After   json.Number `form:"after" json:"after" binding:"integer"`
+	Timeout int         `form:"timeout" json:"timeout" binding:"omitempty,min=1,max=300"`
+}
+
+// setupReplicationRoutes serves the node's status and promotion, and the log
+// and snapshots replicas tail. Every node ships its log, so any of them can
+// be replicated; node is nil unless this one is a replica.
+func (ids idMap) setupReplicationRoutes(router gin.IRoutes, node *replicaNode) {
+	router.GET("/v2/replication", func(context *gin.Context) {
+		respond(context, http.StatusOK, node.status())
+	})
+	router.POST("/v2/replication/promote", func(context *gin.Context) {
+		if node == nil {
+			abortWithError(context, ErrNotReplica)
+			return
+		}
+		mutex.Lock()
+		node.promote()
+		mutex.Unlock()
+		respond(context, http.StatusOK, node.status())
+	})
+	router.GET("/replication/snapshot", func(context *gin.Context) {
+		mutex.Lock()
+		snapshot := ids.snapshot()
+		mutex.Unlock()
+		context.JSON(http.StatusOK, snapshot)
+	})
+	router.GET("/replication/log", func(context *gin.Context) {
+		var request replicationLogRequest
+		if err := bindRequest(context, &request); err != nil {
+			abortWithError(context, err)
+			return
+		}
+		after, _ := request.After.Int64()
+		if request.Timeout == 0 {
+			request.Timeout = defaultWatchTimeout
+		}
+		timeout := time.NewTimer(time.Duration(request.Timeout) * time.Second)
+		defer timeout.Stop()
+
+		batch, err := shipped.since(request.Epoch, uint64(after), context.Request.Context().Done(), timeout.C)
+		if err == ErrWatchCancelled {
+			return
+		}
+		if err != nil {
+			abortWithError(context, err)
+			return
+		}
+		context.JSON(http.StatusOK, batch)
+	})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReplicaTailsPrimary(t *testing.T) {
+	// setup
+	primaryIDs := NewIDMap()
+	mutex.Lock()
+	primaryIDs.Set("records", "live", 100)
+	primaryIDs.Set("orders", "live", 7)
+	mutex.Unlock()
+	primary := httptest.NewServer(primaryIDs.SetupRouter())
+	defer primary.Close()
+
+	ids := NewIDMap()
+	replica = newReplicaNode(ids, primary.URL)
+	replica.pollTimeout = time.Second
+	replica.retryInterval = 10 * time.Millisecond
+	node := replica
+	testRouter := ids.SetupRouter()
+	replica = nil
+	node.start()
+	defer node.stop()
+	peek := func(name string) int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return ids["live"][name]
+	}
+
+	// test that the replica starts from a snapshot
+	waitFor(t, "the replica to load the snapshot", func() bool { return peek("records") == 100 && peek("orders") == 7 })
+
+	// test that it then follows the primary's changes
+	http.Get(primary.URL + "/getter/live/records")
+	request, _ := http.NewRequest("DELETE", primary.URL+"/v2/environments/live/counters/orders", nil)
+	http.DefaultClient.Do(request)
+	waitFor(t, "the replica to apply the increment", func() bool { return peek("records") == 100+incrementBy })
+	waitFor(t, "the replica to apply the delete", func() bool { return peek("orders") == 0 })
+
+	// test that reads are served and writes are redirected to the primary
+	if response := serveAccept(t, testRouter, "/v2/environments/live/counters/records", ""); response.Code != 200 {
+		t.Error("Expected status code 200, got ", response.Code)
+	}
+	for _, write := range []struct{ method, path string }{
+		{"GET", "/getter/live/records"},
+		{"POST", "/v2/environments/live/counters/records:next"},
+	} {
+		request, _ := http.NewRequest(write.method, write.path, nil)
+		response := httptest.NewRecorder()
+		testRouter.ServeHTTP(response, request)
+		if response.Code != 307 || response.Header().Get("Location") != primary.URL+write.path {
+			t.Errorf("Expected %s to redirect to the primary, got %d %v", write.path, response.Code, response.Header())
+		}
+	}
+
+	// test that it reports no lag once caught up
+	var status ReplicationStatus
+	response := serveAccept(t, testRouter, "/v2/replication", "")
+	json.Unmarshal(response.Body.Bytes(), &status)
+	if status.Role != replicationReplica || status.Lag != 0 || !status.Connected || status.Primary != primary.URL {
+		t.Errorf("Expected a connected replica without lag, got `%s`", response.Body)
+	}
+
+	// test that once promoted, it accepts writes and stops following
+	request, _ = http.NewRequest("POST", "/v2/replication/promote", nil)
+	response = httptest.NewRecorder()
+	testRouter.ServeHTTP(response, request)
+	if response.Code != 200 || node.status().Role != replicationPrimary {
+		t.Errorf("Expected the replica to be promoted, got %d `%s`", response.Code, response.Body)
+	}
+	code, counter := serveV2(t, testRouter, "POST", "/v2/environments/live/counters/records:next", "")
+	if code != 200 || counter.ID != 100+2*incrementBy {
+		t.Errorf("Expected %d, got %d %v", 100+2*incrementBy, code, counter)
+	}
+	http.Get(primary.URL + "/getter/live/records")
+	time.Sleep(50 * time.Millisecond)
+	if id := peek("records"); id != 100+2*incrementBy {
+		t.Error("Expected the promoted replica to ignore the old primary, got ", id)
+	}
+}
+
+func TestShippingLog(t *testing.T) {
+	// setup
+	shipping := newShippingLog(3)
+	for id := 1; id <= 5; id++ {
+		shipping.append(raftCommand{Type: ChangeSet, Name: "records", Environment: "live", ID: id})
+	}
+	timeout := make(chan time.Time)
+	close(timeout)
+
+	tests := []struct {
+		epoch    string
+		after    uint64
+		err      error
+		sequence uint64
+	}{
+		{shipping.epoch, 2, nil, 3},
+		{"", 4, nil, 5},
+		{shipping.epoch, 5, nil, 0},
+		{shipping.epoch, 1, ErrHistoryCompacted, 0},
+		{shipping.epoch, 6, ErrSequenceUnknown, 0},
+		{"other", 2, ErrEpochChanged, 0},
+	}
+
+	for _, test := range tests {
+		batch, err := shipping.since(test.epoch, test.after, nil, timeout)
+		// test for the first entry returned, or the error
+		if err != test.err {
+			t.Errorf("Expected %v after %d, got %v", test.err, test.after, err)
+		}
+		if test.sequence != 0 && (len(batch.Entries) == 0 || batch.Entries[0].Sequence != test.sequence) {
+			t.Errorf("Expected entries from %d, got %v", test.sequence, batch.Entries)
+		}
+		if test.sequence == 0 && len(batch.Entries) != 0 {
+			t.Error("Expected no entries, got ", batch.Entries)
+		}
+	}
+}
+
+func TestPromotePrimary(t *testing.T) {
+	// setup
+	testRouter := NewIDMap().SetupRouter()
+	request, _ := http.NewRequest("POST", "/v2/replication/promote", nil)
+	response := httptest.NewRecorder()
+	testRouter.ServeHTTP(response, request)
+
+	// test for 409 response code
+	if response.Code != 409 {
+		t.Error("Expected status code 409, got ", response.Code)
+	}
+}
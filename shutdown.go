@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	drainDelay      = flag.Duration("drain-delay", 5*time.Second, "how long to keep serving on SIGTERM or SIGINT, failing /readyz, before draining")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "how long to wait for in-flight requests to finish on SIGTERM or SIGINT")
+	snapshotFile    = flag.String("snapshot-file", "", "file to load the counters from on start, and write every counter to, as an export, once shut down")
+)
+
+// unready is closed as soon as the server starts shutting down, failing
+// readiness probes so load balancers stop sending it traffic before it
+// drains.
+var unready = make(chan struct{})
+
+// draining is closed once the server starts draining, ending long polls and
+// event streams early so they don't hold up the drain.
+var draining = make(chan struct{})
+
+// shutdownHooks stop the listeners besides the HTTP API, giving up on
+// anything still in flight once deadline is closed. Listeners register them
+// once listening.
+var shutdownHooks = struct {
+	mutex sync.Mutex
+	hooks []func(deadline <-chan struct{}) error
+}{}
+
+func onShutdown(hook func(deadline <-chan struct{}) error) {
+	shutdownHooks.mutex.Lock()
+	defer shutdownHooks.mutex.Unlock()
+	shutdownHooks.hooks = append(shutdownHooks.hooks, hook)
+}
+
+func isUnready() bool {
+	select {
+	case <-unready:
+		return true
+	default:
+		return false
+	}
+}
+
+func isDraining() bool {
+	select {
+	case <-draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// connectionTracker follows the connections a listener besides the HTTP API
+// has open, so shutting down can close those waiting for a command, and wait
+// for the others to finish the one they're serving.
+type connectionTracker struct {
+	mutex sync.Mutex
+	// busy is whether each connection is serving a command
+	busy   map[net.Conn]bool
+	closed bool
+	idle   chan struct{}
+}
+
+func newConnectionTracker() *connectionTracker {
+	return &connectionTracker{busy: map[net.Conn]bool{}, idle: make(chan struct{})}
+}
+
+// add follows a new connection, or returns false once the tracker is
+// closed.
+func (connections *connectionTracker) add(connection net.Conn) bool {
+	connections.mutex.Lock()
+	defer connections.mutex.Unlock()
+	if connections.closed {
+		return false
+	}
+	connections.busy[connection] = false
+	return true
+}
+
+func (connections *connectionTracker) remove(connection net.Conn) {
+	connections.mutex.Lock()
+	defer connections.mutex.Unlock()
+	delete(connections.busy, connection)
+	if connections.closed && len(connections.busy) == 0 {
+		close(connections.idle)
+	}
+}
+
+// begin marks a connection as serving the command it has read, or returns
+// false once the tracker is closed, when the command should be dropped
+// unanswered.
+func (connections *connectionTracker) begin(connection net.Conn) bool {
+	connections.mutex.Lock()
+	defer connections.mutex.Unlock()
+	if connections.closed {
+		return false
+	}
+	connections.busy[connection] = true
+	return true
+}
+
+// end marks a connection as waiting for its next command, or returns false
+// once the tracker is closed, when the connection should be closed once its
+// reply is flushed.
+func (connections *connectionTracker) end(connection net.Conn) bool {
+	connections.mutex.Lock()
+	defer connections.mutex.Unlock()
+	connections.busy[connection] = false
+	return !connections.closed
+}
+
+// drain closes listener, and the connections waiting for a command, then
+// waits for the rest to finish theirs. At deadline it closes them too,
+// failing.
+func (connections *connectionTracker) drain(listener net.Listener, protocol string, deadline <-chan struct{}) error {
+	listener.Close()
+	connections.mutex.Lock()
+	if !connections.closed {
+		connections.closed = true
+		for connection, busy := range connections.busy {
+			if !busy {
+				connection.Close()
+			}
+		}
+		if len(connections.busy) == 0 {
+			close(connections.idle)
+		}
+	}
+	connections.mutex.Unlock()
+	select {
+	case <-connections.idle:
+		return nil
+	case <-deadline:
+	}
+	connections.mutex.Lock()
+	defer connections.mutex.Unlock()
+	for connection := range connections.busy {
+		connection.Close()
+	}
+	return fmt.Errorf("%s commands still in flight after -shutdown-timeout were cut off", protocol)
+}
+
+// shutdownError is returned by serve when it was stopped, but not cleanly:
+// requests were cut off, or the final snapshot wasn't written.
+type shutdownError struct {
+	problems []string
+}
+
+func (err shutdownError) Error() string {
+	return "shut down uncleanly: " + strings.Join(err.problems, "; ")
+}
+
+// shutdown fails readiness probes, and keeps serving for delay so load
+// balancers notice. It then stops accepting connections and waits, up to
+// timeout, for the requests in flight to finish, before it stops replicating,
+// hands back what's left of any leases, and writes every counter to file, if
+// it's set. It leaves the store locked, so nothing changes after the final
+// snapshot.
+func (ids idMap) shutdown(server *http.Server, delay, timeout time.Duration, file string) error {
+	close(unready)
+	time.Sleep(delay)
+	close(draining)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	problems := []string{}
+	if err := server.Shutdown(ctx); err != nil {
+		server.Close()
+		problems = append(problems, "requests still in flight after -shutdown-timeout were cut off")
+	}
+	shutdownHooks.mutex.Lock()
+	hooks := shutdownHooks.hooks
+	shutdownHooks.mutex.Unlock()
+	for _, hook := range hooks {
+		if err := hook(ctx.Done()); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if leaser != nil {
+		leaser.releaseAll()
+	}
+	if replica != nil {
+		replica.stop()
+	}
+	if cluster != nil {
+		cluster.stop()
+	}
+
+	mutex.Lock()
+	if file != "" {
+		export := ids.Export()
+		if err := writeSnapshotFile(file, export); err != nil {
+			problems = append(problems, "writing the final snapshot: "+err.Error())
+		} else {
+			log.Printf("wrote %d counters, as of sequence %d, to %s", len(export.Counters), export.Sequence, file)
+		}
+	}
+	if len(problems) > 0 {
+		return shutdownError{problems}
+	}
+	return nil
+}
+
+// loadSnapshotFile imports the counters written to file by the last
+// shutdown, if there are any, so they carry over a restart. It fails if file
+// exists but can't be read or imported, rather than starting over from
+// nothing.
+func (ids idMap) loadSnapshotFile(file string) error {
+	encoded, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var export Export
+	if err := json.Unmarshal(encoded, &export); err != nil {
+		return fmt.Errorf("reading the snapshot in %s: %v", file, err)
+	}
+	if err := validateStruct(&export); err != nil {
+		return fmt.Errorf("reading the snapshot in %s: %v", file, err)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if _, err := ids.Import(export, ImportFailOnConflict, false); err != nil {
+		return fmt.Errorf("importing the snapshot in %s: %v", file, err)
+	}
+	log.Printf("loaded %d counters, as of sequence %d, from %s", len(export.Counters), export.Sequence, file)
+	return nil
+}
+
+// writeSnapshotFile writes export to file, replacing it only once the new
+// contents are synced to disk, so a crash leaves the old snapshot or the new
+// one, never part of either.
+func writeSnapshotFile(file string, export Export) error {
+	encoded, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileSynced(file, append(encoded, '\n'))
+}
+
+// writeFileSynced replaces file with data, so that after a crash it holds
+// either all of data or what it held before.
+func writeFileSynced(file string, data []byte) error {
+	temporary, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temporary.Name())
+	if _, err := temporary.Write(data); err != nil {
+		temporary.Close()
+		return err
+	}
+	if err := temporary.Sync(); err != nil {
+		temporary.Close()
+		return err
+	}
+	if err := temporary.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(temporary.Name(), file); err != nil {
+		return err
+	}
+	return syncDirectory(filepath.Dir(file))
+}
+
+// syncDirectory makes the files created in, or renamed into, a directory
+// durable.
+func syncDirectory(path string) error {
+	directory, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer directory.Close()
+	return directory.Sync()
+}
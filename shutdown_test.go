@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// startServer serves router as serve does, returning the server and its URL.
+func startServer(t *testing.T, router http.Handler) (*http.Server, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: router}
+	go server.Serve(listener)
+	return server, "http://" + listener.Addr().String()
+}
+
+func TestShutdown(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	mutex.Lock()
+	ids.Set("records", "live", 100)
+	ids.Set("orders", "dev", 7)
+	mutex.Unlock()
+	server, url := startServer(t, ids.SetupRouter())
+	file := filepath.Join(t.TempDir(), "counters.json")
+	defer func() {
+		unready = make(chan struct{})
+		draining = make(chan struct{})
+	}()
+
+	watched := make(chan int)
+	go func() {
+		response, err := http.Get(url + "/v2/environments/live/counters/records/watch?after=100&timeout=300")
+		if err != nil {
+			watched <- 0
+			return
+		}
+		response.Body.Close()
+		watched <- response.StatusCode
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	stopped := make(chan error)
+	go func() {
+		stopped <- ids.shutdown(server, 200*time.Millisecond, 5*time.Second, file)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// test that during the drain delay, requests are still served but the
+	// node isn't ready
+	response, err := http.Get(url + "/readyz")
+	if err != nil {
+		t.Fatal("Expected requests served during the drain delay, got ", err)
+	}
+	var health Health
+	json.NewDecoder(response.Body).Decode(&health)
+	response.Body.Close()
+	if response.StatusCode != 503 || !reflect.DeepEqual(health.Reasons, []string{"shutting down"}) {
+		t.Errorf("Expected status code 503 while shutting down, got %d %v", response.StatusCode, health)
+	}
+
+	// test that long polls are ended, so the drain finishes in time
+	if err := <-stopped; err != nil {
+		t.Error("Expected a clean shutdown, got ", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Error("Expected the watch ended early, took ", elapsed)
+	}
+	if code := <-watched; code == 0 {
+		t.Error("Expected the watch answered rather than cut off")
+	}
+
+	// test that the store is left locked, with its final snapshot on disk
+	if mutex.TryLock() {
+		t.Error("Expected the store left locked")
+	}
+	mutex.Unlock()
+	encoded, err := ioutil.ReadFile(file)
+	var export Export
+	if err != nil || json.Unmarshal(encoded, &export) != nil {
+		t.Fatalf("Expected an export in %s, got %v `%s`", file, err, encoded)
+	}
+	expected := []ExportedCounter{{Environment: "dev", Name: "orders", ID: 7}, {Environment: "live", Name: "records", ID: 100}}
+	if !reflect.DeepEqual(export.Counters, expected) {
+		t.Error("Expected the counters exported, got ", export.Counters)
+	}
+
+	// test that new connections are refused
+	if _, err := http.Get(url + "/healthz"); err == nil {
+		t.Error("Expected the server closed")
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	// setup
+	router := NewIDMap().SetupRouter()
+	release := make(chan struct{})
+	defer close(release)
+	router.GET("/slow", func(*gin.Context) {
+		<-release
+	})
+	server, url := startServer(t, router)
+	defer func() {
+		unready = make(chan struct{})
+		draining = make(chan struct{})
+	}()
+	go http.Get(url + "/slow")
+	time.Sleep(50 * time.Millisecond)
+
+	// test that requests still in flight at the deadline are cut off, and the
+	// shutdown reported unclean
+	err := NewIDMap().shutdown(server, 0, 50*time.Millisecond, filepath.Join(os.DevNull, "missing", "counters.json"))
+	mutex.Unlock()
+	problems, ok := err.(shutdownError)
+	if !ok || len(problems.problems) != 2 {
+		t.Error("Expected the cut off requests and failed snapshot reported, got ", err)
+	}
+}
+
+func TestLoadSnapshotFile(t *testing.T) {
+	// setup
+	directory := t.TempDir()
+	file := filepath.Join(directory, "counters.json")
+	ids := NewIDMap()
+	mutex.Lock()
+	ids.Set("records", "live", 100)
+	export := ids.Export()
+	mutex.Unlock()
+	if err := writeSnapshotFile(file, export); err != nil {
+		t.Fatal(err)
+	}
+
+	// test that the last shutdown's counters are loaded
+	loaded := NewIDMap()
+	if err := loaded.loadSnapshotFile(file); err != nil || loaded["live"]["records"] != 100 {
+		t.Errorf("Expected the counters loaded, got %v (%v)", loaded, err)
+	}
+
+	// test that a missing file starts empty, but one that can't be read
+	// fails
+	if err := NewIDMap().loadSnapshotFile(filepath.Join(directory, "missing.json")); err != nil {
+		t.Error("Expected a missing snapshot to be skipped, got ", err)
+	}
+	ioutil.WriteFile(file, []byte(`{"version": 1, "counters": [`), 0644)
+	if err := NewIDMap().loadSnapshotFile(file); err == nil {
+		t.Error("Expected a damaged snapshot to fail")
+	}
+	if err := NewIDMap().loadSnapshotFile(directory); err == nil {
+		t.Error("Expected an unreadable snapshot to fail")
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+// snapshotVersionHeader is set on listings to the version of the snapshot
+// they were served from, and changePositionHeader to the same as a position
+// in the change feed, to fetch the changes after.
+const (
+	snapshotVersionHeader = "X-Snapshot-Version"
+	changePositionHeader  = "X-Change-Position"
+)
+
+// resets counts calls to resetState, which empties the counters without
+// feeding the change feed, so no snapshot from before one is reused. It's
+// guarded by the mutex.
+var resets uint64
+
+// counterSnapshot is every counter as of Version, the change feed's sequence
+// when it was taken. Its maps are never changed once taken, so it's read
+// without holding any lock.
+type counterSnapshot struct {
+	Version uint64
+	IDs     idMap
+	resets  uint64
+}
+
+// snapshotter takes snapshots of a set of counters for listing them. Each
+// snapshot shares the maps of the environments that haven't changed since
+// the one before, found from the change feed, so only the changed ones are
+// copied while writers are held up. Its latest snapshot is guarded by the
+// mutex.
+type snapshotter struct {
+	ids    idMap
+	latest counterSnapshot
+}
+
+func (ids idMap) newSnapshotter() *snapshotter {
+	return &snapshotter{ids: ids}
+}
+
+// take returns a snapshot of the counters as they are now.
+func (snapshots *snapshotter) take() counterSnapshot {
+	mutex.Lock()
+	defer mutex.Unlock()
+	version, _ := changes.wait()
+	latest := snapshots.latest
+	if latest.IDs != nil && latest.resets == resets && latest.Version == version {
+		return latest
+	}
+
+	var pending []Change
+	var err error
+	if latest.IDs != nil && latest.resets == resets {
+		pending, err = changes.since(latest.Version)
+	}
+	snapshot := counterSnapshot{Version: version, resets: resets}
+	if latest.IDs == nil || latest.resets != resets || err != nil {
+		snapshot.IDs = snapshots.ids.Copy()
+	} else {
+		snapshot.IDs = make(idMap, len(snapshots.ids))
+		for environment, names := range latest.IDs {
+			snapshot.IDs[environment] = names
+		}
+		copied := map[string]bool{}
+		for _, change := range pending {
+			if !copied[change.Environment] {
+				snapshot.IDs.copyEnvironment(snapshots.ids, change.Environment)
+				copied[change.Environment] = true
+			}
+		}
+	}
+	snapshots.latest = snapshot
+	return snapshot
+}
+
+// copyEnvironment replaces an environment's map, shared with an earlier
+// snapshot, with a copy of it in from, or drops it if from has none.
+func (ids idMap) copyEnvironment(from idMap, environment string) {
+	names, ok := from[environment]
+	if !ok {
+		delete(ids, environment)
+		return
+	}
+	copied := make(map[string]int, len(names))
+	for name, id := range names {
+		copied[name] = id
+	}
+	ids[environment] = copied
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestSnapshotter(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	mutex.Lock()
+	ids.Set("records", "live", 100)
+	ids.Set("records", "dev", 7)
+	mutex.Unlock()
+	snapshots := ids.newSnapshotter()
+	first := snapshots.take()
+
+	// test that an unchanged store gives the same snapshot
+	if again := snapshots.take(); again.Version != first.Version || reflect.ValueOf(again.IDs).Pointer() != reflect.ValueOf(first.IDs).Pointer() {
+		t.Error("Expected the snapshot to be reused, got ", again)
+	}
+
+	// test that only the changed environment is copied, leaving the first snapshot as it was
+	mutex.Lock()
+	ids.Get("records", "live")
+	ids.Set("orders", "staging", 1)
+	mutex.Unlock()
+	second := snapshots.take()
+	if second.Version <= first.Version {
+		t.Errorf("Expected a version after %d, got %d", first.Version, second.Version)
+	}
+	if !reflect.DeepEqual(second.IDs, idMap{"live": {"records": 100 + incrementBy}, "dev": {"records": 7}, "staging": {"orders": 1}}) {
+		t.Error("Expected the snapshot to match the counters, got ", second.IDs)
+	}
+	if reflect.ValueOf(second.IDs["dev"]).Pointer() != reflect.ValueOf(first.IDs["dev"]).Pointer() {
+		t.Error("Expected the unchanged environment to be shared")
+	}
+	if first.IDs["live"]["records"] != 100 || len(first.IDs) != 2 {
+		t.Error("Expected the first snapshot unchanged, got ", first.IDs)
+	}
+
+	// test that deletes and resets are reflected
+	mutex.Lock()
+	ids.Delete("records", "dev")
+	mutex.Unlock()
+	if third := snapshots.take(); len(third.IDs) != 2 || third.IDs["dev"] != nil {
+		t.Error("Expected the deleted environment dropped, got ", third.IDs)
+	}
+	mutex.Lock()
+	ids.resetState()
+	mutex.Unlock()
+	if fourth := snapshots.take(); len(fourth.IDs) != 0 {
+		t.Error("Expected an empty snapshot after a reset, got ", fourth.IDs)
+	}
+}
+
+func TestListingsCarrySnapshotVersion(t *testing.T) {
+	// setup
+	testRouter := NewIDMap().SetupRouter()
+	code, _ := serveV2(t, testRouter, "POST", "/v2/environments/live/counters/records"+nextSuffix, "")
+	if code != 200 {
+		t.Fatal("Expected status code 200, got ", code)
+	}
+	version, _ := changes.wait()
+
+	for _, path := range []string{"/lister", "/v2/counters"} {
+		request, _ := http.NewRequest("GET", path, nil)
+		response := httptest.NewRecorder()
+		testRouter.ServeHTTP(response, request)
+
+		// test for the version of the snapshot served
+		if header := response.Header().Get(snapshotVersionHeader); header != strconv.FormatUint(version, 10) {
+			t.Errorf("Expected version %d from %s, got `%s`", version, path, header)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"sort"
+)
+
+// What applying a Spec does to each counter.
+const (
+	PlanCreate = "create"
+	PlanUpdate = "update"
+	PlanDelete = "delete"
+)
+
+// Spec declares the counters of some environments, keyed by environment and
+// then name. Applying it creates or reconfigures every counter listed, and
+// deletes every other counter in the environments it lists.
+type Spec struct {
+	Environments map[string]map[string]CounterSpec `json:"environments" yaml:"environments" binding:"required"`
+}
+
+// CounterSpec is a counter's config in a Spec. Numbers left out take the
+// server's defaults, with the default start moved within min and max.
+type CounterSpec struct {
+	Start     *int   `json:"start,omitempty" yaml:"start,omitempty"`
+	Step      *int   `json:"step,omitempty" yaml:"step,omitempty"`
+	Min       *int   `json:"min,omitempty" yaml:"min,omitempty"`
+	Max       *int   `json:"max,omitempty" yaml:"max,omitempty"`
+	Format    string `json:"format,omitempty" yaml:"format,omitempty"`
+	Monotonic bool   `json:"monotonic,omitempty" yaml:"monotonic,omitempty"`
+}
+
+// PlanChange is what applying a Spec does to one counter. ID and Config are
+// the counter as it is, absent for counters it creates, and NewID and
+// NewConfig as it will be, absent if they don't change. Refused explains
+// why applying would fail instead.
+type PlanChange struct {
+	Action      string         `json:"action" yaml:"action"`
+	Environment string         `json:"environment" yaml:"environment"`
+	Name        string         `json:"name" yaml:"name"`
+	ID          *int           `json:"id,omitempty" yaml:"id,omitempty"`
+	NewID       *int           `json:"new_id,omitempty" yaml:"new_id,omitempty"`
+	Config      *CounterConfig `json:"config,omitempty" yaml:"config,omitempty"`
+	NewConfig   *CounterConfig `json:"new_config,omitempty" yaml:"new_config,omitempty"`
+	Refused     string         `json:"refused,omitempty" yaml:"refused,omitempty"`
+}
+
+// Plan is every change applying a Spec makes, or made, sorted by environment
+// and then name.
+type Plan struct {
+	Created   int          `json:"created" yaml:"created"`
+	Updated   int          `json:"updated" yaml:"updated"`
+	Deleted   int          `json:"deleted" yaml:"deleted"`
+	Unchanged int          `json:"unchanged" yaml:"unchanged"`
+	Refused   int          `json:"refused" yaml:"refused"`
+	Changes   []PlanChange `json:"changes" yaml:"changes"`
+}
+
+func (ids idMap) setupSpecRoutes(router gin.IRoutes) {
+	router.POST("/v2/plan", ids.planSpec)
+	router.POST("/v2/apply", ids.applySpec)
+}
+
+// planSpec and applySpec take a force query parameter, allowing counters
+// moved outside their new bounds to be lowered to their start.
+func (ids idMap) planSpec(context *gin.Context) {
+	var spec Spec
+	if err := bindYAMLRequest(context, &spec); err != nil {
+		abortWithError(context, err)
+		return
+	}
+	mutex.Lock()
+	plan, err := ids.Plan(spec, context.Query("force") == "true")
+	mutex.Unlock()
+	if err != nil {
+		abortWithError(context, err)
+		return
+	}
+	respond(context, http.StatusOK, plan)
+}
+
+func (ids idMap) applySpec(context *gin.Context) {
+	var spec Spec
+	if err := bindYAMLRequest(context, &spec); err != nil {
+		abortWithError(context, err)
+		return
+	}
+	mutex.Lock()
+	plan, err := ids.Apply(spec, context.Query("force") == "true")
+	mutex.Unlock()
+	if err != nil {
+		abortWithError(context, err)
+		return
+	}
+	respond(context, http.StatusOK, plan)
+}
+
+// config resolves the spec against the server's defaults.
+func (spec CounterSpec) config() CounterConfig {
+	config := defaultConfig()
+	for _, field := range []struct {
+		value *int
+		into  *int
+	}{{spec.Step, &config.Step}, {spec.Min, &config.Min}, {spec.Max, &config.Max}} {
+		if field.value != nil {
+			*field.into = *field.value
+		}
+	}
+	if spec.Start != nil {
+		config.Start = *spec.Start
+	} else if config.Start < config.Min {
+		config.Start = config.Min
+	} else if config.Start > config.Max {
+		config.Start = config.Max
+	}
+	config.Format = spec.Format
+	config.Monotonic = spec.Monotonic
+	return config
+}
+
+// Plan diffs spec against the counters, without changing anything. It fails
+// if the spec is invalid, but reports changes that applying would refuse,
+// including lowering counters to their start unless force is set. The
+// caller must hold the mutex.
+func (ids idMap) Plan(spec Spec, force bool) (Plan, error) {
+	plan := Plan{Changes: []PlanChange{}}
+	details := []*APIError{}
+	for _, environment := range sortedKeys(spec.Environments) {
+		if !identifierRegex.MatchString(environment) || len(environment) > 64 {
+			message := "must be 1 to 64 letters, digits, `.`, `_` or `-`"
+			details = append(details, prefixedErrors("environments", NewAPIError(CodeInvalidArgument, environment, message))...)
+			continue
+		}
+		counters := spec.Environments[environment]
+		names := []string{}
+		for name := range counters {
+			names = append(names, name)
+		}
+		// counters that aren't in the spec are deleted
+		for name := range ids[environment] {
+			if _, ok := counters[name]; !ok {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			prefix := "environments." + environment + "." + name
+			counterSpec, listed := counters[name]
+			if !listed {
+				plan.add(ids.planDelete(name, environment))
+				continue
+			}
+			key := CounterKey{Environment: environment, Name: name}
+			err := validateStruct(&key)
+			desired := counterSpec.config()
+			if err == nil {
+				err = desired.validate()
+			}
+			if err != nil {
+				details = append(details, prefixedErrors(prefix, err)...)
+				continue
+			}
+			if change, ok := ids.planCounter(name, environment, desired, force); ok {
+				plan.add(change)
+			} else {
+				plan.Unchanged++
+			}
+		}
+	}
+	return plan, newBatchError(details)
+}
+
+// planCounter returns what applying desired does to a counter, or false if
+// nothing changes.
+func (ids idMap) planCounter(name, environment string, desired CounterConfig, force bool) (PlanChange, bool) {
+	change := PlanChange{Environment: environment, Name: name, NewConfig: &desired}
+	id, found := ids[environment][name]
+	if !found {
+		change.Action = PlanCreate
+		change.NewID = &desired.Start
+		return change, true
+	}
+
+	change.Action = PlanUpdate
+	change.ID = &id
+	current := configFor(name, environment)
+	change.Config = &current
+	// counters outside the new bounds start over, which hands out IDs again
+	// if that lowers them
+	if id < desired.Min || id > desired.Max {
+		change.NewID = &desired.Start
+		switch {
+		case desired.Start >= id:
+		case current.Monotonic || desired.Monotonic:
+			change.Refused = fmt.Sprintf("would lower the monotonic counter from %d to %d", id, desired.Start)
+		case !force:
+			change.Refused = fmt.Sprintf("would lower the counter from %d to its start %d, handing out IDs again; apply with force to allow it", id, desired.Start)
+		}
+	}
+	if current == desired {
+		change.NewConfig = nil
+	}
+	return change, change.NewID != nil || change.NewConfig != nil
+}
+
+func (ids idMap) planDelete(name, environment string) PlanChange {
+	id := ids[environment][name]
+	current := configFor(name, environment)
+	change := PlanChange{Action: PlanDelete, Environment: environment, Name: name, ID: &id, Config: &current}
+	if current.Monotonic {
+		change.Refused = "would delete a monotonic counter; apply it with monotonic false first"
+	}
+	return change
+}
+
+func (plan *Plan) add(change PlanChange) {
+	switch {
+	case change.Refused != "":
+		plan.Refused++
+	case change.Action == PlanCreate:
+		plan.Created++
+	case change.Action == PlanUpdate:
+		plan.Updated++
+	case change.Action == PlanDelete:
+		plan.Deleted++
+	}
+	plan.Changes = append(plan.Changes, change)
+}
+
+// Apply makes every change in spec's Plan, or none of them if the spec is
+// invalid or any change is refused. In cluster mode the changes are committed
+// as one entry, so losing the leadership doesn't leave some of them applied
+// either. The caller must hold the mutex.
+func (ids idMap) Apply(spec Spec, force bool) (Plan, error) {
+	plan, err := ids.Plan(spec, force)
+	if err != nil {
+		return Plan{}, err
+	}
+	details := []*APIError{}
+	commands := []raftCommand{}
+	for _, change := range plan.Changes {
+		if change.Refused != "" {
+			prefix := "environments." + change.Environment + "." + change.Name
+			details = append(details, prefixedErrors(prefix, NewAPIError(CodeConflict, "", change.Refused))...)
+			continue
+		}
+		command := raftCommand{Environment: change.Environment, Name: change.Name}
+		if change.Action == PlanDelete {
+			command.Type, command.ID = ChangeDelete, *change.ID
+			commands = append(commands, command)
+			continue
+		}
+		if change.NewConfig != nil {
+			config := *change.NewConfig
+			commands = append(commands, raftCommand{Type: commandConfig, Environment: change.Environment, Name: change.Name, Config: &config})
+		}
+		if change.NewID != nil {
+			command.Type, command.ID = ChangeSet, *change.NewID
+			commands = append(commands, command)
+		}
+	}
+	if err := newBatchError(details); err != nil {
+		return Plan{}, err
+	}
+	if err := ids.commitAll(commands); err != nil {
+		return Plan{}, err
+	}
+	return plan, nil
+}
+
+func sortedKeys(environments map[string]map[string]CounterSpec) []string {
+	keys := []string{}
+	for key := range environments {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+const testSpec = `environments:
+  live:
+    records:
+      start: 1000
+      step: 1
+      min: 1000
+      format: REC-%06d
+      monotonic: true
+    orders:
+      step: 2
+    new: {}
+`
+
+func serveSpec(t *testing.T, testRouter http.Handler, path, contentType, body string) *httptest.ResponseRecorder {
+	request, err := http.NewRequest("POST", path, bytes.NewBufferString(body))
+	if err != nil {
+		t.Error(err)
+	}
+	request.Header.Add("Content-Type", contentType)
+	response := httptest.NewRecorder()
+	testRouter.ServeHTTP(response, request)
+	return response
+}
+
+func TestPlanAndApply(t *testing.T) {
+	// setup
+	ids := idMap{"live": {"records": 7, "orders": 50, "old": 3}, "dev": {"records": 9}}
+	defer func() { configs = counterConfigs{} }()
+	testRouter := ids.SetupRouter()
+	response := serveSpec(t, testRouter, "/v2/plan", "application/x-yaml", testSpec)
+
+	// test that a plan lists every change without making them
+	var plan Plan
+	json.Unmarshal(response.Body.Bytes(), &plan)
+	if response.Code != 200 || plan.Created != 1 || plan.Updated != 2 || plan.Deleted != 1 || plan.Refused != 0 {
+		t.Errorf("Expected 1 create, 2 updates and 1 delete, got %d `%s`", response.Code, response.Body)
+	}
+	actions := []string{}
+	for _, change := range plan.Changes {
+		actions = append(actions, change.Action+" "+change.Name)
+	}
+	expected := []string{"create new", "delete old", "update orders", "update records"}
+	if !reflect.DeepEqual(actions, expected) {
+		t.Errorf("Expected %v, got %v", expected, actions)
+	}
+	if records := plan.Changes[3]; records.NewID == nil || *records.NewID != 1000 || records.NewConfig.Max != maxID {
+		t.Error("Expected records to be raised to its start, got ", records)
+	}
+	if len(ids["live"]) != 3 || len(configs) != 0 {
+		t.Error("Expected a plan to change nothing, got ", ids)
+	}
+
+	// test that applying makes the changes, leaving unlisted environments
+	response = serveSpec(t, testRouter, "/v2/apply", "application/x-yaml", testSpec)
+	if response.Code != 200 {
+		t.Errorf("Expected status code 200, got %d: %s", response.Code, response.Body)
+	}
+	stored := idMap{"live": {"records": 1000, "orders": 50, "new": initialValue}, "dev": {"records": 9}}
+	if !reflect.DeepEqual(ids, stored) {
+		t.Errorf("Expected %v, got %v", stored, ids)
+	}
+	code, counter := serveV2(t, testRouter, "POST", "/v2/environments/live/counters/records:next", "")
+	if code != 200 || counter.ID != 1001 || counter.Formatted != "REC-001001" {
+		t.Errorf("Expected REC-001001, got %d %v", code, counter)
+	}
+	if _, counter = serveV2(t, testRouter, "POST", "/v2/environments/live/counters/orders:next", ""); counter.ID != 52 {
+		t.Error("Expected orders to step by 2, got ", counter.ID)
+	}
+
+	// test that applying it again changes nothing
+	response = serveSpec(t, testRouter, "/v2/plan", "application/x-yaml", testSpec)
+	plan = Plan{}
+	json.Unmarshal(response.Body.Bytes(), &plan)
+	if len(plan.Changes) != 0 || plan.Unchanged != 3 {
+		t.Errorf("Expected no changes, got `%s`", response.Body)
+	}
+}
+
+func TestApplyRefusesLoweringMonotonicCounters(t *testing.T) {
+	tests := []struct {
+		body    string
+		refused string
+	}{
+		{`{"environments": {"live": {"records": {"start": 0, "max": 10, "monotonic": true}}}}`, "live.records"},
+		{`{"environments": {"live": {}}}`, "live.records"},
+	}
+
+	for _, test := range tests {
+		// setup
+		ids := idMap{"live": {"records": 100}}
+		configs[CounterKey{Environment: "live", Name: "records"}] = CounterConfig{Start: 0, Step: 1, Min: 0, Max: maxID, Monotonic: true}
+		testRouter := ids.SetupRouter()
+
+		// test that the plan reports the refusal
+		response := serveSpec(t, testRouter, "/v2/plan", "application/json", test.body)
+		var plan Plan
+		json.Unmarshal(response.Body.Bytes(), &plan)
+		if response.Code != 200 || plan.Refused != 1 || plan.Changes[0].Refused == "" {
+			t.Errorf("Expected a refused change, got %d `%s`", response.Code, response.Body)
+		}
+
+		// test that applying fails with 409 and changes nothing
+		response = serveSpec(t, testRouter, "/v2/apply", "application/json", test.body)
+		var apiError APIError
+		json.Unmarshal(response.Body.Bytes(), &apiError)
+		if response.Code != 409 || apiError.Field != "environments."+test.refused {
+			t.Errorf("Expected a conflict on %s, got %d `%s`", test.refused, response.Code, response.Body)
+		}
+		if ids["live"]["records"] != 100 || !configs[CounterKey{Environment: "live", Name: "records"}].Monotonic {
+			t.Error("Expected nothing to be applied, got ", ids)
+		}
+		configs = counterConfigs{}
+	}
+}
+
+func TestApplyRefusesResettingCountersWithoutForce(t *testing.T) {
+	// setup
+	ids := idMap{"live": {"records": 100}}
+	defer func() { configs = counterConfigs{} }()
+	testRouter := ids.SetupRouter()
+	body := `{"environments": {"live": {"records": {"start": 0, "max": 10}}}}`
+
+	// test that lowering a counter to its start is refused
+	response := serveSpec(t, testRouter, "/v2/apply", "application/json", body)
+	if response.Code != 409 || ids["live"]["records"] != 100 {
+		t.Errorf("Expected a conflict leaving records at 100, got %d `%s`", response.Code, response.Body)
+	}
+
+	// test that force allows it
+	response = serveSpec(t, testRouter, "/v2/apply?force=true", "application/json", body)
+	if response.Code != 200 || ids["live"]["records"] != 0 {
+		t.Errorf("Expected records reset to 0, got %d `%s`", response.Code, response.Body)
+	}
+}
+
+func TestSpecInvalid(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	testRouter := ids.SetupRouter()
+	body := `{"environments": {
+		"live": {"records": {"step": 0}, "bad name": {}, "orders": {"start": 5, "min": 10}},
+		"bad!env": {}
+	}}`
+	response := serveSpec(t, testRouter, "/v2/apply", "application/json", body)
+
+	// test for 400 response code, and every invalid field
+	var apiError APIError
+	json.Unmarshal(response.Body.Bytes(), &apiError)
+	fields := []string{}
+	for _, detail := range apiError.Details {
+		fields = append(fields, detail.Field)
+	}
+	expected := []string{"environments.bad!env", "environments.live.bad name.name", "environments.live.orders.start", "environments.live.records.step"}
+	if response.Code != 400 || !reflect.DeepEqual(fields, expected) {
+		t.Errorf("Expected fields %v, got %d %v", expected, response.Code, fields)
+	}
+	if len(ids) != 0 || len(configs) != 0 {
+		t.Error("Expected nothing to be applied, got ", ids)
+	}
+}
+
+func TestApplyClustered(t *testing.T) {
+	// setup
+	ids := idMap{"live": {"old": 3}}
+	defer func() { configs = counterConfigs{} }()
+	cluster = ids.newRaftNode("http://localhost:0", []string{"http://localhost:1"})
+	defer func() {
+		cluster.stop()
+		cluster = nil
+	}()
+	step := 2
+	spec := Spec{Environments: map[string]map[string]CounterSpec{"live": {"records": {Step: &step}, "orders": {}}}}
+
+	// test that a spec that isn't committed changes nothing
+	mutex.Lock()
+	_, err := ids.Apply(spec, false)
+	mutex.Unlock()
+	if err != ErrLeadershipLost || !reflect.DeepEqual(ids, idMap{"live": {"old": 3}}) || len(configs) != 0 {
+		t.Errorf("Expected ErrLeadershipLost and nothing applied, got %v %v %v", err, ids, configs)
+	}
+
+	// test that a committed spec is one entry in the log
+	cluster.stop()
+	cluster = ids.newRaftNode("http://localhost:0", nil)
+	cluster.start()
+	leaderOf(t, []*testNode{{node: cluster}})
+	mutex.Lock()
+	_, err = ids.Apply(spec, false)
+	mutex.Unlock()
+	stored := idMap{"live": {"records": initialValue, "orders": initialValue}}
+	if err != nil || !reflect.DeepEqual(ids, stored) || configs[CounterKey{Environment: "live", Name: "records"}].Step != 2 {
+		t.Errorf("Expected %v, got %v (%v)", stored, ids, err)
+	}
+	if status := cluster.status(); status.LastIndex != 2 {
+		t.Error("Expected a noop and the spec in the log, got ", status)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"gopkg.in/go-playground/validator.v8"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var identifierRegex = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// CounterKey identifies a counter in request bodies and v2 paths.
+type CounterKey struct {
+	Environment string `form:"environment" json:"environment" binding:"required,max=64,identifier"`
+	Name        string `form:"name" json:"name" binding:"required,max=128,identifier"`
+}
+
+// parseKey splits a key like `live:records`, as used by the Redis and
+// memcached listeners, into a CounterKey.
+func parseKey(key string) (CounterKey, error) {
+	parts := strings.SplitN(key, ":", 2)
+	if len(parts) != 2 {
+		return CounterKey{}, NewAPIError(CodeInvalidArgument, "", "key must look like environment:name")
+	}
+	counterKey := CounterKey{Environment: parts[0], Name: parts[1]}
+	return counterKey, validateStruct(&counterKey)
+}
+
+// CounterValue is the body accepted when setting a counter. IDs are capped at
+// 2^53-1 so they survive a round trip through JSON decoders that store numbers
+// as doubles.
+type CounterValue struct {
+	ID json.Number `form:"id" json:"id" binding:"integer,min=0,max=9007199254740991"`
+}
+
+// setterRequest is the body accepted by `/setter`, either as JSON or as form
+// fields.
+type setterRequest struct {
+	CounterKey
+	CounterValue
+}
+
+func init() {
+	binding.Validator = newStructValidator()
+}
+
+// structValidator replaces gin's default validator so the binding tags can use
+// the `identifier` and `integer` validations and report JSON field names.
+type structValidator struct {
+	validate *validator.Validate
+}
+
+func newStructValidator() *structValidator {
+	validate := validator.New(&validator.Config{TagName: "binding", FieldNameTag: "json"})
+	validate.RegisterValidation("identifier", isIdentifier)
+	validate.RegisterValidation("integer", isInteger)
+	validate.RegisterValidation("oneof", isOneOf)
+	validate.RegisterCustomTypeFunc(numberValue, json.Number(""))
+	return &structValidator{validate: validate}
+}
+
+func (v *structValidator) ValidateStruct(obj interface{}) error {
+	value := reflect.ValueOf(obj)
+	if value.Kind() == reflect.Ptr {
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return nil
+	}
+	if err := v.validate.Struct(obj); err != nil {
+		return err
+	}
+	return nil
+}
+
+func isIdentifier(v *validator.Validate, topStruct reflect.Value, currentStruct reflect.Value, field reflect.Value, fieldType reflect.Type, fieldKind reflect.Kind, param string) bool {
+	return fieldKind == reflect.String && identifierRegex.MatchString(field.String())
+}
+
+// isInteger passes json.Numbers that numberValue was able to convert.
+func isInteger(v *validator.Validate, topStruct reflect.Value, currentStruct reflect.Value, field reflect.Value, fieldType reflect.Type, fieldKind reflect.Kind, param string) bool {
+	return fieldKind == reflect.Int64
+}
+
+// isOneOf passes strings equal to one of the space separated words in param.
+func isOneOf(v *validator.Validate, topStruct reflect.Value, currentStruct reflect.Value, field reflect.Value, fieldType reflect.Type, fieldKind reflect.Kind, param string) bool {
+	for _, word := range strings.Fields(param) {
+		if fieldKind == reflect.String && field.String() == word {
+			return true
+		}
+	}
+	return false
+}
+
+// numberValue exposes a json.Number to the validator as an int64 so that
+// `min` and `max` compare numerically. Empty numbers become nil and numbers
+// that aren't integers stay strings, which fail the `integer` validation.
+func numberValue(field reflect.Value) interface{} {
+	number := field.Interface().(json.Number)
+	if number == "" {
+		return nil
+	}
+	if id, err := number.Int64(); err == nil {
+		return id
+	}
+	return string(number)
+}
+
+// bindRequest binds the body, or form fields, of the request into obj based on
+// its Content-Type, and returns validation failures as an APIError.
+func bindRequest(context *gin.Context, obj interface{}) error {
+	b := binding.Default(context.Request.Method, context.ContentType())
+	err := b.Bind(context.Request, obj)
+	if err == nil {
+		return nil
+	}
+	if validationErrors, ok := err.(validator.ValidationErrors); ok {
+		return newValidationError(validationErrors)
+	}
+	return NewAPIError(CodeInvalidArgument, "", fmt.Sprintf("Unable to parse %s request: %s", b.Name(), err))
+}
+
+// validateStruct runs the binding validator over obj and returns failures as
+// an APIError.
+func validateStruct(obj interface{}) error {
+	err := binding.Validator.ValidateStruct(obj)
+	if validationErrors, ok := err.(validator.ValidationErrors); ok {
+		return newValidationError(validationErrors)
+	}
+	return err
+}
+
+// newValidationError reports every invalid field in Details, and the first
+// one by name at the top level.
+func newValidationError(validationErrors validator.ValidationErrors) *APIError {
+	details := []*APIError{}
+	for _, fieldError := range validationErrors {
+		details = append(details, NewAPIError(CodeInvalidArgument, fieldError.Name, fieldErrorMessage(fieldError)))
+	}
+	sort.Sort(byField(details))
+	apiError := NewAPIError(CodeInvalidArgument, details[0].Field, details[0].Message)
+	apiError.Details = details
+	return apiError
+}
+
+func fieldErrorMessage(fieldError *validator.FieldError) string {
+	if fieldError.Kind == reflect.Invalid || fieldError.Tag == "required" {
+		return fmt.Sprintf("%s field was not passed or is empty", fieldError.Name)
+	}
+	switch fieldError.Tag {
+	case "identifier":
+		return fmt.Sprintf("%s may only contain letters, digits, `.`, `_` and `-`", fieldError.Name)
+	case "integer":
+		return fmt.Sprintf("Error converting `%v` to an integer", fieldError.Value)
+	case "oneof":
+		return fmt.Sprintf("%s must be one of `%s`", fieldError.Name, strings.Join(strings.Fields(fieldError.Param), "`, `"))
+	case "min", "max":
+		bound := "at least"
+		if fieldError.Tag == "max" {
+			bound = "at most"
+		}
+		if fieldError.Kind == reflect.String {
+			return fmt.Sprintf("%s must be %s %s characters long", fieldError.Name, bound, fieldError.Param)
+		}
+		return fmt.Sprintf("%s must be %s %s", fieldError.Name, bound, fieldError.Param)
+	}
+	return fmt.Sprintf("%s failed the `%s` validation", fieldError.Name, fieldError.Tag)
+}
+
+type byField []*APIError
+
+func (errors byField) Len() int           { return len(errors) }
+func (errors byField) Swap(i, j int)      { errors[i], errors[j] = errors[j], errors[i] }
+func (errors byField) Less(i, j int) bool { return errors[i].Field < errors[j].Field }
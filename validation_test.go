@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSetterEndpointJSON(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	testRouter := ids.SetupRouter()
+	body := `{"environment": "live", "name": "records_name", "id": 56}`
+	request, err := http.NewRequest("POST", "/setter", bytes.NewBufferString(body))
+	if err != nil {
+		t.Error(err)
+	}
+	request.Header.Add("Content-Type", "application/json")
+	response := httptest.NewRecorder()
+	testRouter.ServeHTTP(response, request)
+
+	// test for 200 response code
+	if response.Code != 200 {
+		t.Error("Expected status code 200, got ", response.Code)
+	}
+
+	// test for passed JSON encoded id
+	var id TestID
+	err = json.Unmarshal(response.Body.Bytes(), &id)
+	if err != nil {
+		t.Errorf("Unable to unmarshal `%s`", response.Body)
+	}
+	if id.ID != 56 {
+		t.Errorf("Expected `56`, got `%d`", id.ID)
+	}
+	if ids["live"]["records_name"] != 56 {
+		t.Error("Expected 56 to be stored, got ", ids["live"]["records_name"])
+	}
+}
+
+func TestSetterEndpointValidation(t *testing.T) {
+	tests := []struct {
+		body   string
+		fields []string
+	}{
+		{`{"environment": "live", "name": "", "id": 56}`, []string{"name"}},
+		{`{"environment": "live", "id": 56}`, []string{"name"}},
+		{`{"environment": "live", "name": "records name", "id": 56}`, []string{"name"}},
+		{`{"environment": "live", "name": "records_name"}`, []string{"id"}},
+		{`{"environment": "live", "name": "records_name", "id": -1}`, []string{"id"}},
+		{`{"environment": "live", "name": "records_name", "id": 1.5}`, []string{"id"}},
+		{`{"environment": "live", "name": "records_name", "id": 9007199254740992}`, []string{"id"}},
+		{`{"name": "records/name", "id": -1}`, []string{"environment", "id", "name"}},
+	}
+
+	for _, test := range tests {
+		// setup
+		ids := NewIDMap()
+		testRouter := ids.SetupRouter()
+		request, err := http.NewRequest("POST", "/setter", bytes.NewBufferString(test.body))
+		if err != nil {
+			t.Error(err)
+		}
+		request.Header.Add("Content-Type", "application/json")
+		response := httptest.NewRecorder()
+		testRouter.ServeHTTP(response, request)
+
+		// test for 400 response code
+		if response.Code != 400 {
+			t.Errorf("Expected status code 400 for `%s`, got %d", test.body, response.Code)
+		}
+
+		// test for an error on every invalid field
+		var apiError APIError
+		err = json.Unmarshal(response.Body.Bytes(), &apiError)
+		if err != nil {
+			t.Errorf("Unable to unmarshal `%s`", response.Body)
+		}
+		if apiError.Field != test.fields[0] {
+			t.Errorf("Expected field `%s` for `%s`, got `%s`", test.fields[0], test.body, apiError.Field)
+		}
+		if len(apiError.Details) != len(test.fields) {
+			t.Errorf("Expected %d details for `%s`, got %d", len(test.fields), test.body, len(apiError.Details))
+			continue
+		}
+		for i, field := range test.fields {
+			if apiError.Details[i].Field != field || apiError.Details[i].Message == "" {
+				t.Errorf("Expected a message on field `%s` for `%s`, got %v", field, test.body, apiError.Details[i])
+			}
+		}
+
+		// test that no counter was created
+		if len(ids) != 0 {
+			t.Errorf("Expected no environments for `%s`, got %v", test.body, ids)
+		}
+	}
+}
+
+func TestSetterEndpointMalformedJSON(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	testRouter := ids.SetupRouter()
+	request, err := http.NewRequest("POST", "/setter", bytes.NewBufferString(`{"environment": "live"`))
+	if err != nil {
+		t.Error(err)
+	}
+	request.Header.Add("Content-Type", "application/json")
+	response := httptest.NewRecorder()
+	testRouter.ServeHTTP(response, request)
+
+	// test for 400 response code
+	if response.Code != 400 {
+		t.Error("Expected status code 400, got ", response.Code)
+	}
+
+	// test for JSON encoded error
+	var apiError APIError
+	err = json.Unmarshal(response.Body.Bytes(), &apiError)
+	if err != nil {
+		t.Errorf("Unable to unmarshal `%s`", response.Body)
+	}
+	if apiError.Code != CodeInvalidArgument {
+		t.Errorf("Expected code `%s`, got `%s`", CodeInvalidArgument, apiError.Code)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"time"
+)
+
+const defaultWatchTimeout = 30
+
+// watchRequest is the query accepted by the watch route.
+type watchRequest struct {
+	After   json.Number `form:"after" json:"after" binding:"integer"`
+	Timeout int         `form:"timeout" json:"timeout" binding:"omitempty,min=1,max=300"`
+}
+
+func (ids idMap) setupWatchRoutes(router gin.IRoutes) {
+	router.GET("/v2/environments/:environment/counters/:name/watch", ids.watchCounter)
+}
+
+// watchCounter holds the request until the counter is above `after`, then
+// returns it.
+func (ids idMap) watchCounter(context *gin.Context) {
+	key, err := counterKey(context)
+	if err != nil {
+		abortWithError(context, err)
+		return
+	}
+	var request watchRequest
+	if err := bindRequest(context, &request); err != nil {
+		abortWithError(context, err)
+		return
+	}
+	after, _ := request.After.Int64()
+	if request.Timeout == 0 {
+		request.Timeout = defaultWatchTimeout
+	}
+	timeout := time.NewTimer(time.Duration(request.Timeout) * time.Second)
+	defer timeout.Stop()
+
+	id, err := ids.Watch(key.Name, key.Environment, int(after), context.Request.Context().Done(), timeout.C)
+	if err == ErrWatchCancelled {
+		return
+	}
+	respondWithCounter(context, key, id, err)
+}
+
+// Watch blocks until the counter is above after and returns it, or fails with
+// ErrWatchCancelled once done is closed or ErrWatchTimeout once timeout fires,
+// or the server starts draining.
+// Unlike the other idMap methods it takes the lock itself, and only briefly:
+// it follows the change feed rather than the counters, so waiting doesn't
+// contend with writers.
+func (ids idMap) Watch(name, environment string, after int, done <-chan struct{}, timeout <-chan time.Time) (int, error) {
+	if err := validateKey(name, environment); err != nil {
+		return 0, err
+	}
+
+	// read the counter and the sequence it's current as of together
+	unlock := ids.readEnvironment(environment)
+	last, _ := changes.wait()
+	id, err := ids.Peek(name, environment)
+	unlock()
+	exists := err == nil
+
+	for !exists || id <= after {
+		current, changed := changes.wait()
+		if current == last {
+			select {
+			case <-changed:
+			case <-timeout:
+				return 0, ErrWatchTimeout
+			case <-draining:
+				return 0, ErrWatchTimeout
+			case <-done:
+				return 0, ErrWatchCancelled
+			}
+			continue
+		}
+
+		pending, err := changes.since(last)
+		if err == ErrHistoryCompacted {
+			// fell too far behind the feed, so read the counter directly
+			unlock := ids.readEnvironment(environment)
+			last, _ = changes.wait()
+			id, err = ids.Peek(name, environment)
+			unlock()
+			exists = err == nil
+			continue
+		}
+		for _, change := range pending {
+			if change.Environment == environment && change.Name == name {
+				id = change.ID
+				exists = change.Type != ChangeDelete
+			}
+			last = change.Sequence
+		}
+	}
+	return id, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// serveWatch starts a watch in the background, and returns a channel of its
+// response.
+func serveWatch(t *testing.T, testRouter http.Handler, request *http.Request) chan *httptest.ResponseRecorder {
+	responses := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		response := httptest.NewRecorder()
+		testRouter.ServeHTTP(response, request)
+		responses <- response
+	}()
+	return responses
+}
+
+func TestWatchReturnsWhenPassed(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	ids["watch-test"] = map[string]int{"records": 75}
+	testRouter := ids.SetupRouter()
+	request, err := http.NewRequest("GET", "/v2/environments/watch-test/counters/records/watch?after=70", nil)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// test that a counter already past the value returns immediately
+	select {
+	case response := <-serveWatch(t, testRouter, request):
+		var counter Counter
+		json.Unmarshal(response.Body.Bytes(), &counter)
+		if response.Code != 200 || counter.ID != 75 {
+			t.Errorf("Expected 75, got %d `%s`", response.Code, response.Body)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected the watch to return immediately")
+	}
+}
+
+func TestWatchWaitsForChange(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	testRouter := ids.SetupRouter()
+	request, err := http.NewRequest("GET", "/v2/environments/watch-test/counters/builds/watch?after=50", nil)
+	if err != nil {
+		t.Error(err)
+	}
+	responses := serveWatch(t, testRouter, request)
+
+	// test that creating the counter below the value doesn't return
+	time.Sleep(50 * time.Millisecond)
+	mutex.Lock()
+	ids.Get("builds", "watch-test")
+	ids.Get("other", "watch-test")
+	mutex.Unlock()
+	select {
+	case response := <-responses:
+		t.Fatalf("Expected the watch to wait, got `%s`", response.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// test that passing the value returns the counter
+	mutex.Lock()
+	ids.Get("builds", "watch-test")
+	ids.Get("builds", "watch-test")
+	mutex.Unlock()
+	select {
+	case response := <-responses:
+		var counter Counter
+		json.Unmarshal(response.Body.Bytes(), &counter)
+		if response.Code != 200 || counter.ID != initialValue+2*incrementBy {
+			t.Errorf("Expected %d, got %d `%s`", initialValue+2*incrementBy, response.Code, response.Body)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected the watch to return")
+	}
+}
+
+func TestWatchTimeout(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	testRouter := ids.SetupRouter()
+	request, err := http.NewRequest("GET", "/v2/environments/watch-test/counters/never/watch?after=0&timeout=1", nil)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// test for 408 response code
+	select {
+	case response := <-serveWatch(t, testRouter, request):
+		var apiError APIError
+		json.Unmarshal(response.Body.Bytes(), &apiError)
+		if response.Code != 408 || apiError.Code != CodeDeadlineExceeded {
+			t.Errorf("Expected status code 408, got %d `%s`", response.Code, response.Body)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("Expected the watch to time out")
+	}
+}
+
+func TestWatchClientGone(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	server := httptest.NewServer(ids.SetupRouter())
+	defer server.Close()
+	transport := &http.Transport{}
+	client := &http.Client{Transport: transport, Timeout: 100 * time.Millisecond}
+
+	// test that the handler returns once the client goes away
+	_, err := client.Get(server.URL + "/v2/environments/watch-test/counters/gone/watch?after=0")
+	if err == nil {
+		t.Error("Expected the client to time out")
+	}
+	transport.CloseIdleConnections()
+	finished := make(chan struct{})
+	go func() {
+		server.Close()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(2 * time.Second):
+		t.Error("Expected the watch to be cancelled with its connection")
+	}
+}
+
+func TestWatchBadRequests(t *testing.T) {
+	// setup
+	ids := NewIDMap()
+	testRouter := ids.SetupRouter()
+
+	for _, path := range []string{
+		"/v2/environments/watch-test/counters/records/watch",
+		"/v2/environments/watch-test/counters/records/watch?after=soon",
+		"/v2/environments/watch-test/counters/records/watch?after=1&timeout=301",
+		"/v2/environments/watch-test/counters/rec%20ords/watch?after=1",
+	} {
+		request, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		response := httptest.NewRecorder()
+		testRouter.ServeHTTP(response, request)
+
+		// test for 400 response code
+		if response.Code != 400 {
+			t.Errorf("Expected status code 400 for %s, got %d", path, response.Code)
+		}
+	}
+}